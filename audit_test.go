@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+)
+
+func (ts *testServer) audit(t *testing.T, req *pb.AuditReq) *pb.AuditResp {
+	req.AccessToken = ts.token
+	resp, err := ts.Audit(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// TestAudit checks the folders older than a descendant are reported,
+// and only them, without being fixed.
+func TestAudit(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/b/f.txt")
+	ts.put(t, testHome+"/c/g.txt")
+	ts.put(t, testHome+"/d/h.txt")
+
+	if resp := ts.audit(t, &pb.AuditReq{Path: testHome}); resp.Checked != 8 || len(resp.Stale) != 0 {
+		t.Errorf("got %v, want the 8 records checked and none stale", resp)
+	}
+
+	ts.clock.Advance(time.Second)
+	desync(t, ts, testHome+"/a/b/f.txt", "lost")
+	desync(t, ts, testHome+"/c/g.txt", "lost")
+	before := dbState(t, ts)
+
+	resp := ts.audit(t, &pb.AuditReq{Path: testHome})
+	want := []string{testHome, testHome + "/a", testHome + "/a/b", testHome + "/c"}
+	if !reflect.DeepEqual(resp.Stale, want) || resp.Next != "" {
+		t.Errorf("got %v, want %v stale", resp, want)
+	}
+	if after := dbState(t, ts); strings.Join(after, "\n") != strings.Join(before, "\n") {
+		t.Errorf("the audit changed the records into\n%s", strings.Join(after, "\n"))
+	}
+
+	resp = ts.audit(t, &pb.AuditReq{Path: testHome + "/c"})
+	if !reflect.DeepEqual(resp.Stale, []string{testHome + "/c"}) {
+		t.Errorf("got %v, want only %s/c stale", resp.Stale, testHome)
+	}
+}
+
+// TestAuditResume checks a subtree is audited by bounded runs, each one
+// resumed after the last record of the previous one.
+func TestAuditResume(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/b/c/f.txt")
+	ts.clock.Advance(time.Second)
+	desync(t, ts, testHome+"/a/b/c/f.txt", "lost")
+
+	var runs, checked int64
+	stale := []string{}
+	req := &pb.AuditReq{Path: testHome, Limit: 2}
+	for {
+		resp := ts.audit(t, req)
+		runs++
+		checked += resp.Checked
+		stale = append(stale, resp.Stale...)
+		if resp.Next == "" {
+			break
+		}
+		req.After = resp.Next
+	}
+	if runs != 3 || checked != 5 || len(stale) != 4 {
+		t.Errorf("got %d runs checking %d records and %v stale, want 3 runs, 5 records and 4 stale", runs, checked, stale)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"github.com/clawio/service-auth/lib"
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+	"io"
+	"strings"
+)
+
+type identityKey struct{}
+
+// identity returns the identity authenticated by the authServer. The
+// token is only verified there, so a handler called without it fails.
+func (s *server) identity(ctx context.Context) (*lib.Identity, error) {
+	if idt, ok := ctx.Value(identityKey{}).(*lib.Identity); ok {
+		return idt, nil
+	}
+	return nil, unauthenticatedError
+}
+
+// accessToken returns the bearer token of the authorization metadata
+// or, for the clients that still send it in every message, the token
+// of the request.
+func accessToken(ctx context.Context, token string) string {
+	if md, ok := metadata.FromContext(ctx); ok && len(md["authorization"]) > 0 {
+		return strings.TrimPrefix(md["authorization"][0], "Bearer ")
+	}
+	return token
+}
+
+// authServer wraps the server to authenticate every RPC before its
+// handler runs, as the grpc version in use has no interceptors.
+// Version does not require authentication.
+type authServer struct {
+	s *server
+}
+
+func newAuthServer(s *server) pb.PropServer {
+	return &authServer{s: s}
+}
+
+// authenticate returns ctx holding the identity of the access token.
+func (a *authServer) authenticate(ctx context.Context, token string) (context.Context, error) {
+	idt, err := a.s.parseToken(accessToken(ctx, token))
+	if err != nil {
+		a.s.requestLogger(ctx).Error(err)
+		return ctx, unauthenticatedError
+	}
+	return context.WithValue(ctx, identityKey{}, idt), nil
+}
+
+func (a *authServer) Put(ctx context.Context, req *pb.PutReq) (*pb.Void, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.Void{}, err
+	}
+	return a.s.Put(ctx, req)
+}
+
+func (a *authServer) Get(ctx context.Context, req *pb.GetReq) (*pb.Record, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.Record{}, err
+	}
+	return a.s.Get(ctx, req)
+}
+
+func (a *authServer) Mv(ctx context.Context, req *pb.MvReq) (*pb.MvResp, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.MvResp{}, err
+	}
+	return a.s.Mv(ctx, req)
+}
+
+func (a *authServer) Rm(ctx context.Context, req *pb.RmReq) (*pb.RmResp, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.RmResp{}, err
+	}
+	return a.s.Rm(ctx, req)
+}
+
+func (a *authServer) List(ctx context.Context, req *pb.ListReq) (*pb.ListResp, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.ListResp{}, err
+	}
+	return a.s.List(ctx, req)
+}
+
+func (a *authServer) Stat(ctx context.Context, req *pb.StatReq) (*pb.Record, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.Record{}, err
+	}
+	return a.s.Stat(ctx, req)
+}
+
+func (a *authServer) Copy(ctx context.Context, req *pb.CopyReq) (*pb.Void, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.Void{}, err
+	}
+	return a.s.Copy(ctx, req)
+}
+
+func (a *authServer) BatchPut(ctx context.Context, req *pb.BatchPutReq) (*pb.Void, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.Void{}, err
+	}
+	return a.s.BatchPut(ctx, req)
+}
+
+func (a *authServer) BatchGet(ctx context.Context, req *pb.BatchGetReq) (*pb.BatchGetResp, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.BatchGetResp{}, err
+	}
+	return a.s.BatchGet(ctx, req)
+}
+
+func (a *authServer) Exists(ctx context.Context, req *pb.ExistsReq) (*pb.ExistsResp, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.ExistsResp{}, err
+	}
+	return a.s.Exists(ctx, req)
+}
+
+func (a *authServer) GetByID(ctx context.Context, req *pb.GetByIdReq) (*pb.Record, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.Record{}, err
+	}
+	return a.s.GetByID(ctx, req)
+}
+
+func (a *authServer) ChangesSince(ctx context.Context, req *pb.ChangesReq) (*pb.ChangesResp, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.ChangesResp{}, err
+	}
+	return a.s.ChangesSince(ctx, req)
+}
+
+func (a *authServer) Touch(ctx context.Context, req *pb.TouchReq) (*pb.Void, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.Void{}, err
+	}
+	return a.s.Touch(ctx, req)
+}
+
+func (a *authServer) Restore(ctx context.Context, req *pb.RestoreReq) (*pb.RestoreResp, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.RestoreResp{}, err
+	}
+	return a.s.Restore(ctx, req)
+}
+
+func (a *authServer) Purge(ctx context.Context, req *pb.PurgeReq) (*pb.PurgeResp, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.PurgeResp{}, err
+	}
+	return a.s.Purge(ctx, req)
+}
+
+func (a *authServer) Count(ctx context.Context, req *pb.CountReq) (*pb.CountResp, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.CountResp{}, err
+	}
+	return a.s.Count(ctx, req)
+}
+
+func (a *authServer) Reconcile(ctx context.Context, req *pb.ReconcileReq) (*pb.ReconcileResp, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.ReconcileResp{}, err
+	}
+	return a.s.Reconcile(ctx, req)
+}
+
+func (a *authServer) GetTree(ctx context.Context, req *pb.GetTreeReq) (*pb.TreeNode, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.TreeNode{}, err
+	}
+	return a.s.GetTree(ctx, req)
+}
+
+func (a *authServer) RmMany(ctx context.Context, req *pb.RmManyReq) (*pb.RmResp, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.RmResp{}, err
+	}
+	return a.s.RmMany(ctx, req)
+}
+
+func (a *authServer) Version(ctx context.Context, req *pb.Void) (*pb.VersionResp, error) {
+	return a.s.Version(ctx, req)
+}
+
+func (a *authServer) RmByID(ctx context.Context, req *pb.RmByIdReq) (*pb.RmResp, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.RmResp{}, err
+	}
+	return a.s.RmByID(ctx, req)
+}
+
+func (a *authServer) FindByChecksum(ctx context.Context, req *pb.ChecksumReq) (*pb.ChecksumResp, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.ChecksumResp{}, err
+	}
+	return a.s.FindByChecksum(ctx, req)
+}
+
+func (a *authServer) RecomputeEtag(ctx context.Context, req *pb.RecomputeEtagReq) (*pb.Record, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.Record{}, err
+	}
+	return a.s.RecomputeEtag(ctx, req)
+}
+
+func (a *authServer) GetWithAncestors(ctx context.Context, req *pb.GetReq) (*pb.AncestorsResp, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.AncestorsResp{}, err
+	}
+	return a.s.GetWithAncestors(ctx, req)
+}
+
+func (a *authServer) Audit(ctx context.Context, req *pb.AuditReq) (*pb.AuditResp, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.AuditResp{}, err
+	}
+	return a.s.Audit(ctx, req)
+}
+
+func (a *authServer) HasChildren(ctx context.Context, req *pb.HasChildrenReq) (*pb.HasChildrenResp, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.HasChildrenResp{}, err
+	}
+	return a.s.HasChildren(ctx, req)
+}
+
+func (a *authServer) ListByCheckpoint(ctx context.Context, req *pb.CheckpointReq) (*pb.CheckpointResp, error) {
+	ctx, err := a.authenticate(ctx, req.AccessToken)
+	if err != nil {
+		return &pb.CheckpointResp{}, err
+	}
+	return a.s.ListByCheckpoint(ctx, req)
+}
+
+func (a *authServer) Watch(req *pb.WatchReq, stream pb.Prop_WatchServer) error {
+	ctx, err := a.authenticate(stream.Context(), req.AccessToken)
+	if err != nil {
+		return err
+	}
+	return a.s.Watch(req, &watchStream{stream, ctx})
+}
+
+// Import is authenticated with the access token of the first message,
+// that is handed to the handler as if it had not been received.
+func (a *authServer) Import(stream pb.Prop_ImportServer) error {
+	first, recvErr := stream.Recv()
+	if recvErr != nil && recvErr != io.EOF {
+		return recvErr
+	}
+	token := ""
+	if first != nil {
+		token = first.AccessToken
+	}
+	ctx, err := a.authenticate(stream.Context(), token)
+	if err != nil {
+		return err
+	}
+	return a.s.Import(&importStream{stream, ctx, true, first, recvErr})
+}
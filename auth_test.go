@@ -0,0 +1,197 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestAuthAccessTokenOfRequest(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a.txt")
+	ts.get(t, testHome+"/a.txt")
+}
+
+func TestAuthBearerMetadata(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ctx := metadata.NewContext(context.Background(), metadata.Pairs("authorization", "Bearer "+ts.token))
+
+	if _, err := ts.Put(ctx, &pb.PutReq{Path: testHome + "/a.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the metadata takes precedence over the token of the request
+	_, err := ts.Get(ctx, &pb.GetReq{AccessToken: "stale", Path: testHome + "/a.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// even when only the token of the request is valid
+	stale := metadata.NewContext(context.Background(), metadata.Pairs("authorization", "Bearer stale"))
+	_, err = ts.Get(stale, &pb.GetReq{AccessToken: ts.token, Path: testHome + "/a.txt"})
+	wantCode(t, err, codes.Unauthenticated)
+}
+
+func TestAuthAccessToken(t *testing.T) {
+	bearer := metadata.NewContext(context.Background(), metadata.Pairs("authorization", "Bearer header"))
+	for _, c := range []struct {
+		ctx   context.Context
+		token string
+		want  string
+	}{
+		{context.Background(), "message", "message"},
+		{bearer, "", "header"},
+		{bearer, "message", "header"},
+		{context.Background(), "", ""},
+	} {
+		if got := accessToken(c.ctx, c.token); got != c.want {
+			t.Errorf("got the token %q with %q in the message, want %q", got, c.token, c.want)
+		}
+	}
+}
+
+func TestAuthRejected(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ctx := context.Background()
+
+	for name, token := range map[string]string{
+		"missing":   "",
+		"malformed": "not a token",
+		"expired":   testToken(t, "demo", time.Now().Add(-time.Hour)),
+	} {
+		_, err := ts.Get(ctx, &pb.GetReq{AccessToken: token, Path: testHome})
+		if err == nil {
+			t.Errorf("%s token accepted", name)
+			continue
+		}
+		wantCode(t, err, codes.Unauthenticated)
+	}
+}
+
+// TestAuthOnlyByAuthServer checks the handlers do not verify the tokens
+// themselves, they only trust the identity authenticated by authServer.
+func TestAuthOnlyByAuthServer(t *testing.T) {
+	ts := newTestServer(t, nil)
+
+	_, err := ts.s.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: testHome + "/a.txt"})
+	wantCode(t, err, codes.Unauthenticated)
+
+	if _, err = ts.s.identity(context.Background()); err == nil {
+		t.Error("got an identity out of an unauthenticated context")
+	}
+}
+
+func TestAuthVersionIsPublic(t *testing.T) {
+	ts := newTestServer(t, nil)
+	if _, err := ts.Version(context.Background(), &pb.Void{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAuthForeignHome checks the token of bob is denied on the records
+// of demo, that are left untouched.
+func TestAuthForeignHome(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/f.txt")
+	before := dbState(t, ts)
+
+	bob := testToken(t, "bob", time.Now().Add(time.Hour))
+	ctx := context.Background()
+	calls := map[string]func() error{
+		"get": func() error {
+			_, err := ts.Get(ctx, &pb.GetReq{AccessToken: bob, Path: testHome + "/a/f.txt"})
+			return err
+		},
+		"put": func() error {
+			_, err := ts.Put(ctx, &pb.PutReq{AccessToken: bob, Path: testHome + "/a/f.txt"})
+			return err
+		},
+		"list": func() error {
+			_, err := ts.List(ctx, &pb.ListReq{AccessToken: bob, Path: testHome + "/a"})
+			return err
+		},
+		"mv": func() error {
+			_, err := ts.Mv(ctx, &pb.MvReq{AccessToken: bob, Src: testHome + "/a", Dst: testHome + "/b"})
+			return err
+		},
+		"rm": func() error {
+			_, err := ts.Rm(ctx, &pb.RmReq{AccessToken: bob, Path: testHome + "/a"})
+			return err
+		},
+		"copy": func() error {
+			_, err := ts.Copy(ctx, &pb.CopyReq{AccessToken: bob, Src: testHome + "/a", Dst: "/local/users/b/bob/a"})
+			return err
+		},
+	}
+	for name, call := range calls {
+		if err := call(); grpc.Code(err) != codes.PermissionDenied {
+			t.Errorf("%s: got %v, want PermissionDenied", name, err)
+		}
+	}
+	if after := dbState(t, ts); !reflect.DeepEqual(after, before) {
+		t.Errorf("the denied calls changed the records into\n%s", strings.Join(after, "\n"))
+	}
+
+	// the token is still allowed in the home of bob
+	_, err := ts.Put(ctx, &pb.PutReq{AccessToken: bob, Path: "/local/users/b/bob/f.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAuthMvAcrossHomes checks a Mv is denied when either end is out of
+// the home of the caller, even if the other end is in it.
+func TestAuthMvAcrossHomes(t *testing.T) {
+	ts := newTestServer(t, nil)
+	bobHome := "/local/users/b/bob"
+	bob := testToken(t, "bob", time.Now().Add(time.Hour))
+	ts.put(t, testHome+"/a/f.txt")
+	if _, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: bob, Path: bobHome + "/g.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	before := dbState(t, ts)
+
+	for _, req := range []*pb.MvReq{
+		{Src: testHome + "/a", Dst: bobHome + "/a"},
+		{Src: bobHome + "/g.txt", Dst: testHome + "/g.txt"},
+	} {
+		req.AccessToken = ts.token
+		_, err := ts.Mv(context.Background(), req)
+		if grpc.Code(err) != codes.PermissionDenied {
+			t.Errorf("mv %s to %s: got %v, want PermissionDenied", req.Src, req.Dst, err)
+		}
+	}
+	if after := dbState(t, ts); !reflect.DeepEqual(after, before) {
+		t.Errorf("the denied moves changed the records into\n%s", strings.Join(after, "\n"))
+	}
+}
+
+// TestAuthPreviousSecrets checks the tokens signed by a secret replaced by
+// a rotation are still accepted, unlike the ones of an unknown secret.
+func TestAuthPreviousSecrets(t *testing.T) {
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.sharedSecret = "new"
+		p.previousSecrets = []string{" ", "older", testSecret}
+	})
+	exp := time.Now().Add(time.Hour)
+
+	for _, secret := range []string{"new", testSecret, "older"} {
+		_, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: signedToken(t, "demo", exp, secret), Path: testHome + "/a.txt"})
+		if err != nil {
+			t.Errorf("token signed by %s: %v", secret, err)
+		}
+	}
+	for _, secret := range []string{"unknown", ""} {
+		_, err := ts.Get(context.Background(), &pb.GetReq{AccessToken: signedToken(t, "demo", exp, secret), Path: testHome + "/a.txt"})
+		if grpc.Code(err) != codes.Unauthenticated {
+			t.Errorf("token signed by %q: got %v, want Unauthenticated", secret, err)
+		}
+	}
+}
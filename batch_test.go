@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+// failingIDs returns a generator of sequential ids failing its nth call.
+func failingIDs(n int) func() (string, error) {
+	gen := newSequentialIDs("seq")
+	calls := 0
+	return func() (string, error) {
+		calls++
+		if calls == n {
+			return "", errors.New("no more ids")
+		}
+		return gen()
+	}
+}
+
+func batchPutReq(token string, paths ...string) *pb.BatchPutReq {
+	req := &pb.BatchPutReq{AccessToken: token}
+	for _, p := range paths {
+		req.Entries = append(req.Entries, &pb.BatchPutEntry{Path: testHome + p})
+	}
+	return req
+}
+
+// TestBatchPutRollsBack checks an entry failing after others are saved
+// rolls back the whole batch.
+func TestBatchPutRollsBack(t *testing.T) {
+	ts := newTestServer(t, func(p *newServerParams) {
+		// the etag of the batch, the id of a.txt and of the home are
+		// generated before the id of b.txt
+		p.idGen = failingIDs(4)
+	})
+
+	_, err := ts.BatchPut(context.Background(), batchPutReq(ts.token, "/a.txt", "/b.txt", "/c.txt"))
+	wantCode(t, err, codes.Internal)
+	if n := ts.count(t); n != 0 {
+		t.Errorf("the failed batch left %d records", n)
+	}
+}
+
+// TestBatchPutPropagatesOnce checks the ancestors shared by the entries
+// are updated once, deeper first.
+func TestBatchPutPropagatesOnce(t *testing.T) {
+	ts := newSequentialIDsServer(t)
+	ts.put(t, testHome+"/d/e/x.txt")
+	ts.clock.Advance(time.Second)
+
+	propagated := observePropagated(ts)
+	_, err := ts.BatchPut(context.Background(), batchPutReq(ts.token, "/d/a.txt", "/d/b.txt", "/d/e/c.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{testHome + "/d/e", testHome + "/d", testHome}
+	if got := propagated(); !reflect.DeepEqual(got, want) {
+		t.Errorf("propagated to %s, want %s", strings.Join(got, " "), strings.Join(want, " "))
+	}
+	wantEtag(t, ts, "seq-6", "/d/a.txt", "/d/b.txt", "/d/e/c.txt", "/d/e", "/d", "")
+	wantEtag(t, ts, "seq-1", "/d/e/x.txt")
+}
+
+// TestBatchGetMixed checks the records found are returned in the order
+// they were requested and the others are reported as not found.
+func TestBatchGetMixed(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a.txt")
+	ts.put(t, testHome+"/b/c.txt")
+
+	paths := []string{testHome + "/b/c.txt", testHome + "/missing", testHome + "/a.txt", testHome + "/b/gone"}
+	resp, err := ts.BatchGet(context.Background(), &pb.BatchGetReq{AccessToken: ts.token, Paths: paths})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Records) != 2 || resp.Records[0].Path != paths[0] || resp.Records[1].Path != paths[2] {
+		t.Errorf("got the records %v, want c.txt and a.txt", resp.Records)
+	}
+	if want := []string{paths[1], paths[3]}; !reflect.DeepEqual(resp.NotFound, want) {
+		t.Errorf("got not found %v, want %v", resp.NotFound, want)
+	}
+}
+
+func TestBatchGetLarge(t *testing.T) {
+	ts := newTestServer(t, nil)
+	n := 2000
+	putSubtree(t, ts, testHome+"/big", n)
+
+	paths := []string{}
+	for i := 0; i < n; i++ {
+		paths = append(paths, fmt.Sprintf("%s/big/f%d", testHome, i))
+	}
+	paths = append(paths, testHome+"/big/missing")
+	resp, err := ts.BatchGet(context.Background(), &pb.BatchGetReq{AccessToken: ts.token, Paths: paths})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Records) != n || len(resp.NotFound) != 1 {
+		t.Fatalf("got %d records and %d not found, want %d and 1", len(resp.Records), len(resp.NotFound), n)
+	}
+	for i, rec := range resp.Records {
+		if rec.Path != paths[i] {
+			t.Fatalf("got %s at %d, want %s", rec.Path, i, paths[i])
+		}
+	}
+}
+
+func TestBatchGetForeignHome(t *testing.T) {
+	ts := newTestServer(t, nil)
+	_, err := ts.BatchGet(context.Background(), &pb.BatchGetReq{AccessToken: ts.token, Paths: []string{testHome + "/a", "/local/users/o/other/a"}})
+	wantCode(t, err, codes.PermissionDenied)
+}
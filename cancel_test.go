@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+// TestMvCanceled cancels a Mv of a large subtree once its first record is
+// renamed: the Mv fails with Canceled without renaming the others, and
+// what it renamed is rolled back.
+func TestMvCanceled(t *testing.T) {
+	ts := newTestServer(t, nil)
+	putSubtree(t, ts, testHome+"/src", subtreePageSize)
+	ts.clock.Advance(time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var updates int64
+	ts.s.db.Callback().Update().After("gorm:update").Register("test:cancel", func(scope *gorm.Scope) {
+		if atomic.AddInt64(&updates, 1) == 1 {
+			cancel()
+		}
+	})
+
+	start := time.Now()
+	_, err := ts.Mv(ctx, &pb.MvReq{AccessToken: ts.token, Src: testHome + "/src", Dst: testHome + "/dst"})
+	wantCode(t, err, codes.Canceled)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("the canceled Mv took %s", d)
+	}
+	if n := atomic.LoadInt64(&updates); n != 1 {
+		t.Errorf("got %d updates, want none after the cancellation", n)
+	}
+	ts.record(t, testHome+"/src/f1")
+}
+
+// TestCanceledWrites checks the writes of a request canceled or past its
+// deadline before it starts fail with the matching code and change
+// nothing.
+func TestCanceledWrites(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/f.txt")
+	ts.clock.Advance(time.Second)
+	before := dbState(t, ts)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	for code, ctx := range map[codes.Code]context.Context{codes.Canceled: canceled, codes.DeadlineExceeded: expired} {
+		_, err := ts.Put(ctx, &pb.PutReq{AccessToken: ts.token, Path: testHome + "/b.txt"})
+		wantCode(t, err, code)
+		_, err = ts.Mv(ctx, &pb.MvReq{AccessToken: ts.token, Src: testHome + "/a", Dst: testHome + "/c"})
+		wantCode(t, err, code)
+		_, err = ts.Rm(ctx, &pb.RmReq{AccessToken: ts.token, Path: testHome + "/a"})
+		wantCode(t, err, code)
+	}
+	if after := dbState(t, ts); !reflect.DeepEqual(after, before) {
+		t.Errorf("the canceled writes left\n%s\nwant\n%s", strings.Join(after, "\n"), strings.Join(before, "\n"))
+	}
+}
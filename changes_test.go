@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+// changesSince pages through the changes below the home after since,
+// limit at a time, and returns the paths changed below the home.
+func changesSince(t *testing.T, ts *testServer, since int64, limit int32) []string {
+	paths := []string{}
+	req := &pb.ChangesReq{AccessToken: ts.token, Path: testHome, Since: since, Limit: limit}
+	for {
+		resp, err := ts.ChangesSince(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range resp.Records {
+			paths = append(paths, rec.Path[len(testHome):])
+		}
+		if resp.ContinuationToken == "" {
+			return paths
+		}
+		req.ContinuationToken = resp.ContinuationToken
+	}
+}
+
+func TestChangesSince(t *testing.T) {
+	ts := newFixedTimeServer(t)
+	for _, p := range []string{"/a/f.txt", "/a/g.txt", "/b/h.txt"} {
+		ts.put(t, testHome+p)
+	}
+	since := ts.clock.Now().Unix()
+
+	ts.clock.Advance(time.Second)
+	ts.put(t, testHome+"/a/g.txt")
+	// the changes are ordered by mtime and path
+	want := []string{"", "/a", "/a/g.txt"}
+	if got := changesSince(t, ts, since, 0); !reflect.DeepEqual(got, want) {
+		t.Errorf("got the changes %v, want %v", got, want)
+	}
+	if got := changesSince(t, ts, since+1, 0); len(got) != 0 {
+		t.Errorf("got the changes %v after the last one, want none", got)
+	}
+}
+
+// TestChangesSinceContinuation checks the pages of the changes resume
+// where the previous one ended, the records sharing an mtime included.
+func TestChangesSinceContinuation(t *testing.T) {
+	ts := newFixedTimeServer(t)
+	for _, p := range []string{"/a/f.txt", "/a/g.txt", "/b/h.txt", "/b/i.txt", "/c.txt"} {
+		ts.put(t, testHome+p)
+	}
+	ts.clock.Advance(time.Second)
+	ts.put(t, testHome+"/b/i.txt")
+
+	all := changesSince(t, ts, 0, 0)
+	if len(all) != 8 {
+		t.Fatalf("got the changes %v, want the 8 records", all)
+	}
+	for _, limit := range []int32{1, 2, 3, 7} {
+		if got := changesSince(t, ts, 0, limit); !reflect.DeepEqual(got, all) {
+			t.Errorf("got the changes %v by pages of %d, want %v", got, limit, all)
+		}
+	}
+
+	_, err := ts.ChangesSince(context.Background(), &pb.ChangesReq{AccessToken: ts.token, Path: testHome, ContinuationToken: "bad"})
+	wantCode(t, err, codes.InvalidArgument)
+}
+
+// TestChangesSinceTombstones checks the records removed after since are
+// listed as deleted at the time of the removal, the removed subtree
+// included.
+func TestChangesSinceTombstones(t *testing.T) {
+	ts := newTrashServer(t)
+	for _, p := range []string{"/a/f.txt", "/a/g.txt", "/b/c/h.txt"} {
+		ts.put(t, testHome+p)
+	}
+	since := ts.clock.Now().Unix()
+
+	ts.clock.Advance(time.Second)
+	for _, p := range []string{"/a/f.txt", "/b/c"} {
+		if _, err := ts.Rm(context.Background(), &pb.RmReq{AccessToken: ts.token, Path: testHome + p}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := ts.ChangesSince(context.Background(), &pb.ChangesReq{AccessToken: ts.token, Path: testHome, Since: since})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := map[string]bool{}
+	for _, rec := range resp.Records {
+		if rec.Modified != ts.clock.Now().Unix() {
+			t.Errorf("%s changed at %d, want %d", rec.Path, rec.Modified, ts.clock.Now().Unix())
+		}
+		deleted[rec.Path[len(testHome):]] = rec.Deleted
+	}
+	want := map[string]bool{"": false, "/a": false, "/a/f.txt": true, "/b": false, "/b/c": true, "/b/c/h.txt": true}
+	if !reflect.DeepEqual(deleted, want) {
+		t.Errorf("got the changes %v, want %v", deleted, want)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+)
+
+// listByCheckpoint pages through the changes after checkpoint, limit at a
+// time, and returns the paths changed with the last checkpoint.
+func listByCheckpoint(t *testing.T, ts *testServer, checkpoint int64, limit int32) ([]string, int64) {
+	var paths []string
+	req := &pb.CheckpointReq{AccessToken: ts.token, Path: testHome, Checkpoint: checkpoint, Limit: limit}
+	for {
+		resp, err := ts.ListByCheckpoint(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range resp.Records {
+			paths = append(paths, rec.Path)
+		}
+		if resp.ContinuationToken == "" {
+			return paths, resp.Checkpoint
+		}
+		req.ContinuationToken = resp.ContinuationToken
+	}
+}
+
+// wantChanged checks every path of want is changed exactly once.
+func wantChanged(t *testing.T, changed []string, want []string) {
+	seen := map[string]int{}
+	for _, p := range changed {
+		seen[p]++
+	}
+	for _, p := range want {
+		if seen[p] != 1 {
+			t.Errorf("%s changed %d times, want once", p, seen[p])
+		}
+	}
+}
+
+// TestListByCheckpointSameSecond checks no change is skipped when many
+// records share an mtime second, whatever the page the seq falls in.
+func TestListByCheckpointSameSecond(t *testing.T) {
+	ts := newFixedTimeServer(t)
+	var want []string
+	for i := 0; i < 25; i++ {
+		p := fmt.Sprintf("%s/f%d", testHome, i)
+		ts.put(t, p)
+		want = append(want, p)
+	}
+
+	changed, checkpoint := listByCheckpoint(t, ts, 0, 7)
+	wantChanged(t, changed, want)
+	if rec := ts.record(t, want[len(want)-1]); checkpoint != rec.Seq {
+		t.Errorf("got checkpoint %d, want the seq %d of the last put", checkpoint, rec.Seq)
+	}
+
+	// the clock did not move, the next changes share the same second
+	var next []string
+	for i := 25; i < 40; i++ {
+		p := fmt.Sprintf("%s/f%d", testHome, i)
+		ts.put(t, p)
+		next = append(next, p)
+	}
+	changed, _ = listByCheckpoint(t, ts, checkpoint, 4)
+	wantChanged(t, changed, next)
+	for _, p := range changed {
+		for _, old := range want {
+			if p == old {
+				t.Errorf("%s changed before the checkpoint is listed again", p)
+			}
+		}
+	}
+}
+
+// TestListByCheckpointSharedSeq checks the records written by the same
+// transaction, which share a seq, are not skipped when a page ends
+// between them.
+func TestListByCheckpointSharedSeq(t *testing.T) {
+	ts := newFixedTimeServer(t)
+	ts.put(t, testHome+"/a/b/c/d.txt")
+
+	changed, _ := listByCheckpoint(t, ts, 0, 1)
+	wantChanged(t, changed, []string{testHome, testHome + "/a", testHome + "/a/b", testHome + "/a/b/c", testHome + "/a/b/c/d.txt"})
+}
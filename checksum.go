@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/hex"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"strings"
+)
+
+// checksumSizes maps the known checksum algorithms
+// to the size in bytes of their digests.
+var checksumSizes = map[string]int{
+	"adler32": 4,
+	"crc32":   4,
+	"md5":     16,
+	"sha1":    20,
+	"sha256":  32,
+	"sha512":  64,
+}
+
+// formatChecksum returns the checksum in the algo:hexdigest format.
+func formatChecksum(algo, digest string) string {
+	return strings.ToLower(algo) + ":" + strings.ToLower(digest)
+}
+
+// parseChecksum splits a checksum in the algo:hexdigest format
+// checking that the algorithm is known and the digest matches it.
+func parseChecksum(c string) (algo, digest string, err error) {
+	tokens := strings.SplitN(c, ":", 2)
+	if len(tokens) != 2 {
+		return "", "", grpc.Errorf(codes.InvalidArgument, "checksum %s is not in the algo:hexdigest format", c)
+	}
+
+	algo = strings.ToLower(tokens[0])
+	digest = strings.ToLower(tokens[1])
+
+	size, ok := checksumSizes[algo]
+	if !ok {
+		return "", "", grpc.Errorf(codes.InvalidArgument, "checksum algorithm %s is unknown", tokens[0])
+	}
+
+	raw, err := hex.DecodeString(digest)
+	if err != nil || len(raw) != size {
+		return "", "", grpc.Errorf(codes.InvalidArgument, "checksum digest %s is not a valid %s digest", tokens[1], algo)
+	}
+
+	return algo, digest, nil
+}
+
+// normalizeChecksum validates a checksum sent by a client and returns it
+// in its canonical form. An empty checksum is allowed for records without
+// content. Checksums without algorithm are only accepted if legacy is set,
+// to not break clients sending them before the format was enforced.
+func normalizeChecksum(c string, legacy bool) (string, error) {
+	if c == "" {
+		return "", nil
+	}
+
+	if legacy && !strings.Contains(c, ":") {
+		return c, nil
+	}
+
+	algo, digest, err := parseChecksum(c)
+	if err != nil {
+		return "", err
+	}
+
+	return formatChecksum(algo, digest), nil
+}
+
+// nullChecksum returns the column value of a normalized checksum. An
+// unknown checksum is stored as NULL rather than as an empty string,
+// so the records without content never match each other.
+func nullChecksum(c string) *string {
+	if c == "" {
+		return nil
+	}
+	return &c
+}
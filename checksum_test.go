@@ -0,0 +1,175 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestNormalizeChecksum(t *testing.T) {
+	for c, want := range map[string]string{
+		"":                                     "",
+		"md5:d41d8cd98f00b204e9800998ecf8427e": "md5:d41d8cd98f00b204e9800998ecf8427e",
+		"MD5:D41D8CD98F00B204E9800998ECF8427E": "md5:d41d8cd98f00b204e9800998ecf8427e",
+		"adler32:0a1b2c3d":                     "adler32:0a1b2c3d",
+		"sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709": "sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709",
+	} {
+		if got, err := normalizeChecksum(c, false); err != nil || got != want {
+			t.Errorf("normalizeChecksum(%q) = %q, %v, want %q", c, got, err, want)
+		}
+	}
+
+	for _, c := range []string{
+		"d41d8cd98f00b204e9800998ecf8427e",
+		"md4:d41d8cd98f00b204e9800998ecf8427e",
+		"md5:d41d8cd98f00b204",
+		"md5:not hexadecimal at all, really!",
+		"sha256:d41d8cd98f00b204e9800998ecf8427e",
+		":d41d8cd98f00b204e9800998ecf8427e",
+	} {
+		if got, err := normalizeChecksum(c, false); grpc.Code(err) != codes.InvalidArgument {
+			t.Errorf("normalizeChecksum(%q) = %q, %v, want InvalidArgument", c, got, err)
+		}
+	}
+}
+
+// TestLegacyChecksums checks the bare checksums are only accepted, as
+// they are, with the compatibility flag. The prefixed ones are still
+// validated.
+func TestLegacyChecksums(t *testing.T) {
+	bare := "d41d8cd98f00b204e9800998ecf8427e"
+	if got, err := normalizeChecksum(bare, true); err != nil || got != bare {
+		t.Errorf("got %q, %v, want the bare checksum", got, err)
+	}
+	if _, err := normalizeChecksum("md4:"+bare, true); grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v for an unknown algorithm, want InvalidArgument", err)
+	}
+
+	ts := newTestServer(t, nil)
+	_, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: testHome + "/a.txt", Checksum: bare})
+	wantCode(t, err, codes.InvalidArgument)
+	_, err = ts.BatchPut(context.Background(), &pb.BatchPutReq{AccessToken: ts.token, Entries: []*pb.BatchPutEntry{{Path: testHome + "/a.txt", Checksum: bare}}})
+	wantCode(t, err, codes.InvalidArgument)
+
+	ts = newTestServer(t, func(p *newServerParams) {
+		p.legacyChecksums = true
+	})
+	_, err = ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: testHome + "/a.txt", Checksum: bare})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := ts.get(t, testHome+"/a.txt"); rec.Checksum != bare {
+		t.Errorf("got the checksum %s, want %s", rec.Checksum, bare)
+	}
+}
+
+func TestFormatChecksum(t *testing.T) {
+	algo, digest, err := parseChecksum(formatChecksum("SHA1", "DA39A3EE5E6B4B0D3255BFEF95601890AFD80709"))
+	if err != nil || algo != "sha1" || digest != "da39a3ee5e6b4b0d3255bfef95601890afd80709" {
+		t.Errorf("got %s, %s, %v", algo, digest, err)
+	}
+}
+
+// TestFindByChecksum checks all the records with the checksum below the
+// path are found, and only them.
+func TestFindByChecksum(t *testing.T) {
+	ts := newTestServer(t, nil)
+	empty := formatChecksum("sha1", "da39a3ee5e6b4b0d3255bfef95601890afd80709")
+	other := formatChecksum("sha1", "a9993e364706816aba3e25717850c26c9cd0d89d")
+	for p, checksum := range map[string]string{
+		"/a/x.txt":   empty,
+		"/b/y.txt":   empty,
+		"/b/c/z.txt": empty,
+		"/b/w.txt":   other,
+		"/v.txt":     "",
+	} {
+		_, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: testHome + p, Checksum: checksum})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for p, want := range map[string][]string{
+		testHome:        {testHome + "/a/x.txt", testHome + "/b/c/z.txt", testHome + "/b/y.txt"},
+		testHome + "/b": {testHome + "/b/c/z.txt", testHome + "/b/y.txt"},
+	} {
+		resp, err := ts.FindByChecksum(context.Background(), &pb.ChecksumReq{AccessToken: ts.token, Path: p, Checksum: strings.ToUpper(empty)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(resp.Paths, want) {
+			t.Errorf("got %v below %s, want %v", resp.Paths, p, want)
+		}
+	}
+
+	resp, err := ts.FindByChecksum(context.Background(), &pb.ChecksumReq{AccessToken: ts.token, Path: testHome, Checksum: formatChecksum("md5", "d41d8cd98f00b204e9800998ecf8427e")})
+	if err != nil || len(resp.Paths) != 0 {
+		t.Errorf("got %v, %v, want no path", resp.Paths, err)
+	}
+	_, err = ts.FindByChecksum(context.Background(), &pb.ChecksumReq{AccessToken: ts.token, Path: testHome})
+	wantCode(t, err, codes.InvalidArgument)
+}
+
+// nullChecksums returns the number of records with a NULL checksum.
+func nullChecksums(t *testing.T, ts *testServer) int64 {
+	var n int64
+	if err := ts.s.db.Model(record{}).Where("checksum IS NULL").Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// TestUnknownChecksum checks the folders created by a Get with
+// ForceCreation have no checksum, apart from the files with one.
+func TestUnknownChecksum(t *testing.T) {
+	ts := newTestServer(t, nil)
+	rec, err := ts.Get(context.Background(), &pb.GetReq{AccessToken: ts.token, Path: testHome + "/a", ForceCreation: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.HasChecksum || rec.Checksum != "" {
+		t.Errorf("got %v, want no checksum", rec)
+	}
+	// the home and the folder
+	if n := nullChecksums(t, ts); n != 2 {
+		t.Errorf("got %d NULL checksums, want 2", n)
+	}
+
+	sum := formatChecksum("sha1", "da39a3ee5e6b4b0d3255bfef95601890afd80709")
+	_, err = ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: testHome + "/a/f.txt", Checksum: sum})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := ts.get(t, testHome+"/a/f.txt"); !rec.HasChecksum || rec.Checksum != sum {
+		t.Errorf("got %v, want the checksum %s", rec, sum)
+	}
+	if n := nullChecksums(t, ts); n != 2 {
+		t.Errorf("got %d NULL checksums, want 2", n)
+	}
+}
+
+// TestMigrateEmptyChecksums checks the empty checksums stored before they
+// meant unknown are turned into NULL.
+func TestMigrateEmptyChecksums(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a.txt")
+	if err := ts.s.db.Model(record{}).UpdateColumn("checksum", "").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range migrations {
+		if m.version == 5 {
+			if err := m.up(ts.s.db, ts.s.dialect); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if n := nullChecksums(t, ts); n != ts.count(t) {
+		t.Errorf("got %d NULL checksums of %d records", n, ts.count(t))
+	}
+}
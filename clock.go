@@ -0,0 +1,12 @@
+package main
+
+import "time"
+
+// clock tells the time the records are modified at.
+type clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
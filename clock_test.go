@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	rus "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// fakeClock only moves when told to, so the mtimes given to the records
+// are known beforehand when checking the propagation.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+var fixedTime = time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)
+
+func newFixedTimeServer(t *testing.T) *testServer {
+	return newTestServer(t, func(p *newServerParams) {
+		p.clock = newFakeClock(fixedTime)
+	})
+}
+
+// wantModified checks the records of the paths below the home are
+// modified at mtime.
+func wantModified(t *testing.T, ts *testServer, mtime int64, paths ...string) {
+	for _, p := range paths {
+		if rec := ts.get(t, testHome+p); rec.Modified != mtime {
+			t.Errorf("%s modified at %d, want %d", testHome+p, rec.Modified, mtime)
+		}
+	}
+}
+
+func TestClockPut(t *testing.T) {
+	ts := newFixedTimeServer(t)
+	ts.put(t, testHome+"/a/b/c.txt")
+	wantModified(t, ts, fixedTime.Unix(), "/a/b/c.txt", "/a/b", "/a", "")
+
+	ts.clock.Advance(time.Hour)
+	ts.put(t, testHome+"/a/d.txt")
+	later := fixedTime.Add(time.Hour).Unix()
+	wantModified(t, ts, later, "/a/d.txt", "/a", "")
+	wantModified(t, ts, fixedTime.Unix(), "/a/b/c.txt", "/a/b")
+}
+
+// TestClockMv checks the ancestors of both ends of a move get the time
+// of the move, the moved records keep their own.
+func TestClockMv(t *testing.T) {
+	ts := newFixedTimeServer(t)
+	ts.put(t, testHome+"/a/f.txt")
+	ts.put(t, testHome+"/b/g.txt")
+
+	ts.clock.Advance(time.Hour)
+	_, err := ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: testHome + "/a/f.txt", Dst: testHome + "/b/f.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantModified(t, ts, fixedTime.Add(time.Hour).Unix(), "/a", "/b", "")
+	wantModified(t, ts, fixedTime.Unix(), "/b/f.txt", "/b/g.txt")
+}
+
+func TestClockRm(t *testing.T) {
+	ts := newFixedTimeServer(t)
+	ts.put(t, testHome+"/a/b/c.txt")
+	ts.put(t, testHome+"/a/d.txt")
+
+	ts.clock.Advance(time.Hour)
+	if _, err := ts.Rm(context.Background(), &pb.RmReq{AccessToken: ts.token, Path: testHome + "/a/b"}); err != nil {
+		t.Fatal(err)
+	}
+	wantModified(t, ts, fixedTime.Add(time.Hour).Unix(), "/a", "")
+	wantModified(t, ts, fixedTime.Unix(), "/a/d.txt")
+}
+
+// TestMTimeAfter2038 checks the mtimes past the 32 bits Unix time are
+// stored and read back unchanged.
+func TestMTimeAfter2038(t *testing.T) {
+	later := time.Date(2100, 1, 2, 15, 4, 5, 0, time.UTC)
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.clock = newFakeClock(later)
+	})
+	ts.put(t, testHome+"/a/f.txt")
+	wantModified(t, ts, later.Unix(), "/a/f.txt", "/a", "")
+
+	// an mtime given by the client can not be in the future
+	mtime := later.Add(-time.Hour).Unix()
+	_, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: testHome + "/a/g.txt", Mtime: mtime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantModified(t, ts, mtime, "/a/g.txt")
+	if rec := ts.record(t, testHome+"/a/g.txt"); rec.MTime != mtime {
+		t.Errorf("got the mtime %d in the database, want %d", rec.MTime, mtime)
+	}
+}
+
+// TestChangeLog checks the mtime of a change is logged as the integer
+// stored and as a timestamp, never as a misformatted value.
+func TestChangeLog(t *testing.T) {
+	logger, logs := newCapturingLogger()
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.clock = newFakeClock(fixedTime)
+		p.logger = logger
+	})
+	ts.put(t, testHome+"/a/f.txt")
+
+	// a stale change stops at the first ancestor
+	stale := fixedTime.Add(-time.Second).Unix()
+	if err := ts.s.propagateChanges(context.Background(), ts.s.db, testHome+"/a/f.txt", "stale", stale, ""); err != nil {
+		t.Fatal(err)
+	}
+	warnings := logs.find("updated in the meanwhile")
+	if len(warnings) != 1 {
+		t.Fatalf("got %d warnings, want the one of the stale change", len(warnings))
+	}
+	e := warnings[0]
+	if e.Data["etag"] != "stale" || e.Data["mtime"] != stale || e.Data["modified"] != "2016-01-02T15:04:04Z" {
+		t.Errorf("got the fields %v, want the etag and mtime of the stale change", e.Data)
+	}
+
+	line, err := (&rus.TextFormatter{DisableColors: true}).Format(&e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(line); !strings.Contains(s, fmt.Sprintf("mtime=%d", stale)) || strings.Contains(s, "%!") {
+		t.Errorf("got the line %q, want the mtime %d", s, stale)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+func (ts *testServer) copy(t *testing.T, src, dst string, overwrite bool) {
+	_, err := ts.Copy(context.Background(), &pb.CopyReq{AccessToken: ts.token, Src: src, Dst: dst, Overwrite: overwrite})
+	if err != nil {
+		t.Fatalf("copy %s to %s: %s", src, dst, err)
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	ts := newTestServer(t, nil)
+	sum := "md5:d41d8cd98f00b204e9800998ecf8427e"
+	_, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: testHome + "/a.txt", Checksum: sum, Size: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := ts.get(t, testHome+"/a.txt")
+	ts.clock.Advance(time.Second)
+
+	ts.copy(t, testHome+"/a.txt", testHome+"/b.txt", false)
+
+	cp := ts.get(t, testHome+"/b.txt")
+	if cp.Id == src.Id || cp.Checksum != sum || cp.Size != 3 {
+		t.Errorf("got copy %v of %v", cp, src)
+	}
+	if cp.Etag == src.Etag || cp.Modified <= src.Modified {
+		t.Errorf("copy %v did not get a fresh etag and mtime", cp)
+	}
+	if home := ts.get(t, testHome); home.Etag != cp.Etag {
+		t.Errorf("home etag %s is not the one of the copy %s", home.Etag, cp.Etag)
+	}
+	ts.get(t, testHome+"/a.txt")
+}
+
+func TestCopyFolder(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/b/c.txt")
+	ts.put(t, testHome+"/a/d.txt")
+
+	ts.copy(t, testHome+"/a", testHome+"/x", false)
+
+	for _, p := range []string{"/x", "/x/b", "/x/b/c.txt", "/x/d.txt"} {
+		cp := ts.get(t, testHome+p)
+		orig := ts.get(t, testHome+"/a"+p[len("/x"):])
+		if cp.Id == orig.Id || cp.Kind != orig.Kind {
+			t.Errorf("got copy %v of %v", cp, orig)
+		}
+	}
+}
+
+func TestCopyExisting(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a.txt")
+	ts.put(t, testHome+"/b.txt")
+
+	_, err := ts.Copy(context.Background(), &pb.CopyReq{AccessToken: ts.token, Src: testHome + "/a.txt", Dst: testHome + "/b.txt"})
+	wantCode(t, err, codes.AlreadyExists)
+
+	_, err = ts.Copy(context.Background(), &pb.CopyReq{AccessToken: ts.token, Src: testHome + "/a", Dst: testHome + "/a/b"})
+	wantCode(t, err, codes.InvalidArgument)
+}
+
+// TestCopyOverwrite checks the overwritten records the copies do not
+// replace are left as tombstones and their removal is published.
+func TestCopyOverwrite(t *testing.T) {
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.softDelete = true
+	})
+	ts.put(t, testHome+"/src/same.txt")
+	ts.put(t, testHome+"/dst/same.txt")
+	ts.put(t, testHome+"/dst/gone.txt")
+	old := ts.get(t, testHome+"/dst/same.txt")
+	ts.clock.Advance(time.Second)
+	since := ts.clock.Now().Unix() - 1
+
+	sub := ts.s.hub.subscribe(testHome + "/dst")
+	defer ts.s.hub.unsubscribe(sub)
+
+	ts.copy(t, testHome+"/src", testHome+"/dst", true)
+
+	if cp := ts.get(t, testHome+"/dst/same.txt"); cp.Id == old.Id {
+		t.Errorf("%v was not replaced by the copy", cp)
+	}
+	_, err := ts.Get(context.Background(), &pb.GetReq{AccessToken: ts.token, Path: testHome + "/dst/gone.txt"})
+	wantCode(t, err, codes.NotFound)
+
+	resp, err := ts.ChangesSince(context.Background(), &pb.ChangesReq{AccessToken: ts.token, Path: testHome + "/dst", Since: since})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tombstone := false
+	for _, rec := range resp.Records {
+		if rec.Path == testHome+"/dst/gone.txt" {
+			tombstone = rec.Deleted
+		}
+	}
+	if !tombstone {
+		t.Errorf("got changes %v, want the tombstone of gone.txt", resp.Records)
+	}
+
+	select {
+	case ev := <-sub.events:
+		if ev.Path != testHome+"/dst" || !ev.Deleted {
+			t.Errorf("got event %v, want the removal of dst first", ev)
+		}
+	default:
+		t.Error("the removal of dst was not published")
+	}
+}
+
+func TestCopyOntoTrash(t *testing.T) {
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.softDelete = true
+	})
+	ts.put(t, testHome+"/a.txt")
+	ts.put(t, testHome+"/b.txt")
+	if _, err := ts.Rm(context.Background(), &pb.RmReq{AccessToken: ts.token, Path: testHome + "/b.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ts.copy(t, testHome+"/a.txt", testHome+"/b.txt", false)
+	ts.get(t, testHome+"/b.txt")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+// TestCountNestedTree checks the folder node is counted with its
+// descendants unless excluded, and a sibling sharing its prefix is not.
+func TestCountNestedTree(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, p := range []string{"/a/b/c.txt", "/a/b/d.txt", "/a/e.txt", "/ab/f.txt"} {
+		ts.put(t, testHome+p)
+	}
+
+	for _, c := range []struct {
+		path        string
+		excludeSelf bool
+		want        int64
+	}{
+		{"/a", false, 5},
+		{"/a", true, 4},
+		{"/a/b", false, 3},
+		{"/a/b", true, 2},
+		{"/a/e.txt", false, 1},
+		{"/a/e.txt", true, 0},
+		{"", true, 7},
+		{"/missing", false, 0},
+	} {
+		resp, err := ts.Count(context.Background(), &pb.CountReq{AccessToken: ts.token, Path: testHome + c.path, ExcludeSelf: c.excludeSelf})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Count != c.want {
+			t.Errorf("%s, excluding itself %t: got %d, want %d", c.path, c.excludeSelf, resp.Count, c.want)
+		}
+	}
+}
+
+func TestCountErrors(t *testing.T) {
+	ts := newTestServer(t, nil)
+	_, err := ts.Count(context.Background(), &pb.CountReq{Path: testHome})
+	wantCode(t, err, codes.Unauthenticated)
+	_, err = ts.Count(context.Background(), &pb.CountReq{AccessToken: ts.token, Path: "/local/users/b/bob"})
+	wantCode(t, err, codes.PermissionDenied)
+}
+
+// TestHasChildren checks only the records strictly below the path count,
+// not a sibling sharing its prefix nor a removed one.
+func TestHasChildren(t *testing.T) {
+	ts := newTrashServer(t)
+	for _, p := range []string{"/one/f.txt", "/a.txt", "/emptyx/g.txt", "/gone/h.txt"} {
+		ts.put(t, testHome+p)
+	}
+	_, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: testHome + "/empty", Kind: pb.Kind_FOLDER})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ts.Rm(context.Background(), &pb.RmReq{AccessToken: ts.token, Path: testHome + "/gone/h.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for p, want := range map[string]bool{
+		"":         true,
+		"/one":     true,
+		"/empty":   false,
+		"/a.txt":   false,
+		"/gone":    false,
+		"/missing": false,
+	} {
+		resp, err := ts.HasChildren(context.Background(), &pb.HasChildrenReq{AccessToken: ts.token, Path: testHome + p})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.HasChildren != want {
+			t.Errorf("%s has children %t, want %t", testHome+p, resp.HasChildren, want)
+		}
+	}
+}
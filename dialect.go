@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"strings"
+)
+
+const defaultDriver = "mysql"
+
+// dialect hides the SQL dialect differences of the statements gorm
+// cannot build for us.
+type dialect interface {
+	// upsert inserts the record or updates checksum, etag, mtime, size
+	// and kind if a record with the same path already exists. The id of
+	// an existing record is kept, so it is still found by it. A record in
+	// the trash is taken out of it.
+	upsert(db *gorm.DB, id, p, checksum, etag string, mtime, size int64, kind pb.Kind) error
+
+	// upsertMany is upsert for many records in a single statement. The
+	// records must have different paths.
+	upsertMany(db *gorm.DB, recs []*record) error
+
+	// widenMTime alters the m_time column to a 64 bits integer.
+	widenMTime(db *gorm.DB) error
+
+	// retryable reports if err is a transient error, like a deadlock,
+	// after which the operation can succeed if run again.
+	retryable(err error) bool
+
+	// duplicate reports if err is the violation of a unique key, as left
+	// by a concurrent write of the same key.
+	duplicate(err error) bool
+
+	// validateDSN checks the DSN before connecting, so a malformed one
+	// fails the startup with an error telling what is wrong.
+	validateDSN(dsn string) error
+}
+
+func newDialect(driver string) (dialect, error) {
+	switch driver {
+	case "mysql":
+		return &mysqlDialect{}, nil
+	case "postgres":
+		return &postgresDialect{}, nil
+	case "sqlite3":
+		return &sqliteDialect{}, nil
+	default:
+		return nil, fmt.Errorf("driver %s is not supported", driver)
+	}
+}
+
+// upsertColumns are the columns written by upsert, in the order of its
+// arguments, the parent_path derived from p following it and the seq
+// marker of the transaction last. path is the conflict target and is
+// never updated.
+var upsertColumns = []string{"id", "path", "parent_path", "checksum", "e_tag", "m_time", "size", "kind", "seq"}
+
+// upsertKeptColumns are the columns an upsert leaves as they are on
+// conflict. seq is not among them: updating a record is a change, so it
+// gets a new seq like any other write.
+var upsertKeptColumns = map[string]bool{"id": true, "path": true}
+
+// upsertSQL builds the statement inserting rows records of upsertColumns
+// into the records table of db. On conflict the columns but
+// upsertKeptColumns are updated, each as formatted by assign, after the
+// onConflict clause of the dialect, and the record is taken out of the
+// trash.
+func upsertSQL(db *gorm.DB, onConflict string, rows int, assign func(col string) string) string {
+
+	scope := db.NewScope(&record{})
+
+	cols := make([]string, len(upsertColumns))
+	marks := make([]string, len(upsertColumns))
+	sets := []string{}
+	for i, c := range upsertColumns {
+		cols[i] = scope.Quote(c)
+		marks[i] = "?"
+		if !upsertKeptColumns[c] {
+			sets = append(sets, assign(scope.Quote(c)))
+		}
+	}
+	sets = append(sets, scope.Quote("deleted_at")+"=NULL")
+
+	values := make([]string, rows)
+	for i := range values {
+		values[i] = "(" + strings.Join(marks, ",") + ")"
+	}
+
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES %s %s %s", scope.QuotedTableName(), strings.Join(cols, ","), strings.Join(values, ","), onConflict, strings.Join(sets, ", "))
+}
+
+// upsertArgs are the arguments of the statement of upsertSQL for recs,
+// written in the transaction db.
+func upsertArgs(db *gorm.DB, recs []*record) []interface{} {
+	args := make([]interface{}, 0, len(recs)*len(upsertColumns))
+	for _, r := range recs {
+		args = append(args, r.ID, r.Path, parentPath(r.Path), r.Checksum, r.ETag, r.MTime, r.Size, r.Kind, seqMarker(db))
+	}
+	return args
+}
+
+type mysqlDialect struct{}
+
+func (d *mysqlDialect) upsert(db *gorm.DB, id, p, checksum, etag string, mtime, size int64, kind pb.Kind) error {
+	return d.upsertMany(db, []*record{{ID: id, Path: p, Checksum: nullChecksum(checksum), ETag: etag, MTime: mtime, Size: size, Kind: kind}})
+}
+
+func (*mysqlDialect) upsertMany(db *gorm.DB, recs []*record) error {
+	sql := upsertSQL(db, "ON DUPLICATE KEY UPDATE", len(recs), func(col string) string {
+		return col + "=VALUES(" + col + ")"
+	})
+	return db.Exec(sql, upsertArgs(db, recs)...).Error
+}
+
+func (*mysqlDialect) widenMTime(db *gorm.DB) error {
+	return db.Model(&record{}).ModifyColumn("m_time", "bigint").Error
+}
+
+// retryable matches deadlocks (1213), lock wait timeouts (1205) and
+// broken connections.
+func (*mysqlDialect) retryable(err error) bool {
+	if err == mysql.ErrInvalidConn {
+		return true
+	}
+	if e, ok := err.(*mysql.MySQLError); ok {
+		return e.Number == 1213 || e.Number == 1205
+	}
+	return false
+}
+
+// duplicate matches duplicate entries (1062).
+func (*mysqlDialect) duplicate(err error) bool {
+	if e, ok := err.(*mysql.MySQLError); ok {
+		return e.Number == 1062
+	}
+	return false
+}
+
+type postgresDialect struct{}
+
+func (d *postgresDialect) upsert(db *gorm.DB, id, p, checksum, etag string, mtime, size int64, kind pb.Kind) error {
+	return d.upsertMany(db, []*record{{ID: id, Path: p, Checksum: nullChecksum(checksum), ETag: etag, MTime: mtime, Size: size, Kind: kind}})
+}
+
+// upsertMany fails if two records have the same path, as a statement can
+// not update a row twice.
+func (*postgresDialect) upsertMany(db *gorm.DB, recs []*record) error {
+	sql := upsertSQL(db, "ON CONFLICT (path) DO UPDATE SET", len(recs), func(col string) string {
+		return col + "=EXCLUDED." + col
+	})
+	return db.Exec(sql, upsertArgs(db, recs)...).Error
+}
+
+func (*postgresDialect) widenMTime(db *gorm.DB) error {
+	return db.Exec(`ALTER TABLE ` + recordsTable(db) + ` ALTER COLUMN m_time TYPE bigint`).Error
+}
+
+// retryable matches serialization failures (40001) and deadlocks (40P01).
+func (*postgresDialect) retryable(err error) bool {
+	if e, ok := err.(*pq.Error); ok {
+		return e.Code == "40001" || e.Code == "40P01"
+	}
+	return false
+}
+
+// duplicate matches unique violations (23505).
+func (*postgresDialect) duplicate(err error) bool {
+	if e, ok := err.(*pq.Error); ok {
+		return e.Code == "23505"
+	}
+	return false
+}
+
+// sqliteDialect is meant for embedded and test deployments.
+// The driver is only linked in when building with -tags sqlite.
+type sqliteDialect struct{}
+
+func (d *sqliteDialect) upsert(db *gorm.DB, id, p, checksum, etag string, mtime, size int64, kind pb.Kind) error {
+	return d.upsertMany(db, []*record{{ID: id, Path: p, Checksum: nullChecksum(checksum), ETag: etag, MTime: mtime, Size: size, Kind: kind}})
+}
+
+// upsertMany is limited by the number of variables of a statement, 999
+// before SQLite 3.32, so the records are at most 111 by statement there.
+// The upsert clause needs SQLite 3.24.
+func (*sqliteDialect) upsertMany(db *gorm.DB, recs []*record) error {
+	sql := upsertSQL(db, "ON CONFLICT (path) DO UPDATE SET", len(recs), func(col string) string {
+		return col + "=excluded." + col
+	})
+	return db.Exec(sql, upsertArgs(db, recs)...).Error
+}
+
+// widenMTime is a no-op because SQLite integers are already 64 bits wide.
+func (*sqliteDialect) widenMTime(db *gorm.DB) error {
+	return nil
+}
+
+// retryable matches a locked database. The error is matched by its
+// message because the driver is not always linked in.
+func (*sqliteDialect) retryable(err error) bool {
+	return strings.Contains(err.Error(), "database is locked")
+}
+
+// duplicate matches a failed unique constraint, by its message like
+// retryable.
+func (*sqliteDialect) duplicate(err error) bool {
+	return strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// newMockDB returns a gorm handle of driver backed by sqlmock, that
+// matches the statements literally.
+func newMockDB(t *testing.T, driver string) (*gorm.DB, sqlmock.Sqlmock) {
+	sqlDB, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	db, err := gorm.Open(driver, sqlDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &db, mock
+}
+
+func TestUpsertSQL(t *testing.T) {
+	tests := []struct {
+		driver string
+		want   string
+	}{
+		{"mysql", "INSERT INTO `records` (`id`,`path`,`parent_path`,`checksum`,`e_tag`,`m_time`,`size`,`kind`,`seq`) VALUES (?,?,?,?,?,?,?,?,?) " +
+			"ON DUPLICATE KEY UPDATE `parent_path`=VALUES(`parent_path`), `checksum`=VALUES(`checksum`), `e_tag`=VALUES(`e_tag`), " +
+			"`m_time`=VALUES(`m_time`), `size`=VALUES(`size`), `kind`=VALUES(`kind`), `seq`=VALUES(`seq`), `deleted_at`=NULL"},
+		{"postgres", `INSERT INTO "records" ("id","path","parent_path","checksum","e_tag","m_time","size","kind","seq") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9) ` +
+			`ON CONFLICT (path) DO UPDATE SET "parent_path"=EXCLUDED."parent_path", "checksum"=EXCLUDED."checksum", "e_tag"=EXCLUDED."e_tag", ` +
+			`"m_time"=EXCLUDED."m_time", "size"=EXCLUDED."size", "kind"=EXCLUDED."kind", "seq"=EXCLUDED."seq", "deleted_at"=NULL`},
+		{"sqlite3", `INSERT INTO "records" ("id","path","parent_path","checksum","e_tag","m_time","size","kind","seq") VALUES (?,?,?,?,?,?,?,?,?) ` +
+			`ON CONFLICT (path) DO UPDATE SET "parent_path"=excluded."parent_path", "checksum"=excluded."checksum", "e_tag"=excluded."e_tag", ` +
+			`"m_time"=excluded."m_time", "size"=excluded."size", "kind"=excluded."kind", "seq"=excluded."seq", "deleted_at"=NULL`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.driver, func(t *testing.T) {
+			db, mock := newMockDB(t, tt.driver)
+			d, err := newDialect(tt.driver)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mock.ExpectExec(tt.want).
+				WithArgs("id1", "/a/b", "/a", "md5:x", "etag1", int64(10), int64(20), pb.Kind_FILE, int64(0)).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+
+			if err := d.upsert(db, "id1", "/a/b", "md5:x", "etag1", 10, 20, pb.Kind_FILE); err != nil {
+				t.Fatal(err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestUpsertKeepsID checks no dialect updates the id of an existing
+// record, that GetByID and RmByID find it by.
+func TestUpsertKeepsID(t *testing.T) {
+	for _, driver := range []string{"mysql", "postgres", "sqlite3"} {
+		t.Run(driver, func(t *testing.T) {
+			db, _ := newMockDB(t, driver)
+			sql := upsertSQL(db, "ON CONFLICT", 2, func(col string) string {
+				return col + "=new"
+			})
+			scope := db.NewScope(&record{})
+			for _, c := range []string{"id", "path"} {
+				if regexp.MustCompile(regexp.QuoteMeta(scope.Quote(c) + "=")).MatchString(sql) {
+					t.Errorf("%s is updated on conflict: %s", c, sql)
+				}
+			}
+		})
+	}
+}
+
+func TestUpsertManyRows(t *testing.T) {
+	db, mock := newMockDB(t, "postgres")
+	d := &postgresDialect{}
+
+	recs := []*record{
+		{ID: "id1", Path: "/a", ETag: "e1", Kind: pb.Kind_FOLDER},
+		{ID: "id2", Path: "/a/b", ETag: "e2", Kind: pb.Kind_FILE},
+	}
+	mock.ExpectExec(`INSERT INTO "records" ("id","path","parent_path","checksum","e_tag","m_time","size","kind","seq") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9),($10,$11,$12,$13,$14,$15,$16,$17,$18) `+
+		`ON CONFLICT (path) DO UPDATE SET "parent_path"=EXCLUDED."parent_path", "checksum"=EXCLUDED."checksum", "e_tag"=EXCLUDED."e_tag", `+
+		`"m_time"=EXCLUDED."m_time", "size"=EXCLUDED."size", "kind"=EXCLUDED."kind", "seq"=EXCLUDED."seq", "deleted_at"=NULL`).
+		WithArgs("id1", "/a", "/", nil, "e1", int64(0), int64(0), pb.Kind_FOLDER, int64(0),
+			"id2", "/a/b", "/a", nil, "e2", int64(0), int64(0), pb.Kind_FILE, int64(0)).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	if err := d.upsertMany(db, recs); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpsertTablePrefix(t *testing.T) {
+	db, _ := newMockDB(t, "mysql")
+	db, err := withTablePrefix(db, "prop_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sql := upsertSQL(db, "ON DUPLICATE KEY UPDATE", 1, func(col string) string {
+		return col + "=VALUES(" + col + ")"
+	})
+	if want := "INSERT INTO `prop_records` "; sql[:len(want)] != want {
+		t.Errorf("got %s, want it to start with %s", sql, want)
+	}
+}
+
+func TestNewDialect(t *testing.T) {
+	for driver, want := range map[string]dialect{"mysql": &mysqlDialect{}, "postgres": &postgresDialect{}, "sqlite3": &sqliteDialect{}} {
+		d, err := newDialect(driver)
+		if err != nil || reflect.TypeOf(d) != reflect.TypeOf(want) {
+			t.Errorf("got %T, %v for %s, want %T", d, err, driver, want)
+		}
+	}
+	if _, err := newDialect("oracle"); err == nil {
+		t.Error("got a dialect of an unsupported driver")
+	}
+}
+
+func TestWidenMTimeSQL(t *testing.T) {
+	tests := []struct {
+		driver string
+		d      dialect
+		want   string
+	}{
+		{"mysql", &mysqlDialect{}, "ALTER TABLE `records` MODIFY `m_time` bigint"},
+		{"postgres", &postgresDialect{}, `ALTER TABLE "records" ALTER COLUMN m_time TYPE bigint`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.driver, func(t *testing.T) {
+			db, mock := newMockDB(t, tt.driver)
+			mock.ExpectExec(tt.want).WillReturnResult(sqlmock.NewResult(0, 0))
+			if err := tt.d.widenMTime(db); err != nil {
+				t.Fatal(err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestDialectErrors(t *testing.T) {
+	tests := []struct {
+		d                    dialect
+		err                  error
+		retryable, duplicate bool
+	}{
+		{&mysqlDialect{}, &mysql.MySQLError{Number: 1213}, true, false},
+		{&mysqlDialect{}, &mysql.MySQLError{Number: 1205}, true, false},
+		{&mysqlDialect{}, mysql.ErrInvalidConn, true, false},
+		{&mysqlDialect{}, &mysql.MySQLError{Number: 1062}, false, true},
+		{&mysqlDialect{}, &mysql.MySQLError{Number: 1146}, false, false},
+		{&postgresDialect{}, &pq.Error{Code: "40001"}, true, false},
+		{&postgresDialect{}, &pq.Error{Code: "40P01"}, true, false},
+		{&postgresDialect{}, &pq.Error{Code: "23505"}, false, true},
+		{&postgresDialect{}, &pq.Error{Code: "42P01"}, false, false},
+		{&sqliteDialect{}, errors.New("database is locked"), true, false},
+		{&sqliteDialect{}, errors.New("UNIQUE constraint failed: records.path"), false, true},
+		{&sqliteDialect{}, errors.New("no such table: records"), false, false},
+	}
+	for _, tt := range tests {
+		if got := tt.d.retryable(tt.err); got != tt.retryable {
+			t.Errorf("%T: %v retryable: %t, want %t", tt.d, tt.err, got, tt.retryable)
+		}
+		if got := tt.d.duplicate(tt.err); got != tt.duplicate {
+			t.Errorf("%T: %v duplicate: %t, want %t", tt.d, tt.err, got, tt.duplicate)
+		}
+	}
+}
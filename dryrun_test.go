@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+)
+
+// paths returns the paths of the records of ts, in order.
+func paths(t *testing.T, ts *testServer) []string {
+	paths := []string{}
+	if err := ts.s.db.Model(record{}).Order("path").Pluck("path", &paths).Error; err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+// missing returns the paths of before that are not in after.
+func missing(before, after []string) []string {
+	left := map[string]bool{}
+	for _, p := range after {
+		left[p] = true
+	}
+	gone := []string{}
+	for _, p := range before {
+		if !left[p] {
+			gone = append(gone, p)
+		}
+	}
+	return gone
+}
+
+func newDryRunServer(t *testing.T) *testServer {
+	ts := newTestServer(t, nil)
+	for _, p := range []string{"/a/b/c.txt", "/a/d.txt", "/ab.txt"} {
+		ts.put(t, testHome+p)
+	}
+	ts.clock.Advance(time.Second)
+	return ts
+}
+
+// TestRmDryRun checks a dry run changes nothing and returns the paths
+// the real run removes.
+func TestRmDryRun(t *testing.T) {
+	ts := newDryRunServer(t)
+	before := dbState(t, ts)
+	beforePaths := paths(t, ts)
+
+	dry := ts.rm(t, &pb.RmReq{Path: testHome + "/a", DryRun: true})
+	if after := dbState(t, ts); !reflect.DeepEqual(after, before) {
+		t.Errorf("the dry run left\n%s\nwant\n%s", strings.Join(after, "\n"), strings.Join(before, "\n"))
+	}
+
+	resp := ts.rm(t, &pb.RmReq{Path: testHome + "/a"})
+	if gone := missing(beforePaths, paths(t, ts)); !reflect.DeepEqual(dry.Paths, gone) {
+		t.Errorf("the dry run listed %v, the run removed %v", dry.Paths, gone)
+	}
+	if dry.Deleted != resp.Deleted {
+		t.Errorf("the dry run counted %d records, the run removed %d", dry.Deleted, resp.Deleted)
+	}
+}
+
+func TestMvDryRun(t *testing.T) {
+	ts := newDryRunServer(t)
+	before := dbState(t, ts)
+	beforePaths := paths(t, ts)
+
+	req := &pb.MvReq{AccessToken: ts.token, Src: testHome + "/a", Dst: testHome + "/e", DryRun: true}
+	dry, err := ts.Mv(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after := dbState(t, ts); !reflect.DeepEqual(after, before) {
+		t.Errorf("the dry run left\n%s\nwant\n%s", strings.Join(after, "\n"), strings.Join(before, "\n"))
+	}
+
+	req.DryRun = false
+	if _, err = ts.Mv(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if gone := missing(beforePaths, paths(t, ts)); !reflect.DeepEqual(dry.Paths, gone) {
+		t.Errorf("the dry run listed %v, the run moved %v", dry.Paths, gone)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// dsnVariable matches the ${NAME} references of a DSN.
+var dsnVariable = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// expandDSN replaces the ${NAME} references of dsn with the environment
+// variables they name, so the credentials can be kept apart from the
+// rest of the DSN. A bare $ is left as is as it is common in passwords.
+func expandDSN(dsn string) (string, error) {
+	var missing string
+	dsn = dsnVariable.ReplaceAllStringFunc(dsn, func(ref string) string {
+		name := dsnVariable.FindStringSubmatch(ref)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok && missing == "" {
+			missing = name
+		}
+		return v
+	})
+	if missing != "" {
+		return "", fmt.Errorf("DSN references %s that is not set", missing)
+	}
+	return dsn, nil
+}
+
+// dsnPassword matches the password field of a key=value DSN.
+var dsnPassword = regexp.MustCompile(`password=('(\\.|[^'\\])*'|\S*)`)
+
+// redactDSN hides the password of dsn so it can be logged. It knows the
+// URL, key=value and MySQL forms.
+func redactDSN(dsn string) string {
+
+	// scheme://[user[:password]@]host/...
+	if i := strings.Index(dsn, "://"); i >= 0 {
+		rest := dsn[i+3:]
+		userHost := rest
+		if slash := strings.Index(rest, "/"); slash >= 0 {
+			userHost = rest[:slash]
+		}
+		at := strings.LastIndex(userHost, "@")
+		if at < 0 {
+			return dsn
+		}
+		if colon := strings.Index(userHost[:at], ":"); colon >= 0 {
+			return dsn[:i+3] + userHost[:colon+1] + "******" + rest[at:]
+		}
+		return dsn
+	}
+
+	if dsnPassword.MatchString(dsn) {
+		return dsnPassword.ReplaceAllString(dsn, "password=******")
+	}
+
+	// [user[:password]@][net[(addr)]]/dbname[?params]
+	slash := strings.LastIndex(dsn, "/")
+	if slash < 0 {
+		return dsn
+	}
+	at := strings.LastIndex(dsn[:slash], "@")
+	if at < 0 {
+		return dsn
+	}
+	if colon := strings.Index(dsn[:at], ":"); colon >= 0 {
+		return dsn[:colon+1] + "******" + dsn[at:]
+	}
+	return dsn
+}
+
+// validateDSN checks the [user[:password]@][net[(addr)]]/dbname[?params]
+// form of the MySQL driver and that it names the database. The errors of
+// the validations do not quote the DSN as it may hold the password.
+func (*mysqlDialect) validateDSN(dsn string) error {
+
+	slash := strings.LastIndex(dsn, "/")
+	if slash < 0 {
+		return fmt.Errorf("it has no /dbname")
+	}
+
+	addr := dsn[:slash]
+	if at := strings.LastIndex(addr, "@"); at >= 0 {
+		addr = addr[at+1:]
+	}
+	if open := strings.Index(addr, "("); open >= 0 {
+		if open == 0 {
+			return fmt.Errorf("address %s has no network, like tcp(host:port)", addr)
+		}
+		if !strings.HasSuffix(addr, ")") {
+			return fmt.Errorf("address %s is not closed by )", addr)
+		}
+	}
+
+	name, params := dsn[slash+1:], ""
+	if q := strings.Index(name, "?"); q >= 0 {
+		name, params = name[:q], name[q+1:]
+	}
+	if name == "" {
+		return fmt.Errorf("it names no database after /")
+	}
+	if params == "" {
+		return nil
+	}
+	for _, param := range strings.Split(params, "&") {
+		if kv := strings.SplitN(param, "=", 2); len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("parameter %s is not key=value", kv[0])
+		}
+	}
+	return nil
+}
+
+// validateDSN checks the URL or key=value form of the PostgreSQL driver.
+// The missing fields take the defaults of the driver.
+func (*postgresDialect) validateDSN(dsn string) error {
+
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		// the error of the parser quotes the URL, password included
+		if _, err := url.Parse(dsn); err != nil {
+			return fmt.Errorf("it is not a valid URL")
+		}
+		return nil
+	}
+	if strings.Contains(dsn, "://") {
+		return fmt.Errorf("its URL scheme is not postgres://")
+	}
+
+	s := strings.TrimSpace(dsn)
+	for s != "" {
+		eq := strings.Index(s, "=")
+		if eq <= 0 || strings.ContainsAny(s[:eq], " \t") {
+			return fmt.Errorf("it has a field that is not key=value")
+		}
+		key := s[:eq]
+		s = strings.TrimLeft(s[eq+1:], " \t")
+
+		if strings.HasPrefix(s, "'") {
+			i := 1
+			for ; i < len(s) && s[i] != '\''; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(s) {
+				return fmt.Errorf("value of %s is not closed by '", key)
+			}
+			s = s[i+1:]
+		} else if i := strings.IndexAny(s, " \t"); i >= 0 {
+			s = s[i:]
+		} else {
+			s = ""
+		}
+		s = strings.TrimLeft(s, " \t")
+	}
+	return nil
+}
+
+// validateDSN checks that there is a file name, any name is valid.
+func (*sqliteDialect) validateDSN(dsn string) error {
+	if strings.TrimSpace(dsn) == "" {
+		return fmt.Errorf("it is empty, use a file name or file::memory:?cache=shared")
+	}
+	return nil
+}
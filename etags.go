@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/net/context"
+	"path"
+	"sort"
+)
+
+// childrenETag returns the etag of the folder at p derived from the names
+// and etags of its children, so two servers holding the same tree agree
+// on the etags of the folders. The ids of the children are left out as
+// they are generated by every server. The children are sorted here as
+// the databases do not agree on the order of the paths.
+func childrenETag(db *gorm.DB, p string) (string, error) {
+
+	rows, err := db.Model(record{}).Scopes(withChildren(p)).Select("path, e_tag").Rows()
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	children := []string{}
+	for rows.Next() {
+		var cp, etag string
+		if err = rows.Scan(&cp, &etag); err != nil {
+			return "", err
+		}
+		children = append(children, path.Base(cp)+":"+etag)
+	}
+	if err = rows.Err(); err != nil {
+		return "", err
+	}
+	sort.Strings(children)
+
+	h := sha1.New()
+	for _, c := range children {
+		fmt.Fprintln(h, c)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// recomputeETags gives the folders at paths, ordered from the deepest
+// one, the etag derived from their children. The mtime of the folders
+// whose etag changes is raised to mtime. Every folder is recomputed as
+// its etag depends on all the ones below it, so unlike the propagation
+// of random etags it is not short circuited. It returns the number of
+// folders changed.
+func (s *server) recomputeETags(ctx context.Context, db *gorm.DB, paths []string, mtime int64) (int64, error) {
+
+	var total int64
+	for _, p := range paths {
+		if err := ctxError(ctx); err != nil {
+			return total, err
+		}
+
+		etag, err := childrenETag(db, p)
+		if err != nil {
+			return total, err
+		}
+
+		res := db.Model(record{}).Where("path=? AND e_tag <> ?", p, etag).Updates(map[string]interface{}{
+			"e_tag":  etag,
+			"m_time": gorm.Expr("CASE WHEN m_time < ? THEN ? ELSE m_time END", mtime, mtime),
+		})
+		if res.Error != nil {
+			return total, res.Error
+		}
+		total += res.RowsAffected
+	}
+	return total, nil
+}
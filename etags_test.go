@@ -0,0 +1,149 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+func newChildrenETagsServer(t *testing.T) *testServer {
+	return newTestServer(t, func(p *newServerParams) {
+		p.childrenETags = true
+	})
+}
+
+// putETag puts the file at p below the home with the etag given.
+func (ts *testServer) putETag(t *testing.T, p, etag string) {
+	_, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: testHome + p, Etag: etag})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+var etagsFolders = []string{"", "/a", "/a/b", "/c"}
+
+// TestChildrenETagsIdentical checks two trees built in another order and
+// with other ids end up with the same folder etags.
+func TestChildrenETagsIdentical(t *testing.T) {
+	one := newChildrenETagsServer(t)
+	one.putETag(t, "/a/b/x.txt", "x")
+	one.putETag(t, "/a/y.txt", "y")
+	one.putETag(t, "/c/z.txt", "z")
+
+	two := newChildrenETagsServer(t)
+	two.putETag(t, "/c/z.txt", "z")
+	two.putETag(t, "/a/w.txt", "w")
+	two.putETag(t, "/a/b/x.txt", "x")
+	two.clock.Advance(time.Second)
+	if _, err := two.Mv(context.Background(), &pb.MvReq{AccessToken: two.token, Src: testHome + "/a/w.txt", Dst: testHome + "/a/y.txt", Etag: "mv"}); err != nil {
+		t.Fatal(err)
+	}
+	two.putETag(t, "/a/y.txt", "y")
+
+	for _, p := range etagsFolders {
+		if e1, e2 := one.get(t, testHome+p).Etag, two.get(t, testHome+p).Etag; e1 != e2 {
+			t.Errorf("%s has the etags %s and %s", testHome+p, e1, e2)
+		}
+	}
+	if one.get(t, testHome+"/a").Id == two.get(t, testHome+"/a").Id {
+		t.Error("the trees share their ids")
+	}
+
+	// a change of a file changes the etags of all its ancestors only
+	before := map[string]string{}
+	for _, p := range etagsFolders {
+		before[p] = one.get(t, testHome+p).Etag
+	}
+	one.clock.Advance(time.Second)
+	one.putETag(t, "/a/b/x.txt", "x2")
+	for _, p := range etagsFolders {
+		changed := one.get(t, testHome+p).Etag != before[p]
+		if want := p != "/c"; changed != want {
+			t.Errorf("%s changed is %t, want %t", testHome+p, changed, want)
+		}
+	}
+}
+
+// TestRecomputeEtag checks RecomputeEtag restores the derived etags of the
+// folders below and above the path.
+func TestRecomputeEtag(t *testing.T) {
+	ts := newChildrenETagsServer(t)
+	ts.putETag(t, "/a/b/x.txt", "x")
+	ts.putETag(t, "/c/z.txt", "z")
+	want := map[string]string{}
+	for _, p := range etagsFolders {
+		want[p] = ts.get(t, testHome+p).Etag
+	}
+
+	for _, p := range etagsFolders {
+		if err := ts.s.db.Model(record{}).Where("path = ?", testHome+p).UpdateColumn("e_tag", "random").Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec, err := ts.RecomputeEtag(context.Background(), &pb.RecomputeEtagReq{AccessToken: ts.token, Path: testHome + "/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Etag != want["/a"] {
+		t.Errorf("got the etag %s, want %s", rec.Etag, want["/a"])
+	}
+	// the home is derived from /c as it is
+	wantEtag(t, ts, want["/a/b"], "/a/b")
+	wantEtag(t, ts, "random", "/c")
+	if rec := ts.get(t, testHome); rec.Etag == "random" || rec.Etag == want[""] {
+		t.Errorf("got the etag %s for the home, want it derived from the stale /c", rec.Etag)
+	}
+
+	if _, err = ts.RecomputeEtag(context.Background(), &pb.RecomputeEtagReq{AccessToken: ts.token, Path: testHome}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range etagsFolders {
+		wantEtag(t, ts, want[p], p)
+	}
+}
+
+func TestRecomputeEtagErrors(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/x.txt")
+	_, err := ts.RecomputeEtag(context.Background(), &pb.RecomputeEtagReq{AccessToken: ts.token, Path: testHome + "/a"})
+	wantCode(t, err, codes.FailedPrecondition)
+
+	ts = newChildrenETagsServer(t)
+	_, err = ts.RecomputeEtag(context.Background(), &pb.RecomputeEtagReq{AccessToken: ts.token, Path: testHome + "/missing"})
+	wantCode(t, err, codes.NotFound)
+}
+
+// TestChildrenETagsTouch checks a touched folder keeps the etag derived
+// from its children while a touched file changes the ones of its
+// ancestors.
+func TestChildrenETagsTouch(t *testing.T) {
+	ts := newChildrenETagsServer(t)
+	ts.putETag(t, "/a/b/x.txt", "x")
+	derived := ts.get(t, testHome+"/a").Etag
+
+	ts.clock.Advance(time.Second)
+	if _, err := ts.Touch(context.Background(), &pb.TouchReq{AccessToken: ts.token, Path: testHome + "/a"}); err != nil {
+		t.Fatal(err)
+	}
+	wantEtag(t, ts, derived, "/a")
+	wantModified(t, ts, ts.clock.Now().Unix(), "/a")
+
+	ts.clock.Advance(time.Second)
+	if _, err := ts.Touch(context.Background(), &pb.TouchReq{AccessToken: ts.token, Path: testHome + "/a/b/x.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	etag := ts.get(t, testHome+"/a/b/x.txt").Etag
+	if etag == "x" {
+		t.Error("the touched file kept its etag")
+	}
+	two := newChildrenETagsServer(t)
+	two.putETag(t, "/a/b/x.txt", etag)
+	for _, p := range etagsFolders[:3] {
+		if e1, e2 := ts.get(t, testHome+p).Etag, two.get(t, testHome+p).Etag; e1 != e2 {
+			t.Errorf("%s has the etag %s, want %s derived from the touched file", testHome+p, e1, e2)
+		}
+	}
+}
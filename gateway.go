@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	rus "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// gateway exposes the unary RPCs over JSON/HTTP for the clients that can
+// not speak gRPC, on the routes of the google.api.http options of the
+// proto. The generated reverse proxy calls the RPCs through a gRPC
+// client, connected in memory to a server of its own so the requests go
+// through the same metadata as the gRPC ones: the Authorization header
+// is the authorization metadata and the Grpc-Metadata-<key> headers are
+// the <key> metadata, like Grpc-Metadata-Trace for the trace id.
+type gateway struct {
+	srv       *grpc.Server
+	conn      *grpc.ClientConn
+	marshaler runtime.Marshaler
+}
+
+func newGateway(srv pb.PropServer, logger *rus.Logger) (*gateway, error) {
+	lis := newPipeListener()
+	grpcServer := grpc.NewServer()
+	pb.RegisterPropServer(grpcServer, srv)
+	go func() {
+		if err := grpcServer.Serve(lis); err != nil && err != errPipeListenerClosed {
+			logger.Error(err)
+		}
+	}()
+
+	conn, err := grpc.Dial("gateway", grpc.WithInsecure(), grpc.WithDialer(lis.dial))
+	if err != nil {
+		grpcServer.Stop()
+		return nil, err
+	}
+
+	// the records are encoded like the proto3 JSON mapping does, with
+	// the enums as their names, keeping the field names of the proto
+	return &gateway{
+		srv:       grpcServer,
+		conn:      conn,
+		marshaler: &runtime.JSONPb{OrigName: true},
+	}, nil
+}
+
+// ServeHTTP serves r through a mux registered with the context of r, as
+// the generated handlers call the RPCs with the context they are
+// registered with: the RPC is canceled when the client goes away.
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mux := runtime.NewServeMux(runtime.WithMarshalerOption(runtime.MIMEWildcard, g.marshaler))
+	if err := pb.RegisterPropHandler(r.Context(), mux, g.conn); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mux.ServeHTTP(w, r)
+}
+
+// Close stops the gRPC server of the gateway.
+func (g *gateway) Close() error {
+	err := g.conn.Close()
+	g.srv.Stop()
+	return err
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+// newGatewayServer returns an HTTP server of the gateway of ts.
+func newGatewayServer(t *testing.T, ts *testServer) *httptest.Server {
+	gw, err := newGateway(ts.PropServer, log.StandardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := httptest.NewServer(gw)
+	t.Cleanup(func() {
+		hs.Close()
+		gw.Close()
+	})
+	return hs
+}
+
+// do sends a request with the access token of ts and returns the
+// response with its decoded JSON body.
+func do(t *testing.T, ts *testServer, req *http.Request) (*http.Response, map[string]interface{}) {
+	req.Header.Set("Authorization", "Bearer "+ts.token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body := map[string]interface{}{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func newRequest(t *testing.T, method, u, body string) *http.Request {
+	req, err := http.NewRequest(method, u, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestGatewayGet(t *testing.T) {
+	ts := newTestServer(t, nil)
+	hs := newGatewayServer(t, ts)
+	ts.put(t, testHome+"/a.txt")
+	rec := ts.get(t, testHome+"/a.txt")
+
+	u := hs.URL + "/v1/records?path=" + url.QueryEscape(testHome+"/a.txt")
+	resp, body := do(t, ts, newRequest(t, "GET", u, ""))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d: %v", resp.StatusCode, body)
+	}
+	if body["id"] != rec.Id || body["path"] != rec.Path || body["etag"] != rec.Etag {
+		t.Errorf("got %v, want %v", body, rec)
+	}
+	// the enums are encoded with their names
+	if body["kind"] != "FILE" {
+		t.Errorf("got kind %v, want FILE", body["kind"])
+	}
+}
+
+func TestGatewayForceCreation(t *testing.T) {
+	ts := newTestServer(t, nil)
+	hs := newGatewayServer(t, ts)
+
+	u := hs.URL + "/v1/records?path=" + url.QueryEscape(testHome+"/a") + "&force_creation=true"
+	resp, body := do(t, ts, newRequest(t, "GET", u, ""))
+	if resp.StatusCode != http.StatusOK || body["kind"] != "FOLDER" {
+		t.Fatalf("got status %d and %v, want the created folder", resp.StatusCode, body)
+	}
+	ts.get(t, testHome+"/a")
+}
+
+func TestGatewayPutRmMv(t *testing.T) {
+	ts := newTestServer(t, nil)
+	hs := newGatewayServer(t, ts)
+
+	resp, body := do(t, ts, newRequest(t, "PUT", hs.URL+"/v1/records", `{"path": "`+testHome+`/a.txt"}`))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("put: got status %d: %v", resp.StatusCode, body)
+	}
+	ts.get(t, testHome+"/a.txt")
+
+	resp, body = do(t, ts, newRequest(t, "POST", hs.URL+"/v1/mv", `{"src": "`+testHome+`/a.txt", "dst": "`+testHome+`/b.txt"}`))
+	if resp.StatusCode != http.StatusOK || body["etag"] == nil {
+		t.Fatalf("mv: got status %d and %v", resp.StatusCode, body)
+	}
+	ts.get(t, testHome+"/b.txt")
+
+	resp, body = do(t, ts, newRequest(t, "DELETE", hs.URL+"/v1/records?path="+url.QueryEscape(testHome+"/b.txt"), ""))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("rm: got status %d: %v", resp.StatusCode, body)
+	}
+	_, err := ts.Get(context.Background(), &pb.GetReq{AccessToken: ts.token, Path: testHome + "/b.txt"})
+	wantCode(t, err, codes.NotFound)
+}
+
+func TestGatewayRPC(t *testing.T) {
+	ts := newTestServer(t, nil)
+	hs := newGatewayServer(t, ts)
+
+	resp, body := do(t, ts, newRequest(t, "POST", hs.URL+"/v1/rpc/Version", "{}"))
+	if resp.StatusCode != http.StatusOK || body["driver"] != "sqlite3" {
+		t.Errorf("got status %d and %v, want the version", resp.StatusCode, body)
+	}
+}
+
+func TestGatewayErrors(t *testing.T) {
+	ts := newTestServer(t, nil)
+	hs := newGatewayServer(t, ts)
+	u := hs.URL + "/v1/records?path=" + url.QueryEscape(testHome+"/missing")
+
+	resp, _ := do(t, ts, newRequest(t, "GET", u, ""))
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d for a missing record, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	ts.token = "not a token"
+	resp, _ = do(t, ts, newRequest(t, "GET", u, ""))
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d for a bad token, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+// TestGatewayTrace checks the trace id of the Grpc-Metadata-Trace header
+// is the one of the request, and returned in the Grpc-Trailer-Trace
+// trailer.
+func TestGatewayTrace(t *testing.T) {
+	ts, e := newTracedServer(t)
+	hs := newGatewayServer(t, ts)
+
+	req := newRequest(t, "PUT", hs.URL+"/v1/records", `{"path": "`+testHome+`/a.txt"}`)
+	req.Header.Set("Grpc-Metadata-Trace", "http-trace-1")
+	resp, body := do(t, ts, req)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d: %v", resp.StatusCode, body)
+	}
+
+	if ids := e.traceIDs(); len(ids) != 1 || !ids["http-trace-1"] {
+		t.Errorf("got trace ids %v, want only http-trace-1", ids)
+	}
+	if id := resp.Trailer.Get("Grpc-Trailer-Trace"); id != "http-trace-1" {
+		t.Errorf("got trailer trace %q, want http-trace-1", id)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1alpha"
+)
+
+// healthServiceName is the service name accepted by the health checks
+// besides the empty one that stands for the whole server.
+const healthServiceName = "propagator.Prop"
+
+// healthServer implements the gRPC health checking protocol. The server
+// is SERVING only while the database answers to a ping and it is not
+// shutting down.
+type healthServer struct {
+	srv *server
+}
+
+func newHealthServer(srv *server) healthpb.HealthServer {
+	return &healthServer{srv: srv}
+}
+
+func (h *healthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+
+	if req.Service != "" && req.Service != healthServiceName {
+		return nil, grpc.Errorf(codes.NotFound, "unknown service %s", req.Service)
+	}
+
+	h.srv.mu.Lock()
+	closing := h.srv.closing
+	h.srv.mu.Unlock()
+	if closing {
+		return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_NOT_SERVING}, nil
+	}
+
+	if err := h.srv.db.DB().Ping(); err != nil {
+		h.srv.logger.Errorf("health check failed: %s", err)
+		return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_NOT_SERVING}, nil
+	}
+
+	return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+}
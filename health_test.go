@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1alpha"
+)
+
+func wantStatus(t *testing.T, h healthpb.HealthServer, want healthpb.HealthCheckResponse_ServingStatus) {
+	t.Helper()
+	resp, err := h.Check(context.Background(), &healthpb.HealthCheckRequest{Service: healthServiceName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != want {
+		t.Errorf("got status %s, want %s", resp.Status, want)
+	}
+}
+
+// TestHealthDatabase checks the status follows the availability of the
+// database.
+func TestHealthDatabase(t *testing.T) {
+	ts := newTestServer(t, nil)
+	h := newHealthServer(ts.s)
+	wantStatus(t, h, healthpb.HealthCheckResponse_SERVING)
+
+	db := ts.s.db
+	closed, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	ts.s.db = &closed
+	wantStatus(t, h, healthpb.HealthCheckResponse_NOT_SERVING)
+
+	ts.s.db = db
+	wantStatus(t, h, healthpb.HealthCheckResponse_SERVING)
+}
+
+func TestHealthShutdown(t *testing.T) {
+	ts := newTestServer(t, nil)
+	h := newHealthServer(ts.s)
+	ts.s.Close()
+	wantStatus(t, h, healthpb.HealthCheckResponse_NOT_SERVING)
+}
+
+func TestHealthServices(t *testing.T) {
+	ts := newTestServer(t, nil)
+	h := newHealthServer(ts.s)
+	if resp, err := h.Check(context.Background(), &healthpb.HealthCheckRequest{}); err != nil || resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("got %v, %v for the whole server, want it serving", resp, err)
+	}
+	_, err := h.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "other.Service"})
+	wantCode(t, err, codes.NotFound)
+}
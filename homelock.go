@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// homeLocks is a mutex per home directory, so the propagations of the
+// changes under the same home run one after the other while the ones of
+// different homes still run in parallel. The mutexes are dropped when
+// nobody holds or waits for them.
+type homeLocks struct {
+	mu    sync.Mutex
+	locks map[string]*homeLock
+}
+
+type homeLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newHomeLocks() *homeLocks {
+	return &homeLocks{locks: map[string]*homeLock{}}
+}
+
+// lock locks the homes and returns the function unlocking them. The
+// homes are locked in order so two requests touching the same homes,
+// like two moves between them, can not deadlock.
+func (l *homeLocks) lock(homes ...string) func() {
+
+	sort.Strings(homes)
+	held := []string{}
+	for i, h := range homes {
+		if i > 0 && h == homes[i-1] {
+			continue
+		}
+
+		l.mu.Lock()
+		hl, ok := l.locks[h]
+		if !ok {
+			hl = &homeLock{}
+			l.locks[h] = hl
+		}
+		hl.refs++
+		l.mu.Unlock()
+
+		hl.Lock()
+		held = append(held, h)
+	}
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for _, h := range held {
+			hl := l.locks[h]
+			hl.Unlock()
+			hl.refs--
+			if hl.refs == 0 {
+				delete(l.locks, h)
+			}
+		}
+	}
+}
+
+// lockHomes locks the homes of paths until the returned function is
+// called, when serializeHomes is set. The paths above the home
+// directories are not locked as no propagation starts there.
+func (s *server) lockHomes(paths ...string) func() {
+
+	if !s.p.serializeHomes {
+		return func() {}
+	}
+
+	homes := []string{}
+	for _, p := range paths {
+		if len(strings.Split(p, "/")) < s.p.homeDepth {
+			continue
+		}
+		h := homeOf(p, s.p.homeDepth)
+		if s.p.caseInsensitive {
+			h = strings.ToLower(h)
+		}
+		homes = append(homes, h)
+	}
+	return s.locks.lock(homes...)
+}
+
+// staleCond is the condition of the records propagation may update. The
+// mtimes have a precision of one second so, when the propagations of a
+// home are serialized, the later of two changes of the same second wins
+// and leaves its etag on the ancestors. Otherwise the first one wins as
+// the order of the concurrent ones is unknown.
+func (s *server) staleCond() string {
+	if s.p.serializeHomes {
+		return "m_time <= ?"
+	}
+	return "m_time < ?"
+}
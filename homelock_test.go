@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+)
+
+func TestHomeLocks(t *testing.T) {
+	l := newHomeLocks()
+	unlock := l.lock("/b", "/a", "/b")
+
+	locked := make(chan struct{})
+	go func() {
+		defer l.lock("/a")()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("a held home was locked again")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// other homes are not held
+	l.lock("/c")()
+
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the home was not released")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.locks) != 0 {
+		t.Errorf("got %d mutexes left, want none", len(l.locks))
+	}
+}
+
+// TestSerializeHomes fires many puts under one home within the same
+// second and checks its ancestors end up with the etag of the last one
+// written, the record with the highest seq.
+func TestSerializeHomes(t *testing.T) {
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.dsn = "file:" + filepath.Join(t.TempDir(), "prop.db") + "?_busy_timeout=10000"
+		p.maxSqlConcurrency = 4
+		p.maxSqlIdle = 4
+		p.clock = newFakeClock(fixedTime)
+		p.serializeHomes = true
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := fmt.Sprintf("%s/a/f%d.txt", testHome, i)
+			if _, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: p}); err != nil {
+				t.Errorf("put %s: %v", p, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var last record
+	if err := ts.s.db.Where("parent_path = ?", testHome+"/a").Order("seq DESC").First(&last).Error; err != nil {
+		t.Fatal(err)
+	}
+	wantEtag(t, ts, last.ETag, "/a", "")
+}
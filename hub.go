@@ -0,0 +1,72 @@
+package main
+
+import (
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"strings"
+	"sync"
+)
+
+// subscriptionBuffer is the number of events a subscriber can lag behind
+// before new events are dropped for it.
+const subscriptionBuffer = 128
+
+// hub is an in-process publish/subscribe hub used to notify
+// Watch subscribers about the changes done by the mutating handlers.
+type hub struct {
+	mu   sync.Mutex
+	subs map[*subscription]struct{}
+}
+
+type subscription struct {
+	prefix string
+	events chan *pb.Record
+}
+
+func newHub() *hub {
+	h := &hub{}
+	h.subs = map[*subscription]struct{}{}
+	return h
+}
+
+// subscribe returns a subscription to the changes of the records
+// at prefix and below.
+func (h *hub) subscribe(prefix string) *subscription {
+	sub := &subscription{}
+	sub.prefix = prefix
+	sub.events = make(chan *pb.Record, subscriptionBuffer)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subs[sub] = struct{}{}
+	return sub
+}
+
+func (h *hub) unsubscribe(sub *subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, sub)
+}
+
+// publish notifies the subscribers interested in the path of rec.
+// A deleted record notifies a removal, that also concerns the
+// subscribers watching below the removed path.
+// It never blocks, events are dropped for subscribers that are not
+// keeping up.
+func (h *hub) publish(rec *pb.Record) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		if !isUnder(rec.Path, sub.prefix) && !(rec.Deleted && isUnder(sub.prefix, rec.Path)) {
+			continue
+		}
+		select {
+		case sub.events <- rec:
+		default:
+		}
+	}
+}
+
+// isUnder reports whether p is equal to or a descendant of ancestor.
+func isUnder(p, ancestor string) bool {
+	return p == ancestor || strings.HasPrefix(p, strings.TrimSuffix(ancestor, "/")+"/")
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/jinzhu/gorm"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"time"
+)
+
+// defaultIdempotencyTTL is how long a Put idempotency key is remembered.
+const defaultIdempotencyTTL = 24 * time.Hour
+
+// idempotencyKey remembers a Put done with a client provided key so a
+// retry of it returns the same result instead of writing again.
+type idempotencyKey struct {
+	// ID is the key sent by the client.
+	ID      string `gorm:"primary_key"`
+	Path    string
+	ETag    string
+	Created int64 `sql:"index"`
+}
+
+// getIdempotencyKey returns the key if it has not expired yet.
+func (s *server) getIdempotencyKey(db *gorm.DB, key string) (*idempotencyKey, error) {
+	k := &idempotencyKey{}
+	since := s.p.clock.Now().Add(-s.p.idempotencyTTL).Unix()
+	err := db.Where("id=? AND created >= ?", key, since).First(k).Error
+	return k, err
+}
+
+// saveIdempotencyKey stores the key of a Put, removing the expired ones.
+// It fails with Aborted when a concurrent Put with the same key stored it
+// first, so the retry of the client finds the key applied.
+func (s *server) saveIdempotencyKey(db *gorm.DB, key, p, etag string, created int64) error {
+	since := s.p.clock.Now().Add(-s.p.idempotencyTTL).Unix()
+	err := db.Where("created < ?", since).Delete(idempotencyKey{}).Error
+	if err != nil {
+		return err
+	}
+	err = db.Create(&idempotencyKey{ID: key, Path: p, ETag: etag, Created: created}).Error
+	if err != nil && s.dialect.duplicate(err) {
+		return grpc.Errorf(codes.Aborted, "put with idempotency key %s was applied concurrently", key)
+	}
+	return err
+}
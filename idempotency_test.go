@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+func (ts *testServer) putWithKey(p, key string) error {
+	_, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: p, IdempotencyKey: key})
+	return err
+}
+
+// TestIdempotencyKeyRetry checks the retry of a Put with the same key
+// keeps the etag of the first one and does not propagate again.
+func TestIdempotencyKeyRetry(t *testing.T) {
+	ts := newTestServer(t, nil)
+	if err := ts.putWithKey(testHome+"/a/f.txt", "key"); err != nil {
+		t.Fatal(err)
+	}
+	before := dbState(t, ts)
+
+	ts.clock.Advance(time.Second)
+	propagated := observePropagated(ts)
+	if err := ts.putWithKey(testHome+"/a/f.txt", "key"); err != nil {
+		t.Fatal(err)
+	}
+	if after := dbState(t, ts); !reflect.DeepEqual(after, before) {
+		t.Errorf("the retry left\n%s\nwant\n%s", strings.Join(after, "\n"), strings.Join(before, "\n"))
+	}
+	if got := propagated(); len(got) != 0 {
+		t.Errorf("the retry propagated to %v", got)
+	}
+
+	// another key is another put
+	if err := ts.putWithKey(testHome+"/a/f.txt", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if after := dbState(t, ts); reflect.DeepEqual(after, before) {
+		t.Error("the put with another key was not applied")
+	}
+}
+
+func TestIdempotencyKeyOtherPath(t *testing.T) {
+	ts := newTestServer(t, nil)
+	if err := ts.putWithKey(testHome+"/a.txt", "key"); err != nil {
+		t.Fatal(err)
+	}
+	wantCode(t, ts.putWithKey(testHome+"/b.txt", "key"), codes.InvalidArgument)
+}
+
+func TestIdempotencyKeyExpired(t *testing.T) {
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.idempotencyTTL = time.Minute
+	})
+	if err := ts.putWithKey(testHome+"/a.txt", "key"); err != nil {
+		t.Fatal(err)
+	}
+	etag := ts.get(t, testHome+"/a.txt").Etag
+
+	ts.clock.Advance(2 * time.Minute)
+	if err := ts.putWithKey(testHome+"/a.txt", "key"); err != nil {
+		t.Fatal(err)
+	}
+	if rec := ts.get(t, testHome+"/a.txt"); rec.Etag == etag {
+		t.Errorf("the put after the key expired kept the etag %s", etag)
+	}
+	var keys int64
+	ts.s.db.Model(idempotencyKey{}).Count(&keys)
+	if keys != 1 {
+		t.Errorf("got %d keys, want the expired one replaced", keys)
+	}
+}
+
+// TestIdempotencyKeyOldMtime checks the key of a Put carrying an mtime
+// older than the TTL, as a replica sends, expires after the TTL from the
+// time of the Put and not from the mtime.
+func TestIdempotencyKeyOldMtime(t *testing.T) {
+	ts := newTestServer(t, nil)
+	req := &pb.PutReq{AccessToken: ts.token, Path: testHome + "/a.txt", IdempotencyKey: "key", Mtime: ts.clock.Now().Add(-48 * time.Hour).Unix()}
+	if _, err := ts.Put(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	before := dbState(t, ts)
+
+	ts.clock.Advance(time.Second)
+	if _, err := ts.Put(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if after := dbState(t, ts); strings.Join(after, "\n") != strings.Join(before, "\n") {
+		t.Errorf("the retry changed\n%s\ninto\n%s", strings.Join(before, "\n"), strings.Join(after, "\n"))
+	}
+}
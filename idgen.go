@@ -0,0 +1,12 @@
+package main
+
+import "github.com/nu7hatch/gouuid"
+
+// newUUID returns a random UUID, the default id and etag of the records.
+func newUUID() (string, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
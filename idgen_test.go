@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+// newSequentialIDs returns a generator of the ids prefix-1, prefix-2 and
+// so on, so the ids and etags given to the records are known beforehand
+// when checking the propagation.
+func newSequentialIDs(prefix string) func() (string, error) {
+	var mu sync.Mutex
+	var n int
+	return func() (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		n++
+		return fmt.Sprintf("%s-%d", prefix, n), nil
+	}
+}
+
+func newSequentialIDsServer(t *testing.T) *testServer {
+	return newTestServer(t, func(p *newServerParams) {
+		p.idGen = newSequentialIDs("seq")
+	})
+}
+
+// wantEtag checks the records of the paths below the home have etag.
+func wantEtag(t *testing.T, ts *testServer, etag string, paths ...string) {
+	for _, p := range paths {
+		if rec := ts.get(t, testHome+p); rec.Etag != etag {
+			t.Errorf("%s has etag %s, want %s", testHome+p, rec.Etag, etag)
+		}
+	}
+}
+
+func TestSequentialIDs(t *testing.T) {
+	gen := newSequentialIDs("x")
+	for _, want := range []string{"x-1", "x-2", "x-3"} {
+		if id, err := gen(); err != nil || id != want {
+			t.Errorf("got %s, %v, want %s", id, err, want)
+		}
+	}
+}
+
+// TestEtagPut checks the etag of a put is the first id it generates, the
+// next ones being the ids of the record and of its new ancestors, and
+// that it is the etag of the record and of all its ancestors.
+func TestEtagPut(t *testing.T) {
+	ts := newSequentialIDsServer(t)
+	ts.put(t, testHome+"/a/b/c.txt")
+	wantEtag(t, ts, "seq-1", "/a/b/c.txt", "/a/b", "/a", "")
+	for p, id := range map[string]string{"/a/b/c.txt": "seq-2", "/a/b": "seq-3", "/a": "seq-4", "": "seq-5"} {
+		if rec := ts.get(t, testHome+p); rec.Id != id {
+			t.Errorf("%s has id %s, want %s", testHome+p, rec.Id, id)
+		}
+	}
+
+	ts.clock.Advance(time.Second)
+	ts.put(t, testHome+"/a/d.txt")
+	wantEtag(t, ts, "seq-6", "/a/d.txt", "/a", "")
+	wantEtag(t, ts, "seq-1", "/a/b/c.txt", "/a/b")
+}
+
+func TestEtagMv(t *testing.T) {
+	ts := newSequentialIDsServer(t)
+	ts.put(t, testHome+"/a/f.txt")
+	ts.put(t, testHome+"/b/g.txt")
+
+	ts.clock.Advance(time.Second)
+	resp, err := ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: testHome + "/a/f.txt", Dst: testHome + "/b/f.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Etag != "seq-8" {
+		t.Errorf("got the etag %s for the move, want seq-8", resp.Etag)
+	}
+	wantEtag(t, ts, "seq-8", "/a", "/b", "")
+	// the moved record keeps its own etag
+	wantEtag(t, ts, "seq-1", "/b/f.txt")
+}
+
+func TestEtagRm(t *testing.T) {
+	ts := newSequentialIDsServer(t)
+	ts.put(t, testHome+"/a/b/c.txt")
+	ts.put(t, testHome+"/a/d.txt")
+
+	ts.clock.Advance(time.Second)
+	if _, err := ts.Rm(context.Background(), &pb.RmReq{AccessToken: ts.token, Path: testHome + "/a/b"}); err != nil {
+		t.Fatal(err)
+	}
+	wantEtag(t, ts, "seq-8", "/a", "")
+	wantEtag(t, ts, "seq-6", "/a/d.txt")
+}
+
+// TestEtagPutProvided checks the etag and mtime sent by the client are
+// stored and propagated as they are, and generated when left out.
+func TestEtagPutProvided(t *testing.T) {
+	ts := newSequentialIDsServer(t)
+	mtime := ts.clock.Now().Add(time.Minute).Unix()
+	_, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: testHome + "/a/f.txt", Etag: "client", Mtime: mtime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantEtag(t, ts, "client", "/a/f.txt", "/a", "")
+	wantModified(t, ts, mtime, "/a/f.txt", "/a", "")
+	if rec := ts.get(t, testHome+"/a/f.txt"); rec.Id != "seq-1" {
+		t.Errorf("got the id %s, want seq-1 as no etag was generated", rec.Id)
+	}
+
+	ts.clock.Advance(2 * time.Minute)
+	ts.put(t, testHome+"/a/g.txt")
+	wantEtag(t, ts, "seq-4", "/a/g.txt", "/a", "")
+	wantModified(t, ts, ts.clock.Now().Unix(), "/a/g.txt", "/a", "")
+}
+
+func TestEtagPutInvalid(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, req := range []*pb.PutReq{
+		{Etag: "with space"},
+		{Etag: "tab\t"},
+		{Etag: strings.Repeat("e", maxETagLength+1)},
+		{Mtime: -1},
+		{Mtime: ts.clock.Now().Add(maxMTimeSkew + time.Minute).Unix()},
+	} {
+		req.AccessToken = ts.token
+		req.Path = testHome + "/a.txt"
+		_, err := ts.Put(context.Background(), req)
+		wantCode(t, err, codes.InvalidArgument)
+	}
+	if n := ts.count(t); n != 0 {
+		t.Errorf("got %d records, want none created", n)
+	}
+}
+
+// TestEtagMvRmProvided checks the etag and mtime of a replicated Mv or
+// Rm are the ones propagated, with no id generated.
+func TestEtagMvRmProvided(t *testing.T) {
+	ts := newSequentialIDsServer(t)
+	ts.put(t, testHome+"/a/f.txt")
+	ts.put(t, testHome+"/b/g.txt")
+
+	mtime := ts.clock.Now().Add(time.Second).Unix()
+	resp, err := ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: testHome + "/a/f.txt", Dst: testHome + "/b/f.txt", Etag: "primary-mv", Mtime: mtime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Etag != "primary-mv" || resp.Modified != mtime {
+		t.Errorf("got the etag %s and mtime %d, want the provided ones", resp.Etag, resp.Modified)
+	}
+	wantEtag(t, ts, "primary-mv", "/a", "/b", "")
+	wantModified(t, ts, mtime, "/a", "/b", "")
+
+	mtime++
+	if _, err = ts.Rm(context.Background(), &pb.RmReq{AccessToken: ts.token, Path: testHome + "/b/g.txt", Etag: "primary-rm", Mtime: mtime}); err != nil {
+		t.Fatal(err)
+	}
+	wantEtag(t, ts, "primary-rm", "/b", "")
+	wantModified(t, ts, mtime, "/b", "")
+
+	// the next generated etag follows the ids of the puts
+	ts.clock.Advance(5 * time.Second)
+	ts.put(t, testHome+"/c.txt")
+	wantEtag(t, ts, "seq-8", "")
+}
+
+func TestEtagMvRmInvalid(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a.txt")
+	before := dbState(t, ts)
+	future := ts.clock.Now().Add(maxMTimeSkew + time.Minute).Unix()
+
+	_, err := ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: testHome + "/a.txt", Dst: testHome + "/b.txt", Etag: "with space"})
+	wantCode(t, err, codes.InvalidArgument)
+	_, err = ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: testHome + "/a.txt", Dst: testHome + "/b.txt", Mtime: future})
+	wantCode(t, err, codes.InvalidArgument)
+	_, err = ts.Rm(context.Background(), &pb.RmReq{AccessToken: ts.token, Path: testHome + "/a.txt", Etag: "tab\t"})
+	wantCode(t, err, codes.InvalidArgument)
+	_, err = ts.Rm(context.Background(), &pb.RmReq{AccessToken: ts.token, Path: testHome + "/a.txt", Mtime: -1})
+	wantCode(t, err, codes.InvalidArgument)
+	if after := dbState(t, ts); strings.Join(after, "\n") != strings.Join(before, "\n") {
+		t.Errorf("the rejected calls changed the records into\n%s", strings.Join(after, "\n"))
+	}
+}
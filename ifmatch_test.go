@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+func TestIfMatchMatching(t *testing.T) {
+	ts := newSequentialIDsServer(t)
+	ts.put(t, testHome+"/a/f.txt")
+
+	ts.clock.Advance(time.Second)
+	_, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: testHome + "/a/f.txt", IfMatchEtag: "seq-1", Size: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the put generates its etag and does not need another id
+	wantEtag(t, ts, "seq-5", "/a/f.txt", "/a", "")
+	if rec := ts.get(t, testHome+"/a/f.txt"); rec.Id != "seq-2" || rec.Size != 3 {
+		t.Errorf("got %v, want the record seq-2 updated in place", rec)
+	}
+}
+
+// TestIfMatchMismatching checks a put with a stale etag is rejected with
+// the current etag and leaves the record and its ancestors as they are.
+func TestIfMatchMismatching(t *testing.T) {
+	ts := newSequentialIDsServer(t)
+	ts.put(t, testHome+"/a/f.txt")
+	ts.clock.Advance(time.Second)
+	ts.put(t, testHome+"/a/f.txt")
+	before := dbState(t, ts)
+
+	ts.clock.Advance(time.Second)
+	_, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: testHome + "/a/f.txt", IfMatchEtag: "seq-1"})
+	wantCode(t, err, codes.Aborted)
+	if err != nil && !strings.Contains(err.Error(), "seq-5") {
+		t.Errorf("got %v, want the current etag seq-5", err)
+	}
+	if after := dbState(t, ts); strings.Join(after, "\n") != strings.Join(before, "\n") {
+		t.Errorf("the rejected put changed\n%s\ninto\n%s", strings.Join(before, "\n"), strings.Join(after, "\n"))
+	}
+}
+
+func TestIfMatchMissing(t *testing.T) {
+	ts := newTestServer(t, nil)
+	_, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: testHome + "/a/f.txt", IfMatchEtag: "etag"})
+	wantCode(t, err, codes.NotFound)
+
+	var count int64
+	ts.s.db.Model(record{}).Count(&count)
+	if count != 0 {
+		t.Errorf("got %d records, want none created", count)
+	}
+}
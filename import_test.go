@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+// fakeImportStream is the server side of an Import stream, that hands
+// the messages of reqs over and keeps the response.
+type fakeImportStream struct {
+	ctx  context.Context
+	reqs []*pb.ImportReq
+	resp *pb.ImportResp
+}
+
+func (s *fakeImportStream) Recv() (*pb.ImportReq, error) {
+	if len(s.reqs) == 0 {
+		return nil, io.EOF
+	}
+	req := s.reqs[0]
+	s.reqs = s.reqs[1:]
+	return req, nil
+}
+
+func (s *fakeImportStream) SendAndClose(resp *pb.ImportResp) error {
+	s.resp = resp
+	return nil
+}
+
+func (s *fakeImportStream) Context() context.Context     { return s.ctx }
+func (s *fakeImportStream) SendHeader(metadata.MD) error { return nil }
+func (s *fakeImportStream) SetTrailer(metadata.MD)       {}
+func (s *fakeImportStream) SendMsg(m interface{}) error  { return nil }
+func (s *fakeImportStream) RecvMsg(m interface{}) error  { return nil }
+
+// importTree returns the messages importing the home with folders
+// folders of files files each, all with the etag old. The files come
+// before their folders.
+func importTree(ts *testServer, folders, files int, skip bool) []*pb.ImportReq {
+	old := ts.clock.Now().Add(-time.Hour).Unix()
+	reqs := []*pb.ImportReq{}
+	for i := 0; i < folders; i++ {
+		for j := 0; j < files; j++ {
+			reqs = append(reqs, &pb.ImportReq{Path: fmt.Sprintf("%s/d%d/f%d", testHome, i, j), Etag: "old", Mtime: old})
+		}
+		reqs = append(reqs, &pb.ImportReq{Path: fmt.Sprintf("%s/d%d", testHome, i), Etag: "old", Mtime: old})
+	}
+	reqs = append(reqs, &pb.ImportReq{Path: testHome, Etag: "old", Mtime: old})
+	reqs[0].AccessToken = ts.token
+	reqs[0].SkipPropagation = skip
+	return reqs
+}
+
+func (ts *testServer) importAll(t *testing.T, reqs []*pb.ImportReq) *pb.ImportResp {
+	stream := &fakeImportStream{ctx: context.Background(), reqs: reqs}
+	if err := ts.Import(stream); err != nil {
+		t.Fatal(err)
+	}
+	return stream.resp
+}
+
+func newImportServer(t *testing.T) *testServer {
+	return newTestServer(t, func(p *newServerParams) {
+		p.idGen = newSequentialIDs("seq")
+		p.importBatchSize = 250
+	})
+}
+
+// TestImport checks a few thousand records are imported by batches and
+// the folders end up with the etag of the import, the first id.
+func TestImport(t *testing.T) {
+	ts := newImportServer(t)
+	resp := ts.importAll(t, importTree(ts, 10, 300, false))
+	if resp.Imported != 3011 || resp.Failed != 0 {
+		t.Errorf("got %d imported and %d failed, want 3011 and none", resp.Imported, resp.Failed)
+	}
+	if n := ts.count(t); n != 3011 {
+		t.Errorf("got %d records, want 3011", n)
+	}
+
+	wantEtag(t, ts, "seq-1", "", "/d0", "/d9")
+	wantEtag(t, ts, "old", "/d0/f0", "/d9/f299")
+	if rec := ts.get(t, testHome+"/d3"); rec.Kind != pb.Kind_FOLDER {
+		t.Errorf("got the kind %s for a folder", rec.Kind)
+	}
+}
+
+func TestImportSkipPropagation(t *testing.T) {
+	ts := newImportServer(t)
+	resp := ts.importAll(t, importTree(ts, 3, 5, true))
+	if resp.Imported != 19 {
+		t.Errorf("got %d imported, want 19", resp.Imported)
+	}
+	wantEtag(t, ts, "old", "", "/d0", "/d2", "/d1/f4")
+}
+
+// TestImportErrors checks the rejected records are counted and reported
+// while the others are imported.
+func TestImportErrors(t *testing.T) {
+	ts := newImportServer(t)
+	reqs := importTree(ts, 2, 2, false)
+	reqs = append(reqs,
+		&pb.ImportReq{Path: "/local/users/o/other/f.txt"},
+		&pb.ImportReq{Path: testHome + "/d0/bad", Etag: "with space"},
+	)
+
+	resp := ts.importAll(t, reqs)
+	if resp.Imported != 7 || resp.Failed != 2 {
+		t.Errorf("got %d imported and %d failed, want 7 and 2", resp.Imported, resp.Failed)
+	}
+	if len(resp.Errors) != 2 || resp.Errors[0].Path != "/local/users/o/other/f.txt" || resp.Errors[1].Path != testHome+"/d0/bad" {
+		t.Errorf("got the errors %v", resp.Errors)
+	}
+	if n := ts.count(t); n != 7 {
+		t.Errorf("got %d records, want 7", n)
+	}
+	wantEtag(t, ts, "seq-1", "", "/d0", "/d1")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// TestConcurrentPuts drives pairs of simultaneous Puts of the same new
+// path, on a database file with a connection for each. Both succeed or
+// the loser fails with Aborted, a raw database error never escapes.
+func TestConcurrentPuts(t *testing.T) {
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.dsn = "file:" + filepath.Join(t.TempDir(), "prop.db") + "?_busy_timeout=10000"
+		p.maxSqlConcurrency = 2
+		p.maxSqlIdle = 2
+	})
+
+	for i := 0; i < 20; i++ {
+		p := fmt.Sprintf("%s/a%d/b.txt", testHome, i)
+		start := make(chan struct{})
+		errs := make(chan error, 2)
+		var wg sync.WaitGroup
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				_, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: p})
+				errs <- err
+			}()
+		}
+		close(start)
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			if err != nil && grpc.Code(err) != codes.Aborted {
+				t.Errorf("put %s: %v", p, err)
+			}
+		}
+		var count int64
+		ts.s.db.Model(record{}).Where("path = ?", p).Count(&count)
+		if count != 1 {
+			t.Errorf("got %d records at %s, want 1", count, p)
+		}
+	}
+}
+
+// TestInsertTakenID checks the insert of a record with the id of another
+// one fails with Aborted.
+func TestInsertTakenID(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a.txt")
+	taken := ts.record(t, testHome+"/a.txt").ID
+
+	mtime := ts.clock.Now().Unix()
+	err := ts.s.insert(context.Background(), ts.s.db, taken, testHome+"/b.txt", "", "etag", mtime, 0, pb.Kind_FILE)
+	wantCode(t, err, codes.Aborted)
+}
+
+func TestSaveIdempotencyKeyTwice(t *testing.T) {
+	ts := newTestServer(t, nil)
+	created := ts.clock.Now().Unix()
+	if err := ts.s.saveIdempotencyKey(ts.s.db, "key", testHome+"/a.txt", "etag", created); err != nil {
+		t.Fatal(err)
+	}
+	err := ts.s.saveIdempotencyKey(ts.s.db, "key", testHome+"/a.txt", "etag", created)
+	wantCode(t, err, codes.Aborted)
+}
+
+func TestSQLiteDuplicate(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a.txt")
+	rec := ts.record(t, testHome+"/a.txt")
+
+	err := ts.s.db.Create(rec).Error
+	if err == nil || !ts.s.dialect.duplicate(err) {
+		t.Errorf("got %v, want a unique violation", err)
+	}
+	if ts.s.dialect.duplicate(fmt.Errorf("no such table: records")) {
+		t.Error("another error is taken for a unique violation")
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// defaultKeepAlive is the number of seconds between the TCP keepalive
+// probes of the accepted connections.
+const defaultKeepAlive = 30
+
+// keepAliveListener enables TCP keepalive on the accepted connections,
+// so the ones left half-open by a client that vanished behind a NAT
+// fail once the probes are not answered. The gRPC version in use has no
+// keepalive of its own, it notices the failure and cancels the streams
+// of the connection, like the Watch ones, that would block forever.
+type keepAliveListener struct {
+	*net.TCPListener
+	period time.Duration
+}
+
+// newKeepAliveListener returns lis probing every period, or lis as is
+// when period is not positive.
+func newKeepAliveListener(lis net.Listener, period time.Duration) net.Listener {
+	tcp, ok := lis.(*net.TCPListener)
+	if !ok || period <= 0 {
+		return lis
+	}
+	return &keepAliveListener{tcp, period}
+}
+
+func (l *keepAliveListener) Accept() (net.Conn, error) {
+	c, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	if err = c.SetKeepAlive(true); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err = c.SetKeepAlivePeriod(l.period); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
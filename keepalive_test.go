@@ -0,0 +1,74 @@
+// +build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sockopt returns the value of the socket option of c.
+func sockopt(t *testing.T, c *net.TCPConn, level, opt int) int {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		v, serr = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	if err != nil || serr != nil {
+		t.Fatal(err, serr)
+	}
+	return v
+}
+
+// TestKeepAliveListener checks the accepted connections are probed every
+// period. The probes reaping a half-open connection can be seen by
+// dropping the packets of a connected client, as with
+//
+//	iptables -A INPUT -p tcp --sport <client port> -j DROP
+//
+// the connection failing once the probes are not answered.
+func TestKeepAliveListener(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis := newKeepAliveListener(tcp, 7*time.Second)
+	defer lis.Close()
+
+	go func() {
+		if c, err := net.Dial("tcp", lis.Addr().String()); err == nil {
+			defer c.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+	c, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	conn := c.(*net.TCPConn)
+	if v := sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); v != 1 {
+		t.Errorf("got SO_KEEPALIVE %d, want it enabled", v)
+	}
+	if v := sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); v != 7 {
+		t.Errorf("got TCP_KEEPIDLE %d, want the period of 7 seconds", v)
+	}
+}
+
+func TestKeepAliveDisabled(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	if lis := newKeepAliveListener(tcp, 0); lis != tcp {
+		t.Error("the listener is wrapped without a period")
+	}
+}
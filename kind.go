@@ -0,0 +1,49 @@
+package main
+
+import (
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// validateKind rejects the kinds unknown to this version.
+func validateKind(k pb.Kind) error {
+	if _, ok := pb.Kind_name[int32(k)]; !ok {
+		return grpc.Errorf(codes.InvalidArgument, "kind %d is unknown", k)
+	}
+	return nil
+}
+
+// defaultKind is the kind of a new record at p whose kind is not set, a
+// folder when it already has children and a file otherwise.
+func defaultKind(db *gorm.DB, p string) (pb.Kind, error) {
+	var count int64
+	err := db.Model(record{}).Scopes(withChildren(p)).Count(&count).Error
+	if err != nil {
+		return pb.Kind_UNKNOWN, err
+	}
+	if count > 0 {
+		return pb.Kind_FOLDER, nil
+	}
+	return pb.Kind_FILE, nil
+}
+
+// markFolders gives the folder kind to the records at paths, the parents
+// of the records written, as a record with children is a folder.
+func (s *server) markFolders(ctx context.Context, db *gorm.DB, paths []string) error {
+
+	if len(paths) == 0 {
+		return nil
+	}
+
+	_, sp := s.startSpan(ctx, "markFolders")
+
+	// the slice must be the first argument because of the way gorm
+	// expands the placeholders
+	err := db.Model(record{}).Where("path IN (?) AND kind <> ?", paths, pb.Kind_FOLDER).
+		UpdateColumn("kind", pb.Kind_FOLDER).Error
+	sp.finish(err)
+	return err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+// TestKindForceCreation checks the parent a Get with ForceCreation
+// creates is a folder, and the file put below it a file.
+func TestKindForceCreation(t *testing.T) {
+	ts := newTestServer(t, nil)
+	rec, err := ts.Get(context.Background(), &pb.GetReq{AccessToken: ts.token, Path: testHome + "/a", ForceCreation: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Kind != pb.Kind_FOLDER {
+		t.Errorf("got the kind %s for the created record, want a folder", rec.Kind)
+	}
+
+	ts.put(t, testHome+"/a/f.txt")
+	if rec := ts.get(t, testHome+"/a/f.txt"); rec.Kind != pb.Kind_FILE {
+		t.Errorf("got the kind %s for the uploaded file", rec.Kind)
+	}
+	if rec := ts.get(t, testHome+"/a"); rec.Kind != pb.Kind_FOLDER {
+		t.Errorf("got the kind %s for its parent", rec.Kind)
+	}
+	if rec := ts.get(t, testHome); rec.Kind != pb.Kind_FOLDER {
+		t.Errorf("got the kind %s for the home", rec.Kind)
+	}
+}
+
+// TestKindDefault checks a put without a kind gives a folder to the
+// paths with children and a file to the others.
+func TestKindDefault(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/f.txt")
+	ts.put(t, testHome+"/a")
+	ts.put(t, testHome+"/g")
+	if rec := ts.get(t, testHome+"/a"); rec.Kind != pb.Kind_FOLDER {
+		t.Errorf("got the kind %s for a path with children", rec.Kind)
+	}
+	if rec := ts.get(t, testHome+"/g"); rec.Kind != pb.Kind_FILE {
+		t.Errorf("got the kind %s for a path without children", rec.Kind)
+	}
+}
+
+func TestListKind(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, p := range []string{"/a/b/c.txt", "/a/d.txt", "/e.txt"} {
+		ts.put(t, testHome+p)
+	}
+	_, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: testHome + "/empty", Kind: pb.Kind_FOLDER})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for kind, want := range map[pb.Kind][]string{
+		pb.Kind_FOLDER:  {"/a", "/empty"},
+		pb.Kind_FILE:    {"/e.txt"},
+		pb.Kind_UNKNOWN: {"/a", "/e.txt", "/empty"},
+	} {
+		if got := ts.list(t, &pb.ListReq{Path: testHome, Kind: kind}); !reflect.DeepEqual(got, want) {
+			t.Errorf("got the %s children %v, want %v", kind, got, want)
+		}
+	}
+	want := []string{"/a/b/c.txt", "/a/d.txt", "/e.txt"}
+	if got := ts.list(t, &pb.ListReq{Path: testHome, Recursive: true, Kind: pb.Kind_FILE}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got the files %v, want %v", got, want)
+	}
+
+	_, err = ts.List(context.Background(), &pb.ListReq{AccessToken: ts.token, Path: testHome, Kind: 7})
+	wantCode(t, err, codes.InvalidArgument)
+	_, err = ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: testHome + "/x", Kind: 7})
+	wantCode(t, err, codes.InvalidArgument)
+}
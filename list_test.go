@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+// list returns the paths below the home that req lists.
+func (ts *testServer) list(t *testing.T, req *pb.ListReq) []string {
+	req.AccessToken = ts.token
+	resp, err := ts.List(context.Background(), req)
+	if err != nil {
+		t.Fatalf("list %s: %s", req.Path, err)
+	}
+	paths := []string{}
+	for _, rec := range resp.Records {
+		paths = append(paths, rec.Path[len(testHome):])
+	}
+	return paths
+}
+
+func TestListEmptyFolder(t *testing.T) {
+	ts := newTestServer(t, nil)
+	_, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: testHome + "/empty", Kind: pb.Kind_FOLDER})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ts.list(t, &pb.ListReq{Path: testHome + "/empty"}); len(got) != 0 {
+		t.Errorf("got %v, want no children", got)
+	}
+}
+
+func TestListFlatFolder(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, p := range []string{"/flat/c.txt", "/flat/a.txt", "/flat/b.txt"} {
+		ts.put(t, testHome+p)
+	}
+	want := []string{"/flat/a.txt", "/flat/b.txt", "/flat/c.txt"}
+	if got := ts.list(t, &pb.ListReq{Path: testHome + "/flat"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// TestListNestedTree checks only the direct children are listed, unless
+// the listing is recursive.
+func TestListNestedTree(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, p := range []string{"/n/a/b/c.txt", "/n/a/d.txt", "/n/e.txt", "/no.txt"} {
+		ts.put(t, testHome+p)
+	}
+
+	want := []string{"/n/a", "/n/e.txt"}
+	if got := ts.list(t, &pb.ListReq{Path: testHome + "/n"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	want = []string{"/n/a", "/n/a/b", "/n/a/b/c.txt", "/n/a/d.txt", "/n/e.txt"}
+	if got := ts.list(t, &pb.ListReq{Path: testHome + "/n", Recursive: true}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got recursively %v, want %v", got, want)
+	}
+}
+
+func TestListErrors(t *testing.T) {
+	ts := newTestServer(t, nil)
+	_, err := ts.List(context.Background(), &pb.ListReq{AccessToken: "bad", Path: testHome})
+	wantCode(t, err, codes.Unauthenticated)
+	_, err = ts.List(context.Background(), &pb.ListReq{AccessToken: ts.token, Path: "/local/users/o/other"})
+	wantCode(t, err, codes.PermissionDenied)
+}
+
+// listPages lists the folder p by pages of size, calling between before
+// every page but the first, and returns the paths listed.
+func (ts *testServer) listPages(t *testing.T, p string, size int64, between func()) []string {
+	var paths []string
+	req := &pb.ListReq{AccessToken: ts.token, Path: p, PageSize: size}
+	for {
+		resp, err := ts.List(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Records) > int(size) {
+			t.Fatalf("got a page of %d records, want at most %d", len(resp.Records), size)
+		}
+		for _, rec := range resp.Records {
+			paths = append(paths, rec.Path)
+		}
+		if resp.NextPageToken == "" {
+			return paths
+		}
+		req.PageToken = resp.NextPageToken
+		if between != nil {
+			between()
+		}
+	}
+}
+
+func TestListPages(t *testing.T) {
+	ts := newTestServer(t, nil)
+	n := 3000
+	putSubtree(t, ts, testHome+"/wide", n)
+
+	paths := ts.listPages(t, testHome+"/wide", 700, nil)
+	if len(paths) != n || !sort.StringsAreSorted(paths) {
+		t.Fatalf("got %d paths, want the %d children in order", len(paths), n)
+	}
+	wantChanged(t, paths, paths)
+}
+
+// TestListPagesInserted checks the children inserted while paginating
+// are listed once if they sort after the page token, and not otherwise,
+// the others being listed once.
+func TestListPagesInserted(t *testing.T) {
+	ts := newTestServer(t, nil)
+	n := 2000
+	putSubtree(t, ts, testHome+"/wide", n)
+	before := ts.listPages(t, testHome+"/wide", int64(n), nil)
+
+	var inserted []string
+	pages := 0
+	paths := ts.listPages(t, testHome+"/wide", 300, func() {
+		pages++
+		// f0-x sorts before the page token and f999-x after it
+		for _, p := range []string{fmt.Sprintf("/wide/f0-%d", pages), fmt.Sprintf("/wide/f999-%d", pages)} {
+			ts.put(t, testHome+p)
+			inserted = append(inserted, testHome+p)
+		}
+	})
+	wantChanged(t, paths, before)
+	seen := map[string]int{}
+	for _, p := range paths {
+		seen[p]++
+	}
+	for _, p := range inserted {
+		if seen[p] > 1 {
+			t.Errorf("%s listed %d times", p, seen[p])
+		}
+		if strings.HasPrefix(p, testHome+"/wide/f0-") && seen[p] != 0 {
+			t.Errorf("%s inserted before the page token is listed", p)
+		}
+		if strings.HasPrefix(p, testHome+"/wide/f999-") && seen[p] != 1 {
+			t.Errorf("%s inserted after the page token is listed %d times, want once", p, seen[p])
+		}
+	}
+	if !sort.StringsAreSorted(paths) {
+		t.Error("the pages are not in order")
+	}
+}
+
+func TestListPageToken(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/f.txt")
+	for _, token := range []string{"%%%", encodePageToken(testHome + "/a"), encodePageToken(testHome + "/b/f.txt")} {
+		_, err := ts.List(context.Background(), &pb.ListReq{AccessToken: ts.token, Path: testHome + "/a", PageToken: token})
+		wantCode(t, err, codes.InvalidArgument)
+	}
+	_, err := ts.List(context.Background(), &pb.ListReq{AccessToken: ts.token, Path: testHome + "/a", PageSize: -1})
+	wantCode(t, err, codes.InvalidArgument)
+}
@@ -1,67 +1,456 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	pb "github.com/clawio/service-localfs-prop/proto/propagator"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1alpha"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const (
-	serviceID              = "CLAWIO_LOCALFS_PROP"
-	dsnEnvar               = serviceID + "_DSN"
-	portEnvar              = serviceID + "_PORT"
-	logLevelEnvar          = serviceID + "_LOGLEVEL"
-	maxSqlIdleEnvar        = serviceID + "_MAXSQLIDLE"
-	maxSqlConcurrencyEnvar = serviceID + "_MAXSQLCONCURRENCY"
-	sharedSecretEnvar      = "CLAWIO_SHAREDSECRET"
+	serviceID               = "CLAWIO_LOCALFS_PROP"
+	driverEnvar             = serviceID + "_DRIVER"
+	dsnEnvar                = serviceID + "_DSN"
+	dsnFileEnvar            = serviceID + "_DSNFILE"
+	portEnvar               = serviceID + "_PORT"
+	logLevelEnvar           = serviceID + "_LOGLEVEL"
+	maxSqlIdleEnvar         = serviceID + "_MAXSQLIDLE"
+	maxSqlConcurrencyEnvar  = serviceID + "_MAXSQLCONCURRENCY"
+	sqlLogEnvar             = serviceID + "_SQLLOG"
+	sqlConnMaxLifetimeEnvar = serviceID + "_SQLCONNMAXLIFETIME"
+	homeDepthEnvar          = serviceID + "_HOMEDEPTH"
+	bulkPropagationEnvar    = serviceID + "_BULKPROPAGATION"
+	shutdownTimeoutEnvar    = serviceID + "_SHUTDOWNTIMEOUT"
+	legacyChecksumsEnvar    = serviceID + "_LEGACYCHECKSUMS"
+	metricsPortEnvar        = serviceID + "_METRICSPORT"
+	spanExporterEnvar       = serviceID + "_SPANEXPORTER"
+	gatewayPortEnvar        = serviceID + "_GATEWAYPORT"
+	softDeleteEnvar         = serviceID + "_SOFTDELETE"
+	propagateSizeEnvar      = serviceID + "_PROPAGATESIZE"
+	trashRetentionEnvar     = serviceID + "_TRASHRETENTION"
+	idempotencyTTLEnvar     = serviceID + "_IDEMPOTENCYTTL"
+	tablePrefixEnvar        = serviceID + "_TABLEPREFIX"
+	caseInsensitiveEnvar    = serviceID + "_CASEINSENSITIVE"
+	propagatorEnvar         = serviceID + "_PROPAGATOR"
+	propagationBoundsEnvar  = serviceID + "_PROPAGATIONBOUNDARIES"
+	readOnlyEnvar           = serviceID + "_READONLY"
+	rateLimitEnvar          = serviceID + "_RATELIMIT"
+	rateBurstEnvar          = serviceID + "_RATEBURST"
+	tlsCertEnvar            = serviceID + "_TLSCERT"
+	tlsKeyEnvar             = serviceID + "_TLSKEY"
+	tlsClientCAEnvar        = serviceID + "_TLSCLIENTCA"
+	tokenCacheTTLEnvar      = serviceID + "_TOKENCACHETTL"
+	tokenCacheSizeEnvar     = serviceID + "_TOKENCACHESIZE"
+	keepAliveEnvar          = serviceID + "_KEEPALIVE"
+	maxSubtreeNodesEnvar    = serviceID + "_MAXSUBTREENODES"
+	maxPathLengthEnvar      = serviceID + "_MAXPATHLENGTH"
+	maxPathSegmentsEnvar    = serviceID + "_MAXPATHSEGMENTS"
+	childrenETagsEnvar      = serviceID + "_CHILDRENETAGS"
+	importBatchSizeEnvar    = serviceID + "_IMPORTBATCHSIZE"
+	serializeHomesEnvar     = serviceID + "_SERIALIZEHOMES"
+	repairOnReadEnvar       = serviceID + "_REPAIRONREAD"
+	sharedSecretEnvar       = "CLAWIO_SHAREDSECRET"
+	previousSecretsEnvar    = "CLAWIO_PREVIOUSSHAREDSECRETS"
 )
 
 type environ struct {
-	dsn               string
-	port              int
-	logLevel          string
-	maxSqlIdle        int
-	maxSqlConcurrency int
-	sharedSecret      string
+	driver             string
+	dsn                string
+	dsnFile            string
+	port               int
+	logLevel           string
+	maxSqlIdle         int
+	maxSqlConcurrency  int
+	sqlConnMaxLifetime int
+	sqlLog             bool
+	homeDepth          int
+	bulkPropagation    bool
+	shutdownTimeout    int
+	legacyChecksums    bool
+	metricsPort        int
+	spanExporter       string
+	gatewayPort        int
+	softDelete         bool
+	propagateSize      bool
+	trashRetention     int
+	idempotencyTTL     int
+	tablePrefix        string
+	caseInsensitive    bool
+	propagator         string
+	propagationBounds  []string
+	readOnly           bool
+	rateLimit          float64
+	rateBurst          int
+	tlsCert            string
+	tlsKey             string
+	tlsClientCA        string
+	tokenCacheTTL      int
+	tokenCacheSize     int
+	keepAlive          int
+	maxSubtreeNodes    int64
+	maxPathLength      int
+	maxPathSegments    int
+	childrenETags      bool
+	importBatchSize    int
+	serializeHomes     bool
+	repairOnRead       bool
+	sharedSecret       string
+	previousSecrets    []string
 }
 
+// defaultShutdownTimeout is the number of seconds in-flight
+// requests have to finish after a SIGTERM.
+const defaultShutdownTimeout = 30
+
 func getEnviron() (*environ, error) {
 	e := &environ{}
+	e.driver = os.Getenv(driverEnvar)
+	if e.driver == "" {
+		e.driver = defaultDriver
+	}
 	e.dsn = os.Getenv(dsnEnvar)
-	port, err := strconv.Atoi(os.Getenv(portEnvar))
+
+	// the DSN can be read from a secrets file instead, and both can
+	// reference the environment for the credentials
+	e.dsnFile = os.Getenv(dsnFileEnvar)
+	if e.dsnFile != "" {
+		if e.dsn != "" {
+			return nil, fmt.Errorf("%s and %s are both set", dsnEnvar, dsnFileEnvar)
+		}
+		data, err := ioutil.ReadFile(e.dsnFile)
+		if err != nil {
+			return nil, err
+		}
+		e.dsn = strings.TrimSpace(string(data))
+	}
+	dsn, err := expandDSN(e.dsn)
 	if err != nil {
 		return nil, err
 	}
-	e.port = port
+	e.dsn = dsn
 
-	maxSqlIdle, err := strconv.Atoi(os.Getenv(maxSqlIdleEnvar))
+	port, err := strconv.Atoi(os.Getenv(portEnvar))
 	if err != nil {
 		return nil, err
 	}
-	e.maxSqlIdle = maxSqlIdle
+	e.port = port
 
-	maxSqlConcurrency, err := strconv.Atoi(os.Getenv(maxSqlConcurrencyEnvar))
-	if err != nil {
-		return nil, err
+	// the pool settings are optional, the server applies defaults
+	if v := os.Getenv(maxSqlIdleEnvar); v != "" {
+		maxSqlIdle, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		e.maxSqlIdle = maxSqlIdle
+	}
+
+	if v := os.Getenv(maxSqlConcurrencyEnvar); v != "" {
+		maxSqlConcurrency, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		e.maxSqlConcurrency = maxSqlConcurrency
+	}
+
+	if v := os.Getenv(sqlConnMaxLifetimeEnvar); v != "" {
+		sqlConnMaxLifetime, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		e.sqlConnMaxLifetime = sqlConnMaxLifetime
+	}
+
+	if v := os.Getenv(sqlLogEnvar); v != "" {
+		sqlLog, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, err
+		}
+		e.sqlLog = sqlLog
+	}
+
+	// the home depth is optional to preserve compatibility with
+	// deployments using the /local/users/<letter>/<user> layout
+	e.homeDepth = defaultHomeDepth
+	if v := os.Getenv(homeDepthEnvar); v != "" {
+		homeDepth, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		e.homeDepth = homeDepth
+	}
+
+	if v := os.Getenv(bulkPropagationEnvar); v != "" {
+		bulkPropagation, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, err
+		}
+		e.bulkPropagation = bulkPropagation
 	}
-	e.maxSqlConcurrency = maxSqlConcurrency
+
+	if v := os.Getenv(legacyChecksumsEnvar); v != "" {
+		legacyChecksums, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, err
+		}
+		e.legacyChecksums = legacyChecksums
+	}
+
+	// metrics are only served when a port is configured
+	if v := os.Getenv(metricsPortEnvar); v != "" {
+		metricsPort, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		e.metricsPort = metricsPort
+	}
+
+	e.spanExporter = os.Getenv(spanExporterEnvar)
+
+	if v := os.Getenv(softDeleteEnvar); v != "" {
+		softDelete, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, err
+		}
+		e.softDelete = softDelete
+	}
+
+	if v := os.Getenv(propagateSizeEnvar); v != "" {
+		propagateSize, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, err
+		}
+		e.propagateSize = propagateSize
+	}
+
+	if v := os.Getenv(trashRetentionEnvar); v != "" {
+		trashRetention, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		e.trashRetention = trashRetention
+	}
+
+	if v := os.Getenv(idempotencyTTLEnvar); v != "" {
+		idempotencyTTL, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		e.idempotencyTTL = idempotencyTTL
+	}
+
+	// the JSON/HTTP gateway is only served when a port is configured
+	if v := os.Getenv(gatewayPortEnvar); v != "" {
+		gatewayPort, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		e.gatewayPort = gatewayPort
+	}
+
+	e.shutdownTimeout = defaultShutdownTimeout
+	if v := os.Getenv(shutdownTimeoutEnvar); v != "" {
+		shutdownTimeout, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		e.shutdownTimeout = shutdownTimeout
+	}
+
+	e.tablePrefix = os.Getenv(tablePrefixEnvar)
+
+	if v := os.Getenv(caseInsensitiveEnvar); v != "" {
+		caseInsensitive, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, err
+		}
+		e.caseInsensitive = caseInsensitive
+	}
+
+	e.propagator = os.Getenv(propagatorEnvar)
+
+	// the boundaries are a comma separated list of paths
+	if v := os.Getenv(propagationBoundsEnvar); v != "" {
+		e.propagationBounds = strings.Split(v, ",")
+	}
+
+	if v := os.Getenv(readOnlyEnvar); v != "" {
+		readOnly, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, err
+		}
+		e.readOnly = readOnly
+	}
+
+	if v := os.Getenv(rateLimitEnvar); v != "" {
+		rateLimit, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, err
+		}
+		e.rateLimit = rateLimit
+	}
+
+	if v := os.Getenv(rateBurstEnvar); v != "" {
+		rateBurst, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		e.rateBurst = rateBurst
+	}
+
+	// the listeners are in plaintext unless a certificate is configured
+	e.tlsCert = os.Getenv(tlsCertEnvar)
+	e.tlsKey = os.Getenv(tlsKeyEnvar)
+	e.tlsClientCA = os.Getenv(tlsClientCAEnvar)
+
+	if v := os.Getenv(tokenCacheTTLEnvar); v != "" {
+		tokenCacheTTL, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		e.tokenCacheTTL = tokenCacheTTL
+	}
+
+	if v := os.Getenv(tokenCacheSizeEnvar); v != "" {
+		tokenCacheSize, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		e.tokenCacheSize = tokenCacheSize
+	}
+
+	// 0 disables the keepalive probes
+	e.keepAlive = defaultKeepAlive
+	if v := os.Getenv(keepAliveEnvar); v != "" {
+		keepAlive, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		e.keepAlive = keepAlive
+	}
+
+	if v := os.Getenv(maxSubtreeNodesEnvar); v != "" {
+		maxSubtreeNodes, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		e.maxSubtreeNodes = maxSubtreeNodes
+	}
+
+	if v := os.Getenv(maxPathLengthEnvar); v != "" {
+		maxPathLength, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		e.maxPathLength = maxPathLength
+	}
+
+	if v := os.Getenv(maxPathSegmentsEnvar); v != "" {
+		maxPathSegments, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		e.maxPathSegments = maxPathSegments
+	}
+
+	if v := os.Getenv(childrenETagsEnvar); v != "" {
+		childrenETags, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, err
+		}
+		e.childrenETags = childrenETags
+	}
+
+	if v := os.Getenv(importBatchSizeEnvar); v != "" {
+		importBatchSize, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		e.importBatchSize = importBatchSize
+	}
+
+	if v := os.Getenv(serializeHomesEnvar); v != "" {
+		serializeHomes, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, err
+		}
+		e.serializeHomes = serializeHomes
+	}
+
+	if v := os.Getenv(repairOnReadEnvar); v != "" {
+		repairOnRead, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, err
+		}
+		e.repairOnRead = repairOnRead
+	}
+
 	e.logLevel = os.Getenv(logLevelEnvar)
 
 	e.sharedSecret = os.Getenv(sharedSecretEnvar)
+
+	// the secrets replaced by a rotation are a comma separated list
+	if v := os.Getenv(previousSecretsEnvar); v != "" {
+		e.previousSecrets = strings.Split(v, ",")
+	}
 	return e, nil
 }
 func printEnviron(e *environ) {
-	log.Infof("%s=%s", dsnEnvar, e.dsn)
+	log.Infof("%s=%s", driverEnvar, e.driver)
+	log.Infof("%s=%s", dsnEnvar, redactDSN(e.dsn))
+	log.Infof("%s=%s", dsnFileEnvar, e.dsnFile)
 	log.Infof("%s=%d", portEnvar, e.port)
 	log.Infof("%s=%d", maxSqlIdleEnvar, e.maxSqlIdle)
 	log.Infof("%s=%d", maxSqlConcurrencyEnvar, e.maxSqlConcurrency)
+	log.Infof("%s=%d", sqlConnMaxLifetimeEnvar, e.sqlConnMaxLifetime)
+	log.Infof("%s=%t", sqlLogEnvar, e.sqlLog)
+	log.Infof("%s=%d", homeDepthEnvar, e.homeDepth)
+	log.Infof("%s=%t", bulkPropagationEnvar, e.bulkPropagation)
+	log.Infof("%s=%d", shutdownTimeoutEnvar, e.shutdownTimeout)
+	log.Infof("%s=%t", legacyChecksumsEnvar, e.legacyChecksums)
+	log.Infof("%s=%d", metricsPortEnvar, e.metricsPort)
+	log.Infof("%s=%s", spanExporterEnvar, e.spanExporter)
+	log.Infof("%s=%d", gatewayPortEnvar, e.gatewayPort)
+	log.Infof("%s=%t", softDeleteEnvar, e.softDelete)
+	log.Infof("%s=%t", propagateSizeEnvar, e.propagateSize)
+	log.Infof("%s=%d", trashRetentionEnvar, e.trashRetention)
+	log.Infof("%s=%d", idempotencyTTLEnvar, e.idempotencyTTL)
+	log.Infof("%s=%s", tablePrefixEnvar, e.tablePrefix)
+	log.Infof("%s=%t", caseInsensitiveEnvar, e.caseInsensitive)
+	log.Infof("%s=%s", propagatorEnvar, e.propagator)
+	log.Infof("%s=%s", propagationBoundsEnvar, strings.Join(e.propagationBounds, ","))
+	log.Infof("%s=%t", readOnlyEnvar, e.readOnly)
+	log.Infof("%s=%g", rateLimitEnvar, e.rateLimit)
+	log.Infof("%s=%d", rateBurstEnvar, e.rateBurst)
+	log.Infof("%s=%s", tlsCertEnvar, e.tlsCert)
+	log.Infof("%s=%s", tlsKeyEnvar, e.tlsKey)
+	log.Infof("%s=%s", tlsClientCAEnvar, e.tlsClientCA)
+	log.Infof("%s=%d", tokenCacheTTLEnvar, e.tokenCacheTTL)
+	log.Infof("%s=%d", tokenCacheSizeEnvar, e.tokenCacheSize)
+	log.Infof("%s=%d", keepAliveEnvar, e.keepAlive)
+	log.Infof("%s=%d", maxSubtreeNodesEnvar, e.maxSubtreeNodes)
+	log.Infof("%s=%d", maxPathLengthEnvar, e.maxPathLength)
+	log.Infof("%s=%d", maxPathSegmentsEnvar, e.maxPathSegments)
+	log.Infof("%s=%t", childrenETagsEnvar, e.childrenETags)
+	log.Infof("%s=%d", importBatchSizeEnvar, e.importBatchSize)
+	log.Infof("%s=%t", serializeHomesEnvar, e.serializeHomes)
+	log.Infof("%s=%t", repairOnReadEnvar, e.repairOnRead)
 	log.Infof("%s=%d", portEnvar, e.port)
 	log.Infof("%s=%s", sharedSecretEnvar, "******")
+	log.Infof("%s=%d secrets", previousSecretsEnvar, len(e.previousSecrets))
 }
 
 func main() {
@@ -80,13 +469,58 @@ func main() {
 	log.SetLevel(l)
 
 	log.Infof("Service %s started", serviceID)
+	log.Infof("version=%s commit=%s built=%s", version, gitCommit, buildTime)
 	printEnviron(env)
 
 	p := &newServerParams{}
+	p.logger = log.StandardLogger()
+	p.driver = env.driver
 	p.dsn = env.dsn
 	p.sharedSecret = env.sharedSecret
+	p.previousSecrets = env.previousSecrets
 	p.maxSqlIdle = env.maxSqlIdle
 	p.maxSqlConcurrency = env.maxSqlConcurrency
+	p.sqlConnMaxLifetime = time.Duration(env.sqlConnMaxLifetime) * time.Second
+	p.sqlLog = env.sqlLog
+	p.homeDepth = env.homeDepth
+	p.bulkPropagation = env.bulkPropagation
+	p.legacyChecksums = env.legacyChecksums
+	p.softDelete = env.softDelete
+	p.propagateSize = env.propagateSize
+	p.trashRetention = time.Duration(env.trashRetention) * time.Second
+	p.idempotencyTTL = time.Duration(env.idempotencyTTL) * time.Second
+	p.tablePrefix = env.tablePrefix
+	p.caseInsensitive = env.caseInsensitive
+	p.readOnly = env.readOnly
+	p.rateLimit = env.rateLimit
+	p.rateBurst = env.rateBurst
+	p.tokenCacheTTL = time.Duration(env.tokenCacheTTL) * time.Second
+	p.tokenCacheSize = env.tokenCacheSize
+	p.maxSubtreeNodes = env.maxSubtreeNodes
+	p.maxPathLength = env.maxPathLength
+	p.maxPathSegments = env.maxPathSegments
+	p.childrenETags = env.childrenETags
+	p.importBatchSize = env.importBatchSize
+	p.serializeHomes = env.serializeHomes
+	p.repairOnRead = env.repairOnRead
+
+	p.spanExporter, err = newSpanExporter(env.spanExporter, log.StandardLogger())
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	p.propagator, err = newPropagator(env.propagator, env.homeDepth, env.propagationBounds)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	tlsConfig, err := newTLSConfig(env.tlsCert, env.tlsKey, env.tlsClientCA)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
 
 	srv, err := newServer(p)
 	if err != nil {
@@ -94,13 +528,80 @@ func main() {
 		os.Exit(1)
 	}
 
+	keepAlive := time.Duration(env.keepAlive) * time.Second
+
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", env.port))
 	if err != nil {
 		log.Error(err)
 		os.Exit(1)
 	}
+	lis = newKeepAliveListener(lis, keepAlive)
 
-	grpcServer := grpc.NewServer()
-	pb.RegisterPropServer(grpcServer, srv)
-	grpcServer.Serve(lis)
+	if env.metricsPort > 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", srv.metrics)
+		go func() {
+			err := http.ListenAndServe(fmt.Sprintf(":%d", env.metricsPort), mux)
+			if err != nil {
+				log.Error(err)
+			}
+		}()
+	}
+
+	propServer := newTraceServer(newMetricsServer(newAuthServer(srv), srv.metrics))
+
+	if env.gatewayPort > 0 {
+		gw, err := newGateway(propServer, log.StandardLogger())
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		defer gw.Close()
+		go func() {
+			gwLis, err := net.Listen("tcp", fmt.Sprintf(":%d", env.gatewayPort))
+			if err != nil {
+				log.Error(err)
+				return
+			}
+			gwLis = newKeepAliveListener(gwLis, keepAlive)
+			// the gateway carries the access tokens too
+			if tlsConfig != nil {
+				gwLis = tls.NewListener(gwLis, tlsConfig)
+			}
+			if err := http.Serve(gwLis, gw); err != nil {
+				log.Error(err)
+			}
+		}()
+	}
+
+	opts := []grpc.ServerOption{}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	grpcServer := grpc.NewServer(opts...)
+	pb.RegisterPropServer(grpcServer, propServer)
+	healthpb.RegisterHealthServer(grpcServer, newHealthServer(srv))
+
+	go func() {
+		if err := grpcServer.Serve(lis); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	// on SIGTERM new connections are refused and in-flight requests
+	// are drained before the database is closed
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	sig := <-sigs
+	log.Infof("received %s, shutting down", sig)
+	lis.Close()
+
+	timeout := time.Duration(env.shutdownTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Error(err)
+	}
+	grpcServer.Stop()
 }
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds in seconds of the request
+// duration histogram buckets.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type rpcKey struct {
+	method string
+	code   codes.Code
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// metrics keeps the counters exposed on the metrics endpoint
+// in the Prometheus text format.
+type metrics struct {
+	mu              sync.Mutex
+	requests        map[rpcKey]uint64
+	latencies       map[string]*histogram
+	propagationRows int64
+
+	// propagationUpdates and propagationNoops count the propagations
+	// that updated some ancestors and the ones that updated none.
+	propagationUpdates uint64
+	propagationNoops   uint64
+}
+
+func newMetrics() *metrics {
+	m := &metrics{}
+	m.requests = map[rpcKey]uint64{}
+	m.latencies = map[string]*histogram{}
+	return m
+}
+
+// observe records a finished request. It is meant to be deferred
+// with the start time of the request and its returned error.
+func (m *metrics) observe(method string, start time.Time, err *error) {
+	dur := time.Since(start).Seconds()
+	code := grpc.Code(*err)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[rpcKey{method, code}]++
+
+	h, ok := m.latencies[method]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latencies[method] = h
+	}
+	for i, b := range latencyBuckets {
+		if dur <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += dur
+	h.count++
+}
+
+// observePropagation records the rows affected by the last propagation
+// and counts it as an update or a no-op when it did not fail. Many no-ops
+// are a symptom of missing ancestors, as the propagation of a change
+// stops at the first ancestor it does not update.
+func (m *metrics) observePropagation(n int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.propagationRows = n
+	if err != nil {
+		return
+	}
+	if n > 0 {
+		m.propagationUpdates++
+	} else {
+		m.propagationNoops++
+	}
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	keys := []rpcKey{}
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Sort(byMethodAndCode(keys))
+
+	fmt.Fprintln(w, "# HELP prop_rpc_requests_total Number of finished RPCs.")
+	fmt.Fprintln(w, "# TYPE prop_rpc_requests_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "prop_rpc_requests_total{method=%q,code=%q} %d\n", k.method, k.code.String(), m.requests[k])
+	}
+
+	methods := []string{}
+	for method := range m.latencies {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	fmt.Fprintln(w, "# HELP prop_rpc_duration_seconds Duration of the RPCs.")
+	fmt.Fprintln(w, "# TYPE prop_rpc_duration_seconds histogram")
+	for _, method := range methods {
+		h := m.latencies[method]
+		for i, b := range latencyBuckets {
+			fmt.Fprintf(w, "prop_rpc_duration_seconds_bucket{method=%q,le=\"%g\"} %d\n", method, b, h.counts[i])
+		}
+		fmt.Fprintf(w, "prop_rpc_duration_seconds_bucket{method=%q,le=\"+Inf\"} %d\n", method, h.count)
+		fmt.Fprintf(w, "prop_rpc_duration_seconds_sum{method=%q} %g\n", method, h.sum)
+		fmt.Fprintf(w, "prop_rpc_duration_seconds_count{method=%q} %d\n", method, h.count)
+	}
+
+	fmt.Fprintln(w, "# HELP prop_propagation_rows_affected Rows updated by the last propagation.")
+	fmt.Fprintln(w, "# TYPE prop_propagation_rows_affected gauge")
+	fmt.Fprintf(w, "prop_propagation_rows_affected %d\n", m.propagationRows)
+
+	fmt.Fprintln(w, "# HELP prop_propagation_updates_total Number of propagations that updated some ancestors.")
+	fmt.Fprintln(w, "# TYPE prop_propagation_updates_total counter")
+	fmt.Fprintf(w, "prop_propagation_updates_total %d\n", m.propagationUpdates)
+
+	fmt.Fprintln(w, "# HELP prop_propagation_noops_total Number of propagations that updated no ancestor.")
+	fmt.Fprintln(w, "# TYPE prop_propagation_noops_total counter")
+	fmt.Fprintf(w, "prop_propagation_noops_total %d\n", m.propagationNoops)
+}
+
+type byMethodAndCode []rpcKey
+
+func (k byMethodAndCode) Len() int      { return len(k) }
+func (k byMethodAndCode) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+func (k byMethodAndCode) Less(i, j int) bool {
+	if k[i].method != k[j].method {
+		return k[i].method < k[j].method
+	}
+	return k[i].code < k[j].code
+}
+
+// metricsServer wraps a PropServer to record the count, code and
+// duration of every RPC, as the grpc version in use has no interceptors.
+type metricsServer struct {
+	srv     pb.PropServer
+	metrics *metrics
+}
+
+func newMetricsServer(srv pb.PropServer, m *metrics) pb.PropServer {
+	return &metricsServer{srv: srv, metrics: m}
+}
+
+func (m *metricsServer) Put(ctx context.Context, req *pb.PutReq) (res *pb.Void, err error) {
+	defer m.metrics.observe("Put", time.Now(), &err)
+	return m.srv.Put(ctx, req)
+}
+
+func (m *metricsServer) Get(ctx context.Context, req *pb.GetReq) (res *pb.Record, err error) {
+	defer m.metrics.observe("Get", time.Now(), &err)
+	return m.srv.Get(ctx, req)
+}
+
+func (m *metricsServer) Mv(ctx context.Context, req *pb.MvReq) (res *pb.MvResp, err error) {
+	defer m.metrics.observe("Mv", time.Now(), &err)
+	return m.srv.Mv(ctx, req)
+}
+
+func (m *metricsServer) Rm(ctx context.Context, req *pb.RmReq) (res *pb.RmResp, err error) {
+	defer m.metrics.observe("Rm", time.Now(), &err)
+	return m.srv.Rm(ctx, req)
+}
+
+func (m *metricsServer) List(ctx context.Context, req *pb.ListReq) (res *pb.ListResp, err error) {
+	defer m.metrics.observe("List", time.Now(), &err)
+	return m.srv.List(ctx, req)
+}
+
+func (m *metricsServer) Stat(ctx context.Context, req *pb.StatReq) (res *pb.Record, err error) {
+	defer m.metrics.observe("Stat", time.Now(), &err)
+	return m.srv.Stat(ctx, req)
+}
+
+func (m *metricsServer) Copy(ctx context.Context, req *pb.CopyReq) (res *pb.Void, err error) {
+	defer m.metrics.observe("Copy", time.Now(), &err)
+	return m.srv.Copy(ctx, req)
+}
+
+func (m *metricsServer) BatchPut(ctx context.Context, req *pb.BatchPutReq) (res *pb.Void, err error) {
+	defer m.metrics.observe("BatchPut", time.Now(), &err)
+	return m.srv.BatchPut(ctx, req)
+}
+
+func (m *metricsServer) BatchGet(ctx context.Context, req *pb.BatchGetReq) (res *pb.BatchGetResp, err error) {
+	defer m.metrics.observe("BatchGet", time.Now(), &err)
+	return m.srv.BatchGet(ctx, req)
+}
+
+func (m *metricsServer) Exists(ctx context.Context, req *pb.ExistsReq) (res *pb.ExistsResp, err error) {
+	defer m.metrics.observe("Exists", time.Now(), &err)
+	return m.srv.Exists(ctx, req)
+}
+
+func (m *metricsServer) GetByID(ctx context.Context, req *pb.GetByIdReq) (res *pb.Record, err error) {
+	defer m.metrics.observe("GetByID", time.Now(), &err)
+	return m.srv.GetByID(ctx, req)
+}
+
+func (m *metricsServer) ChangesSince(ctx context.Context, req *pb.ChangesReq) (res *pb.ChangesResp, err error) {
+	defer m.metrics.observe("ChangesSince", time.Now(), &err)
+	return m.srv.ChangesSince(ctx, req)
+}
+
+func (m *metricsServer) Touch(ctx context.Context, req *pb.TouchReq) (res *pb.Void, err error) {
+	defer m.metrics.observe("Touch", time.Now(), &err)
+	return m.srv.Touch(ctx, req)
+}
+
+func (m *metricsServer) Restore(ctx context.Context, req *pb.RestoreReq) (res *pb.RestoreResp, err error) {
+	defer m.metrics.observe("Restore", time.Now(), &err)
+	return m.srv.Restore(ctx, req)
+}
+
+func (m *metricsServer) Purge(ctx context.Context, req *pb.PurgeReq) (res *pb.PurgeResp, err error) {
+	defer m.metrics.observe("Purge", time.Now(), &err)
+	return m.srv.Purge(ctx, req)
+}
+
+func (m *metricsServer) Count(ctx context.Context, req *pb.CountReq) (res *pb.CountResp, err error) {
+	defer m.metrics.observe("Count", time.Now(), &err)
+	return m.srv.Count(ctx, req)
+}
+
+func (m *metricsServer) Reconcile(ctx context.Context, req *pb.ReconcileReq) (res *pb.ReconcileResp, err error) {
+	defer m.metrics.observe("Reconcile", time.Now(), &err)
+	return m.srv.Reconcile(ctx, req)
+}
+
+func (m *metricsServer) GetTree(ctx context.Context, req *pb.GetTreeReq) (res *pb.TreeNode, err error) {
+	defer m.metrics.observe("GetTree", time.Now(), &err)
+	return m.srv.GetTree(ctx, req)
+}
+
+func (m *metricsServer) RmMany(ctx context.Context, req *pb.RmManyReq) (res *pb.RmResp, err error) {
+	defer m.metrics.observe("RmMany", time.Now(), &err)
+	return m.srv.RmMany(ctx, req)
+}
+
+func (m *metricsServer) Version(ctx context.Context, req *pb.Void) (res *pb.VersionResp, err error) {
+	defer m.metrics.observe("Version", time.Now(), &err)
+	return m.srv.Version(ctx, req)
+}
+
+func (m *metricsServer) RmByID(ctx context.Context, req *pb.RmByIdReq) (res *pb.RmResp, err error) {
+	defer m.metrics.observe("RmByID", time.Now(), &err)
+	return m.srv.RmByID(ctx, req)
+}
+
+func (m *metricsServer) FindByChecksum(ctx context.Context, req *pb.ChecksumReq) (res *pb.ChecksumResp, err error) {
+	defer m.metrics.observe("FindByChecksum", time.Now(), &err)
+	return m.srv.FindByChecksum(ctx, req)
+}
+
+func (m *metricsServer) RecomputeEtag(ctx context.Context, req *pb.RecomputeEtagReq) (res *pb.Record, err error) {
+	defer m.metrics.observe("RecomputeEtag", time.Now(), &err)
+	return m.srv.RecomputeEtag(ctx, req)
+}
+
+func (m *metricsServer) GetWithAncestors(ctx context.Context, req *pb.GetReq) (res *pb.AncestorsResp, err error) {
+	defer m.metrics.observe("GetWithAncestors", time.Now(), &err)
+	return m.srv.GetWithAncestors(ctx, req)
+}
+
+func (m *metricsServer) Audit(ctx context.Context, req *pb.AuditReq) (res *pb.AuditResp, err error) {
+	defer m.metrics.observe("Audit", time.Now(), &err)
+	return m.srv.Audit(ctx, req)
+}
+
+func (m *metricsServer) HasChildren(ctx context.Context, req *pb.HasChildrenReq) (res *pb.HasChildrenResp, err error) {
+	defer m.metrics.observe("HasChildren", time.Now(), &err)
+	return m.srv.HasChildren(ctx, req)
+}
+
+func (m *metricsServer) ListByCheckpoint(ctx context.Context, req *pb.CheckpointReq) (res *pb.CheckpointResp, err error) {
+	defer m.metrics.observe("ListByCheckpoint", time.Now(), &err)
+	return m.srv.ListByCheckpoint(ctx, req)
+}
+
+func (m *metricsServer) Watch(req *pb.WatchReq, stream pb.Prop_WatchServer) (err error) {
+	defer m.metrics.observe("Watch", time.Now(), &err)
+	return m.srv.Watch(req, stream)
+}
+
+func (m *metricsServer) Import(stream pb.Prop_ImportServer) (err error) {
+	defer m.metrics.observe("Import", time.Now(), &err)
+	return m.srv.Import(stream)
+}
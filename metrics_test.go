@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+)
+
+// scrape returns the metrics of ts as served on the metrics endpoint.
+func scrape(t *testing.T, ts *testServer) string {
+	w := httptest.NewRecorder()
+	ts.s.metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("got the content type %s", ct)
+	}
+	return w.Body.String()
+}
+
+// wantMetrics checks the metrics of ts have the lines of want.
+func wantMetrics(t *testing.T, ts *testServer, want ...string) {
+	t.Helper()
+	got := scrape(t, ts)
+	lines := map[string]bool{}
+	for _, l := range strings.Split(got, "\n") {
+		lines[l] = true
+	}
+	for _, l := range want {
+		if !lines[l] {
+			t.Errorf("the metrics have no line %s:\n%s", l, got)
+		}
+	}
+}
+
+func TestMetricsRequests(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a.txt")
+	ts.put(t, testHome+"/b.txt")
+	ts.Get(context.Background(), &pb.GetReq{AccessToken: ts.token, Path: testHome + "/missing"})
+
+	wantMetrics(t, ts,
+		`prop_rpc_requests_total{method="Put",code="OK"} 2`,
+		`prop_rpc_requests_total{method="Get",code="NotFound"} 1`,
+		`prop_rpc_duration_seconds_bucket{method="Put",le="+Inf"} 2`,
+		`prop_rpc_duration_seconds_count{method="Put"} 2`,
+		`prop_rpc_duration_seconds_count{method="Get"} 1`,
+	)
+}
+
+// TestMetricsPropagationRows checks the gauge holds the rows updated by
+// the last propagation.
+func TestMetricsPropagationRows(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/b/c.txt")
+	ts.clock.Advance(time.Second)
+	ts.put(t, testHome+"/a/b/d.txt")
+	wantMetrics(t, ts, "prop_propagation_rows_affected 3")
+}
+
+// TestMetricsPropagationNoops checks a propagation to missing ancestors
+// counts a no-op, Put creating them beforehand, and a put under existing
+// ones counts an update.
+func TestMetricsPropagationNoops(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/b/c.txt")
+	wantMetrics(t, ts,
+		"prop_propagation_noops_total 0",
+		"prop_propagation_updates_total 1",
+	)
+
+	ts.clock.Advance(time.Second)
+	err := ts.s.propagateChanges(context.Background(), ts.s.db, "/local/users/b/bob/a/f.txt", "etag", ts.clock.Now().Unix(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantMetrics(t, ts,
+		"prop_propagation_noops_total 1",
+		"prop_propagation_updates_total 1",
+	)
+
+	ts.put(t, testHome+"/a/b/d.txt")
+	wantMetrics(t, ts,
+		"prop_propagation_noops_total 1",
+		"prop_propagation_updates_total 2",
+	)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"github.com/jinzhu/gorm"
+	rus "github.com/sirupsen/logrus"
+	"time"
+)
+
+// migration is a versioned change of the schema. DDL statements are not
+// transactional in every database so a migration interrupted before it
+// is recorded is run again on the next start and must be safe to rerun.
+type migration struct {
+	version int64
+	name    string
+	up      func(db *gorm.DB, dl dialect) error
+}
+
+// migrations are applied in order on startup. New migrations are appended
+// with the next version, existing ones are never changed.
+var migrations = []migration{
+	{1, "create tables", func(db *gorm.DB, dl dialect) error {
+		err := db.AutoMigrate(&record{}, &idempotencyKey{}).Error
+		if err != nil {
+			return err
+		}
+
+		// the index names are prefixed too as some databases require them to
+		// be unique in the whole schema.
+		err = db.Model(&record{}).AddUniqueIndex(tablePrefix(db)+"idx_path", "path").Error
+		if err != nil {
+			return err
+		}
+
+		// The composite index serves the propagation WHERE path=? AND m_time<?
+		return db.Model(&record{}).AddIndex(tablePrefix(db)+"idx_path_mtime", "path", "m_time").Error
+	}},
+	{2, "widen m_time", func(db *gorm.DB, dl dialect) error {
+		// AutoMigrate does not alter existing columns so tables created when
+		// mtime was an uint32 are widened here. Existing values are preserved.
+		return dl.widenMTime(db)
+	}},
+	{3, "parent paths", func(db *gorm.DB, dl dialect) error {
+		// AutoMigrate adds the indexed parent_path column to the existing tables,
+		// the records created before it are backfilled by pages.
+		err := autoMigrateRecords(db)
+		if err != nil {
+			return err
+		}
+
+		for {
+			recs := []record{}
+			err = db.Unscoped().Select("id, path").
+				Where("(parent_path IS NULL OR parent_path = '') AND path <> '/'").
+				Order("path").Limit(migrationPageSize).Find(&recs).Error
+			if err != nil {
+				return err
+			}
+			for _, rec := range recs {
+				err = db.Unscoped().Model(record{}).Where("id=?", rec.ID).
+					UpdateColumn("parent_path", parentPath(rec.Path)).Error
+				if err != nil {
+					return err
+				}
+			}
+			if len(recs) < migrationPageSize {
+				return nil
+			}
+		}
+	}},
+	{4, "checksum index", func(db *gorm.DB, dl dialect) error {
+		// AutoMigrate adds the indexes of the tags to the existing tables
+		return autoMigrateRecords(db)
+	}},
+	{5, "null checksums", func(db *gorm.DB, dl dialect) error {
+		// the unknown checksums were stored as empty strings
+		return db.Unscoped().Model(record{}).Where("checksum = ''").UpdateColumn("checksum", gorm.Expr("NULL")).Error
+	}},
+	{6, "kinds", func(db *gorm.DB, dl dialect) error {
+		// AutoMigrate adds the kind column. The existing records with
+		// children are folders and the others files.
+		err := autoMigrateRecords(db)
+		if err != nil {
+			return err
+		}
+
+		parents := []string{}
+		err = db.Unscoped().Model(record{}).Where("parent_path <> ''").Pluck("DISTINCT parent_path", &parents).Error
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(parents); i += migrationPageSize {
+			end := i + migrationPageSize
+			if end > len(parents) {
+				end = len(parents)
+			}
+			err = db.Unscoped().Model(record{}).Where("path IN (?)", parents[i:end]).
+				UpdateColumn("kind", pb.Kind_FOLDER).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return db.Unscoped().Model(record{}).Where("kind IS NULL OR kind = ?", pb.Kind_UNKNOWN).
+			UpdateColumn("kind", pb.Kind_FILE).Error
+	}},
+	{7, "change sequence", func(db *gorm.DB, dl dialect) error {
+		// AutoMigrate adds the indexed seq column and the sequences table.
+		err := autoMigrateRecords(db)
+		if err != nil {
+			return err
+		}
+		err = db.AutoMigrate(&sequence{}).Error
+		if err != nil {
+			return err
+		}
+
+		// the existing records share the first seq
+		err = db.Unscoped().Model(record{}).Where("seq IS NULL OR seq = 0").UpdateColumn("seq", 1).Error
+		if err != nil {
+			return err
+		}
+
+		err = db.Where("name = ?", recordsSequence).First(&sequence{}).Error
+		if err == gorm.RecordNotFound {
+			return db.Create(&sequence{Name: recordsSequence, Value: 1}).Error
+		}
+		return err
+	}},
+}
+
+// migrationPageSize is the number of records a data migration loads at once.
+const migrationPageSize = 1000
+
+// autoMigrateRecords is AutoMigrate for the records table. The SQLite
+// dialect of gorm does not see the columns added by an ALTER TABLE, so
+// AutoMigrate would add them again once a migration added them, like
+// the first one does to the tables created before the migrations were
+// tracked. The columns are probed first and AutoMigrate only runs when
+// one is missing, otherwise the indexes of the tags are added alone, with
+// the names AutoMigrate gives them.
+func autoMigrateRecords(db *gorm.DB) error {
+	scope := db.NewScope(&record{})
+	for _, f := range scope.GetStructFields() {
+		if f.IsNormal && !hasColumn(db, &record{}, f.DBName) {
+			return db.AutoMigrate(&record{}).Error
+		}
+	}
+	for _, f := range scope.GetStructFields() {
+		if f.Tag.Get("sql") != "index" {
+			continue
+		}
+		err := db.Model(&record{}).AddIndex(fmt.Sprintf("idx_%s_%s", scope.TableName(), f.DBName), f.DBName).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasColumn reports if the table of model has the column, by selecting it.
+func hasColumn(db *gorm.DB, model interface{}, column string) bool {
+	rows, err := db.Unscoped().Model(model).Select(column).Limit(1).Rows()
+	if err != nil {
+		return false
+	}
+	rows.Close()
+	return true
+}
+
+// schemaMigration records an applied migration.
+type schemaMigration struct {
+	Version int64 `gorm:"primary_key"`
+	Name    string
+	Applied int64
+}
+
+// schemaVersion is the version of the last migration.
+func schemaVersion() int64 {
+	return migrations[len(migrations)-1].version
+}
+
+// migrate applies the migrations not recorded in the schema_migrations
+// table. The tables created before the migrations were tracked are
+// brought up to date by the first ones, that leave the existing data as is.
+func migrate(db *gorm.DB, dl dialect, logger *rus.Logger) error {
+
+	err := db.AutoMigrate(&schemaMigration{}).Error
+	if err != nil {
+		return err
+	}
+
+	versions := []int64{}
+	err = db.Model(&schemaMigration{}).Pluck("version", &versions).Error
+	if err != nil {
+		return err
+	}
+	applied := map[int64]bool{}
+	for _, v := range versions {
+		applied[v] = true
+	}
+
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+
+		if err = m.up(db, dl); err != nil {
+			return fmt.Errorf("migration %d %s failed: %s", m.version, m.name, err)
+		}
+
+		err = db.Create(&schemaMigration{Version: m.version, Name: m.name, Applied: time.Now().Unix()}).Error
+		if err != nil {
+			return err
+		}
+
+		logger.Infof("migration %d %s applied", m.version, m.name)
+	}
+
+	return nil
+}
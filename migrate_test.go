@@ -0,0 +1,175 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"github.com/jinzhu/gorm"
+)
+
+// tables returns the names of the tables of the SQLite database of ts,
+// but the internal ones of SQLite.
+func tables(t *testing.T, ts *testServer) []string {
+	names := []string{}
+	err := ts.s.db.Raw("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite!_%' ESCAPE '!' ORDER BY name").Pluck("name", &names).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+// indexes returns the SQL creating each index of the table in the SQLite
+// database of ts, without the quotes, by index name.
+func indexes(t *testing.T, ts *testServer, table string) map[string]string {
+	rows, err := ts.s.db.Raw("SELECT name, sql FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql IS NOT NULL", table).Rows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	idx := map[string]string{}
+	for rows.Next() {
+		var name, sql string
+		if err = rows.Scan(&name, &sql); err != nil {
+			t.Fatal(err)
+		}
+		idx[name] = strings.Replace(sql, `"`, "", -1)
+	}
+	return idx
+}
+
+func TestMigrateIndexes(t *testing.T) {
+	ts := newTestServer(t, nil)
+	idx := indexes(t, ts, "records")
+	if sql, ok := idx["idx_path"]; !ok || !strings.HasPrefix(sql, "CREATE UNIQUE INDEX") || !strings.Contains(sql, "(path)") {
+		t.Errorf("got the index idx_path %q, want a unique index on path", sql)
+	}
+	if sql, ok := idx["idx_path_mtime"]; !ok || !strings.Contains(sql, "(path, m_time)") {
+		t.Errorf("got the index idx_path_mtime %q, want an index on path and m_time", sql)
+	}
+}
+
+// TestMigrateIDIndex checks the ids GetByID looks up are indexed, by
+// their primary key.
+func TestMigrateIDIndex(t *testing.T) {
+	ts := newTestServer(t, nil)
+	rows, err := ts.s.db.Raw("SELECT il.origin, ii.name FROM pragma_index_list('records') il, pragma_index_info(il.name) ii").Rows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	found := false
+	for rows.Next() {
+		var origin, column string
+		if err = rows.Scan(&origin, &column); err != nil {
+			t.Fatal(err)
+		}
+		found = found || (origin == "pk" && column == "id")
+	}
+	if !found {
+		t.Error("the id is not indexed")
+	}
+}
+
+func TestMigrateTablePrefix(t *testing.T) {
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.tablePrefix = "prop_"
+	})
+
+	names := tables(t, ts)
+	for _, name := range names {
+		if !strings.HasPrefix(name, "prop_") {
+			t.Errorf("table %s is not prefixed", name)
+		}
+	}
+	if i := sort.SearchStrings(names, "prop_records"); i == len(names) || names[i] != "prop_records" {
+		t.Errorf("got tables %v, want prop_records among them", names)
+	}
+
+	ts.put(t, testHome+"/a.txt")
+	ts.get(t, testHome+"/a.txt")
+}
+
+func TestMigrateRerun(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a.txt")
+
+	if err := migrate(ts.s.db, ts.s.dialect, ts.s.logger); err != nil {
+		t.Fatal(err)
+	}
+
+	versions := []int64{}
+	if err := ts.s.db.Model(&schemaMigration{}).Order("version").Pluck("version", &versions).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != len(migrations) || versions[len(versions)-1] != schemaVersion() {
+		t.Errorf("got versions %v, want the %d migrations once", versions, len(migrations))
+	}
+	ts.get(t, testHome+"/a.txt")
+}
+
+func TestMigrationsRerun(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/b.txt")
+
+	// an interrupted migration is run again on the next start
+	for _, m := range migrations[1:] {
+		if err := m.up(ts.s.db, ts.s.dialect); err != nil {
+			t.Errorf("migration %d %s: %s", m.version, m.name, err)
+		}
+	}
+	if rec := ts.get(t, testHome+"/a"); rec.Kind != pb.Kind_FOLDER {
+		t.Errorf("got %v, want a folder", rec)
+	}
+}
+
+// TestMigrateLegacyTables checks the tables created before the migrations
+// were tracked are brought up to date, their records backfilled.
+func TestMigrateLegacyTables(t *testing.T) {
+	dsn := "file:" + filepath.Join(t.TempDir(), "prop.db")
+	db, err := gorm.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE "records" ("id" varchar(255),"path" varchar(255),"checksum" varchar(255),"e_tag" varchar(255),"m_time" integer , PRIMARY KEY ("id"))`,
+		"INSERT INTO records VALUES ('home', '" + testHome + "', '', 'etag', 1)",
+		"INSERT INTO records VALUES ('a', '" + testHome + "/a', '', 'etag', 1)",
+		"INSERT INTO records VALUES ('f', '" + testHome + "/a/f.txt', 'md5:d41d8cd98f00b204e9800998ecf8427e', 'etag', 1)",
+	} {
+		if err = db.Exec(stmt).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.dsn = dsn
+	})
+	var version int64
+	if err = ts.s.db.Model(&schemaMigration{}).Select("MAX(version)").Row().Scan(&version); err != nil || version != schemaVersion() {
+		t.Errorf("got the version %d, %v, want %d", version, err, schemaVersion())
+	}
+	for p, want := range map[string]struct {
+		parent string
+		kind   pb.Kind
+		sum    bool
+	}{
+		"/a":       {testHome, pb.Kind_FOLDER, false},
+		"/a/f.txt": {testHome + "/a", pb.Kind_FILE, true},
+	} {
+		rec := ts.record(t, testHome+p)
+		if rec.ParentPath != want.parent || rec.Kind != want.kind || (rec.Checksum != nil) != want.sum || rec.Seq != 1 {
+			t.Errorf("got %s parent=%s seq=%d, want the parent %s and the kind %s", rec, rec.ParentPath, rec.Seq, want.parent, want.kind)
+		}
+	}
+	idx := indexes(t, ts, "records")
+	for _, name := range []string{"idx_path", "idx_records_parent_path", "idx_records_checksum", "idx_records_seq"} {
+		if _, ok := idx[name]; !ok {
+			t.Errorf("the index %s is missing", name)
+		}
+	}
+	ts.put(t, testHome+"/a/g.txt")
+}
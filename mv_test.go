@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+// putSubtree creates the folder root with n files below it. The files
+// are inserted in a single transaction, without propagating, as the
+// put of each would be slow for a large subtree.
+func putSubtree(t testing.TB, ts *testServer, root string, n int) {
+	ts.put(t, root+"/f0")
+	tx := ts.s.db.Begin()
+	for i := 1; i < n; i++ {
+		rec := &record{
+			ID:         fmt.Sprintf("%s-f%d", root, i),
+			Path:       fmt.Sprintf("%s/f%d", root, i),
+			ParentPath: root,
+			ETag:       "etag",
+			MTime:      ts.clock.Now().Unix(),
+			Kind:       pb.Kind_FILE,
+		}
+		if err := tx.Create(rec).Error; err != nil {
+			tx.Rollback()
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// observeLoadedRecords returns a function telling the largest number of
+// records loaded by a single query of ts since it was called.
+func observeLoadedRecords(ts *testServer) func() int {
+	var mu sync.Mutex
+	var max int
+	ts.s.db.Callback().Query().After("gorm:query").Register("test:loaded_records", func(scope *gorm.Scope) {
+		recs, ok := scope.Value.(*[]record)
+		if !ok {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if len(*recs) > max {
+			max = len(*recs)
+		}
+	})
+	return func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return max
+	}
+}
+
+// TestMvLargeSubtree checks a subtree larger than a page is rebased as a
+// whole while no query loads more than a page of records.
+func TestMvLargeSubtree(t *testing.T) {
+	ts := newTestServer(t, nil)
+	n := 2*subtreePageSize + subtreePageSize/2
+	putSubtree(t, ts, testHome+"/src", n)
+	ts.clock.Advance(time.Second)
+
+	loaded := observeLoadedRecords(ts)
+	_, err := ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: testHome + "/src", Dst: testHome + "/dst"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the subtree is loaded a full page at a time
+	if max := loaded(); max != subtreePageSize {
+		t.Errorf("a query loaded %d records, want the page of %d", max, subtreePageSize)
+	}
+
+	var left, rebased, children int64
+	ts.s.db.Model(record{}).Scopes(withPathPrefix(testHome + "/src")).Count(&left)
+	ts.s.db.Model(record{}).Scopes(withPathPrefix(testHome + "/dst")).Count(&rebased)
+	ts.s.db.Model(record{}).Where("parent_path = ?", testHome+"/dst").Count(&children)
+	if left != 0 || rebased != int64(n)+1 || children != int64(n) {
+		t.Errorf("got %d records left, %d rebased and %d children of dst, want 0, %d and %d", left, rebased, children, n+1, n)
+	}
+}
+
+func BenchmarkMvSubtree(b *testing.B) {
+	ts := newTestServer(b, nil)
+	putSubtree(b, ts, testHome+"/a", subtreePageSize)
+	paths := []string{testHome + "/a", testHome + "/b"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// the subtree is moved back and forth
+		ts.clock.Advance(time.Second)
+		_, err := ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: paths[i%2], Dst: paths[(i+1)%2]})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// renameFunc renames the record at src and its descendants to dst.
+type renameFunc func(ts *testServer, tx *gorm.DB, src, dst string) ([]*pb.Record, error)
+
+func fastPathRename(ts *testServer, tx *gorm.DB, src, dst string) ([]*pb.Record, error) {
+	rec, err := getRecordByPath(tx, src)
+	if err != nil {
+		return nil, err
+	}
+	return ts.s.renameRecord(context.Background(), tx, rec, dst)
+}
+
+func subtreeRename(ts *testServer, tx *gorm.DB, src, dst string) ([]*pb.Record, error) {
+	_, moved, err := ts.s.rebaseSubtree(context.Background(), tx, src, dst)
+	return moved, err
+}
+
+func rename(t testing.TB, ts *testServer, f renameFunc, src, dst string) []*pb.Record {
+	tx := ts.s.db.Begin()
+	moved, err := f(ts, tx, src, dst)
+	if err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	if err = tx.Commit().Error; err != nil {
+		t.Fatal(err)
+	}
+	return moved
+}
+
+// TestMvFastPath checks the rename of a single file leaves the same state
+// and returns the same records as the rename of a subtree.
+func TestMvFastPath(t *testing.T) {
+	states := [][]string{}
+	moved := [][]*pb.Record{}
+	for _, f := range []renameFunc{fastPathRename, subtreeRename} {
+		ts := newTestServer(t, func(p *newServerParams) {
+			p.clock = newFakeClock(fixedTime)
+			p.idGen = newSequentialIDs("seq")
+		})
+		ts.put(t, testHome+"/a/f.txt")
+		ts.put(t, testHome+"/b/g.txt")
+
+		moved = append(moved, rename(t, ts, f, testHome+"/a/f.txt", testHome+"/b/f.txt"))
+		states = append(states, dbState(t, ts))
+	}
+	if !reflect.DeepEqual(states[0], states[1]) {
+		t.Errorf("the fast path left\n%s\nwant\n%s", strings.Join(states[0], "\n"), strings.Join(states[1], "\n"))
+	}
+	if !reflect.DeepEqual(moved[0], moved[1]) {
+		t.Errorf("the fast path moved %v, want %v", moved[0], moved[1])
+	}
+}
+
+// TestMvFastPathFullMv checks a Mv of a single file, that takes the fast
+// path, moves the record with its etag and mtime and propagates to the
+// ancestors of both ends.
+func TestMvFastPathFullMv(t *testing.T) {
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.clock = newFakeClock(fixedTime)
+		p.idGen = newSequentialIDs("seq")
+	})
+	ts.put(t, testHome+"/a/f.txt")
+	ts.put(t, testHome+"/b/g.txt")
+	ts.clock.Advance(time.Second)
+
+	resp, err := ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: testHome + "/a/f.txt", Dst: testHome + "/b/f.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Records) != 1 || resp.Records[0].Path != testHome+"/b/f.txt" {
+		t.Errorf("got moved records %v, want f.txt at its new path", resp.Records)
+	}
+	rec := ts.record(t, testHome+"/b/f.txt")
+	if rec.ParentPath != testHome+"/b" || rec.ETag != "seq-1" || rec.MTime != fixedTime.Unix() {
+		t.Errorf("got %v, want the record at its new parent with its own etag and mtime", rec)
+	}
+	wantEtag(t, ts, resp.Etag, "/a", "/b", "")
+}
+
+func benchmarkRename(b *testing.B, f renameFunc) {
+	ts := newTestServer(b, nil)
+	ts.put(b, testHome+"/a/f.txt")
+	paths := []string{testHome + "/a/f.txt", testHome + "/a/g.txt"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rename(b, ts, f, paths[i%2], paths[(i+1)%2])
+	}
+}
+
+func BenchmarkRenameFastPath(b *testing.B) { benchmarkRename(b, fastPathRename) }
+func BenchmarkRenameSubtree(b *testing.B)  { benchmarkRename(b, subtreeRename) }
+
+// TestMvSharedCharacters checks the subtree is rebased by its prefix
+// only, the names of the children sharing characters with the source.
+func TestMvSharedCharacters(t *testing.T) {
+	ts := newTestServer(t, nil)
+	src, dst := testHome+"/ab", testHome+"/ba"
+	for _, p := range []string{"/ab/b.txt", "/ab/ba/ab.txt", "/ab/ab"} {
+		ts.put(t, testHome+p)
+	}
+	ts.clock.Advance(time.Second)
+
+	if _, err := ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: src, Dst: dst}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/ba", "/ba/b.txt", "/ba/ba", "/ba/ba/ab.txt", "/ba/ab"} {
+		rec := ts.record(t, testHome+p)
+		if rec.ParentPath != parentPath(rec.Path) {
+			t.Errorf("%s has parent %s", rec.Path, rec.ParentPath)
+		}
+	}
+	var left int64
+	ts.s.db.Model(record{}).Scopes(withPathPrefix(src)).Count(&left)
+	if left != 0 {
+		t.Errorf("%d records left below %s", left, src)
+	}
+}
+
+// TestMvRollsBack checks the renames of a Mv are made in its transaction:
+// when the second one fails, the first is rolled back.
+func TestMvRollsBack(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/f.txt")
+	before := dbState(t, ts)
+	ts.clock.Advance(time.Second)
+
+	failNth(ts.s.db.Callback().Update().Before("gorm:update").Register, 2)
+	_, err := ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: testHome + "/a", Dst: testHome + "/b"})
+	wantCode(t, err, codes.Internal)
+	if after := dbState(t, ts); !reflect.DeepEqual(after, before) {
+		t.Errorf("the failed Mv left\n%s\nwant\n%s", strings.Join(after, "\n"), strings.Join(before, "\n"))
+	}
+}
+
+// TestMvOccupiedDestination checks a Mv onto existing records fails
+// before changing anything unless overwriting.
+func TestMvOccupiedDestination(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/f.txt")
+	ts.put(t, testHome+"/b/g.txt")
+	before := dbState(t, ts)
+	ts.clock.Advance(time.Second)
+
+	req := &pb.MvReq{AccessToken: ts.token, Src: testHome + "/a", Dst: testHome + "/b"}
+	_, err := ts.Mv(context.Background(), req)
+	wantCode(t, err, codes.AlreadyExists)
+	if after := dbState(t, ts); !reflect.DeepEqual(after, before) {
+		t.Errorf("the rejected Mv left\n%s\nwant\n%s", strings.Join(after, "\n"), strings.Join(before, "\n"))
+	}
+
+	// the destination subtree is replaced by the source one
+	id := ts.get(t, testHome+"/a/f.txt").Id
+	req.Overwrite = true
+	if _, err = ts.Mv(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if rec := ts.get(t, testHome+"/b/f.txt"); rec.Id != id {
+		t.Errorf("got %v, want the record %s moved", rec, id)
+	}
+	_, err = ts.Get(context.Background(), &pb.GetReq{AccessToken: ts.token, Path: testHome + "/b/g.txt"})
+	wantCode(t, err, codes.NotFound)
+	if n := ts.count(t); n != 3 {
+		t.Errorf("got %d records, want b, f.txt and the home", n)
+	}
+}
+
+// TestMvOverwriteMissingSrc checks an overwriting Mv of a missing src
+// fails without removing dst.
+func TestMvOverwriteMissingSrc(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/b/g.txt")
+	before := dbState(t, ts)
+	ts.clock.Advance(time.Second)
+
+	_, err := ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: testHome + "/missing", Dst: testHome + "/b", Overwrite: true})
+	wantCode(t, err, codes.NotFound)
+	if after := dbState(t, ts); !reflect.DeepEqual(after, before) {
+		t.Errorf("the failed Mv left\n%s\nwant\n%s", strings.Join(after, "\n"), strings.Join(before, "\n"))
+	}
+}
+
+// TestMvOverwriteTrash checks the records of dst an overwriting Mv
+// replaces are left in the trash, like Copy does, but for the ones at the
+// paths of the moved records, and that watchers learn about the removal.
+func TestMvOverwriteTrash(t *testing.T) {
+	ts := newTrashServer(t)
+	ts.put(t, testHome+"/a/f.txt")
+	ts.put(t, testHome+"/b/f.txt")
+	ts.put(t, testHome+"/b/g.txt")
+	id := ts.get(t, testHome+"/a/f.txt").Id
+	stream, _ := watch(t, ts, context.Background(), testHome+"/b")
+	ts.clock.Advance(time.Second)
+
+	_, err := ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: testHome + "/a", Dst: testHome + "/b", Overwrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := ts.get(t, testHome+"/b/f.txt"); rec.Id != id {
+		t.Errorf("got %v, want the record %s moved", rec, id)
+	}
+	if rec := ts.record(t, testHome+"/b/g.txt"); rec.DeletedAt == nil || rec.MTime != ts.clock.Now().Unix() {
+		t.Errorf("got %v, want g.txt in the trash at the time of the Mv", rec)
+	}
+	if ev := nextEvent(t, stream); ev.Path != testHome+"/b" || !ev.Deleted {
+		t.Errorf("got event %v, want the removal of b", ev)
+	}
+}
+
+// TestMvResponse checks a Mv returns the rebased records as they are
+// stored, with the etag and mtime it propagated.
+func TestMvResponse(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, p := range []string{"/a/b/c.txt", "/a/d.txt", "/e.txt"} {
+		ts.put(t, testHome+p)
+	}
+	ts.clock.Advance(time.Second)
+
+	resp, err := ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: testHome + "/a", Dst: testHome + "/f"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored []record
+	ts.s.db.Scopes(withPathPrefix(testHome + "/f")).Order("path").Find(&stored)
+	if len(resp.Records) != len(stored) {
+		t.Fatalf("got %d moved records, want the %d below f", len(resp.Records), len(stored))
+	}
+	moved := map[string]*pb.Record{}
+	for _, rec := range resp.Records {
+		moved[rec.Path] = rec
+	}
+	for i := range stored {
+		if want := stored[i].toProto(); !reflect.DeepEqual(moved[want.Path], want) {
+			t.Errorf("got the moved record %v, want %v", moved[want.Path], want)
+		}
+	}
+	if home := ts.get(t, testHome); resp.Etag != home.Etag || resp.Modified != ts.clock.Now().Unix() {
+		t.Errorf("got the etag %s and mtime %d, want the ones propagated %s and %d", resp.Etag, resp.Modified, home.Etag, ts.clock.Now().Unix())
+	}
+}
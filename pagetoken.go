@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/base64"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// defaultListPageSize is the size of the pages of a List that sends
+	// a page token without a page size.
+	defaultListPageSize = 1000
+
+	// maxListPageSize bounds the records returned by a single List.
+	maxListPageSize = 10000
+)
+
+// encodePageToken returns the token of the page starting after the
+// record at path p. The pages are built on the path ordering so the
+// records inserted between two calls never make a page skip or repeat
+// records, they are only returned if they sort after the token.
+func encodePageToken(p string) string {
+	return base64.URLEncoding.EncodeToString([]byte(p))
+}
+
+// decodePageToken returns the path the page starts after. The path must
+// be below p, the path being listed.
+func decodePageToken(token, p string) (string, error) {
+	b, err := base64.URLEncoding.DecodeString(token)
+	if err != nil || string(b) == p || !isUnder(string(b), p) {
+		return "", grpc.Errorf(codes.InvalidArgument, "page token %s is not valid for %s", token, p)
+	}
+	return string(b), nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// TestConnectionPool checks the pool of the database handle has the
+// configured limits.
+func TestConnectionPool(t *testing.T) {
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.dsn = "file:" + filepath.Join(t.TempDir(), "prop.db")
+		p.maxSqlConcurrency = 3
+		p.maxSqlIdle = 2
+		p.sqlConnMaxLifetime = time.Millisecond
+	})
+	db := ts.s.db.DB()
+	if n := db.Stats().MaxOpenConnections; n != 3 {
+		t.Errorf("got %d open connections at most, want 3", n)
+	}
+
+	ctx := context.Background()
+	conns := []*sql.Conn{}
+	for i := 0; i < 3; i++ {
+		c, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+	if n := db.Stats().Idle; n != 2 {
+		t.Errorf("got %d idle connections, want 2", n)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	ts.put(t, testHome+"/a.txt")
+	if n := db.Stats().MaxLifetimeClosed; n == 0 {
+		t.Error("no connection was closed past its lifetime")
+	}
+}
+
+func TestConnectionPoolIdleLimit(t *testing.T) {
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.maxSqlConcurrency = 2
+		p.maxSqlIdle = 5
+	})
+	if ts.s.p.maxSqlIdle != 2 {
+		t.Errorf("got %d idle connections at most, want the 2 open ones", ts.s.p.maxSqlIdle)
+	}
+}
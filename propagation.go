@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"path"
+)
+
+// propagator chooses the ancestors the changes of a record are
+// propagated to.
+type propagator interface {
+	// ancestors returns the ancestors of p to update, deeper paths first
+	// so the propagation can be short circuited.
+	ancestors(p string) []string
+}
+
+// newPropagator returns the propagator with the given name.
+// An empty name propagates till the home directory.
+func newPropagator(name string, homeDepth int, boundaries []string) (propagator, error) {
+	switch name {
+	case "", "home":
+		return &homePropagator{homeDepth}, nil
+	case "boundary":
+		b := &boundaryPropagator{homeDepth: homeDepth, boundaries: map[string]bool{}}
+		for _, p := range boundaries {
+			if p != "" {
+				b.boundaries[path.Clean(p)] = true
+			}
+		}
+		return b, nil
+	case "none":
+		return nopPropagator{}, nil
+	default:
+		return nil, fmt.Errorf("propagator %s is not supported", name)
+	}
+}
+
+// propagatesTo reports if pr propagates the changes of p to ancestor.
+func propagatesTo(pr propagator, p, ancestor string) bool {
+	for _, a := range pr.ancestors(p) {
+		if a == ancestor {
+			return true
+		}
+	}
+	return false
+}
+
+// homePropagator propagates to all the ancestors till the home directory.
+type homePropagator struct {
+	homeDepth int
+}
+
+func (h *homePropagator) ancestors(p string) []string {
+	return getPathsTillHome(p, h.homeDepth)
+}
+
+// boundaryPropagator propagates like homePropagator but stops at the
+// first boundary, like a quota or shared folder root, that is updated
+// while its ancestors are not.
+type boundaryPropagator struct {
+	homeDepth  int
+	boundaries map[string]bool
+}
+
+func (b *boundaryPropagator) ancestors(p string) []string {
+	paths := getPathsTillHome(p, b.homeDepth)
+	for i, a := range paths {
+		if b.boundaries[a] {
+			return paths[:i+1]
+		}
+	}
+	return paths
+}
+
+// nopPropagator does not propagate at all.
+type nopPropagator struct{}
+
+func (nopPropagator) ancestors(p string) []string { return []string{} }
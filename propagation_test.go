@@ -0,0 +1,454 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+// observePropagated returns a function telling the paths, in order, the
+// propagation of ts updated one at a time since it was called.
+func observePropagated(ts *testServer) func() []string {
+	var mu sync.Mutex
+	var paths []string
+	ts.s.db.Callback().Update().After("gorm:update").Register("test:propagated", func(scope *gorm.Scope) {
+		if !strings.Contains(scope.Sql, `"e_tag" = ?`) || !strings.Contains(scope.Sql, "path=? AND") {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, v := range scope.SqlVars {
+			if p, ok := v.(string); ok && strings.HasPrefix(p, "/") {
+				paths = append(paths, p)
+			}
+		}
+	})
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, paths...)
+	}
+}
+
+func TestPathsTillStop(t *testing.T) {
+	paths := []string{"/h/a/b", "/h/a", "/h"}
+	tests := []struct {
+		stop string
+		want []string
+	}{
+		{"", paths},
+		{"/h/a", []string{"/h/a/b", "/h/a"}},
+		{"/h/a/b", []string{"/h/a/b"}},
+		{"/elsewhere", paths},
+	}
+	for _, tt := range tests {
+		if got := pathsTillStop(paths, tt.stop); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("stop %q: got %v, want %v", tt.stop, got, tt.want)
+		}
+	}
+}
+
+func TestPathsTillHomeDepth(t *testing.T) {
+	tests := []struct {
+		p         string
+		homeDepth int
+		want      []string
+	}{
+		{"/users/demo/a/b.txt", 3, []string{"/users/demo/a", "/users/demo"}},
+		{"/users/demo/a/b.txt", 4, []string{"/users/demo/a"}},
+		{"/demo/a/b.txt", 2, []string{"/demo/a", "/demo"}},
+		{"/users/demo", 3, []string{}},
+		// paths shorter than the home never propagate
+		{"/users", 3, []string{}},
+		{"/users/demo/a", 6, []string{}},
+	}
+	for _, tt := range tests {
+		if got := getPathsTillHome(tt.p, tt.homeDepth); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("getPathsTillHome(%s, %d) = %v, want %v", tt.p, tt.homeDepth, got, tt.want)
+		}
+	}
+}
+
+// TestPathsTillHomeShort checks the paths of one and three segments,
+// above the default home, have no ancestors to propagate to and fail the
+// handlers instead of panicking them. A path of five has the home.
+func TestPathsTillHomeShort(t *testing.T) {
+	tests := []struct {
+		p    string
+		want []string
+	}{
+		{"/local", []string{}},
+		{"/local/users/d", []string{}},
+		{"/local/users/d/demo/a", []string{testHome}},
+	}
+	for _, tt := range tests {
+		if got := getPathsTillHome(tt.p, defaultHomeDepth); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("getPathsTillHome(%s) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+
+	ts := newTestServer(t, nil)
+	for _, p := range []string{"/local", "/local/users/d"} {
+		_, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: p})
+		wantCode(t, err, codes.PermissionDenied)
+		_, err = ts.Get(context.Background(), &pb.GetReq{AccessToken: ts.token, Path: p, ForceCreation: true})
+		wantCode(t, err, codes.PermissionDenied)
+	}
+	ts.put(t, testHome+"/a")
+}
+
+// TestCustomHomeDepth checks a server with homes at /users/<pid>
+// authorizes and propagates by the configured depth.
+func TestCustomHomeDepth(t *testing.T) {
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.homeDepth = 3
+	})
+	ts.put(t, "/users/demo/a/f.txt")
+	rec := ts.get(t, "/users/demo/a/f.txt")
+	if home := ts.get(t, "/users/demo"); home.Etag != rec.Etag {
+		t.Errorf("home has etag %s, want the etag %s of the put", home.Etag, rec.Etag)
+	}
+
+	for _, p := range []string{"/users/other/f.txt", "/users", testHome + "/f.txt"} {
+		_, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: p})
+		wantCode(t, err, codes.PermissionDenied)
+	}
+}
+
+func TestCommonAncestor(t *testing.T) {
+	tests := []struct{ a, b, want string }{
+		{"/a/b/c", "/a/b/d/e", "/a/b"},
+		{"/a/b", "/a/bc", "/a"},
+		{"/a", "/b", "/"},
+		{"/a/b/", "/a/b/c", "/a/b"},
+	}
+	for _, tt := range tests {
+		if got := commonAncestor(tt.a, tt.b); got != tt.want {
+			t.Errorf("commonAncestor(%s, %s) = %s, want %s", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestPropagateStopPath(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/b/c.txt")
+	home := ts.get(t, testHome)
+	ts.clock.Advance(time.Second)
+
+	mtime := ts.clock.Now().Unix()
+	err := ts.s.propagateChanges(context.Background(), ts.s.db, testHome+"/a/b/c.txt", "stop-etag", mtime, testHome+"/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{testHome + "/a/b", testHome + "/a"} {
+		if rec := ts.get(t, p); rec.Etag != "stop-etag" || rec.Modified != mtime {
+			t.Errorf("%s was not updated: %v", p, rec)
+		}
+	}
+	if rec := ts.get(t, testHome); rec.Etag != home.Etag || rec.Modified != home.Modified {
+		t.Errorf("%s above the stop path was updated: %v", testHome, rec)
+	}
+}
+
+// TestMvSharedAncestors checks the ancestors shared by the source and
+// the destination of a move are propagated to once. The homes are
+// serialized so an ancestor with the same mtime would be updated again.
+func TestMvSharedAncestors(t *testing.T) {
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.serializeHomes = true
+	})
+	ts.put(t, testHome+"/a/x/f.txt")
+	ts.put(t, testHome+"/a/y/g.txt")
+	ts.clock.Advance(time.Second)
+
+	propagated := observePropagated(ts)
+	resp, err := ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: testHome + "/a/x/f.txt", Dst: testHome + "/a/y/f.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantEtag(t, ts, resp.Etag, "/a/x", "/a/y", "/a", "")
+	if got, want := propagated(), []string{testHome + "/a/x", testHome + "/a/y", testHome + "/a", testHome}; !reflect.DeepEqual(got, want) {
+		t.Errorf("propagated to %v, want every ancestor once %v", got, want)
+	}
+}
+
+// TestPropagateManyShared checks the ancestors shared by many leaves are
+// updated once, the deeper ones first.
+func TestPropagateManyShared(t *testing.T) {
+	ts := newTestServer(t, nil)
+	leaves := []string{testHome + "/a/b/c.txt", testHome + "/a/b/d.txt", testHome + "/a/e/f.txt", testHome + "/g.txt"}
+	for _, p := range leaves {
+		ts.put(t, p)
+	}
+	ts.clock.Advance(time.Second)
+
+	propagated := observePropagated(ts)
+	if err := ts.s.propagateMany(context.Background(), ts.s.db, leaves, "etag", ts.clock.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+	got := propagated()
+	if want := []string{testHome + "/a/b", testHome + "/a/e", testHome + "/a", testHome}; !reflect.DeepEqual(got, want) {
+		t.Errorf("propagated to %v, want every ancestor once %v", got, want)
+	}
+	wantEtag(t, ts, "etag", "/a/b", "/a/e", "/a", "")
+}
+
+// deepPath returns a path depth folders below the home.
+func deepPath(depth int) string {
+	p := testHome
+	for i := 0; i < depth; i++ {
+		p += fmt.Sprintf("/d%d", i)
+	}
+	return p
+}
+
+// TestBulkPropagation checks the single statement propagation leaves the
+// same state as the one updating an ancestor at a time.
+func TestBulkPropagation(t *testing.T) {
+	states := [][]string{}
+	for _, bulk := range []bool{false, true} {
+		ts := newTestServer(t, func(p *newServerParams) {
+			p.clock = newFakeClock(fixedTime)
+			p.idGen = newSequentialIDs("seq")
+			p.bulkPropagation = bulk
+		})
+		ts.put(t, deepPath(5)+"/a.txt")
+		ts.clock.Advance(time.Second)
+		ts.put(t, deepPath(3)+"/b.txt")
+
+		// a stale change stops at the first ancestor already current
+		stale := ts.clock.Now().Add(-time.Second).Unix()
+		err := ts.s.propagateChanges(context.Background(), ts.s.db, deepPath(5)+"/a.txt", "stale", stale, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ts.clock.Advance(time.Second)
+		_, err = ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: deepPath(5) + "/a.txt", Dst: deepPath(1) + "/a.txt"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts.clock.Advance(time.Second)
+		if _, err = ts.Rm(context.Background(), &pb.RmReq{AccessToken: ts.token, Path: deepPath(4)}); err != nil {
+			t.Fatal(err)
+		}
+		states = append(states, dbState(t, ts))
+	}
+	if !reflect.DeepEqual(states[0], states[1]) {
+		t.Errorf("the bulk propagation left\n%s\nwant\n%s", strings.Join(states[1], "\n"), strings.Join(states[0], "\n"))
+	}
+}
+
+func benchmarkPropagation(b *testing.B, bulk bool) {
+	ts := newTestServer(b, func(p *newServerParams) {
+		p.bulkPropagation = bulk
+	})
+	leaf := deepPath(20) + "/a.txt"
+	ts.put(b, leaf)
+	mtime := ts.clock.Now().Unix()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// every propagation is newer so all the ancestors are updated
+		mtime++
+		err := ts.s.propagateChanges(context.Background(), ts.s.db, leaf, fmt.Sprintf("etag-%d", i), mtime, "")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPropagationPerRow(b *testing.B) { benchmarkPropagation(b, false) }
+func BenchmarkPropagationBulk(b *testing.B)   { benchmarkPropagation(b, true) }
+
+// failHomePropagation makes the propagation of ts fail once it updated
+// the home, after the ancestors below it.
+func failHomePropagation(ts *testServer) {
+	ts.s.db.Callback().Update().After("gorm:update").Register("test:fail_home", func(scope *gorm.Scope) {
+		if !strings.Contains(scope.Sql, `"e_tag" = ?`) {
+			return
+		}
+		for _, v := range scope.SqlVars {
+			if v == testHome {
+				scope.Err(errInjected)
+			}
+		}
+	})
+}
+
+// TestPropagationRollsBack checks the mutations and their propagation
+// are applied in the same transaction, a failed propagation leaving the
+// records as they were.
+func TestPropagationRollsBack(t *testing.T) {
+	for name, mutate := range map[string]func(ts *testServer) error{
+		"put": func(ts *testServer) error {
+			_, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: testHome + "/a/b/g.txt"})
+			return err
+		},
+		"mv": func(ts *testServer) error {
+			_, err := ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: testHome + "/a/f.txt", Dst: testHome + "/a/b/f.txt"})
+			return err
+		},
+		"rm": func(ts *testServer) error {
+			_, err := ts.Rm(context.Background(), &pb.RmReq{AccessToken: ts.token, Path: testHome + "/a/f.txt"})
+			return err
+		},
+	} {
+		ts := newTestServer(t, nil)
+		ts.put(t, testHome+"/a/f.txt")
+		ts.put(t, testHome+"/a/b/c.txt")
+		before := dbState(t, ts)
+		ts.clock.Advance(time.Second)
+
+		failHomePropagation(ts)
+		if err := mutate(ts); err == nil {
+			t.Errorf("%s: the propagation did not fail", name)
+		}
+		if after := dbState(t, ts); !reflect.DeepEqual(after, before) {
+			t.Errorf("%s: the failed propagation left\n%s\nwant\n%s", name, strings.Join(after, "\n"), strings.Join(before, "\n"))
+		}
+	}
+}
+
+// TestPropagationStopsAtCurrent checks the propagation does not update,
+// nor try to, the ancestors above one already changed by a newer write.
+func TestPropagationStopsAtCurrent(t *testing.T) {
+	for _, bulk := range []bool{false, true} {
+		ts := newTestServer(t, func(p *newServerParams) {
+			p.bulkPropagation = bulk
+		})
+		leaf := deepPath(3) + "/a.txt"
+		ts.put(t, leaf)
+		ts.clock.Advance(time.Second)
+
+		// a concurrent write already changed d1 later
+		newer := ts.clock.Now().Add(time.Second).Unix()
+		if err := ts.s.db.Model(record{}).Where("path = ?", deepPath(2)).UpdateColumns(map[string]interface{}{"e_tag": "newer", "m_time": newer}).Error; err != nil {
+			t.Fatal(err)
+		}
+		before := ts.get(t, testHome).Etag
+
+		propagated := observePropagated(ts)
+		err := ts.s.propagateChanges(context.Background(), ts.s.db, leaf, "etag", ts.clock.Now().Unix(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bulk {
+			if got, want := propagated(), []string{deepPath(3), deepPath(2)}; !reflect.DeepEqual(got, want) {
+				t.Errorf("updated %v, want the propagation stopped at %s", got, deepPath(2))
+			}
+		}
+		if rec := ts.get(t, deepPath(3)); rec.Etag != "etag" {
+			t.Errorf("bulk %t: %s has etag %s, want it propagated", bulk, deepPath(3), rec.Etag)
+		}
+		if rec := ts.get(t, deepPath(2)); rec.Etag != "newer" {
+			t.Errorf("bulk %t: %s has etag %s, want the newer one kept", bulk, deepPath(2), rec.Etag)
+		}
+		for _, p := range []string{deepPath(1), testHome} {
+			if rec := ts.get(t, p); rec.Etag != before {
+				t.Errorf("bulk %t: %s has etag %s, want it left as %s", bulk, p, rec.Etag, before)
+			}
+		}
+	}
+}
+
+// TestPropagationErrorReported checks a failed propagation fails the Put
+// with Internal, and the retry of the caller then applies it.
+func TestPropagationErrorReported(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/f.txt")
+	ts.clock.Advance(time.Second)
+
+	var failing int64 = 1
+	ts.s.db.Callback().Update().After("gorm:update").Register("test:fail_propagation", func(scope *gorm.Scope) {
+		if atomic.LoadInt64(&failing) == 1 && strings.Contains(scope.Sql, `"e_tag" = ?`) {
+			scope.Err(errInjected)
+		}
+	})
+	req := &pb.PutReq{AccessToken: ts.token, Path: testHome + "/a/f.txt"}
+	_, err := ts.Put(context.Background(), req)
+	wantCode(t, err, codes.Internal)
+
+	atomic.StoreInt64(&failing, 0)
+	if _, err = ts.Put(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	etag := ts.get(t, testHome+"/a/f.txt").Etag
+	wantEtag(t, ts, etag, "/a", "")
+}
+
+// skipPropagator propagates like homePropagator but leaves out the
+// ancestors of the paths below skipped.
+type skipPropagator struct {
+	skipped string
+}
+
+func (s skipPropagator) ancestors(p string) []string {
+	if isUnder(p, s.skipped) {
+		return []string{}
+	}
+	return getPathsTillHome(p, defaultHomeDepth)
+}
+
+// TestCustomPropagator checks Put, Mv and Rm update the ancestors the
+// propagator chooses only.
+func TestCustomPropagator(t *testing.T) {
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.propagator = skipPropagator{testHome + "/tmp"}
+	})
+	ts.put(t, testHome+"/a/f.txt")
+	ts.put(t, testHome+"/tmp/g.txt")
+	etag := ts.get(t, testHome+"/a/f.txt").Etag
+	ts.clock.Advance(time.Second)
+
+	propagated := observePropagated(ts)
+	ts.put(t, testHome+"/tmp/h.txt")
+	_, err := ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: testHome + "/tmp/g.txt", Dst: testHome + "/tmp/i.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.rm(t, &pb.RmReq{Path: testHome + "/tmp/h.txt"})
+	if got := propagated(); len(got) != 0 {
+		t.Errorf("propagated to %v, want the changes below tmp kept there", got)
+	}
+	wantEtag(t, ts, etag, "")
+
+	ts.put(t, testHome+"/a/g.txt")
+	if got, want := propagated(), []string{testHome + "/a", testHome}; !reflect.DeepEqual(got, want) {
+		t.Errorf("propagated to %v, want %v", got, want)
+	}
+}
+
+// TestBoundaryPropagator checks the propagation stops after updating the
+// first boundary.
+func TestBoundaryPropagator(t *testing.T) {
+	pr, err := newPropagator("boundary", defaultHomeDepth, []string{testHome + "/shared/", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.propagator = pr
+	})
+	ts.put(t, testHome+"/shared/a/f.txt")
+	home := ts.get(t, testHome).Etag
+	ts.clock.Advance(time.Second)
+
+	ts.put(t, testHome+"/shared/a/g.txt")
+	wantEtag(t, ts, ts.get(t, testHome+"/shared/a/g.txt").Etag, "/shared/a", "/shared")
+	wantEtag(t, ts, home, "")
+
+	if _, err = newPropagator("other", defaultHomeDepth, nil); err == nil {
+		t.Error("an unknown propagator is accepted")
+	}
+}
@@ -6,15 +6,60 @@
 Package propagator is a generated protocol buffer package.
 
 It is generated from these files:
+
 	propagator.proto
 
 It has these top-level messages:
+
 	Void
 	PutReq
 	GetReq
 	RmReq
 	MvReq
 	Record
+	ListReq
+	ListResp
+	StatReq
+	CopyReq
+	BatchPutEntry
+	BatchPutReq
+	BatchGetReq
+	BatchGetResp
+	ExistsReq
+	ExistsResp
+	GetByIdReq
+	ChangesReq
+	ChangesResp
+	WatchReq
+	TouchReq
+	RmResp
+	RestoreReq
+	RestoreResp
+	PurgeReq
+	PurgeResp
+	CountReq
+	CountResp
+	MvResp
+	ReconcileReq
+	ReconcileResp
+	GetTreeReq
+	TreeNode
+	RmManyReq
+	VersionResp
+	RmByIdReq
+	ChecksumReq
+	ChecksumResp
+	RecomputeEtagReq
+	ImportReq
+	ImportError
+	ImportResp
+	AncestorsResp
+	AuditReq
+	AuditResp
+	HasChildrenReq
+	HasChildrenResp
+	CheckpointReq
+	CheckpointResp
 */
 package propagator
 
@@ -22,6 +67,8 @@ import proto "github.com/golang/protobuf/proto"
 import fmt "fmt"
 import math "math"
 
+// discarding unused import google_api1 "github.com/grpc-ecosystem/grpc-gateway/third_party/googleapis/google/api"
+
 import (
 	context "golang.org/x/net/context"
 	grpc "google.golang.org/grpc"
@@ -32,6 +79,31 @@ var _ = proto.Marshal
 var _ = fmt.Errorf
 var _ = math.Inf
 
+// Kind tells the folders from the files. UNKNOWN is the kind of the
+// requests that do not set it.
+type Kind int32
+
+const (
+	Kind_UNKNOWN Kind = 0
+	Kind_FILE    Kind = 1
+	Kind_FOLDER  Kind = 2
+)
+
+var Kind_name = map[int32]string{
+	0: "UNKNOWN",
+	1: "FILE",
+	2: "FOLDER",
+}
+var Kind_value = map[string]int32{
+	"UNKNOWN": 0,
+	"FILE":    1,
+	"FOLDER":  2,
+}
+
+func (x Kind) String() string {
+	return proto.EnumName(Kind_name, int32(x))
+}
+
 type Void struct {
 }
 
@@ -39,10 +111,23 @@ func (m *Void) Reset()         { *m = Void{} }
 func (m *Void) String() string { return proto.CompactTextString(m) }
 func (*Void) ProtoMessage()    {}
 
+// PutReq creates or updates the record at path.
+// A retried Put with the same idempotency_key is not applied again.
+// The etag and mtime are generated unless they are set, like when
+// restoring or syncing records from another server.
+// If if_match_etag is set the record is only updated if it still has that
+// etag, otherwise an Aborted error with the current etag is returned.
+// Without kind an existing record keeps its kind and a new one is a file.
 type PutReq struct {
-	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
-	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
-	Checksum    string `protobuf:"bytes,3,opt,name=checksum" json:"checksum,omitempty"`
+	AccessToken    string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path           string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+	Checksum       string `protobuf:"bytes,3,opt,name=checksum" json:"checksum,omitempty"`
+	Size           int64  `protobuf:"varint,4,opt,name=size" json:"size,omitempty"`
+	IdempotencyKey string `protobuf:"bytes,5,opt,name=idempotency_key" json:"idempotency_key,omitempty"`
+	Etag           string `protobuf:"bytes,6,opt,name=etag" json:"etag,omitempty"`
+	Mtime          int64  `protobuf:"varint,7,opt,name=mtime" json:"mtime,omitempty"`
+	IfMatchEtag    string `protobuf:"bytes,8,opt,name=if_match_etag" json:"if_match_etag,omitempty"`
+	Kind           Kind   `protobuf:"varint,9,opt,name=kind,enum=propagator.Kind" json:"kind,omitempty"`
 }
 
 func (m *PutReq) Reset()         { *m = PutReq{} }
@@ -59,37 +144,641 @@ func (m *GetReq) Reset()         { *m = GetReq{} }
 func (m *GetReq) String() string { return proto.CompactTextString(m) }
 func (*GetReq) ProtoMessage()    {}
 
+// RmReq removes the record at path and its descendants.
+// If strict is set a NotFound error is returned when nothing is removed.
+// If older_than is set only the records modified before it are removed.
+// If dry_run is set nothing is removed and the paths that would be
+// removed are returned.
+// The etag and mtime propagated are generated unless they are set, like
+// when replicating the changes of another server.
 type RmReq struct {
 	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
 	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+	Strict      bool   `protobuf:"varint,3,opt,name=strict" json:"strict,omitempty"`
+	OlderThan   int64  `protobuf:"varint,4,opt,name=older_than" json:"older_than,omitempty"`
+	DryRun      bool   `protobuf:"varint,5,opt,name=dry_run" json:"dry_run,omitempty"`
+	Etag        string `protobuf:"bytes,6,opt,name=etag" json:"etag,omitempty"`
+	Mtime       int64  `protobuf:"varint,7,opt,name=mtime" json:"mtime,omitempty"`
 }
 
 func (m *RmReq) Reset()         { *m = RmReq{} }
 func (m *RmReq) String() string { return proto.CompactTextString(m) }
 func (*RmReq) ProtoMessage()    {}
 
+// MvReq moves the record at src and its descendants to dst.
+// If dry_run is set nothing is moved and the paths that would be
+// moved are returned.
+// MvReq fails when dst already exists unless overwrite is set, then the
+// records at dst and below are removed first.
+// The etag and mtime propagated are generated unless they are set, the
+// moved records keep their own.
 type MvReq struct {
 	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
 	Src         string `protobuf:"bytes,2,opt,name=src" json:"src,omitempty"`
 	Dst         string `protobuf:"bytes,3,opt,name=dst" json:"dst,omitempty"`
+	DryRun      bool   `protobuf:"varint,4,opt,name=dry_run" json:"dry_run,omitempty"`
+	Overwrite   bool   `protobuf:"varint,5,opt,name=overwrite" json:"overwrite,omitempty"`
+	Etag        string `protobuf:"bytes,6,opt,name=etag" json:"etag,omitempty"`
+	Mtime       int64  `protobuf:"varint,7,opt,name=mtime" json:"mtime,omitempty"`
 }
 
 func (m *MvReq) Reset()         { *m = MvReq{} }
 func (m *MvReq) String() string { return proto.CompactTextString(m) }
 func (*MvReq) ProtoMessage()    {}
 
+// A Record without a known checksum, like the folders created by Get
+// with force_creation, has an empty checksum and has_checksum unset.
+// A deleted Record is a tombstone of a record in the trash, modified
+// holds the mtime of its removal.
 type Record struct {
-	Id       string `protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
-	Path     string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
-	Checksum string `protobuf:"bytes,3,opt,name=checksum" json:"checksum,omitempty"`
-	Modified uint32 `protobuf:"varint,4,opt,name=modified" json:"modified,omitempty"`
-	Etag     string `protobuf:"bytes,5,opt,name=etag" json:"etag,omitempty"`
+	Id          string `protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
+	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+	Checksum    string `protobuf:"bytes,3,opt,name=checksum" json:"checksum,omitempty"`
+	Modified    int64  `protobuf:"varint,4,opt,name=modified" json:"modified,omitempty"`
+	Etag        string `protobuf:"bytes,5,opt,name=etag" json:"etag,omitempty"`
+	Size        int64  `protobuf:"varint,6,opt,name=size" json:"size,omitempty"`
+	HasChecksum bool   `protobuf:"varint,7,opt,name=has_checksum" json:"has_checksum,omitempty"`
+	Kind        Kind   `protobuf:"varint,8,opt,name=kind,enum=propagator.Kind" json:"kind,omitempty"`
+	Deleted     bool   `protobuf:"varint,9,opt,name=deleted" json:"deleted,omitempty"`
 }
 
 func (m *Record) Reset()         { *m = Record{} }
 func (m *Record) String() string { return proto.CompactTextString(m) }
 func (*Record) ProtoMessage()    {}
 
+// ListReq returns the records ordered by path. With page_size set at
+// most page_size records are returned, and the next page is requested
+// with the next_page_token of the response as page_token.
+// With kind set only the records of that kind are returned.
+type ListReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+	Recursive   bool   `protobuf:"varint,3,opt,name=recursive" json:"recursive,omitempty"`
+	PageToken   string `protobuf:"bytes,4,opt,name=page_token" json:"page_token,omitempty"`
+	PageSize    int64  `protobuf:"varint,5,opt,name=page_size" json:"page_size,omitempty"`
+	Kind        Kind   `protobuf:"varint,6,opt,name=kind,enum=propagator.Kind" json:"kind,omitempty"`
+}
+
+func (m *ListReq) Reset()         { *m = ListReq{} }
+func (m *ListReq) String() string { return proto.CompactTextString(m) }
+func (*ListReq) ProtoMessage()    {}
+
+// ListResp contains a page of records, next_page_token is empty on the
+// last page.
+type ListResp struct {
+	Records       []*Record `protobuf:"bytes,1,rep,name=records" json:"records,omitempty"`
+	NextPageToken string    `protobuf:"bytes,2,opt,name=next_page_token" json:"next_page_token,omitempty"`
+}
+
+func (m *ListResp) Reset()         { *m = ListResp{} }
+func (m *ListResp) String() string { return proto.CompactTextString(m) }
+func (*ListResp) ProtoMessage()    {}
+
+func (m *ListResp) GetRecords() []*Record {
+	if m != nil {
+		return m.Records
+	}
+	return nil
+}
+
+type StatReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+}
+
+func (m *StatReq) Reset()         { *m = StatReq{} }
+func (m *StatReq) String() string { return proto.CompactTextString(m) }
+func (*StatReq) ProtoMessage()    {}
+
+// CopyReq copies the src subtree under dst.
+// If dst already exists the copy fails unless overwrite is set,
+// in which case the dst subtree is removed first, like Rm does.
+type CopyReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Src         string `protobuf:"bytes,2,opt,name=src" json:"src,omitempty"`
+	Dst         string `protobuf:"bytes,3,opt,name=dst" json:"dst,omitempty"`
+	Overwrite   bool   `protobuf:"varint,4,opt,name=overwrite" json:"overwrite,omitempty"`
+}
+
+func (m *CopyReq) Reset()         { *m = CopyReq{} }
+func (m *CopyReq) String() string { return proto.CompactTextString(m) }
+func (*CopyReq) ProtoMessage()    {}
+
+type BatchPutEntry struct {
+	Path     string `protobuf:"bytes,1,opt,name=path" json:"path,omitempty"`
+	Checksum string `protobuf:"bytes,2,opt,name=checksum" json:"checksum,omitempty"`
+	Size     int64  `protobuf:"varint,3,opt,name=size" json:"size,omitempty"`
+	Kind     Kind   `protobuf:"varint,4,opt,name=kind,enum=propagator.Kind" json:"kind,omitempty"`
+}
+
+func (m *BatchPutEntry) Reset()         { *m = BatchPutEntry{} }
+func (m *BatchPutEntry) String() string { return proto.CompactTextString(m) }
+func (*BatchPutEntry) ProtoMessage()    {}
+
+// BatchPutReq inserts all the entries atomically
+// with the same etag and mtime.
+type BatchPutReq struct {
+	AccessToken string           `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Entries     []*BatchPutEntry `protobuf:"bytes,2,rep,name=entries" json:"entries,omitempty"`
+}
+
+func (m *BatchPutReq) Reset()         { *m = BatchPutReq{} }
+func (m *BatchPutReq) String() string { return proto.CompactTextString(m) }
+func (*BatchPutReq) ProtoMessage()    {}
+
+func (m *BatchPutReq) GetEntries() []*BatchPutEntry {
+	if m != nil {
+		return m.Entries
+	}
+	return nil
+}
+
+type BatchGetReq struct {
+	AccessToken string   `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Paths       []string `protobuf:"bytes,2,rep,name=paths" json:"paths,omitempty"`
+}
+
+func (m *BatchGetReq) Reset()         { *m = BatchGetReq{} }
+func (m *BatchGetReq) String() string { return proto.CompactTextString(m) }
+func (*BatchGetReq) ProtoMessage()    {}
+
+// BatchGetResp contains the records found in the order they were
+// requested and the paths that were not found.
+type BatchGetResp struct {
+	Records  []*Record `protobuf:"bytes,1,rep,name=records" json:"records,omitempty"`
+	NotFound []string  `protobuf:"bytes,2,rep,name=not_found" json:"not_found,omitempty"`
+}
+
+func (m *BatchGetResp) Reset()         { *m = BatchGetResp{} }
+func (m *BatchGetResp) String() string { return proto.CompactTextString(m) }
+func (*BatchGetResp) ProtoMessage()    {}
+
+func (m *BatchGetResp) GetRecords() []*Record {
+	if m != nil {
+		return m.Records
+	}
+	return nil
+}
+
+type ExistsReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+}
+
+func (m *ExistsReq) Reset()         { *m = ExistsReq{} }
+func (m *ExistsReq) String() string { return proto.CompactTextString(m) }
+func (*ExistsReq) ProtoMessage()    {}
+
+type ExistsResp struct {
+	Exists bool `protobuf:"varint,1,opt,name=exists" json:"exists,omitempty"`
+}
+
+func (m *ExistsResp) Reset()         { *m = ExistsResp{} }
+func (m *ExistsResp) String() string { return proto.CompactTextString(m) }
+func (*ExistsResp) ProtoMessage()    {}
+
+type GetByIdReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Id          string `protobuf:"bytes,2,opt,name=id" json:"id,omitempty"`
+}
+
+func (m *GetByIdReq) Reset()         { *m = GetByIdReq{} }
+func (m *GetByIdReq) String() string { return proto.CompactTextString(m) }
+func (*GetByIdReq) ProtoMessage()    {}
+
+// ChangesReq asks for the records under path modified after since.
+// To get the next page send the continuation_token of the previous
+// response, which is empty when there are no more changes. With the
+// trash enabled the records removed after since are returned too, as
+// deleted records.
+type ChangesReq struct {
+	AccessToken       string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path              string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+	Since             int64  `protobuf:"varint,3,opt,name=since" json:"since,omitempty"`
+	Limit             int32  `protobuf:"varint,4,opt,name=limit" json:"limit,omitempty"`
+	ContinuationToken string `protobuf:"bytes,5,opt,name=continuation_token" json:"continuation_token,omitempty"`
+}
+
+func (m *ChangesReq) Reset()         { *m = ChangesReq{} }
+func (m *ChangesReq) String() string { return proto.CompactTextString(m) }
+func (*ChangesReq) ProtoMessage()    {}
+
+type ChangesResp struct {
+	Records           []*Record `protobuf:"bytes,1,rep,name=records" json:"records,omitempty"`
+	ContinuationToken string    `protobuf:"bytes,2,opt,name=continuation_token" json:"continuation_token,omitempty"`
+}
+
+func (m *ChangesResp) Reset()         { *m = ChangesResp{} }
+func (m *ChangesResp) String() string { return proto.CompactTextString(m) }
+func (*ChangesResp) ProtoMessage()    {}
+
+func (m *ChangesResp) GetRecords() []*Record {
+	if m != nil {
+		return m.Records
+	}
+	return nil
+}
+
+// WatchReq subscribes to the changes of the records under path.
+// A streamed record with deleted set means the path has been removed.
+type WatchReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+}
+
+func (m *WatchReq) Reset()         { *m = WatchReq{} }
+func (m *WatchReq) String() string { return proto.CompactTextString(m) }
+func (*WatchReq) ProtoMessage()    {}
+
+// TouchReq assigns a new etag and mtime to the record at path
+// keeping its checksum.
+type TouchReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+}
+
+func (m *TouchReq) Reset()         { *m = TouchReq{} }
+func (m *TouchReq) String() string { return proto.CompactTextString(m) }
+func (*TouchReq) ProtoMessage()    {}
+
+// RmResp contains the number of records removed, or that would be
+// removed on a dry run, and the paths of the latter. On RmMany paths
+// are the requested paths removed and not_found the ones missing.
+type RmResp struct {
+	Deleted  int64    `protobuf:"varint,1,opt,name=deleted" json:"deleted,omitempty"`
+	Paths    []string `protobuf:"bytes,2,rep,name=paths" json:"paths,omitempty"`
+	NotFound []string `protobuf:"bytes,3,rep,name=not_found" json:"not_found,omitempty"`
+}
+
+func (m *RmResp) Reset()         { *m = RmResp{} }
+func (m *RmResp) String() string { return proto.CompactTextString(m) }
+func (*RmResp) ProtoMessage()    {}
+
+// RestoreReq takes the records at path and below out of the trash.
+type RestoreReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+}
+
+func (m *RestoreReq) Reset()         { *m = RestoreReq{} }
+func (m *RestoreReq) String() string { return proto.CompactTextString(m) }
+func (*RestoreReq) ProtoMessage()    {}
+
+type RestoreResp struct {
+	Restored int64 `protobuf:"varint,1,opt,name=restored" json:"restored,omitempty"`
+}
+
+func (m *RestoreResp) Reset()         { *m = RestoreResp{} }
+func (m *RestoreResp) String() string { return proto.CompactTextString(m) }
+func (*RestoreResp) ProtoMessage()    {}
+
+// PurgeReq permanently removes the records in the trash at path and
+// below deleted before older_than, or all of them if it is not set.
+type PurgeReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+	OlderThan   int64  `protobuf:"varint,3,opt,name=older_than" json:"older_than,omitempty"`
+}
+
+func (m *PurgeReq) Reset()         { *m = PurgeReq{} }
+func (m *PurgeReq) String() string { return proto.CompactTextString(m) }
+func (*PurgeReq) ProtoMessage()    {}
+
+type PurgeResp struct {
+	Purged int64 `protobuf:"varint,1,opt,name=purged" json:"purged,omitempty"`
+}
+
+func (m *PurgeResp) Reset()         { *m = PurgeResp{} }
+func (m *PurgeResp) String() string { return proto.CompactTextString(m) }
+func (*PurgeResp) ProtoMessage()    {}
+
+// CountReq counts the records at path and below,
+// or only below if exclude_self is set.
+type CountReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+	ExcludeSelf bool   `protobuf:"varint,3,opt,name=exclude_self" json:"exclude_self,omitempty"`
+}
+
+func (m *CountReq) Reset()         { *m = CountReq{} }
+func (m *CountReq) String() string { return proto.CompactTextString(m) }
+func (*CountReq) ProtoMessage()    {}
+
+type CountResp struct {
+	Count int64 `protobuf:"varint,1,opt,name=count" json:"count,omitempty"`
+}
+
+func (m *CountResp) Reset()         { *m = CountResp{} }
+func (m *CountResp) String() string { return proto.CompactTextString(m) }
+func (*CountResp) ProtoMessage()    {}
+
+// MvResp contains the paths that would be moved on a dry run. Otherwise
+// it contains the moved records at their new paths, and the etag and
+// modified time propagated to the ancestors of src and dst.
+type MvResp struct {
+	Paths    []string  `protobuf:"bytes,1,rep,name=paths" json:"paths,omitempty"`
+	Records  []*Record `protobuf:"bytes,2,rep,name=records" json:"records,omitempty"`
+	Etag     string    `protobuf:"bytes,3,opt,name=etag" json:"etag,omitempty"`
+	Modified int64     `protobuf:"varint,4,opt,name=modified" json:"modified,omitempty"`
+}
+
+func (m *MvResp) Reset()         { *m = MvResp{} }
+func (m *MvResp) String() string { return proto.CompactTextString(m) }
+func (*MvResp) ProtoMessage()    {}
+
+func (m *MvResp) GetRecords() []*Record {
+	if m != nil {
+		return m.Records
+	}
+	return nil
+}
+
+// ReconcileReq repairs the etag and mtime of the records at path and
+// below that are older than their newest descendant, as left by a failed
+// propagation. At most limit records are checked, starting after the
+// path after, so a big tree is reconciled in several calls.
+type ReconcileReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+	After       string `protobuf:"bytes,3,opt,name=after" json:"after,omitempty"`
+	Limit       int64  `protobuf:"varint,4,opt,name=limit" json:"limit,omitempty"`
+}
+
+func (m *ReconcileReq) Reset()         { *m = ReconcileReq{} }
+func (m *ReconcileReq) String() string { return proto.CompactTextString(m) }
+func (*ReconcileReq) ProtoMessage()    {}
+
+// ReconcileResp contains the number of records checked and fixed and the
+// path to continue after, empty once the whole tree has been checked.
+type ReconcileResp struct {
+	Checked int64  `protobuf:"varint,1,opt,name=checked" json:"checked,omitempty"`
+	Fixed   int64  `protobuf:"varint,2,opt,name=fixed" json:"fixed,omitempty"`
+	Next    string `protobuf:"bytes,3,opt,name=next" json:"next,omitempty"`
+}
+
+func (m *ReconcileResp) Reset()         { *m = ReconcileResp{} }
+func (m *ReconcileResp) String() string { return proto.CompactTextString(m) }
+func (*ReconcileResp) ProtoMessage()    {}
+
+// GetTreeReq returns the record at path with its descendants nested
+// below it, down to max_depth levels when it is set.
+type GetTreeReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+	MaxDepth    int64  `protobuf:"varint,3,opt,name=max_depth" json:"max_depth,omitempty"`
+}
+
+func (m *GetTreeReq) Reset()         { *m = GetTreeReq{} }
+func (m *GetTreeReq) String() string { return proto.CompactTextString(m) }
+func (*GetTreeReq) ProtoMessage()    {}
+
+type TreeNode struct {
+	Record   *Record     `protobuf:"bytes,1,opt,name=record" json:"record,omitempty"`
+	Children []*TreeNode `protobuf:"bytes,2,rep,name=children" json:"children,omitempty"`
+}
+
+func (m *TreeNode) Reset()         { *m = TreeNode{} }
+func (m *TreeNode) String() string { return proto.CompactTextString(m) }
+func (*TreeNode) ProtoMessage()    {}
+
+func (m *TreeNode) GetRecord() *Record {
+	if m != nil {
+		return m.Record
+	}
+	return nil
+}
+
+func (m *TreeNode) GetChildren() []*TreeNode {
+	if m != nil {
+		return m.Children
+	}
+	return nil
+}
+
+// RmManyReq removes the records at paths and below in one transaction.
+type RmManyReq struct {
+	AccessToken string   `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Paths       []string `protobuf:"bytes,2,rep,name=paths" json:"paths,omitempty"`
+}
+
+func (m *RmManyReq) Reset()         { *m = RmManyReq{} }
+func (m *RmManyReq) String() string { return proto.CompactTextString(m) }
+func (*RmManyReq) ProtoMessage()    {}
+
+// VersionResp describes the build of the running instance, the database
+// driver in use and the version of the schema it expects.
+type VersionResp struct {
+	Version       string `protobuf:"bytes,1,opt,name=version" json:"version,omitempty"`
+	GitCommit     string `protobuf:"bytes,2,opt,name=git_commit" json:"git_commit,omitempty"`
+	BuildTime     string `protobuf:"bytes,3,opt,name=build_time" json:"build_time,omitempty"`
+	Driver        string `protobuf:"bytes,4,opt,name=driver" json:"driver,omitempty"`
+	SchemaVersion int64  `protobuf:"varint,5,opt,name=schema_version" json:"schema_version,omitempty"`
+}
+
+func (m *VersionResp) Reset()         { *m = VersionResp{} }
+func (m *VersionResp) String() string { return proto.CompactTextString(m) }
+func (*VersionResp) ProtoMessage()    {}
+
+// RmByIdReq removes the record with id at its current path, that is
+// stable across moves. Unless recursive is set it fails when the record
+// has descendants.
+type RmByIdReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Id          string `protobuf:"bytes,2,opt,name=id" json:"id,omitempty"`
+	Recursive   bool   `protobuf:"varint,3,opt,name=recursive" json:"recursive,omitempty"`
+}
+
+func (m *RmByIdReq) Reset()         { *m = RmByIdReq{} }
+func (m *RmByIdReq) String() string { return proto.CompactTextString(m) }
+func (*RmByIdReq) ProtoMessage()    {}
+
+// ChecksumReq finds the records at path and below with checksum, so a
+// client can deduplicate a content before uploading it.
+type ChecksumReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+	Checksum    string `protobuf:"bytes,3,opt,name=checksum" json:"checksum,omitempty"`
+}
+
+func (m *ChecksumReq) Reset()         { *m = ChecksumReq{} }
+func (m *ChecksumReq) String() string { return proto.CompactTextString(m) }
+func (*ChecksumReq) ProtoMessage()    {}
+
+// ChecksumResp contains the paths of the matching records ordered by path.
+type ChecksumResp struct {
+	Paths []string `protobuf:"bytes,1,rep,name=paths" json:"paths,omitempty"`
+}
+
+func (m *ChecksumResp) Reset()         { *m = ChecksumResp{} }
+func (m *ChecksumResp) String() string { return proto.CompactTextString(m) }
+func (*ChecksumResp) ProtoMessage()    {}
+
+// RecomputeEtagReq derives again the etags of the folders at path and
+// below, and of its ancestors, from their children. It requires the
+// children etags to be enabled and returns the record at path.
+type RecomputeEtagReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+}
+
+func (m *RecomputeEtagReq) Reset()         { *m = RecomputeEtagReq{} }
+func (m *RecomputeEtagReq) String() string { return proto.CompactTextString(m) }
+func (*RecomputeEtagReq) ProtoMessage()    {}
+
+// ImportReq is a record of an Import stream, that inserts the records of
+// an existing tree by batches. The etag and mtime are generated unless
+// they are set. The access token and skip_propagation are read from the
+// first message only.
+type ImportReq struct {
+	AccessToken     string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path            string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+	Checksum        string `protobuf:"bytes,3,opt,name=checksum" json:"checksum,omitempty"`
+	Size            int64  `protobuf:"varint,4,opt,name=size" json:"size,omitempty"`
+	Etag            string `protobuf:"bytes,5,opt,name=etag" json:"etag,omitempty"`
+	Mtime           int64  `protobuf:"varint,6,opt,name=mtime" json:"mtime,omitempty"`
+	SkipPropagation bool   `protobuf:"varint,7,opt,name=skip_propagation" json:"skip_propagation,omitempty"`
+	Kind            Kind   `protobuf:"varint,8,opt,name=kind,enum=propagator.Kind" json:"kind,omitempty"`
+}
+
+func (m *ImportReq) Reset()         { *m = ImportReq{} }
+func (m *ImportReq) String() string { return proto.CompactTextString(m) }
+func (*ImportReq) ProtoMessage()    {}
+
+type ImportError struct {
+	Path  string `protobuf:"bytes,1,opt,name=path" json:"path,omitempty"`
+	Error string `protobuf:"bytes,2,opt,name=error" json:"error,omitempty"`
+}
+
+func (m *ImportError) Reset()         { *m = ImportError{} }
+func (m *ImportError) String() string { return proto.CompactTextString(m) }
+func (*ImportError) ProtoMessage()    {}
+
+// ImportResp contains the number of records imported and rejected, and
+// the errors of the first records rejected.
+type ImportResp struct {
+	Imported int64          `protobuf:"varint,1,opt,name=imported" json:"imported,omitempty"`
+	Failed   int64          `protobuf:"varint,2,opt,name=failed" json:"failed,omitempty"`
+	Errors   []*ImportError `protobuf:"bytes,3,rep,name=errors" json:"errors,omitempty"`
+}
+
+func (m *ImportResp) Reset()         { *m = ImportResp{} }
+func (m *ImportResp) String() string { return proto.CompactTextString(m) }
+func (*ImportResp) ProtoMessage()    {}
+
+func (m *ImportResp) GetErrors() []*ImportError {
+	if m != nil {
+		return m.Errors
+	}
+	return nil
+}
+
+// AncestorsResp contains the record at the requested path followed by
+// the ones of its ancestors till the home directory, the deeper ones
+// first, and the ancestors that have no record.
+type AncestorsResp struct {
+	Records []*Record `protobuf:"bytes,1,rep,name=records" json:"records,omitempty"`
+	Missing []string  `protobuf:"bytes,2,rep,name=missing" json:"missing,omitempty"`
+}
+
+func (m *AncestorsResp) Reset()         { *m = AncestorsResp{} }
+func (m *AncestorsResp) String() string { return proto.CompactTextString(m) }
+func (*AncestorsResp) ProtoMessage()    {}
+
+func (m *AncestorsResp) GetRecords() []*Record {
+	if m != nil {
+		return m.Records
+	}
+	return nil
+}
+
+// AuditReq looks for the records at path and below that are older than
+// their newest descendant, like Reconcile but without fixing them. At
+// most limit records are checked, starting after the path after.
+type AuditReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+	After       string `protobuf:"bytes,3,opt,name=after" json:"after,omitempty"`
+	Limit       int64  `protobuf:"varint,4,opt,name=limit" json:"limit,omitempty"`
+}
+
+func (m *AuditReq) Reset()         { *m = AuditReq{} }
+func (m *AuditReq) String() string { return proto.CompactTextString(m) }
+func (*AuditReq) ProtoMessage()    {}
+
+// AuditResp contains the number of records checked, the paths of the
+// stale ones and the path to continue after, empty once the whole tree
+// has been checked.
+type AuditResp struct {
+	Checked int64    `protobuf:"varint,1,opt,name=checked" json:"checked,omitempty"`
+	Stale   []string `protobuf:"bytes,2,rep,name=stale" json:"stale,omitempty"`
+	Next    string   `protobuf:"bytes,3,opt,name=next" json:"next,omitempty"`
+}
+
+func (m *AuditResp) Reset()         { *m = AuditResp{} }
+func (m *AuditResp) String() string { return proto.CompactTextString(m) }
+func (*AuditResp) ProtoMessage()    {}
+
+// HasChildrenReq asks if there is any record below path, without
+// counting them. A missing path has no children.
+type HasChildrenReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+}
+
+func (m *HasChildrenReq) Reset()         { *m = HasChildrenReq{} }
+func (m *HasChildrenReq) String() string { return proto.CompactTextString(m) }
+func (*HasChildrenReq) ProtoMessage()    {}
+
+type HasChildrenResp struct {
+	HasChildren bool `protobuf:"varint,1,opt,name=has_children" json:"has_children,omitempty"`
+}
+
+func (m *HasChildrenResp) Reset()         { *m = HasChildrenResp{} }
+func (m *HasChildrenResp) String() string { return proto.CompactTextString(m) }
+func (*HasChildrenResp) ProtoMessage()    {}
+
+// CheckpointReq returns the records under path written after checkpoint,
+// ordered by their seq. Every transaction writing records gives them a
+// seq greater than the ones of the transactions committed before it, so
+// unlike ChangesSince no change is skipped when many share the same mtime
+// or the clocks are skewed. With limit set at most limit records are
+// returned, and the rest is requested with the continuation_token of the
+// response.
+type CheckpointReq struct {
+	AccessToken       string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path              string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+	Checkpoint        int64  `protobuf:"varint,3,opt,name=checkpoint" json:"checkpoint,omitempty"`
+	Limit             int32  `protobuf:"varint,4,opt,name=limit" json:"limit,omitempty"`
+	ContinuationToken string `protobuf:"bytes,5,opt,name=continuation_token" json:"continuation_token,omitempty"`
+}
+
+func (m *CheckpointReq) Reset()         { *m = CheckpointReq{} }
+func (m *CheckpointReq) String() string { return proto.CompactTextString(m) }
+func (*CheckpointReq) ProtoMessage()    {}
+
+// CheckpointResp carries the checkpoint of the last record returned,
+// to be sent by the next listing once there is no continuation_token.
+type CheckpointResp struct {
+	Records           []*Record `protobuf:"bytes,1,rep,name=records" json:"records,omitempty"`
+	Checkpoint        int64     `protobuf:"varint,2,opt,name=checkpoint" json:"checkpoint,omitempty"`
+	ContinuationToken string    `protobuf:"bytes,3,opt,name=continuation_token" json:"continuation_token,omitempty"`
+}
+
+func (m *CheckpointResp) Reset()         { *m = CheckpointResp{} }
+func (m *CheckpointResp) String() string { return proto.CompactTextString(m) }
+func (*CheckpointResp) ProtoMessage()    {}
+
+func (m *CheckpointResp) GetRecords() []*Record {
+	if m != nil {
+		return m.Records
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterEnum("propagator.Kind", Kind_name, Kind_value)
+}
+
 // Reference imports to suppress errors if they are not otherwise used.
 var _ context.Context
 var _ grpc.ClientConn
@@ -99,9 +788,33 @@ var _ grpc.ClientConn
 type PropClient interface {
 	Put(ctx context.Context, in *PutReq, opts ...grpc.CallOption) (*Void, error)
 	Get(ctx context.Context, in *GetReq, opts ...grpc.CallOption) (*Record, error)
-	// rpc Cp(CpReq) returns (Void) {}
-	Mv(ctx context.Context, in *MvReq, opts ...grpc.CallOption) (*Void, error)
-	Rm(ctx context.Context, in *RmReq, opts ...grpc.CallOption) (*Void, error)
+	Mv(ctx context.Context, in *MvReq, opts ...grpc.CallOption) (*MvResp, error)
+	Rm(ctx context.Context, in *RmReq, opts ...grpc.CallOption) (*RmResp, error)
+	List(ctx context.Context, in *ListReq, opts ...grpc.CallOption) (*ListResp, error)
+	Stat(ctx context.Context, in *StatReq, opts ...grpc.CallOption) (*Record, error)
+	Copy(ctx context.Context, in *CopyReq, opts ...grpc.CallOption) (*Void, error)
+	BatchPut(ctx context.Context, in *BatchPutReq, opts ...grpc.CallOption) (*Void, error)
+	BatchGet(ctx context.Context, in *BatchGetReq, opts ...grpc.CallOption) (*BatchGetResp, error)
+	Exists(ctx context.Context, in *ExistsReq, opts ...grpc.CallOption) (*ExistsResp, error)
+	GetByID(ctx context.Context, in *GetByIdReq, opts ...grpc.CallOption) (*Record, error)
+	ChangesSince(ctx context.Context, in *ChangesReq, opts ...grpc.CallOption) (*ChangesResp, error)
+	Watch(ctx context.Context, in *WatchReq, opts ...grpc.CallOption) (Prop_WatchClient, error)
+	Touch(ctx context.Context, in *TouchReq, opts ...grpc.CallOption) (*Void, error)
+	Restore(ctx context.Context, in *RestoreReq, opts ...grpc.CallOption) (*RestoreResp, error)
+	Purge(ctx context.Context, in *PurgeReq, opts ...grpc.CallOption) (*PurgeResp, error)
+	Count(ctx context.Context, in *CountReq, opts ...grpc.CallOption) (*CountResp, error)
+	Reconcile(ctx context.Context, in *ReconcileReq, opts ...grpc.CallOption) (*ReconcileResp, error)
+	GetTree(ctx context.Context, in *GetTreeReq, opts ...grpc.CallOption) (*TreeNode, error)
+	RmMany(ctx context.Context, in *RmManyReq, opts ...grpc.CallOption) (*RmResp, error)
+	Version(ctx context.Context, in *Void, opts ...grpc.CallOption) (*VersionResp, error)
+	RmByID(ctx context.Context, in *RmByIdReq, opts ...grpc.CallOption) (*RmResp, error)
+	FindByChecksum(ctx context.Context, in *ChecksumReq, opts ...grpc.CallOption) (*ChecksumResp, error)
+	RecomputeEtag(ctx context.Context, in *RecomputeEtagReq, opts ...grpc.CallOption) (*Record, error)
+	Import(ctx context.Context, opts ...grpc.CallOption) (Prop_ImportClient, error)
+	GetWithAncestors(ctx context.Context, in *GetReq, opts ...grpc.CallOption) (*AncestorsResp, error)
+	Audit(ctx context.Context, in *AuditReq, opts ...grpc.CallOption) (*AuditResp, error)
+	HasChildren(ctx context.Context, in *HasChildrenReq, opts ...grpc.CallOption) (*HasChildrenResp, error)
+	ListByCheckpoint(ctx context.Context, in *CheckpointReq, opts ...grpc.CallOption) (*CheckpointResp, error)
 }
 
 type propClient struct {
@@ -130,8 +843,8 @@ func (c *propClient) Get(ctx context.Context, in *GetReq, opts ...grpc.CallOptio
 	return out, nil
 }
 
-func (c *propClient) Mv(ctx context.Context, in *MvReq, opts ...grpc.CallOption) (*Void, error) {
-	out := new(Void)
+func (c *propClient) Mv(ctx context.Context, in *MvReq, opts ...grpc.CallOption) (*MvResp, error) {
+	out := new(MvResp)
 	err := grpc.Invoke(ctx, "/propagator.Prop/Mv", in, out, c.cc, opts...)
 	if err != nil {
 		return nil, err
@@ -139,8 +852,8 @@ func (c *propClient) Mv(ctx context.Context, in *MvReq, opts ...grpc.CallOption)
 	return out, nil
 }
 
-func (c *propClient) Rm(ctx context.Context, in *RmReq, opts ...grpc.CallOption) (*Void, error) {
-	out := new(Void)
+func (c *propClient) Rm(ctx context.Context, in *RmReq, opts ...grpc.CallOption) (*RmResp, error) {
+	out := new(RmResp)
 	err := grpc.Invoke(ctx, "/propagator.Prop/Rm", in, out, c.cc, opts...)
 	if err != nil {
 		return nil, err
@@ -148,69 +861,689 @@ func (c *propClient) Rm(ctx context.Context, in *RmReq, opts ...grpc.CallOption)
 	return out, nil
 }
 
-// Server API for Prop service
-
-type PropServer interface {
-	Put(context.Context, *PutReq) (*Void, error)
-	Get(context.Context, *GetReq) (*Record, error)
-	// rpc Cp(CpReq) returns (Void) {}
-	Mv(context.Context, *MvReq) (*Void, error)
-	Rm(context.Context, *RmReq) (*Void, error)
-}
-
-func RegisterPropServer(s *grpc.Server, srv PropServer) {
-	s.RegisterService(&_Prop_serviceDesc, srv)
-}
-
-func _Prop_Put_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
-	in := new(PutReq)
-	if err := dec(in); err != nil {
-		return nil, err
-	}
-	out, err := srv.(PropServer).Put(ctx, in)
+func (c *propClient) List(ctx context.Context, in *ListReq, opts ...grpc.CallOption) (*ListResp, error) {
+	out := new(ListResp)
+	err := grpc.Invoke(ctx, "/propagator.Prop/List", in, out, c.cc, opts...)
 	if err != nil {
 		return nil, err
 	}
 	return out, nil
 }
 
-func _Prop_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
-	in := new(GetReq)
-	if err := dec(in); err != nil {
-		return nil, err
-	}
-	out, err := srv.(PropServer).Get(ctx, in)
+func (c *propClient) Stat(ctx context.Context, in *StatReq, opts ...grpc.CallOption) (*Record, error) {
+	out := new(Record)
+	err := grpc.Invoke(ctx, "/propagator.Prop/Stat", in, out, c.cc, opts...)
 	if err != nil {
 		return nil, err
 	}
 	return out, nil
 }
 
-func _Prop_Mv_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
-	in := new(MvReq)
-	if err := dec(in); err != nil {
+func (c *propClient) Copy(ctx context.Context, in *CopyReq, opts ...grpc.CallOption) (*Void, error) {
+	out := new(Void)
+	err := grpc.Invoke(ctx, "/propagator.Prop/Copy", in, out, c.cc, opts...)
+	if err != nil {
 		return nil, err
 	}
-	out, err := srv.(PropServer).Mv(ctx, in)
+	return out, nil
+}
+
+func (c *propClient) BatchPut(ctx context.Context, in *BatchPutReq, opts ...grpc.CallOption) (*Void, error) {
+	out := new(Void)
+	err := grpc.Invoke(ctx, "/propagator.Prop/BatchPut", in, out, c.cc, opts...)
 	if err != nil {
 		return nil, err
 	}
 	return out, nil
 }
 
-func _Prop_Rm_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
-	in := new(RmReq)
-	if err := dec(in); err != nil {
+func (c *propClient) BatchGet(ctx context.Context, in *BatchGetReq, opts ...grpc.CallOption) (*BatchGetResp, error) {
+	out := new(BatchGetResp)
+	err := grpc.Invoke(ctx, "/propagator.Prop/BatchGet", in, out, c.cc, opts...)
+	if err != nil {
 		return nil, err
 	}
-	out, err := srv.(PropServer).Rm(ctx, in)
+	return out, nil
+}
+
+func (c *propClient) Exists(ctx context.Context, in *ExistsReq, opts ...grpc.CallOption) (*ExistsResp, error) {
+	out := new(ExistsResp)
+	err := grpc.Invoke(ctx, "/propagator.Prop/Exists", in, out, c.cc, opts...)
 	if err != nil {
 		return nil, err
 	}
 	return out, nil
 }
 
-var _Prop_serviceDesc = grpc.ServiceDesc{
+func (c *propClient) GetByID(ctx context.Context, in *GetByIdReq, opts ...grpc.CallOption) (*Record, error) {
+	out := new(Record)
+	err := grpc.Invoke(ctx, "/propagator.Prop/GetByID", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *propClient) ChangesSince(ctx context.Context, in *ChangesReq, opts ...grpc.CallOption) (*ChangesResp, error) {
+	out := new(ChangesResp)
+	err := grpc.Invoke(ctx, "/propagator.Prop/ChangesSince", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *propClient) Watch(ctx context.Context, in *WatchReq, opts ...grpc.CallOption) (Prop_WatchClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Prop_serviceDesc.Streams[0], c.cc, "/propagator.Prop/Watch", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &propWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Prop_WatchClient interface {
+	Recv() (*Record, error)
+	grpc.ClientStream
+}
+
+type propWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *propWatchClient) Recv() (*Record, error) {
+	m := new(Record)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *propClient) Touch(ctx context.Context, in *TouchReq, opts ...grpc.CallOption) (*Void, error) {
+	out := new(Void)
+	err := grpc.Invoke(ctx, "/propagator.Prop/Touch", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *propClient) Restore(ctx context.Context, in *RestoreReq, opts ...grpc.CallOption) (*RestoreResp, error) {
+	out := new(RestoreResp)
+	err := grpc.Invoke(ctx, "/propagator.Prop/Restore", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *propClient) Purge(ctx context.Context, in *PurgeReq, opts ...grpc.CallOption) (*PurgeResp, error) {
+	out := new(PurgeResp)
+	err := grpc.Invoke(ctx, "/propagator.Prop/Purge", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *propClient) Count(ctx context.Context, in *CountReq, opts ...grpc.CallOption) (*CountResp, error) {
+	out := new(CountResp)
+	err := grpc.Invoke(ctx, "/propagator.Prop/Count", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *propClient) Reconcile(ctx context.Context, in *ReconcileReq, opts ...grpc.CallOption) (*ReconcileResp, error) {
+	out := new(ReconcileResp)
+	err := grpc.Invoke(ctx, "/propagator.Prop/Reconcile", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *propClient) GetTree(ctx context.Context, in *GetTreeReq, opts ...grpc.CallOption) (*TreeNode, error) {
+	out := new(TreeNode)
+	err := grpc.Invoke(ctx, "/propagator.Prop/GetTree", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *propClient) RmMany(ctx context.Context, in *RmManyReq, opts ...grpc.CallOption) (*RmResp, error) {
+	out := new(RmResp)
+	err := grpc.Invoke(ctx, "/propagator.Prop/RmMany", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *propClient) Version(ctx context.Context, in *Void, opts ...grpc.CallOption) (*VersionResp, error) {
+	out := new(VersionResp)
+	err := grpc.Invoke(ctx, "/propagator.Prop/Version", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *propClient) RmByID(ctx context.Context, in *RmByIdReq, opts ...grpc.CallOption) (*RmResp, error) {
+	out := new(RmResp)
+	err := grpc.Invoke(ctx, "/propagator.Prop/RmByID", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *propClient) FindByChecksum(ctx context.Context, in *ChecksumReq, opts ...grpc.CallOption) (*ChecksumResp, error) {
+	out := new(ChecksumResp)
+	err := grpc.Invoke(ctx, "/propagator.Prop/FindByChecksum", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *propClient) RecomputeEtag(ctx context.Context, in *RecomputeEtagReq, opts ...grpc.CallOption) (*Record, error) {
+	out := new(Record)
+	err := grpc.Invoke(ctx, "/propagator.Prop/RecomputeEtag", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *propClient) Import(ctx context.Context, opts ...grpc.CallOption) (Prop_ImportClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Prop_serviceDesc.Streams[1], c.cc, "/propagator.Prop/Import", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &propImportClient{stream}
+	return x, nil
+}
+
+type Prop_ImportClient interface {
+	Send(*ImportReq) error
+	CloseAndRecv() (*ImportResp, error)
+	grpc.ClientStream
+}
+
+type propImportClient struct {
+	grpc.ClientStream
+}
+
+func (x *propImportClient) Send(m *ImportReq) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *propImportClient) CloseAndRecv() (*ImportResp, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(ImportResp)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *propClient) GetWithAncestors(ctx context.Context, in *GetReq, opts ...grpc.CallOption) (*AncestorsResp, error) {
+	out := new(AncestorsResp)
+	err := grpc.Invoke(ctx, "/propagator.Prop/GetWithAncestors", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *propClient) Audit(ctx context.Context, in *AuditReq, opts ...grpc.CallOption) (*AuditResp, error) {
+	out := new(AuditResp)
+	err := grpc.Invoke(ctx, "/propagator.Prop/Audit", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *propClient) HasChildren(ctx context.Context, in *HasChildrenReq, opts ...grpc.CallOption) (*HasChildrenResp, error) {
+	out := new(HasChildrenResp)
+	err := grpc.Invoke(ctx, "/propagator.Prop/HasChildren", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *propClient) ListByCheckpoint(ctx context.Context, in *CheckpointReq, opts ...grpc.CallOption) (*CheckpointResp, error) {
+	out := new(CheckpointResp)
+	err := grpc.Invoke(ctx, "/propagator.Prop/ListByCheckpoint", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Server API for Prop service
+
+type PropServer interface {
+	Put(context.Context, *PutReq) (*Void, error)
+	Get(context.Context, *GetReq) (*Record, error)
+	Mv(context.Context, *MvReq) (*MvResp, error)
+	Rm(context.Context, *RmReq) (*RmResp, error)
+	List(context.Context, *ListReq) (*ListResp, error)
+	Stat(context.Context, *StatReq) (*Record, error)
+	Copy(context.Context, *CopyReq) (*Void, error)
+	BatchPut(context.Context, *BatchPutReq) (*Void, error)
+	BatchGet(context.Context, *BatchGetReq) (*BatchGetResp, error)
+	Exists(context.Context, *ExistsReq) (*ExistsResp, error)
+	GetByID(context.Context, *GetByIdReq) (*Record, error)
+	ChangesSince(context.Context, *ChangesReq) (*ChangesResp, error)
+	Watch(*WatchReq, Prop_WatchServer) error
+	Touch(context.Context, *TouchReq) (*Void, error)
+	Restore(context.Context, *RestoreReq) (*RestoreResp, error)
+	Purge(context.Context, *PurgeReq) (*PurgeResp, error)
+	Count(context.Context, *CountReq) (*CountResp, error)
+	Reconcile(context.Context, *ReconcileReq) (*ReconcileResp, error)
+	GetTree(context.Context, *GetTreeReq) (*TreeNode, error)
+	RmMany(context.Context, *RmManyReq) (*RmResp, error)
+	Version(context.Context, *Void) (*VersionResp, error)
+	RmByID(context.Context, *RmByIdReq) (*RmResp, error)
+	FindByChecksum(context.Context, *ChecksumReq) (*ChecksumResp, error)
+	RecomputeEtag(context.Context, *RecomputeEtagReq) (*Record, error)
+	Import(Prop_ImportServer) error
+	GetWithAncestors(context.Context, *GetReq) (*AncestorsResp, error)
+	Audit(context.Context, *AuditReq) (*AuditResp, error)
+	HasChildren(context.Context, *HasChildrenReq) (*HasChildrenResp, error)
+	ListByCheckpoint(context.Context, *CheckpointReq) (*CheckpointResp, error)
+}
+
+func RegisterPropServer(s *grpc.Server, srv PropServer) {
+	s.RegisterService(&_Prop_serviceDesc, srv)
+}
+
+func _Prop_Put_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(PutReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).Put(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(GetReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).Get(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_Mv_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(MvReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).Mv(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_Rm_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(RmReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).Rm(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(ListReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).List(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_Stat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(StatReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).Stat(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_Copy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(CopyReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).Copy(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_BatchPut_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(BatchPutReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).BatchPut(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_BatchGet_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(BatchGetReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).BatchGet(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_Exists_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(ExistsReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).Exists(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_GetByID_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(GetByIdReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).GetByID(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_ChangesSince_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(ChangesReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).ChangesSince(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchReq)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PropServer).Watch(m, &propWatchServer{stream})
+}
+
+type Prop_WatchServer interface {
+	Send(*Record) error
+	grpc.ServerStream
+}
+
+type propWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *propWatchServer) Send(m *Record) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Prop_Touch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(TouchReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).Touch(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_Restore_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(RestoreReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).Restore(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_Purge_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(PurgeReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).Purge(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_Count_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(CountReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).Count(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_Reconcile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(ReconcileReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).Reconcile(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_GetTree_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(GetTreeReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).GetTree(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_RmMany_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(RmManyReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).RmMany(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_Version_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(Void)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).Version(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_RmByID_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(RmByIdReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).RmByID(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_FindByChecksum_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(ChecksumReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).FindByChecksum(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_RecomputeEtag_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(RecomputeEtagReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).RecomputeEtag(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_Import_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(PropServer).Import(&propImportServer{stream})
+}
+
+type Prop_ImportServer interface {
+	SendAndClose(*ImportResp) error
+	Recv() (*ImportReq, error)
+	grpc.ServerStream
+}
+
+type propImportServer struct {
+	grpc.ServerStream
+}
+
+func (x *propImportServer) SendAndClose(m *ImportResp) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *propImportServer) Recv() (*ImportReq, error) {
+	m := new(ImportReq)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Prop_GetWithAncestors_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(GetReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).GetWithAncestors(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_Audit_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(AuditReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).Audit(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_HasChildren_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(HasChildrenReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).HasChildren(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Prop_ListByCheckpoint_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(CheckpointReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).ListByCheckpoint(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+var _Prop_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "propagator.Prop",
 	HandlerType: (*PropServer)(nil),
 	Methods: []grpc.MethodDesc{
@@ -230,6 +1563,109 @@ var _Prop_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Rm",
 			Handler:    _Prop_Rm_Handler,
 		},
+		{
+			MethodName: "List",
+			Handler:    _Prop_List_Handler,
+		},
+		{
+			MethodName: "Stat",
+			Handler:    _Prop_Stat_Handler,
+		},
+		{
+			MethodName: "Copy",
+			Handler:    _Prop_Copy_Handler,
+		},
+		{
+			MethodName: "BatchPut",
+			Handler:    _Prop_BatchPut_Handler,
+		},
+		{
+			MethodName: "BatchGet",
+			Handler:    _Prop_BatchGet_Handler,
+		},
+		{
+			MethodName: "Exists",
+			Handler:    _Prop_Exists_Handler,
+		},
+		{
+			MethodName: "GetByID",
+			Handler:    _Prop_GetByID_Handler,
+		},
+		{
+			MethodName: "ChangesSince",
+			Handler:    _Prop_ChangesSince_Handler,
+		},
+		{
+			MethodName: "Touch",
+			Handler:    _Prop_Touch_Handler,
+		},
+		{
+			MethodName: "Restore",
+			Handler:    _Prop_Restore_Handler,
+		},
+		{
+			MethodName: "Purge",
+			Handler:    _Prop_Purge_Handler,
+		},
+		{
+			MethodName: "Count",
+			Handler:    _Prop_Count_Handler,
+		},
+		{
+			MethodName: "Reconcile",
+			Handler:    _Prop_Reconcile_Handler,
+		},
+		{
+			MethodName: "GetTree",
+			Handler:    _Prop_GetTree_Handler,
+		},
+		{
+			MethodName: "RmMany",
+			Handler:    _Prop_RmMany_Handler,
+		},
+		{
+			MethodName: "Version",
+			Handler:    _Prop_Version_Handler,
+		},
+		{
+			MethodName: "RmByID",
+			Handler:    _Prop_RmByID_Handler,
+		},
+		{
+			MethodName: "FindByChecksum",
+			Handler:    _Prop_FindByChecksum_Handler,
+		},
+		{
+			MethodName: "RecomputeEtag",
+			Handler:    _Prop_RecomputeEtag_Handler,
+		},
+		{
+			MethodName: "GetWithAncestors",
+			Handler:    _Prop_GetWithAncestors_Handler,
+		},
+		{
+			MethodName: "Audit",
+			Handler:    _Prop_Audit_Handler,
+		},
+		{
+			MethodName: "HasChildren",
+			Handler:    _Prop_HasChildren_Handler,
+		},
+		{
+			MethodName: "ListByCheckpoint",
+			Handler:    _Prop_ListByCheckpoint_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _Prop_Watch_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Import",
+			Handler:       _Prop_Import_Handler,
+			ClientStreams: true,
+		},
 	},
-	Streams: []grpc.StreamDesc{},
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/clawio/service-auth/lib"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"sync"
+	"time"
+)
+
+// rateLimitSweep is how often the buckets refilled to the burst are
+// dropped, so the identities that stopped sending requests are forgotten.
+const rateLimitSweep = time.Minute
+
+// rateLimiter is a token bucket per identity. Every request takes a token
+// and the buckets are refilled at rate tokens per second up to burst.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst <= 0 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   map[string]*bucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from the bucket of key and reports if there was one.
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= rateLimitSweep {
+		for k, b := range l.buckets {
+			if b.refill(now, l.rate, l.burst) >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	if b.refill(now, l.rate, l.burst) < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refill adds the tokens earned since the last refill and returns
+// the tokens in the bucket.
+func (b *bucket) refill(now time.Time, rate, burst float64) float64 {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+		b.last = now
+	}
+	return b.tokens
+}
+
+// limit fails when idt has sent more requests than the configured rate.
+// It is checked by the handlers right after authenticating the request.
+func (s *server) limit(idt *lib.Identity) error {
+	if s.limiter == nil {
+		return nil
+	}
+	if !s.limiter.allow(idt.Idp+":"+idt.Pid, time.Now()) {
+		return grpc.Errorf(codes.ResourceExhausted, "rate limit of %s exceeded", idt.Pid)
+	}
+	return nil
+}
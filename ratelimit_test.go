@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !l.allow("a", now) {
+			t.Fatalf("request %d of the burst denied", i)
+		}
+	}
+	if l.allow("a", now) {
+		t.Error("request past the burst allowed")
+	}
+	if !l.allow("b", now) {
+		t.Error("another key is limited")
+	}
+
+	// half a second earns a token at 2 per second
+	now = now.Add(500 * time.Millisecond)
+	if !l.allow("a", now) || l.allow("a", now) {
+		t.Error("want a single token refilled")
+	}
+
+	// the refill is bounded by the burst and the full buckets are swept
+	now = now.Add(rateLimitSweep)
+	l.allow("c", now)
+	if _, ok := l.buckets["b"]; ok {
+		t.Error("the full bucket of b is kept")
+	}
+	for i := 0; i < 3; i++ {
+		if !l.allow("a", now) {
+			t.Fatalf("request %d of the refilled burst denied", i)
+		}
+	}
+	if l.allow("a", now) {
+		t.Error("the bucket refilled past the burst")
+	}
+}
+
+// TestRateLimitIdentities checks an identity past its limit is denied
+// while another one is not.
+func TestRateLimitIdentities(t *testing.T) {
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.rateLimit = 0.001
+		p.rateBurst = 2
+	})
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if _, err := ts.Put(ctx, &pb.PutReq{AccessToken: ts.token, Path: testHome + "/a.txt"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := ts.Get(ctx, &pb.GetReq{AccessToken: ts.token, Path: testHome + "/a.txt"})
+	wantCode(t, err, codes.ResourceExhausted)
+
+	bob := testToken(t, "bob", time.Now().Add(time.Hour))
+	if _, err = ts.Put(ctx, &pb.PutReq{AccessToken: bob, Path: "/local/users/b/bob/a.txt"}); err != nil {
+		t.Fatal(err)
+	}
+}
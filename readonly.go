@@ -0,0 +1,17 @@
+package main
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+var readOnlyError = grpc.Errorf(codes.FailedPrecondition, "server is in read only mode and does not accept changes")
+
+// writable fails when the server is read only. It is checked by the
+// handlers that change records before doing any work.
+func (s *server) writable() error {
+	if s.p.readOnly {
+		return readOnlyError
+	}
+	return nil
+}
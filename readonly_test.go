@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+// newReadOnlyServer returns a read only server on the database of ts.
+func newReadOnlyServer(t *testing.T, ts *testServer) *testServer {
+	return newTestServer(t, func(p *newServerParams) {
+		p.dsn = ts.s.p.dsn
+		p.readOnly = true
+	})
+}
+
+func TestReadOnlyNoSchemaChanges(t *testing.T) {
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.readOnly = true
+	})
+	if names := tables(t, ts); len(names) != 0 {
+		t.Errorf("got tables %v, want none", names)
+	}
+}
+
+func TestReadOnlyReads(t *testing.T) {
+	primary := newTestServer(t, nil)
+	primary.put(t, testHome+"/a/b.txt")
+	before := tables(t, primary)
+
+	ts := newReadOnlyServer(t, primary)
+	if rec := ts.get(t, testHome+"/a/b.txt"); rec.Path != testHome+"/a/b.txt" {
+		t.Errorf("got %v", rec)
+	}
+	resp, err := ts.List(context.Background(), &pb.ListReq{AccessToken: ts.token, Path: testHome + "/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Records) != 1 {
+		t.Errorf("listed %d records, want 1", len(resp.Records))
+	}
+
+	if after := tables(t, ts); len(after) != len(before) {
+		t.Errorf("got tables %v, want %v", after, before)
+	}
+}
+
+func TestReadOnlyRefusesWrites(t *testing.T) {
+	primary := newTestServer(t, nil)
+	primary.put(t, testHome+"/a.txt")
+	ts := newReadOnlyServer(t, primary)
+	ctx := context.Background()
+
+	_, err := ts.Put(ctx, &pb.PutReq{AccessToken: ts.token, Path: testHome + "/b.txt"})
+	wantCode(t, err, codes.FailedPrecondition)
+	_, err = ts.Rm(ctx, &pb.RmReq{AccessToken: ts.token, Path: testHome + "/a.txt"})
+	wantCode(t, err, codes.FailedPrecondition)
+	_, err = ts.Mv(ctx, &pb.MvReq{AccessToken: ts.token, Src: testHome + "/a.txt", Dst: testHome + "/c.txt"})
+	wantCode(t, err, codes.FailedPrecondition)
+
+	// a missing record is not created either
+	_, err = ts.Get(ctx, &pb.GetReq{AccessToken: ts.token, Path: testHome + "/b.txt", ForceCreation: true})
+	wantCode(t, err, codes.NotFound)
+
+	primary.get(t, testHome+"/a.txt")
+}
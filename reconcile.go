@@ -0,0 +1,107 @@
+package main
+
+import (
+	"github.com/jinzhu/gorm"
+	"golang.org/x/net/context"
+	"sort"
+)
+
+const (
+	// defaultReconcileLimit is the number of records a Reconcile checks
+	// when the request does not set a valid limit.
+	defaultReconcileLimit = 1000
+
+	// maxReconcileLimit bounds the work done by a single Reconcile.
+	maxReconcileLimit = 10000
+)
+
+// staleBy returns the newest descendant of rec when it is newer than rec
+// and its changes are meant to reach it, as left by a failed propagation,
+// or nil when rec is current.
+func (s *server) staleBy(rec *record) (*record, error) {
+
+	newest := &record{}
+	err := s.db.Scopes(withDescendants(rec.Path)).Order("m_time desc").First(newest).Error
+	if err == gorm.RecordNotFound {
+		// nothing below rec to take the changes from
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if newest.MTime <= rec.MTime {
+		return nil, nil
+	}
+
+	// the changes of newest are not meant to reach rec
+	if !propagatesTo(s.p.propagator, newest.Path, rec.Path) {
+		return nil, nil
+	}
+	return newest, nil
+}
+
+// reconcile gives rec the etag and mtime of its newest descendant when
+// that one is newer, as it would be after a successful propagation.
+// It reports if rec has been fixed.
+func (s *server) reconcile(ctx context.Context, rec *record) (bool, error) {
+
+	defer s.lockHomes(rec.Path)()
+
+	newest, err := s.staleBy(rec)
+	if err != nil || newest == nil {
+		return false, err
+	}
+
+	// the update does nothing if rec has been updated in the meanwhile
+	var rows int64
+	err = s.transaction(ctx, func(tx *gorm.DB) error {
+		var err error
+		rows, err = s.update(ctx, tx, rec.Path, newest.ETag, newest.MTime)
+		return err
+	})
+	if err != nil || rows == 0 {
+		return false, err
+	}
+
+	withChange(s.logger.WithField("svc", serviceID), newest.ETag, newest.MTime).Infof("reconciled %s with the change of %s", rec.Path, newest.Path)
+
+	rec.ETag, rec.MTime = newest.ETag, newest.MTime
+	s.hub.publish(rec.toProto())
+	return true, nil
+}
+
+// repairAncestors gives the ancestors of rec older than it the etag and
+// mtime of rec, as a successful propagation would have. The ancestors are
+// read first so reading a record whose chain is current does not write.
+// It returns the number of ancestors repaired.
+func (s *server) repairAncestors(ctx context.Context, rec *record) (int64, error) {
+
+	paths := s.p.propagator.ancestors(rec.Path)
+	if len(paths) == 0 {
+		return 0, nil
+	}
+
+	// the slice must be the first argument because of the way gorm
+	// expands the placeholders
+	stale := []string{}
+	err := s.db.Model(record{}).Where("path IN (?) AND m_time < ?", paths, rec.MTime).Pluck("path", &stale).Error
+	if err != nil || len(stale) == 0 {
+		return 0, err
+	}
+
+	defer s.lockHomes(rec.Path)()
+
+	var rows int64
+	err = s.transaction(ctx, func(tx *gorm.DB) error {
+		var err error
+		if s.p.childrenETags {
+			sort.Sort(byDepth(stale))
+			rows, err = s.recomputeETags(ctx, tx, stale, rec.MTime)
+			return err
+		}
+		rows, err = s.updateMany(ctx, tx, stale, rec.ETag, rec.MTime)
+		return err
+	})
+	return rows, err
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+)
+
+// desync changes the record at p as a write whose propagation failed.
+func desync(t *testing.T, ts *testServer, p, etag string) {
+	err := ts.s.db.Model(record{}).Where("path = ?", p).UpdateColumns(map[string]interface{}{"e_tag": etag, "m_time": ts.clock.Now().Unix()}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (ts *testServer) reconcile(t *testing.T, req *pb.ReconcileReq) *pb.ReconcileResp {
+	req.AccessToken = ts.token
+	resp, err := ts.Reconcile(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestReconcile(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/b/f.txt")
+	ts.put(t, testHome+"/c.txt")
+	ts.clock.Advance(time.Second)
+	desync(t, ts, testHome+"/a/b/f.txt", "lost")
+	current := ts.get(t, testHome+"/c.txt").Etag
+
+	resp := ts.reconcile(t, &pb.ReconcileReq{Path: testHome})
+	if resp.Checked != 5 || resp.Fixed != 3 || resp.Next != "" {
+		t.Errorf("got %v, want the 5 records checked and 3 fixed at once", resp)
+	}
+	wantEtag(t, ts, "lost", "/a/b", "/a", "")
+	wantEtag(t, ts, current, "/c.txt")
+
+	if resp = ts.reconcile(t, &pb.ReconcileReq{Path: testHome}); resp.Fixed != 0 {
+		t.Errorf("got %v, want nothing left to fix", resp)
+	}
+}
+
+// TestReconcileResume checks a subtree is reconciled by bounded runs,
+// each one resumed after the last record of the previous one.
+func TestReconcileResume(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/b/c/f.txt")
+	ts.clock.Advance(time.Second)
+	desync(t, ts, testHome+"/a/b/c/f.txt", "lost")
+
+	var runs, fixed int64
+	req := &pb.ReconcileReq{Path: testHome, Limit: 2}
+	for {
+		resp := ts.reconcile(t, req)
+		runs++
+		fixed += resp.Fixed
+		if resp.Checked > req.Limit {
+			t.Errorf("checked %d records, want at most %d", resp.Checked, req.Limit)
+		}
+		if resp.Next == "" {
+			break
+		}
+		req.After = resp.Next
+	}
+	if runs != 3 || fixed != 4 {
+		t.Errorf("fixed %d records in %d runs, want 4 in 3", fixed, runs)
+	}
+	wantEtag(t, ts, "lost", "/a/b/c", "/a/b", "/a", "")
+}
+
+// TestRepairOnRead checks a Get propagates the record read to its stale
+// ancestors only when the repair is enabled.
+func TestRepairOnRead(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		ts := newTestServer(t, func(p *newServerParams) {
+			p.repairOnRead = enabled
+		})
+		ts.put(t, testHome+"/a/b/f.txt")
+		old := ts.get(t, testHome).Etag
+		ts.clock.Advance(time.Second)
+		desync(t, ts, testHome+"/a/b/f.txt", "lost")
+
+		ts.get(t, testHome+"/a/b/f.txt")
+		if enabled {
+			wantEtag(t, ts, "lost", "/a/b", "/a", "")
+			wantModified(t, ts, ts.clock.Now().Unix(), "/a/b", "/a", "")
+		} else {
+			wantEtag(t, ts, old, "/a/b", "/a", "")
+		}
+	}
+}
+
+// TestRepairOnReadCurrent checks the Get of a record whose ancestors are
+// current writes nothing.
+func TestRepairOnReadCurrent(t *testing.T) {
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.repairOnRead = true
+	})
+	ts.put(t, testHome+"/a/b/f.txt")
+	ts.clock.Advance(time.Second)
+	ts.put(t, testHome+"/a/g.txt")
+	before := dbState(t, ts)
+
+	ts.get(t, testHome+"/a/b/f.txt")
+	if after := dbState(t, ts); strings.Join(after, "\n") != strings.Join(before, "\n") {
+		t.Errorf("the Get changed\n%s\ninto\n%s", strings.Join(before, "\n"), strings.Join(after, "\n"))
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/net/context"
+	"runtime/debug"
+	"time"
+)
+
+const (
+	// retryAttempts is the maximum number of times an operation is run.
+	retryAttempts = 3
+
+	// retryBackoff is the wait before the second attempt, it doubles
+	// on every following attempt.
+	retryBackoff = 50 * time.Millisecond
+)
+
+// retry runs fn until it succeeds, fails with an error the dialect does
+// not consider transient, retryAttempts is reached or ctx is done.
+// fn must be safe to run again after a failure, like a whole transaction.
+func (s *server) retry(ctx context.Context, fn func() error) error {
+
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt == retryAttempts || !s.retryable(err) {
+			return err
+		}
+
+		s.logger.Warnf("attempt %d of %d failed with transient error: %s", attempt, retryAttempts, err)
+
+		select {
+		case <-ctx.Done():
+			return ctxError(ctx)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// retryable reports if err is a transient error worth retrying.
+func (s *server) retryable(err error) bool {
+	if err == driver.ErrBadConn {
+		return true
+	}
+	return s.dialect.retryable(err)
+}
+
+// inTransaction reports if db is an open transaction. A failed statement
+// can not be retried alone inside a transaction because the database may
+// have already rolled it back, so the whole transaction must be retried.
+func inTransaction(db *gorm.DB) bool {
+	_, ok := db.CommonDB().(*sql.Tx)
+	return ok
+}
+
+// transaction runs fn inside a transaction that is committed if fn
+// succeeds and rolled back otherwise. The whole transaction is retried
+// on transient errors. It is not begun nor committed once ctx is done,
+// and a panic of fn rolls it back and is returned as an error so the
+// connection goes back to the pool and the server keeps running. The
+// records written by fn get the same seq right before the commit.
+func (s *server) transaction(ctx context.Context, fn func(tx *gorm.DB) error) error {
+	return s.retry(ctx, func() (err error) {
+		if err = ctxError(ctx); err != nil {
+			return err
+		}
+
+		marker, err := newSeqMarker()
+		if err != nil {
+			return err
+		}
+
+		tx := s.db.Begin()
+		if err = tx.Error; err != nil {
+			return err
+		}
+		tx = tx.Set(seqMarkerSetting, marker)
+
+		defer func() {
+			if r := recover(); r != nil {
+				tx.Rollback()
+				s.logger.Errorf("transaction panicked: %v\n%s", r, debug.Stack())
+				err = fmt.Errorf("transaction panicked: %v", r)
+			}
+		}()
+
+		if err = fn(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = assignSeq(tx, marker); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = ctxError(ctx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit().Error
+	})
+}
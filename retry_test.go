@@ -0,0 +1,149 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+// errLocked is a transient error of SQLite.
+var errLocked = errors.New("database is locked")
+
+// failingTimes returns an operation failing with err the first n times it
+// runs, and the number of times it ran.
+func failingTimes(n int, err error) (func() error, *int) {
+	var attempts int
+	return func() error {
+		attempts++
+		if attempts <= n {
+			return err
+		}
+		return nil
+	}, &attempts
+}
+
+func TestRetry(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, tt := range []struct {
+		name     string
+		failures int
+		err      error
+		attempts int
+		wantErr  bool
+	}{
+		{"transient twice", 2, errLocked, 3, false},
+		{"bad connection", 1, driver.ErrBadConn, 2, false},
+		{"transient always", retryAttempts, errLocked, retryAttempts, true},
+		{"not transient", 1, errInjected, 1, true},
+	} {
+		fn, attempts := failingTimes(tt.failures, tt.err)
+		err := ts.s.retry(context.Background(), fn)
+		if (err != nil) != tt.wantErr || *attempts != tt.attempts {
+			t.Errorf("%s: got %v after %d attempts, want an error %t after %d", tt.name, err, *attempts, tt.wantErr, tt.attempts)
+		}
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	fn, attempts := failingTimes(2, errLocked)
+	err := ts.s.retry(ctx, fn)
+	wantCode(t, err, codes.Canceled)
+	if *attempts != 1 {
+		t.Errorf("ran %d times, want the cancellation after the first", *attempts)
+	}
+}
+
+// TestRetryPut checks the transaction of a Put is run again as a whole
+// when its statements fail twice with a transient error.
+func TestRetryPut(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/f.txt")
+	ts.clock.Advance(time.Second)
+
+	var updates int64
+	ts.s.db.Callback().Update().Before("gorm:update").Register("test:locked", func(scope *gorm.Scope) {
+		if atomic.AddInt64(&updates, 1) <= 2 {
+			scope.Err(errLocked)
+		}
+	})
+	ts.put(t, testHome+"/a/g.txt")
+	if updates <= 2 {
+		t.Errorf("ran %d updates, want the put to run again", updates)
+	}
+	etag := ts.get(t, testHome+"/a/g.txt").Etag
+	wantEtag(t, ts, etag, "/a", "")
+	if n := ts.count(t); n != 4 {
+		t.Errorf("got %d records, want g.txt inserted once", n)
+	}
+}
+
+// transactionWrite runs fn after writing a record in the transaction
+// and returns the error of the transaction.
+func transactionWrite(ts *testServer, ctx context.Context, fn func() error) error {
+	return ts.s.transaction(ctx, func(tx *gorm.DB) error {
+		if err := tx.Create(&record{ID: "id", Path: testHome + "/a.txt", ParentPath: testHome, ETag: "etag"}).Error; err != nil {
+			return err
+		}
+		return fn()
+	})
+}
+
+func TestTransaction(t *testing.T) {
+	ts := newTestServer(t, nil)
+	if err := transactionWrite(ts, context.Background(), func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if rec := ts.record(t, testHome+"/a.txt"); rec.Seq == 0 {
+		t.Errorf("got %v, want the record committed with a seq", rec)
+	}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	ts := newTestServer(t, nil)
+	err := transactionWrite(ts, context.Background(), func() error { return errInjected })
+	if err != errInjected {
+		t.Errorf("got %v, want the error of fn", err)
+	}
+	if n := ts.count(t); n != 0 {
+		t.Errorf("got %d records, want the write rolled back", n)
+	}
+}
+
+// TestTransactionPanic checks a panic of fn is returned as an error once
+// the transaction is rolled back, its connection usable again.
+func TestTransactionPanic(t *testing.T) {
+	ts := newTestServer(t, nil)
+	err := transactionWrite(ts, context.Background(), func() error { panic("boom") })
+	if err == nil || err.Error() != "transaction panicked: boom" {
+		t.Errorf("got %v, want the panic returned", err)
+	}
+	if n := ts.count(t); n != 0 {
+		t.Errorf("got %d records, want the write rolled back", n)
+	}
+	ts.put(t, testHome+"/b.txt")
+}
+
+// TestTransactionCanceled checks a transaction is rolled back when its
+// context is done before the commit.
+func TestTransactionCanceled(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	err := transactionWrite(ts, ctx, func() error {
+		cancel()
+		return nil
+	})
+	wantCode(t, err, codes.Canceled)
+	if n := ts.count(t); n != 0 {
+		t.Errorf("got %d records, want the write rolled back", n)
+	}
+}
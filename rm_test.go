@@ -0,0 +1,187 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+func (ts *testServer) rm(t *testing.T, req *pb.RmReq) *pb.RmResp {
+	req.AccessToken = ts.token
+	resp, err := ts.Rm(context.Background(), req)
+	if err != nil {
+		t.Fatalf("rm %s: %s", req.Path, err)
+	}
+	return resp
+}
+
+func TestRmSubtree(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, p := range []string{"/a/b/c.txt", "/a/d.txt", "/e.txt"} {
+		ts.put(t, testHome+p)
+	}
+	if resp := ts.rm(t, &pb.RmReq{Path: testHome + "/a"}); resp.Deleted != 4 {
+		t.Errorf("deleted %d records, want a, b and their 2 files", resp.Deleted)
+	}
+	ts.get(t, testHome+"/e.txt")
+}
+
+func TestRmFile(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/b.txt")
+	ts.put(t, testHome+"/a/c.txt")
+	if resp := ts.rm(t, &pb.RmReq{Path: testHome + "/a/b.txt"}); resp.Deleted != 1 {
+		t.Errorf("deleted %d records, want 1", resp.Deleted)
+	}
+	ts.get(t, testHome+"/a/c.txt")
+}
+
+// TestRmMissing checks the removal of a missing path deletes nothing, and
+// fails in strict mode.
+func TestRmMissing(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a.txt")
+	if resp := ts.rm(t, &pb.RmReq{Path: testHome + "/missing"}); resp.Deleted != 0 {
+		t.Errorf("deleted %d records, want none", resp.Deleted)
+	}
+	_, err := ts.Rm(context.Background(), &pb.RmReq{AccessToken: ts.token, Path: testHome + "/missing", Strict: true})
+	wantCode(t, err, codes.NotFound)
+	if n := ts.count(t); n != 2 {
+		t.Errorf("got %d records, want a.txt and the home", n)
+	}
+}
+
+// TestRmCurrentSecond checks a removal deletes the children written in
+// the same second, like by a concurrent upload.
+func TestRmCurrentSecond(t *testing.T) {
+	ts := newFixedTimeServer(t)
+	ts.put(t, testHome+"/a/old.txt")
+	ts.clock.Advance(time.Second)
+	ts.put(t, testHome+"/a/new.txt")
+
+	if resp := ts.rm(t, &pb.RmReq{Path: testHome + "/a"}); resp.Deleted != 3 {
+		t.Errorf("deleted %d records, want a and its 2 files", resp.Deleted)
+	}
+	if n := ts.count(t); n != 1 {
+		t.Errorf("got %d records, want the home only", n)
+	}
+}
+
+// TestRmOlderThan checks a removal asked to delete only the records
+// older than a time keeps the others.
+func TestRmOlderThan(t *testing.T) {
+	ts := newFixedTimeServer(t)
+	ts.put(t, testHome+"/a/old.txt")
+	ts.clock.Advance(time.Second)
+	ts.put(t, testHome+"/a/new.txt")
+
+	resp := ts.rm(t, &pb.RmReq{Path: testHome + "/a", OlderThan: ts.clock.Now().Unix()})
+	if resp.Deleted != 1 {
+		t.Errorf("deleted %d records, want old.txt only", resp.Deleted)
+	}
+	ts.get(t, testHome+"/a/new.txt")
+	ts.get(t, testHome+"/a")
+}
+
+// TestRmManyMixed checks the existing paths are removed and the missing
+// ones reported, the ancestors of all being propagated to once.
+func TestRmManyMixed(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, p := range []string{"/a/b/c.txt", "/a/b/g.txt", "/a/d.txt", "/e.txt"} {
+		ts.put(t, testHome+p)
+	}
+	ts.clock.Advance(time.Second)
+
+	propagated := observePropagated(ts)
+	resp, err := ts.RmMany(context.Background(), &pb.RmManyReq{AccessToken: ts.token, Paths: []string{
+		testHome + "/e.txt", testHome + "/a/b/c.txt", testHome + "/missing", testHome + "/a/d.txt", testHome + "/a/b/c.txt",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{testHome + "/a/b/c.txt", testHome + "/a/d.txt", testHome + "/e.txt"}; !reflect.DeepEqual(resp.Paths, want) || resp.Deleted != 3 {
+		t.Errorf("removed %d records at %v, want %v", resp.Deleted, resp.Paths, want)
+	}
+	if want := []string{testHome + "/missing"}; !reflect.DeepEqual(resp.NotFound, want) {
+		t.Errorf("got %v not found, want %v", resp.NotFound, want)
+	}
+
+	if got, want := propagated(), []string{testHome + "/a/b", testHome + "/a", testHome}; !reflect.DeepEqual(got, want) {
+		t.Errorf("propagated to %v, want every ancestor once %v", got, want)
+	}
+	etag := ts.get(t, testHome).Etag
+	wantEtag(t, ts, etag, "/a/b", "/a")
+	ts.get(t, testHome+"/a/b/g.txt")
+}
+
+// TestRmManyNested checks a path below another removed one is removed
+// with it.
+func TestRmManyNested(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/b/c.txt")
+	ts.clock.Advance(time.Second)
+
+	resp, err := ts.RmMany(context.Background(), &pb.RmManyReq{AccessToken: ts.token, Paths: []string{testHome + "/a/b/c.txt", testHome + "/a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Deleted != 3 || len(resp.Paths) != 2 || len(resp.NotFound) != 0 {
+		t.Errorf("got %v, want a and its 2 descendants removed", resp)
+	}
+	if n := ts.count(t); n != 1 {
+		t.Errorf("got %d records, want the home only", n)
+	}
+}
+
+// TestRmByIDAfterMv checks the id of a record found before a move
+// removes it at its new path.
+func TestRmByIDAfterMv(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/f.txt")
+	ts.put(t, testHome+"/a/g.txt")
+	id := ts.get(t, testHome+"/a/f.txt").Id
+	folder := ts.get(t, testHome+"/a").Id
+	ts.clock.Advance(time.Second)
+
+	_, err := ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: testHome + "/a", Dst: testHome + "/b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.clock.Advance(time.Second)
+	resp, err := ts.RmByID(context.Background(), &pb.RmByIdReq{AccessToken: ts.token, Id: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Deleted != 1 {
+		t.Errorf("deleted %d records, want f.txt", resp.Deleted)
+	}
+	_, err = ts.Get(context.Background(), &pb.GetReq{AccessToken: ts.token, Path: testHome + "/b/f.txt"})
+	wantCode(t, err, codes.NotFound)
+	if home, b := ts.get(t, testHome), ts.get(t, testHome+"/b"); home.Etag != b.Etag || home.Modified != ts.clock.Now().Unix() {
+		t.Errorf("the removal was not propagated: the home has %v and b %v", home, b)
+	}
+
+	// a folder is only removed with its subtree when asked
+	_, err = ts.RmByID(context.Background(), &pb.RmByIdReq{AccessToken: ts.token, Id: folder})
+	wantCode(t, err, codes.FailedPrecondition)
+	if resp, err = ts.RmByID(context.Background(), &pb.RmByIdReq{AccessToken: ts.token, Id: folder, Recursive: true}); err != nil || resp.Deleted != 2 {
+		t.Errorf("got %v, %v, want b and g.txt deleted", resp, err)
+	}
+	_, err = ts.RmByID(context.Background(), &pb.RmByIdReq{AccessToken: ts.token, Id: folder})
+	wantCode(t, err, codes.NotFound)
+}
+
+func TestRmByIDForeign(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a.txt")
+	id := ts.get(t, testHome+"/a.txt").Id
+
+	bob := testToken(t, "bob", time.Now().Add(time.Hour))
+	_, err := ts.RmByID(context.Background(), &pb.RmByIdReq{AccessToken: bob, Id: id})
+	wantCode(t, err, codes.PermissionDenied)
+	ts.get(t, testHome+"/a.txt")
+}
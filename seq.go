@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/jinzhu/gorm"
+)
+
+// seqMarkerSetting is the gorm setting holding the marker of the records
+// written by the current transaction, until they get their seq.
+const seqMarkerSetting = "clawio:seq_marker"
+
+// recordsSequence is the name of the sequence the seq of the records is
+// drawn from.
+const recordsSequence = "records"
+
+// sequence is a counter of the sequences table.
+type sequence struct {
+	Name  string `gorm:"primary_key"`
+	Value int64
+}
+
+// newSeqMarker returns a random negative marker, so it never matches a
+// seq and two transactions do not share it.
+func newSeqMarker() (int64, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return 0, err
+	}
+	return -int64(binary.BigEndian.Uint64(b)>>1) - 1, nil
+}
+
+// seqMarker returns the marker of the transaction db, 0 outside them.
+func seqMarker(db *gorm.DB) int64 {
+	if m, ok := db.Get(seqMarkerSetting); ok {
+		return m.(int64)
+	}
+	return 0
+}
+
+// registerSeqCallbacks stamps the records created or updated through db
+// with the marker of their transaction, so assignSeq finds them. The
+// upserts, that gorm does not build, write the marker themselves.
+func registerSeqCallbacks(db *gorm.DB) {
+
+	isRecord := func(scope *gorm.Scope) bool {
+		_, ok := scope.IndirectValue().Interface().(record)
+		return ok
+	}
+
+	db.Callback().Create().Before("gorm:create").Register("clawio:seq_create", func(scope *gorm.Scope) {
+		if m := seqMarker(scope.DB()); m != 0 && isRecord(scope) {
+			scope.SetColumn("Seq", m)
+		}
+	})
+
+	db.Callback().Update().Before("gorm:update").Register("clawio:seq_update", func(scope *gorm.Scope) {
+		m := seqMarker(scope.DB())
+		if m == 0 || !isRecord(scope) {
+			return
+		}
+		attrs, ok := scope.InstanceGet("gorm:update_attrs")
+		if !ok {
+			return
+		}
+		stamped := map[string]interface{}{"seq": m}
+		for k, v := range attrs.(map[string]interface{}) {
+			if k != "seq" {
+				stamped[k] = v
+			}
+		}
+		scope.InstanceSet("gorm:update_attrs", stamped)
+	})
+}
+
+// assignSeq gives the records stamped with marker by the transaction tx
+// the next value of the records sequence. The row of the sequence stays
+// locked till tx ends, so the transactions get their seq in the order
+// they commit and a reader that sees a seq also sees all the lower ones.
+// The lock is taken last and only by the transactions writing records.
+func assignSeq(tx *gorm.DB, marker int64) error {
+
+	ids := []string{}
+	err := tx.Unscoped().Model(record{}).Where("seq = ?", marker).Limit(1).Pluck("id", &ids).Error
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+
+	err = tx.Model(&sequence{}).Where("name = ?", recordsSequence).UpdateColumn("value", gorm.Expr("value + 1")).Error
+	if err != nil {
+		return err
+	}
+	seq := &sequence{}
+	if err = tx.Where("name = ?", recordsSequence).First(seq).Error; err != nil {
+		return err
+	}
+
+	// a raw statement so the callbacks do not stamp it with marker again
+	return tx.Exec("UPDATE "+recordsTable(tx)+" SET seq = ? WHERE seq = ?", seq.Value, marker).Error
+}
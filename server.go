@@ -1,19 +1,51 @@
 package main
 
 import (
+	"fmt"
 	"github.com/clawio/service-auth/lib"
 	pb "github.com/clawio/service-localfs-prop/proto/propagator"
 	"github.com/jinzhu/gorm"
-	"github.com/nu7hatch/gouuid"
 	rus "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"io"
 	"path"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
+// defaultChangesLimit is the page size of ChangesSince
+// when the client does not ask for one.
+const defaultChangesLimit = 1000
+
+// subtreePageSize is the number of records loaded at once
+// when processing a subtree.
+const subtreePageSize = 1000
+
+const (
+	// defaultImportBatchSize is the number of records an Import inserts
+	// by statement, small enough for the variable limit of SQLite.
+	defaultImportBatchSize = 100
+
+	// maxImportErrors is the number of rejected records an Import
+	// reports the error of.
+	maxImportErrors = 100
+)
+
+// Connection pool defaults used when the parameters are not set.
+const (
+	defaultMaxSqlConcurrency  = 64
+	defaultMaxSqlIdle         = 16
+	defaultSqlConnMaxLifetime = 5 * time.Minute
+)
+
+// defaultHomeDepth is the number of tokens, including the empty one
+// before the leading slash, of a home directory like /local/users/d/demo
+const defaultHomeDepth = 5
+
 var (
 	unauthenticatedError = grpc.Errorf(codes.Unauthenticated, "identity not found")
 	permissionDenied     = grpc.Errorf(codes.PermissionDenied, "access denied")
@@ -21,61 +53,299 @@ var (
 
 // debugLogger satisfies Gorm's logger interface
 // so that we can log SQL queries at Logrus' debug level
-type debugLogger struct{}
+type debugLogger struct {
+	logger *rus.Logger
+}
 
-func (*debugLogger) Print(msg ...interface{}) {
-	rus.Debug(msg)
+func (l *debugLogger) Print(msg ...interface{}) {
+	l.logger.Debug(msg...)
 }
 
 type newServerParams struct {
+	driver            string
 	dsn               string
 	db                *gorm.DB
 	sharedSecret      string
+	logger            *rus.Logger
 	maxSqlIdle        int
 	maxSqlConcurrency int
+	sqlLog            bool
+	homeDepth         int
+
+	// spanExporter receives the spans of the requests.
+	spanExporter spanExporter
+
+	// clock gives the mtime of the changes and the time the cached tokens
+	// expire by, the real time by default.
+	clock clock
+
+	// idGen gives the ids and etags of the records, random UUIDs by
+	// default.
+	idGen func() (string, error)
+
+	// propagator chooses the ancestors the changes are propagated to,
+	// all of them till the home directory by default.
+	propagator propagator
+
+	// softDelete moves the removed records to the trash, from where
+	// they can be restored until trashRetention expires.
+	softDelete     bool
+	trashRetention time.Duration
+
+	// propagateSize keeps the size of the folders as the sum of the
+	// sizes below them, adjusting the ancestors of a changed record.
+	propagateSize bool
+
+	// caseInsensitive folds the paths to lower case so the paths only
+	// differing in case are the same record.
+	caseInsensitive bool
+
+	// tablePrefix is prepended to the table and index names so several
+	// instances can share a database.
+	tablePrefix string
+
+	// idempotencyTTL is how long the idempotency key of a Put is
+	// remembered.
+	idempotencyTTL time.Duration
+
+	// rateLimit is the number of requests per second accepted from
+	// every identity, with bursts of up to rateBurst requests. Zero
+	// disables the limit.
+	rateLimit float64
+	rateBurst int
+
+	// tokenCacheTTL and tokenCacheSize bound how long and how many
+	// parsed access tokens are kept to skip their verification.
+	tokenCacheTTL  time.Duration
+	tokenCacheSize int
+
+	// maxPathLength is the longest path accepted, in bytes, that must fit
+	// in the path column. maxPathSegments is the deepest one, zero
+	// disables the limit.
+	maxPathLength   int
+	maxPathSegments int
+
+	// maxSubtreeNodes is the number of records a Mv, Copy or Rm can
+	// change at once, as an enormous subtree would lock the table for
+	// long. Zero disables the limit.
+	maxSubtreeNodes int64
+
+	// readOnly rejects the changes while the reads are served, for
+	// maintenance windows or read replicas. The schema is not migrated.
+	readOnly bool
+
+	// legacyChecksums accepts checksums without the algo: prefix.
+	legacyChecksums bool
+
+	// sqlConnMaxLifetime recycles the pooled connections before
+	// the database or a proxy in front of it closes them.
+	sqlConnMaxLifetime time.Duration
+
+	// childrenETags derives the etags of the folders from the names and
+	// etags of their children instead of propagating a random one, so
+	// the servers replicating a tree agree on them.
+	childrenETags bool
+
+	// importBatchSize is the number of records an Import inserts by
+	// statement.
+	importBatchSize int
+
+	// serializeHomes runs the changes under the same home directory one
+	// after the other, so the etags of the ancestors are the ones of the
+	// last change. It only serializes the requests of this process.
+	serializeHomes bool
+
+	// bulkPropagation updates all the ancestors in a single statement
+	// instead of one statement per ancestor. The ancestors from the
+	// first one updated in the meanwhile are left out beforehand.
+	bulkPropagation bool
+
+	// previousSecrets are the shared secrets replaced by a rotation, the
+	// tokens signed with them are still accepted until they expire.
+	previousSecrets []string
+
+	// repairOnRead makes Get propagate the record read to its ancestors
+	// left older than it by a failed propagation.
+	repairOnRead bool
 }
 
 func newServer(p *newServerParams) (*server, error) {
 
-	db, err := newDB("mysql", p.dsn)
+	if p.logger == nil {
+		p.logger = newNopLogger()
+	}
+
+	if p.homeDepth <= 0 {
+		p.homeDepth = defaultHomeDepth
+	}
+
+	if p.driver == "" {
+		p.driver = defaultDriver
+	}
+
+	if p.trashRetention <= 0 {
+		p.trashRetention = defaultTrashRetention
+	}
+
+	if p.idempotencyTTL <= 0 {
+		p.idempotencyTTL = defaultIdempotencyTTL
+	}
+
+	if p.maxPathLength <= 0 {
+		p.maxPathLength = defaultMaxPathLength
+	}
+
+	if p.importBatchSize <= 0 {
+		p.importBatchSize = defaultImportBatchSize
+	}
+
+	if p.tokenCacheTTL <= 0 {
+		p.tokenCacheTTL = defaultTokenCacheTTL
+	}
+
+	if p.tokenCacheSize <= 0 {
+		p.tokenCacheSize = defaultTokenCacheSize
+	}
+
+	// an empty secret would accept the tokens signed without a key
+	secrets := []string{}
+	for _, secret := range p.previousSecrets {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	p.previousSecrets = secrets
+
+	if p.spanExporter == nil {
+		p.spanExporter = nopExporter{}
+	}
+
+	if p.clock == nil {
+		p.clock = realClock{}
+	}
+
+	if p.idGen == nil {
+		p.idGen = newUUID
+	}
+
+	if p.propagator == nil {
+		p.propagator = &homePropagator{p.homeDepth}
+	}
+
+	if p.maxSqlConcurrency <= 0 {
+		p.maxSqlConcurrency = defaultMaxSqlConcurrency
+	}
+
+	if p.maxSqlIdle <= 0 {
+		p.maxSqlIdle = defaultMaxSqlIdle
+	}
+
+	// idle connections above the open limit would be closed right away
+	if p.maxSqlIdle > p.maxSqlConcurrency {
+		p.maxSqlIdle = p.maxSqlConcurrency
+	}
+
+	if p.sqlConnMaxLifetime <= 0 {
+		p.sqlConnMaxLifetime = defaultSqlConnMaxLifetime
+	}
+
+	dl, err := newDialect(p.driver)
+	if err != nil {
+		p.logger.Error(err)
+		return nil, err
+	}
+
+	if err = dl.validateDSN(p.dsn); err != nil {
+		err = fmt.Errorf("%s DSN is invalid: %s", p.driver, err)
+		p.logger.Error(err)
+		return nil, err
+	}
+
+	db, err := newDB(p.driver, p.dsn)
 	if err != nil {
-		rus.Error(err)
+		p.logger.Error(err)
 		return nil, err
 	}
 
-	db.LogMode(true)
-	db.SetLogger(&debugLogger{})
+	// SQL statements contain user paths and logging them has a cost
+	// so it is only enabled on demand
+	db.LogMode(p.sqlLog)
+	db.SetLogger(&debugLogger{p.logger})
 	db.DB().SetMaxIdleConns(p.maxSqlIdle)
 	db.DB().SetMaxOpenConns(p.maxSqlConcurrency)
+	db.DB().SetConnMaxLifetime(p.sqlConnMaxLifetime)
 
-	err = db.AutoMigrate(&record{}).Error
+	// the table names of the instances sharing a database are told
+	// apart by their prefix
+	db, err = withTablePrefix(db, p.tablePrefix)
 	if err != nil {
-		rus.Error(err)
+		p.logger.Error(err)
 		return nil, err
 	}
+	registerSeqCallbacks(db)
 
-	rus.Infof("automigration applied")
+	// a read replica does not accept schema changes either
+	if !p.readOnly {
+		err = migrate(db, dl, p.logger)
+		if err != nil {
+			p.logger.Error(err)
+			return nil, err
+		}
+		p.logger.Infof("schema at version %d", schemaVersion())
+	}
 
 	s := &server{}
 	s.p = p
 	s.db = db
+	s.dialect = dl
+	s.logger = p.logger
+	s.hub = newHub()
+	s.metrics = newMetrics()
+	s.done = make(chan struct{})
+	s.tokens = newTokenCache(p.tokenCacheTTL, p.tokenCacheSize)
+	s.locks = newHomeLocks()
+
+	if p.rateLimit > 0 {
+		s.limiter = newRateLimiter(p.rateLimit, p.rateBurst)
+	}
+
+	if p.softDelete && !p.readOnly {
+		go s.purgeLoop()
+	}
+
 	return s, nil
 }
 
 type server struct {
-	p  *newServerParams
-	db *gorm.DB
+	p       *newServerParams
+	db      *gorm.DB
+	dialect dialect
+	logger  *rus.Logger
+	hub     *hub
+	metrics *metrics
+	limiter *rateLimiter
+	tokens  *tokenCache
+	locks   *homeLocks
+
+	mu       sync.Mutex
+	closing  bool
+	done     chan struct{}
+	inflight sync.WaitGroup
 }
 
 func (s *server) Get(ctx context.Context, req *pb.GetReq) (*pb.Record, error) {
 
-	traceID, err := getGRPCTraceID(ctx)
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
 	if err != nil {
-		rus.Error(err)
-		return &pb.Record{}, err
+		log.Error(err)
+		return &pb.Record{}, toGRPCError(err)
 	}
-	log := rus.WithField("trace", traceID).WithField("svc", serviceID)
-	ctx = newGRPCTraceContext(ctx, traceID)
+	defer s.release()
+
+	ctx, span := s.startSpan(ctx, "get")
+	defer span.finish(nil)
 
 	log.Info("request started")
 
@@ -95,7 +365,7 @@ func (s *server) Get(ctx context.Context, req *pb.GetReq) (*pb.Record, error) {
 
 	}()
 
-	idt, err := lib.ParseToken(req.AccessToken, s.p.sharedSecret)
+	idt, err := s.identity(ctx)
 	if err != nil {
 		log.Error(err)
 		return &pb.Record{}, unauthenticatedError
@@ -103,61 +373,86 @@ func (s *server) Get(ctx context.Context, req *pb.GetReq) (*pb.Record, error) {
 
 	log.Infof("%s", idt)
 
-	p := path.Clean(req.Path)
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.Record{}, toGRPCError(err)
+	}
+
+	p, err := s.normalizePath(req.Path)
+	if err != nil {
+		log.Error(err)
+		return &pb.Record{}, toGRPCError(err)
+	}
 
 	log.Infof("path is %s", p)
 
+	if err = s.authorize(idt, p); err != nil {
+		log.Error(err)
+		return &pb.Record{}, toGRPCError(err)
+	}
+
 	var rec *record
 
-	rec, err = s.getByPath(p)
+	rec, err = s.getByPath(ctx, p)
 	if err != nil {
 		log.Error(err)
 		if err != gorm.RecordNotFound {
-			return &pb.Record{}, err
+			return &pb.Record{}, toGRPCError(err)
 		}
 
-		if !req.ForceCreation {
-			return &pb.Record{}, err
+		// a read only server does not create the missing record
+		if !req.ForceCreation || s.p.readOnly {
+			return &pb.Record{}, toGRPCError(err)
 		}
 
 		if req.ForceCreation {
 			in := &pb.PutReq{}
 			in.AccessToken = req.AccessToken
 			in.Path = req.Path
-			_, e := s.Put(ctx, in)
-			if e != nil {
-				return &pb.Record{}, err
+			in.Kind = pb.Kind_FOLDER
+			_, err = s.Put(ctx, in)
+			if err != nil {
+				log.Error(err)
+				return &pb.Record{}, toGRPCError(err)
 			}
 
-			rec, err = s.getByPath(p)
+			rec, err = s.getByPath(ctx, p)
 			if err != nil {
-				return &pb.Record{}, nil
+				log.Error(err)
+				return &pb.Record{}, toGRPCError(err)
 			}
 		}
 	}
 
-	r := &pb.Record{}
-	r.Id = rec.ID
-	r.Path = rec.Path
-	r.Etag = rec.ETag
-	r.Modified = rec.MTime
-	r.Checksum = rec.Checksum
-	return r, nil
+	if s.p.repairOnRead && !s.p.readOnly {
+		repaired, err := s.repairAncestors(ctx, rec)
+		if err != nil {
+			// the record is returned anyway, the next read tries again
+			log.Warnf("repair of the ancestors of %s failed: %s", p, err)
+		} else if repaired > 0 {
+			withChange(log, rec.ETag, rec.MTime).Infof("%d stale ancestors of %s repaired", repaired, p)
+		}
+	}
+
+	return rec.toProto(), nil
 }
 
-func (s *server) Mv(ctx context.Context, req *pb.MvReq) (*pb.Void, error) {
+// GetWithAncestors returns the record at the path and the ones of its
+// ancestors till the home directory, so a client can check that a change
+// has been propagated. The missing records are not created.
+func (s *server) GetWithAncestors(ctx context.Context, req *pb.GetReq) (*pb.AncestorsResp, error) {
 
-	traceID, err := getGRPCTraceID(ctx)
-	if err != nil {
-		rus.Error(err)
-		return &pb.Void{}, err
-	}
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
 	if err != nil {
-		rus.Error(err)
-		return &pb.Void{}, err
+		log.Error(err)
+		return &pb.AncestorsResp{}, toGRPCError(err)
 	}
-	log := rus.WithField("trace", traceID).WithField("svc", serviceID)
-	ctx = newGRPCTraceContext(ctx, traceID)
+	defer s.release()
+
+	ctx, span := s.startSpan(ctx, "getwithancestors")
+	defer span.finish(nil)
 
 	log.Info("request started")
 
@@ -170,87 +465,87 @@ func (s *server) Mv(ctx context.Context, req *pb.MvReq) (*pb.Void, error) {
 
 		// Log access info
 		log.WithFields(rus.Fields{
-			"method":   "mv",
+			"method":   "getwithancestors",
 			"type":     "grpcaccess",
 			"duration": reqDur.Seconds(),
 		}).Info("request finished")
 
 	}()
 
-	idt, err := lib.ParseToken(req.AccessToken, s.p.sharedSecret)
+	idt, err := s.identity(ctx)
 	if err != nil {
 		log.Error(err)
-		return &pb.Void{}, unauthenticatedError
+		return &pb.AncestorsResp{}, unauthenticatedError
 	}
 
 	log.Infof("%s", idt)
 
-	src := path.Clean(req.Src)
-	dst := path.Clean(req.Dst)
-
-	log.Infof("src path is %s", src)
-	log.Infof("dst path is %s", dst)
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.AncestorsResp{}, toGRPCError(err)
+	}
 
-	recs, err := s.getRecordsWithPathPrefix(src)
+	p, err := s.normalizePath(req.Path)
 	if err != nil {
 		log.Error(err)
-		return &pb.Void{}, nil
+		return &pb.AncestorsResp{}, toGRPCError(err)
 	}
 
-	tx := s.db.Begin()
-	for _, rec := range recs {
-		newPath := path.Join(dst, path.Clean(strings.TrimPrefix(rec.Path, src)))
-		log.Infof("src path %s will be renamed to %s", rec.Path, newPath)
+	log.Infof("path is %s", p)
 
-		err = s.db.Model(record{}).Where("id=?", rec.ID).Updates(record{Path: newPath}).Error
-		if err != nil {
-			log.Error(err)
-			tx.Rollback()
-			return &pb.Void{}, err
-		}
+	if err = s.authorize(idt, p); err != nil {
+		log.Error(err)
+		return &pb.AncestorsResp{}, toGRPCError(err)
 	}
-	tx.Commit()
-
-	log.Infof("renamed %d entries", len(recs))
 
-	etag, err := uuid.NewV4()
+	// the records are read by a single statement so they are the same
+	// snapshot of the chain
+	paths := append([]string{p}, getPathsTillHome(p, s.p.homeDepth)...)
+	var recs []record
+	err = s.db.Where("path IN (?)", paths).Find(&recs).Error
 	if err != nil {
 		log.Error(err)
-		return &pb.Void{}, err
+		return &pb.AncestorsResp{}, toGRPCError(err)
 	}
-	mtime := uint32(time.Now().Unix())
-	err = s.propagateChanges(ctx, dst, etag.String(), mtime, "")
-	if err != nil {
-		log.Error(err)
+
+	byPath := map[string]*record{}
+	for i := range recs {
+		byPath[recs[i].Path] = &recs[i]
 	}
 
-	log.Infof("propagated changes till %s", "")
+	if _, ok := byPath[p]; !ok {
+		log.Error(gorm.RecordNotFound)
+		return &pb.AncestorsResp{}, toGRPCError(gorm.RecordNotFound)
+	}
 
-	return &pb.Void{}, nil
-}
+	res := &pb.AncestorsResp{}
+	for _, ap := range paths {
+		rec, ok := byPath[ap]
+		if !ok {
+			res.Missing = append(res.Missing, ap)
+			continue
+		}
+		res.Records = append(res.Records, rec.toProto())
+	}
 
-func (s *server) getRecordsWithPathPrefix(p string) ([]record, error) {
+	log.Infof("found %d of %d records of the chain", len(res.Records), len(paths))
 
-	var recs []record
+	return res, nil
+}
 
-	// the regexp is path/% instead of path% to avoid getting
-	// path1 and path11 in from the DB
-	err := s.db.Where("path LIKE ? OR path=?", p+"/%", p).Find(&recs).Error
-	if err != nil {
-		return recs, nil
-	}
+func (s *server) List(ctx context.Context, req *pb.ListReq) (*pb.ListResp, error) {
 
-	return recs, nil
-}
-func (s *server) Rm(ctx context.Context, req *pb.RmReq) (*pb.Void, error) {
+	log := s.requestLogger(ctx)
 
-	traceID, err := getGRPCTraceID(ctx)
+	err := s.acquire()
 	if err != nil {
-		rus.Error(err)
-		return &pb.Void{}, err
+		log.Error(err)
+		return &pb.ListResp{}, toGRPCError(err)
 	}
-	log := rus.WithField("trace", traceID).WithField("svc", serviceID)
-	ctx = newGRPCTraceContext(ctx, traceID)
+	defer s.release()
+
+	ctx, span := s.startSpan(ctx, "list")
+	defer span.finish(nil)
 
 	log.Info("request started")
 
@@ -263,56 +558,110 @@ func (s *server) Rm(ctx context.Context, req *pb.RmReq) (*pb.Void, error) {
 
 		// Log access info
 		log.WithFields(rus.Fields{
-			"method":   "rm",
+			"method":   "list",
 			"type":     "grpcaccess",
 			"duration": reqDur.Seconds(),
 		}).Info("request finished")
 
 	}()
 
-	idt, err := lib.ParseToken(req.AccessToken, s.p.sharedSecret)
+	idt, err := s.identity(ctx)
 	if err != nil {
 		log.Error(err)
-		return &pb.Void{}, unauthenticatedError
+		return &pb.ListResp{}, unauthenticatedError
 	}
 
 	log.Infof("%s", idt)
 
-	p := path.Clean(req.Path)
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.ListResp{}, toGRPCError(err)
+	}
+
+	p, err := s.normalizePath(req.Path)
+	if err != nil {
+		log.Error(err)
+		return &pb.ListResp{}, toGRPCError(err)
+	}
 
 	log.Infof("path is %s", p)
 
-	ts := time.Now().Unix()
-	err = s.db.Where("(path LIKE ? OR path=? ) AND m_time < ?", p+"/%", p, ts).Delete(record{}).Error
-	if err != nil {
+	if err = s.authorize(idt, p); err != nil {
 		log.Error(err)
-		return &pb.Void{}, err
+		return &pb.ListResp{}, toGRPCError(err)
 	}
 
-	etag, err := uuid.NewV4()
-	if err != nil {
-		return &pb.Void{}, err
+	if err = validateKind(req.Kind); err != nil {
+		log.Error(err)
+		return &pb.ListResp{}, toGRPCError(err)
+	}
+
+	// without page size nor token the whole listing is returned at once
+	pageSize := int(req.PageSize)
+	if pageSize < 0 {
+		return &pb.ListResp{}, grpc.Errorf(codes.InvalidArgument, "page size %d is negative", req.PageSize)
+	}
+	if pageSize == 0 && req.PageToken != "" {
+		pageSize = defaultListPageSize
+	}
+	if pageSize > maxListPageSize {
+		pageSize = maxListPageSize
+	}
+
+	db := s.db
+	if req.PageToken != "" {
+		after, err := decodePageToken(req.PageToken, p)
+		if err != nil {
+			log.Error(err)
+			return &pb.ListResp{}, err
+		}
+		db = db.Where("path > ?", after)
+	}
+	if req.Kind != pb.Kind_UNKNOWN {
+		db = db.Where("kind=?", req.Kind)
+	}
+	// one more record tells if there is a next page
+	if pageSize > 0 {
+		db = db.Limit(pageSize + 1)
 	}
 
-	err = s.propagateChanges(ctx, p, etag.String(), uint32(ts), "")
+	var recs []record
+	if req.Recursive {
+		err = db.Scopes(withDescendants(p)).Order("path").Find(&recs).Error
+	} else {
+		err = db.Scopes(withChildren(p)).Order("path").Find(&recs).Error
+	}
 	if err != nil {
 		log.Error(err)
+		return &pb.ListResp{}, toGRPCError(err)
 	}
 
-	log.Infof("propagated changes till %s", "")
+	log.Infof("found %d entries", len(recs))
 
-	return &pb.Void{}, nil
+	res := &pb.ListResp{}
+	if pageSize > 0 && len(recs) > pageSize {
+		recs = recs[:pageSize]
+		res.NextPageToken = encodePageToken(recs[pageSize-1].Path)
+	}
+	for i := range recs {
+		res.Records = append(res.Records, recs[i].toProto())
+	}
+	return res, nil
 }
 
-func (s *server) Put(ctx context.Context, req *pb.PutReq) (*pb.Void, error) {
+func (s *server) Stat(ctx context.Context, req *pb.StatReq) (*pb.Record, error) {
 
-	traceID, err := getGRPCTraceID(ctx)
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
 	if err != nil {
-		rus.Error(err)
-		return &pb.Void{}, err
+		log.Error(err)
+		return &pb.Record{}, toGRPCError(err)
 	}
-	log := rus.WithField("trace", traceID).WithField("svc", serviceID)
-	ctx = newGRPCTraceContext(ctx, traceID)
+	defer s.release()
+
+	ctx, span := s.startSpan(ctx, "stat")
+	defer span.finish(nil)
 
 	log.Info("request started")
 
@@ -325,153 +674,3821 @@ func (s *server) Put(ctx context.Context, req *pb.PutReq) (*pb.Void, error) {
 
 		// Log access info
 		log.WithFields(rus.Fields{
-			"method":   "put",
+			"method":   "stat",
 			"type":     "grpcaccess",
 			"duration": reqDur.Seconds(),
 		}).Info("request finished")
 
 	}()
 
-	idt, err := lib.ParseToken(req.AccessToken, s.p.sharedSecret)
+	idt, err := s.identity(ctx)
 	if err != nil {
 		log.Error(err)
-		return &pb.Void{}, unauthenticatedError
+		return &pb.Record{}, unauthenticatedError
 	}
 
 	log.Infof("%s", idt)
 
-	p := path.Clean(req.Path)
-
-	log.Infof("path is %s", p)
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.Record{}, toGRPCError(err)
+	}
 
-	var id string
-	rawEtag, err := uuid.NewV4()
+	p, err := s.normalizePath(req.Path)
 	if err != nil {
 		log.Error(err)
-		return &pb.Void{}, err
+		return &pb.Record{}, toGRPCError(err)
 	}
-	etag := rawEtag.String()
 
-	var mtime = uint32(time.Now().Unix())
+	log.Infof("path is %s", p)
+
+	if err = s.authorize(idt, p); err != nil {
+		log.Error(err)
+		return &pb.Record{}, toGRPCError(err)
+	}
 
-	r, err := s.getByPath(p)
+	// unlike Get, Stat never creates the record as a side effect
+	rec, err := s.getByPath(ctx, p)
 	if err != nil {
 		log.Error(err)
 		if err == gorm.RecordNotFound {
-			rawEtag, err := uuid.NewV4()
-			if err != nil {
-				log.Error(err)
-				return &pb.Void{}, err
-			}
-
-			id = rawEtag.String()
-		} else {
-			return &pb.Void{}, err
+			return &pb.Record{}, grpc.Errorf(codes.NotFound, "path %s not found", p)
 		}
-	} else {
-		id = r.ID
+		return &pb.Record{}, toGRPCError(err)
 	}
 
-	log.Infof("new record will have id=%s path=%s checksum=%s etag=%s mtime=%d", id, p, req.Checksum, etag, mtime)
+	return rec.toProto(), nil
+}
 
-	err = s.insert(id, p, req.Checksum, etag, mtime)
-	if err != nil {
-		log.Error(err)
-		return &pb.Void{}, err
-	}
+func (s *server) BatchGet(ctx context.Context, req *pb.BatchGetReq) (*pb.BatchGetResp, error) {
 
-	log.Infof("new record saved to db")
+	log := s.requestLogger(ctx)
 
-	err = s.propagateChanges(ctx, p, etag, mtime, "")
+	err := s.acquire()
 	if err != nil {
 		log.Error(err)
+		return &pb.BatchGetResp{}, toGRPCError(err)
 	}
+	defer s.release()
 
-	log.Infof("propagated changes till ancestor %s", "")
+	ctx, span := s.startSpan(ctx, "batchget")
+	defer span.finish(nil)
 
-	return &pb.Void{}, nil
-}
+	log.Info("request started")
 
-func (s *server) getByPath(path string) (*record, error) {
+	// Time request
+	reqStart := time.Now()
 
-	r := &record{}
-	err := s.db.Where("path=?", path).First(r).Error
-	return r, err
-}
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
 
-func (s *server) insert(id, p, checksum, etag string, mtime uint32) error {
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "batchget",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
 
-	err := s.db.Exec(`INSERT INTO records (id,path,checksum, e_tag, m_time) VALUES (?,?,?,?,?)
-	ON DUPLICATE KEY UPDATE checksum=VALUES(checksum), e_tag=VALUES(e_tag), m_time=VALUES(m_time)`,
-		id, p, checksum, etag, mtime).Error
+	}()
 
+	idt, err := s.identity(ctx)
 	if err != nil {
-		return err
+		log.Error(err)
+		return &pb.BatchGetResp{}, unauthenticatedError
 	}
 
-	return nil
-}
-func (s *server) update(p, etag string, mtime uint32) int64 {
+	log.Infof("%s", idt)
 
-	return s.db.Model(record{}).Where("path=? AND m_time < ?", p, mtime).Updates(record{ETag: etag, MTime: mtime}).RowsAffected
-}
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.BatchGetResp{}, toGRPCError(err)
+	}
 
-// propagateChanges propagates mtime and etag until the user home directory
-// This propagation is needed for the client to discover changes
-// Ex: given the successful upload of the file /local/users/d/demo/photos/1.png
-// the etag and mtime will be propagated to:
-//    - /local/users/d/demo/photos
-//    - /local/users/d/demo
-func (s *server) propagateChanges(ctx context.Context, p, etag string, mtime uint32, stopPath string) error {
+	paths := []string{}
+	for _, p := range req.Paths {
+		p, err = s.normalizePath(p)
+		if err != nil {
+			log.Error(err)
+			return &pb.BatchGetResp{}, toGRPCError(err)
+		}
+		if err = s.authorize(idt, p); err != nil {
+			log.Error(err)
+			return &pb.BatchGetResp{}, toGRPCError(err)
+		}
+		paths = append(paths, p)
+	}
 
-	traceID, err := getGRPCTraceID(ctx)
+	log.Infof("%d paths requested", len(paths))
+
+	res := &pb.BatchGetResp{}
+	if len(paths) == 0 {
+		return res, nil
+	}
+
+	var recs []record
+	err = s.db.Where("path IN (?)", paths).Find(&recs).Error
 	if err != nil {
-		rus.Error(err)
-		return err
+		log.Error(err)
+		return &pb.BatchGetResp{}, toGRPCError(err)
+	}
+
+	byPath := map[string]*record{}
+	for i := range recs {
+		byPath[recs[i].Path] = &recs[i]
 	}
-	log := rus.WithField("trace", traceID).WithField("svc", serviceID)
-	ctx = newGRPCTraceContext(ctx, traceID)
 
-	// TODO(labkode) assert the list ordered from most deeper to less so we can shortcircuit
-	// after first miss
-	paths := getPathsTillHome(ctx, p)
 	for _, p := range paths {
-		numRows := s.update(p, etag, mtime)
-		if numRows == 0 {
-			log.Warnf("parent path %s has been updated in the meanwhile so we do not override with old info. Propagation stopped", p)
-			// Following the CAS tree approach it does not make sense to update\
-			// parents if child has been updated wit new info
-			break
+		rec, ok := byPath[p]
+		if !ok {
+			res.NotFound = append(res.NotFound, p)
+			continue
 		}
-		log.Infof("parent path %s has being updated", p)
+		res.Records = append(res.Records, rec.toProto())
 	}
 
-	return nil
+	log.Infof("found %d entries", len(res.Records))
+
+	return res, nil
 }
 
-func getPathsTillHome(ctx context.Context, p string) []string {
+func (s *server) Exists(ctx context.Context, req *pb.ExistsReq) (*pb.ExistsResp, error) {
 
-	traceID, err := getGRPCTraceID(ctx)
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
 	if err != nil {
-		rus.Error(err)
-		// FIX: we do not return here the error to not pollute code
-		// that calls this one
+		log.Error(err)
+		return &pb.ExistsResp{}, toGRPCError(err)
 	}
-	log := rus.WithField("trace", traceID).WithField("svc", serviceID)
-	ctx = newGRPCTraceContext(ctx, traceID)
+	defer s.release()
 
-	paths := []string{}
-	tokens := strings.Split(p, "/")
+	ctx, span := s.startSpan(ctx, "exists")
+	defer span.finish(nil)
 
-	if len(tokens) < 5 {
-		// if not under home dir we do not propagate
-		return paths
-	}
+	log.Info("request started")
 
-	homeTokens := tokens[0:5]
-	restTokens := tokens[5:]
+	// Time request
+	reqStart := time.Now()
 
-	home := path.Clean("/" + path.Join(homeTokens...))
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "exists",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	idt, err := s.identity(ctx)
+	if err != nil {
+		log.Error(err)
+		return &pb.ExistsResp{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.ExistsResp{}, toGRPCError(err)
+	}
+
+	p, err := s.normalizePath(req.Path)
+	if err != nil {
+		log.Error(err)
+		return &pb.ExistsResp{}, toGRPCError(err)
+	}
+
+	log.Infof("path is %s", p)
+
+	if err = s.authorize(idt, p); err != nil {
+		log.Error(err)
+		return &pb.ExistsResp{}, toGRPCError(err)
+	}
+
+	// count instead of loading the record, it never creates one
+	var count int
+	err = s.db.Model(&record{}).Where("path=?", p).Count(&count).Error
+	if err != nil {
+		log.Error(err)
+		return &pb.ExistsResp{}, toGRPCError(err)
+	}
+
+	res := &pb.ExistsResp{}
+	res.Exists = count > 0
+	return res, nil
+}
+
+func (s *server) GetByID(ctx context.Context, req *pb.GetByIdReq) (*pb.Record, error) {
+
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
+	if err != nil {
+		log.Error(err)
+		return &pb.Record{}, toGRPCError(err)
+	}
+	defer s.release()
+
+	ctx, span := s.startSpan(ctx, "getbyid")
+	defer span.finish(nil)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "getbyid",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	idt, err := s.identity(ctx)
+	if err != nil {
+		log.Error(err)
+		return &pb.Record{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.Record{}, toGRPCError(err)
+	}
+
+	log.Infof("id is %s", req.Id)
+
+	rec := &record{}
+	err = s.db.Where("id=?", req.Id).First(rec).Error
+	if err != nil {
+		log.Error(err)
+		if err == gorm.RecordNotFound {
+			return &pb.Record{}, grpc.Errorf(codes.NotFound, "id %s not found", req.Id)
+		}
+		return &pb.Record{}, toGRPCError(err)
+	}
+
+	if err = s.authorize(idt, rec.Path); err != nil {
+		log.Error(err)
+		return &pb.Record{}, toGRPCError(err)
+	}
+
+	return rec.toProto(), nil
+}
+
+func (s *server) ChangesSince(ctx context.Context, req *pb.ChangesReq) (*pb.ChangesResp, error) {
+
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
+	if err != nil {
+		log.Error(err)
+		return &pb.ChangesResp{}, toGRPCError(err)
+	}
+	defer s.release()
+
+	ctx, span := s.startSpan(ctx, "changessince")
+	defer span.finish(nil)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "changessince",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	idt, err := s.identity(ctx)
+	if err != nil {
+		log.Error(err)
+		return &pb.ChangesResp{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.ChangesResp{}, toGRPCError(err)
+	}
+
+	p, err := s.normalizePath(req.Path)
+	if err != nil {
+		log.Error(err)
+		return &pb.ChangesResp{}, toGRPCError(err)
+	}
+
+	log.Infof("path is %s", p)
+
+	if err = s.authorize(idt, p); err != nil {
+		log.Error(err)
+		return &pb.ChangesResp{}, toGRPCError(err)
+	}
+
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = defaultChangesLimit
+	}
+
+	// the records in the trash are the tombstones of the removals
+	q := s.db.Scopes(withPathPrefix(p))
+	if s.p.softDelete {
+		q = q.Unscoped()
+	}
+	if req.ContinuationToken != "" {
+		mtime, lastPath, err := decodeChangesToken(req.ContinuationToken)
+		if err != nil {
+			log.Error(err)
+			return &pb.ChangesResp{}, grpc.Errorf(codes.InvalidArgument, "invalid continuation token")
+		}
+		// keyset pagination over (m_time, path) so records sharing
+		// the same mtime are neither skipped nor repeated
+		q = q.Where("m_time > ? OR (m_time = ? AND path > ?)", mtime, mtime, lastPath)
+	} else {
+		q = q.Where("m_time > ?", req.Since)
+	}
+
+	var recs []record
+	err = q.Order("m_time").Order("path").Limit(limit).Find(&recs).Error
+	if err != nil {
+		log.Error(err)
+		return &pb.ChangesResp{}, toGRPCError(err)
+	}
+
+	log.Infof("found %d changes", len(recs))
+
+	res := &pb.ChangesResp{}
+	for i := range recs {
+		res.Records = append(res.Records, recs[i].toProto())
+	}
+	if len(recs) == limit {
+		last := recs[len(recs)-1]
+		res.ContinuationToken = encodeChangesToken(last.MTime, last.Path)
+	}
+	return res, nil
+}
+
+func (s *server) ListByCheckpoint(ctx context.Context, req *pb.CheckpointReq) (*pb.CheckpointResp, error) {
+
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
+	if err != nil {
+		log.Error(err)
+		return &pb.CheckpointResp{}, toGRPCError(err)
+	}
+	defer s.release()
+
+	ctx, span := s.startSpan(ctx, "listbycheckpoint")
+	defer span.finish(nil)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "listbycheckpoint",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	idt, err := s.identity(ctx)
+	if err != nil {
+		log.Error(err)
+		return &pb.CheckpointResp{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.CheckpointResp{}, toGRPCError(err)
+	}
+
+	p, err := s.normalizePath(req.Path)
+	if err != nil {
+		log.Error(err)
+		return &pb.CheckpointResp{}, toGRPCError(err)
+	}
+
+	log.Infof("path is %s", p)
+
+	if err = s.authorize(idt, p); err != nil {
+		log.Error(err)
+		return &pb.CheckpointResp{}, toGRPCError(err)
+	}
+
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = defaultChangesLimit
+	}
+
+	// the records in the trash are the tombstones of the removals
+	q := s.db.Scopes(withPathPrefix(p))
+	if s.p.softDelete {
+		q = q.Unscoped()
+	}
+	checkpoint := req.Checkpoint
+	if req.ContinuationToken != "" {
+		seq, lastPath, err := decodeChangesToken(req.ContinuationToken)
+		if err != nil {
+			log.Error(err)
+			return &pb.CheckpointResp{}, grpc.Errorf(codes.InvalidArgument, "invalid continuation token")
+		}
+		// the records written by the same transaction share the seq
+		q = q.Where("seq > ? OR (seq = ? AND path > ?)", seq, seq, lastPath)
+		checkpoint = seq
+	} else {
+		q = q.Where("seq > ?", req.Checkpoint)
+	}
+
+	var recs []record
+	err = q.Order("seq").Order("path").Limit(limit).Find(&recs).Error
+	if err != nil {
+		log.Error(err)
+		return &pb.CheckpointResp{}, toGRPCError(err)
+	}
+
+	log.Infof("found %d changes after seq %d", len(recs), checkpoint)
+
+	res := &pb.CheckpointResp{}
+	for i := range recs {
+		res.Records = append(res.Records, recs[i].toProto())
+	}
+	res.Checkpoint = checkpoint
+	if len(recs) > 0 {
+		res.Checkpoint = recs[len(recs)-1].Seq
+	}
+	if len(recs) == limit {
+		last := recs[len(recs)-1]
+		res.ContinuationToken = encodeChangesToken(last.Seq, last.Path)
+	}
+	return res, nil
+}
+
+func (s *server) Mv(ctx context.Context, req *pb.MvReq) (*pb.MvResp, error) {
+
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
+	if err != nil {
+		log.Error(err)
+		return &pb.MvResp{}, toGRPCError(err)
+	}
+	defer s.release()
+
+	if err = s.writable(); err != nil {
+		log.Error(err)
+		return &pb.MvResp{}, toGRPCError(err)
+	}
+
+	ctx, span := s.startSpan(ctx, "mv")
+	defer span.finish(nil)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "mv",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	idt, err := s.identity(ctx)
+	if err != nil {
+		log.Error(err)
+		return &pb.MvResp{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.MvResp{}, toGRPCError(err)
+	}
+
+	src, err := s.normalizePath(req.Src)
+	if err != nil {
+		log.Error(err)
+		return &pb.MvResp{}, toGRPCError(err)
+	}
+
+	dst, err := s.normalizePath(req.Dst)
+	if err != nil {
+		log.Error(err)
+		return &pb.MvResp{}, toGRPCError(err)
+	}
+
+	log.Infof("src path is %s", src)
+	log.Infof("dst path is %s", dst)
+
+	if err = s.authorize(idt, src); err != nil {
+		log.Error(err)
+		return &pb.MvResp{}, toGRPCError(err)
+	}
+
+	if err = s.authorize(idt, dst); err != nil {
+		log.Error(err)
+		return &pb.MvResp{}, toGRPCError(err)
+	}
+
+	// authorize only checks the owner token of the paths, the homes
+	// may still differ in the other ones
+	if homeOf(src, s.p.homeDepth) != homeOf(dst, s.p.homeDepth) {
+		log.Errorf("src %s and dst %s are in different homes", src, dst)
+		return &pb.MvResp{}, permissionDenied
+	}
+
+	if strings.HasPrefix(dst, src+"/") {
+		return &pb.MvResp{}, grpc.Errorf(codes.InvalidArgument, "cannot move %s into itself", src)
+	}
+
+	if err = validateETag(req.Etag); err != nil {
+		log.Error(err)
+		return &pb.MvResp{}, toGRPCError(err)
+	}
+
+	if err = validateMTime(req.Mtime, s.p.clock.Now()); err != nil {
+		log.Error(err)
+		return &pb.MvResp{}, toGRPCError(err)
+	}
+
+	// the moved records would collide with the ones at dst. Moving src
+	// onto itself renames nothing so it never collides.
+	occupied := func(db *gorm.DB) (bool, error) {
+		if dst == src {
+			return false, nil
+		}
+		var count int64
+		err := db.Model(record{}).Scopes(withPathPrefix(dst)).Count(&count).Error
+		return count > 0, err
+	}
+
+	if !req.Overwrite {
+		exists, err := occupied(s.db)
+		if err != nil {
+			log.Error(err)
+			return &pb.MvResp{}, toGRPCError(err)
+		}
+		if exists {
+			return &pb.MvResp{}, grpc.Errorf(codes.AlreadyExists, "path %s already exists", dst)
+		}
+	}
+
+	if err = s.limitSubtree(s.db.Model(record{}).Scopes(withPathPrefix(src)), src); err != nil {
+		log.Error(err)
+		return &pb.MvResp{}, toGRPCError(err)
+	}
+
+	if req.DryRun {
+		paths := []string{}
+		err = s.db.Model(record{}).Scopes(withPathPrefix(src)).Order("path").Pluck("path", &paths).Error
+		if err != nil {
+			log.Error(err)
+			return &pb.MvResp{}, toGRPCError(err)
+		}
+		log.Infof("dry run: %d entries would be renamed", len(paths))
+		return &pb.MvResp{Paths: paths}, nil
+	}
+
+	// a replica applies the etag and mtime generated by the primary
+	etag := req.Etag
+	if etag == "" {
+		etag, err = s.p.idGen()
+		if err != nil {
+			log.Error(err)
+			return &pb.MvResp{}, toGRPCError(err)
+		}
+	}
+	mtime := req.Mtime
+	if mtime == 0 {
+		mtime = s.p.clock.Now().Unix()
+	}
+
+	// the rename and the propagation are committed together, the
+	// transaction is run again as a whole on transient errors
+	var root *record
+	var moved []*pb.Record
+	var overwritten bool
+	defer s.lockHomes(src, dst)()
+	err = s.transaction(ctx, func(tx *gorm.DB) error {
+		root, moved, overwritten = nil, nil, false
+
+		// src is checked before dst is touched, an overwrite of dst by
+		// a missing src would only remove it.
+		// A single file, the common case, is renamed with one statement
+		// instead of paging the subtree.
+		recs, err := getRecordsPageWithPathPrefix(tx, src, "", 2)
+		if err != nil {
+			return err
+		}
+		if len(recs) == 0 {
+			return grpc.Errorf(codes.NotFound, "path %s not found", src)
+		}
+
+		// records in the trash under dst would collide with the moved ones
+		err = purgeTrash(tx, dst)
+		if err != nil {
+			return err
+		}
+
+		// dst may have been created since it was checked
+		exists, err := occupied(tx)
+		if err != nil {
+			return err
+		}
+		if exists && !req.Overwrite {
+			return grpc.Errorf(codes.AlreadyExists, "path %s already exists", dst)
+		}
+		if exists {
+			var size int64
+			if rec, err := getRecordByPath(tx, dst); err == nil {
+				size = rec.Size
+			}
+			log.Infof("dst path %s will be overwritten", dst)
+
+			// the records at the paths of the moved ones, in the trash
+			// they would still collide with them, are removed for good
+			srcPaths := []string{}
+			err = tx.Model(record{}).Scopes(withPathPrefix(src)).Pluck("path", &srcPaths).Error
+			if err != nil {
+				return err
+			}
+			paths := make([]string, len(srcPaths))
+			for i, sp := range srcPaths {
+				paths[i] = rebasePath(sp, src, dst)
+			}
+			if err = purgePaths(tx, paths); err != nil {
+				return err
+			}
+
+			// the other overwritten records are removed like Rm does, so
+			// they are left as tombstones when the trash is enabled
+			_, err = s.removeRecords(s.forDelete(tx).Model(record{}).Scopes(withPathPrefix(dst)), mtime)
+			if err != nil {
+				return err
+			}
+			overwritten = true
+
+			err = s.updateSize(ctx, tx, dst, -size, "")
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(recs) == 1 && recs[0].Path == src {
+			root = &recs[0]
+			moved, err = s.renameRecord(ctx, tx, root, dst)
+		} else {
+			root, moved, err = s.rebaseSubtree(ctx, tx, src, dst)
+		}
+		if err != nil {
+			return err
+		}
+
+		err = s.markFolders(ctx, tx, []string{parentPath(dst)})
+		if err != nil {
+			return err
+		}
+
+		// the size moves from the ancestors of src to the ones of dst,
+		// the common ancestors keep it
+		common := commonAncestor(src, dst)
+		if root != nil {
+			err = s.updateSize(ctx, tx, src, -root.Size, common)
+			if err == nil {
+				err = s.updateSize(ctx, tx, dst, root.Size, common)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		// the ancestors from the common one are shared by src and dst,
+		// they are propagated to once
+		return s.propagateMany(ctx, tx, []string{dst, src}, etag, mtime)
+	})
+	if err != nil {
+		log.Error(err)
+		return &pb.MvResp{}, toGRPCError(err)
+	}
+
+	log.Infof("renamed %d entries", len(moved))
+
+	if overwritten {
+		s.hub.publish(&pb.Record{Path: dst, Modified: mtime, Deleted: true})
+	}
+	// watchers below src learn about the removal of the whole subtree
+	s.hub.publish(&pb.Record{Path: src, Modified: mtime, Deleted: true})
+	if root != nil {
+		root.Path = dst
+		s.hub.publish(root.toProto())
+	}
+
+	// the records keep their etag, the new one is the one of the ancestors
+	res := &pb.MvResp{}
+	res.Records = moved
+	res.Etag = etag
+	res.Modified = mtime
+	return res, nil
+}
+
+// renameRecord renames rec, that has no descendants, to dst and returns
+// it at its new path.
+func (s *server) renameRecord(ctx context.Context, tx *gorm.DB, rec *record, dst string) ([]*pb.Record, error) {
+
+	log := s.requestLogger(ctx)
+	log.Infof("src path %s will be renamed to %s", rec.Path, dst)
+
+	err := tx.Model(record{}).Where("id=?", rec.ID).Updates(record{Path: dst, ParentPath: parentPath(dst)}).Error
+	if err != nil {
+		return nil, err
+	}
+	moved := rec.toProto()
+	moved.Path = dst
+	return []*pb.Record{moved}, nil
+}
+
+// rebaseSubtree renames src and its descendants to be below dst. It
+// returns the record of src, nil if it does not exist, and the records at
+// their new paths.
+func (s *server) rebaseSubtree(ctx context.Context, tx *gorm.DB, src, dst string) (*record, []*pb.Record, error) {
+
+	log := s.requestLogger(ctx)
+
+	var root *record
+	var moved []*pb.Record
+
+	// the subtree is processed in pages to not load it in memory at once.
+	// The root comes first because it is the shortest path.
+	var last string
+	for {
+		recs, err := getRecordsPageWithPathPrefix(tx, src, last, subtreePageSize)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(recs) == 0 {
+			break
+		}
+		if root == nil && recs[0].Path == src {
+			root = &recs[0]
+		}
+
+		for _, rec := range recs {
+			if err = ctxError(ctx); err != nil {
+				return nil, nil, err
+			}
+
+			newPath := rebasePath(rec.Path, src, dst)
+			log.Infof("src path %s will be renamed to %s", rec.Path, newPath)
+
+			// dst is valid but the paths below it may be too long
+			if err = s.validatePath(newPath); err != nil {
+				return nil, nil, err
+			}
+
+			err = tx.Model(record{}).Where("id=?", rec.ID).Updates(record{Path: newPath, ParentPath: parentPath(newPath)}).Error
+			if err != nil {
+				return nil, nil, err
+			}
+
+			pr := rec.toProto()
+			pr.Path = newPath
+			moved = append(moved, pr)
+		}
+
+		last = recs[len(recs)-1].Path
+	}
+
+	return root, moved, nil
+}
+
+func (s *server) Copy(ctx context.Context, req *pb.CopyReq) (*pb.Void, error) {
+
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+	defer s.release()
+
+	if err = s.writable(); err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	ctx, span := s.startSpan(ctx, "copy")
+	defer span.finish(nil)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "copy",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	idt, err := s.identity(ctx)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	src, err := s.normalizePath(req.Src)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	dst, err := s.normalizePath(req.Dst)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	log.Infof("src path is %s", src)
+	log.Infof("dst path is %s", dst)
+
+	if err = s.authorize(idt, src); err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	if err = s.authorize(idt, dst); err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	if dst == src || strings.HasPrefix(dst, src+"/") {
+		return &pb.Void{}, grpc.Errorf(codes.InvalidArgument, "cannot copy %s into itself", src)
+	}
+
+	if err = s.limitSubtree(s.db.Model(record{}).Scopes(withPathPrefix(src)), src); err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	etag, err := s.p.idGen()
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+	mtime := s.p.clock.Now().Unix()
+
+	// the copies and the propagation are committed together, the
+	// transaction is run again as a whole on transient errors
+	var recs []record
+	var copies []*record
+	var overwritten bool
+	defer s.lockHomes(dst)()
+	err = s.transaction(ctx, func(tx *gorm.DB) error {
+		var err error
+		recs, err = getRecordsWithPathPrefix(tx, src)
+		if err != nil {
+			return err
+		}
+		if len(recs) == 0 {
+			return grpc.Errorf(codes.NotFound, "path %s not found", src)
+		}
+
+		dstRecs, err := getRecordsWithPathPrefix(tx, dst)
+		if err != nil {
+			return err
+		}
+		// the size of dst ancestors changes by the size of the copied
+		// root minus the size of the overwritten one
+		var sizeDelta int64
+		for _, rec := range dstRecs {
+			if rec.Path == dst {
+				sizeDelta -= rec.Size
+			}
+		}
+
+		if len(dstRecs) > 0 && !req.Overwrite {
+			return grpc.Errorf(codes.AlreadyExists, "path %s already exists", dst)
+		}
+
+		// the records at the paths of the copies, overwritten or in the
+		// trash, would collide with them so they are replaced for good
+		paths := make([]string, len(recs))
+		for i, rec := range recs {
+			paths[i] = rebasePath(rec.Path, src, dst)
+		}
+		if err = purgePaths(tx, paths); err != nil {
+			return err
+		}
+
+		// the other overwritten records are removed like Rm does, so
+		// they are left as tombstones when the trash is enabled
+		overwritten = len(dstRecs) > 0
+		if overwritten {
+			removed, err := s.removeRecords(s.forDelete(tx).Model(record{}).Scopes(withPathPrefix(dst)), mtime)
+			if err != nil {
+				return err
+			}
+			log.Infof("removed %d entries under dst path %s, %d replaced by the copies", len(dstRecs), dst, int64(len(dstRecs))-removed)
+		}
+
+		copies = []*record{}
+		for _, rec := range recs {
+			if err = ctxError(ctx); err != nil {
+				return err
+			}
+
+			id, err := s.p.idGen()
+			if err != nil {
+				return err
+			}
+
+			cp := &record{}
+			cp.ID = id
+			cp.Path = rebasePath(rec.Path, src, dst)
+			cp.ParentPath = parentPath(cp.Path)
+
+			// dst is valid but the paths below it may be too long
+			if err = s.validatePath(cp.Path); err != nil {
+				return err
+			}
+
+			cp.Checksum = rec.Checksum
+			cp.ETag = rec.ETag
+			cp.MTime = rec.MTime
+			cp.Size = rec.Size
+			cp.Kind = rec.Kind
+
+			// the copied root gets fresh info so the change is discovered.
+			// With children etags it keeps the etag of src, as it has the
+			// same children.
+			if rec.Path == src {
+				if !s.p.childrenETags {
+					cp.ETag = etag
+				}
+				cp.MTime = mtime
+			}
+
+			log.Infof("src path %s will be copied to %s", rec.Path, cp.Path)
+
+			err = tx.Create(cp).Error
+			if err != nil {
+				return err
+			}
+			copies = append(copies, cp)
+			if rec.Path == src {
+				sizeDelta += rec.Size
+			}
+		}
+
+		err = s.markFolders(ctx, tx, []string{parentPath(dst)})
+		if err != nil {
+			return err
+		}
+
+		err = s.updateSize(ctx, tx, dst, sizeDelta, "")
+		if err != nil {
+			return err
+		}
+
+		err = s.propagateChanges(ctx, tx, dst, etag, mtime, "")
+		if err != nil {
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	log.Infof("copied %d entries", len(recs))
+
+	if overwritten {
+		s.hub.publish(&pb.Record{Path: dst, Modified: mtime, Deleted: true})
+	}
+	for _, cp := range copies {
+		s.hub.publish(cp.toProto())
+	}
+
+	return &pb.Void{}, nil
+}
+
+// getRecordsPageWithPathPrefix returns at most limit records among the record
+// at p and its descendants, ordered by path, with a path greater than after.
+// db can be the server handle or an open transaction.
+func getRecordsPageWithPathPrefix(db *gorm.DB, p, after string, limit int) ([]record, error) {
+
+	var recs []record
+
+	err := db.Scopes(withPathPrefix(p)).Where("path > ?", after).Order("path").Limit(limit).Find(&recs).Error
+	if err != nil {
+		return recs, err
+	}
+
+	return recs, nil
+}
+
+// getRecordsWithPathPrefix returns the record at p and all its descendants.
+// db can be the server handle or an open transaction.
+func getRecordsWithPathPrefix(db *gorm.DB, p string) ([]record, error) {
+
+	var recs []record
+
+	err := db.Scopes(withPathPrefix(p)).Find(&recs).Error
+	if err != nil {
+		return recs, err
+	}
+
+	return recs, nil
+}
+func (s *server) Rm(ctx context.Context, req *pb.RmReq) (*pb.RmResp, error) {
+
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
+	if err != nil {
+		log.Error(err)
+		return &pb.RmResp{}, toGRPCError(err)
+	}
+	defer s.release()
+
+	if err = s.writable(); err != nil {
+		log.Error(err)
+		return &pb.RmResp{}, toGRPCError(err)
+	}
+
+	ctx, span := s.startSpan(ctx, "rm")
+	defer span.finish(nil)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "rm",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	idt, err := s.identity(ctx)
+	if err != nil {
+		log.Error(err)
+		return &pb.RmResp{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.RmResp{}, toGRPCError(err)
+	}
+
+	p, err := s.normalizePath(req.Path)
+	if err != nil {
+		log.Error(err)
+		return &pb.RmResp{}, toGRPCError(err)
+	}
+
+	log.Infof("path is %s", p)
+
+	if err = s.authorize(idt, p); err != nil {
+		log.Error(err)
+		return &pb.RmResp{}, toGRPCError(err)
+	}
+
+	if err = validateETag(req.Etag); err != nil {
+		log.Error(err)
+		return &pb.RmResp{}, toGRPCError(err)
+	}
+
+	if err = validateMTime(req.Mtime, s.p.clock.Now()); err != nil {
+		log.Error(err)
+		return &pb.RmResp{}, toGRPCError(err)
+	}
+
+	// the whole subtree is removed, including the records modified in
+	// the current second, unless the client asks to keep the newer ones
+	selection := func(db *gorm.DB) *gorm.DB {
+		db = s.forDelete(db).Model(record{}).Scopes(withPathPrefix(p))
+		if req.OlderThan > 0 {
+			db = db.Where("m_time < ?", req.OlderThan)
+		}
+		return db
+	}
+
+	if err = s.limitSubtree(selection(s.db), p); err != nil {
+		log.Error(err)
+		return &pb.RmResp{}, toGRPCError(err)
+	}
+
+	if req.DryRun {
+		paths := []string{}
+		err = selection(s.db).Order("path").Pluck("path", &paths).Error
+		if err != nil {
+			log.Error(err)
+			return &pb.RmResp{}, toGRPCError(err)
+		}
+		log.Infof("dry run: %d records would be deleted", len(paths))
+		if len(paths) == 0 && req.Strict {
+			return &pb.RmResp{}, grpc.Errorf(codes.NotFound, "path %s not found", p)
+		}
+		return &pb.RmResp{Deleted: int64(len(paths)), Paths: paths}, nil
+	}
+
+	// a replica applies the etag and mtime generated by the primary
+	etag := req.Etag
+	if etag == "" {
+		etag, err = s.p.idGen()
+		if err != nil {
+			log.Error(err)
+			return &pb.RmResp{}, toGRPCError(err)
+		}
+	}
+	ts := req.Mtime
+	if ts == 0 {
+		ts = s.p.clock.Now().Unix()
+	}
+
+	// the removal and the propagation are committed together
+	var deleted int64
+	var removed []string
+	defer s.lockHomes(p)()
+	err = s.transaction(ctx, func(tx *gorm.DB) error {
+		// the top-most records removed are the ones whose sizes leave
+		// their ancestors and the ones watchers are told about, that
+		// may not include p when OlderThan keeps it
+		var recs []record
+		err := selection(tx).Select("path, size").Order("path").Find(&recs).Error
+		if err != nil {
+			return err
+		}
+		roots := map[string]bool{}
+		tops := []record{}
+		removed = []string{}
+		for _, rec := range recs {
+			if !underRoot(rec.Path, roots) {
+				roots[rec.Path] = true
+				tops = append(tops, rec)
+				removed = append(removed, rec.Path)
+			}
+		}
+
+		deleted, err = s.removeRecords(selection(tx), ts)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("%d records deleted", deleted)
+
+		// nothing changed so there is nothing to propagate
+		if deleted == 0 {
+			return nil
+		}
+
+		for _, rec := range tops {
+			err = s.updateSize(ctx, tx, rec.Path, -rec.Size, "")
+			if err != nil {
+				return err
+			}
+		}
+
+		err = s.propagateChanges(ctx, tx, p, etag, ts, "")
+		if err != nil {
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+		return &pb.RmResp{}, toGRPCError(err)
+	}
+
+	if deleted == 0 {
+		if req.Strict {
+			return &pb.RmResp{}, grpc.Errorf(codes.NotFound, "path %s not found", p)
+		}
+		return &pb.RmResp{}, nil
+	}
+
+	for _, rp := range removed {
+		s.hub.publish(&pb.Record{Path: rp, Modified: ts, Deleted: true})
+	}
+
+	return &pb.RmResp{Deleted: deleted}, nil
+}
+
+func (s *server) RmMany(ctx context.Context, req *pb.RmManyReq) (*pb.RmResp, error) {
+
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
+	if err != nil {
+		log.Error(err)
+		return &pb.RmResp{}, toGRPCError(err)
+	}
+	defer s.release()
+
+	if err = s.writable(); err != nil {
+		log.Error(err)
+		return &pb.RmResp{}, toGRPCError(err)
+	}
+
+	ctx, span := s.startSpan(ctx, "rmmany")
+	defer span.finish(nil)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "rmmany",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	idt, err := s.identity(ctx)
+	if err != nil {
+		log.Error(err)
+		return &pb.RmResp{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.RmResp{}, toGRPCError(err)
+	}
+
+	// the paths are removed in order so the ones below another requested
+	// path are found already removed with it
+	seen := map[string]bool{}
+	paths := []string{}
+	for _, rp := range req.Paths {
+		p, err := s.normalizePath(rp)
+		if err != nil {
+			log.Error(err)
+			return &pb.RmResp{}, toGRPCError(err)
+		}
+		if err = s.authorize(idt, p); err != nil {
+			log.Error(err)
+			return &pb.RmResp{}, toGRPCError(err)
+		}
+		if err = s.limitSubtree(s.forDelete(s.db).Model(record{}).Scopes(withPathPrefix(p)), p); err != nil {
+			log.Error(err)
+			return &pb.RmResp{}, toGRPCError(err)
+		}
+		if !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	log.Infof("%d paths to remove", len(paths))
+
+	etag, err := s.p.idGen()
+	if err != nil {
+		log.Error(err)
+		return &pb.RmResp{}, toGRPCError(err)
+	}
+	ts := s.p.clock.Now().Unix()
+
+	// the removals and the propagation are committed together
+	var deleted int64
+	var removed, notFound []string
+	defer s.lockHomes(paths...)()
+	err = s.transaction(ctx, func(tx *gorm.DB) error {
+		deleted = 0
+		removed, notFound = []string{}, []string{}
+
+		roots := map[string]bool{}
+
+		for _, p := range paths {
+			if err := ctxError(ctx); err != nil {
+				return err
+			}
+
+			if underRoot(p, roots) {
+				removed = append(removed, p)
+				continue
+			}
+
+			var size int64
+			rec, err := getRecordByPath(tx, p)
+			if err == nil {
+				size = rec.Size
+			} else if err != gorm.RecordNotFound {
+				return err
+			}
+
+			n, err := s.removeRecords(s.forDelete(tx).Model(record{}).Scopes(withPathPrefix(p)), ts)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				notFound = append(notFound, p)
+				continue
+			}
+			deleted += n
+			removed = append(removed, p)
+			roots[p] = true
+
+			err = s.updateSize(ctx, tx, p, -size, "")
+			if err != nil {
+				return err
+			}
+		}
+
+		log.Infof("%d records deleted", deleted)
+
+		// the paths removed along with an ancestor have nothing else
+		// to propagate
+		leaves := []string{}
+		for p := range roots {
+			leaves = append(leaves, p)
+		}
+		err := s.propagateMany(ctx, tx, leaves, etag, ts)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("propagated changes for %d paths", len(leaves))
+
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+		return &pb.RmResp{}, toGRPCError(err)
+	}
+
+	for _, p := range removed {
+		s.hub.publish(&pb.Record{Path: p, Modified: ts, Deleted: true})
+	}
+
+	return &pb.RmResp{Deleted: deleted, Paths: removed, NotFound: notFound}, nil
+}
+
+func (s *server) RmByID(ctx context.Context, req *pb.RmByIdReq) (*pb.RmResp, error) {
+
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
+	if err != nil {
+		log.Error(err)
+		return &pb.RmResp{}, toGRPCError(err)
+	}
+	defer s.release()
+
+	if err = s.writable(); err != nil {
+		log.Error(err)
+		return &pb.RmResp{}, toGRPCError(err)
+	}
+
+	ctx, span := s.startSpan(ctx, "rmbyid")
+	defer span.finish(nil)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "rmbyid",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	idt, err := s.identity(ctx)
+	if err != nil {
+		log.Error(err)
+		return &pb.RmResp{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.RmResp{}, toGRPCError(err)
+	}
+
+	log.Infof("id is %s", req.Id)
+
+	etag, err := s.p.idGen()
+	if err != nil {
+		log.Error(err)
+		return &pb.RmResp{}, toGRPCError(err)
+	}
+	ts := s.p.clock.Now().Unix()
+
+	// the home is locked by the path the record has beforehand, the
+	// moves done by its owner keep it in the same home
+	owned := &record{}
+	if s.db.Where("id=?", req.Id).First(owned).Error == nil {
+		defer s.lockHomes(owned.Path)()
+	}
+
+	// the path is resolved in the transaction so a concurrent move
+	// can not leave the removed records at the old path
+	var p string
+	var deleted int64
+	err = s.transaction(ctx, func(tx *gorm.DB) error {
+		rec := &record{}
+		err := tx.Where("id=?", req.Id).First(rec).Error
+		if err == gorm.RecordNotFound {
+			return grpc.Errorf(codes.NotFound, "id %s not found", req.Id)
+		}
+		if err != nil {
+			return err
+		}
+		p = rec.Path
+
+		log.Infof("path is %s", p)
+
+		if err = s.authorize(idt, p); err != nil {
+			return err
+		}
+
+		selection := s.forDelete(tx).Model(record{})
+		if req.Recursive {
+			selection = selection.Scopes(withPathPrefix(p))
+			if err = s.limitSubtree(selection, p); err != nil {
+				return err
+			}
+		} else {
+			var count int64
+			err = tx.Model(record{}).Scopes(withDescendants(p)).Count(&count).Error
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				return grpc.Errorf(codes.FailedPrecondition, "path %s has %d descendants", p, count)
+			}
+			selection = selection.Where("id=?", rec.ID)
+		}
+
+		deleted, err = s.removeRecords(selection, ts)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("%d records deleted", deleted)
+
+		err = s.updateSize(ctx, tx, p, -rec.Size, "")
+		if err != nil {
+			return err
+		}
+
+		err = s.propagateChanges(ctx, tx, p, etag, ts, "")
+		if err != nil {
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+		return &pb.RmResp{}, toGRPCError(err)
+	}
+
+	s.hub.publish(&pb.Record{Path: p, Modified: ts, Deleted: true})
+
+	return &pb.RmResp{Deleted: deleted}, nil
+}
+
+func (s *server) Put(ctx context.Context, req *pb.PutReq) (*pb.Void, error) {
+
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+	defer s.release()
+
+	if err = s.writable(); err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	ctx, span := s.startSpan(ctx, "put")
+	defer span.finish(nil)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "put",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	idt, err := s.identity(ctx)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	p, err := s.normalizePath(req.Path)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	log.Infof("path is %s", p)
+
+	if err = s.authorize(idt, p); err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	checksum, err := normalizeChecksum(req.Checksum, s.p.legacyChecksums)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	if err = validateETag(req.Etag); err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	if err = validateMTime(req.Mtime, s.p.clock.Now()); err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	if err = validateKind(req.Kind); err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	// a retry of a Put that was already applied is not applied again,
+	// so it neither gets a new etag nor propagates
+	if req.IdempotencyKey != "" {
+		k, err := s.getIdempotencyKey(s.db, req.IdempotencyKey)
+		if err == nil {
+			if k.Path != p {
+				err = grpc.Errorf(codes.InvalidArgument, "idempotency key %s was used for another path", req.IdempotencyKey)
+				log.Error(err)
+				return &pb.Void{}, toGRPCError(err)
+			}
+			log.Infof("put with idempotency key %s already applied with etag %s", req.IdempotencyKey, k.ETag)
+			return &pb.Void{}, nil
+		}
+		if err != gorm.RecordNotFound {
+			log.Error(err)
+			return &pb.Void{}, toGRPCError(err)
+		}
+	}
+
+	var id string
+	etag := req.Etag
+	if etag == "" {
+		rawEtag, err := s.p.idGen()
+		if err != nil {
+			log.Error(err)
+			return &pb.Void{}, toGRPCError(err)
+		}
+		etag = rawEtag
+	}
+
+	var mtime = req.Mtime
+	if mtime == 0 {
+		mtime = s.p.clock.Now().Unix()
+	}
+	var oldSize int64
+	kind := req.Kind
+
+	r, err := s.getByPath(ctx, p)
+	if err != nil {
+		log.Error(err)
+		if err == gorm.RecordNotFound {
+			rawID, err := s.p.idGen()
+			if err != nil {
+				log.Error(err)
+				return &pb.Void{}, toGRPCError(err)
+			}
+
+			id = rawID
+
+			if kind == pb.Kind_UNKNOWN {
+				kind, err = defaultKind(s.db, p)
+				if err != nil {
+					log.Error(err)
+					return &pb.Void{}, toGRPCError(err)
+				}
+			}
+		} else {
+			return &pb.Void{}, toGRPCError(err)
+		}
+	} else {
+		id = r.ID
+		oldSize = r.Size
+		if kind == pb.Kind_UNKNOWN {
+			kind = r.Kind
+		}
+	}
+
+	withChange(log, etag, mtime).Infof("new record will have id=%s path=%s checksum=%s size=%d kind=%s", id, p, checksum, req.Size, kind)
+
+	// the record and the propagation are committed together
+	defer s.lockHomes(p)()
+	err = s.transaction(ctx, func(tx *gorm.DB) error {
+		var err error
+		if req.IfMatchEtag != "" {
+			err = s.updateIfMatch(ctx, tx, p, req.IfMatchEtag, checksum, etag, mtime, req.Size, kind)
+		} else {
+			err = s.insert(ctx, tx, id, p, checksum, etag, mtime, req.Size, kind)
+		}
+		if err != nil {
+			return err
+		}
+
+		log.Infof("new record saved to db")
+
+		created, err := s.createAncestors(ctx, tx, p, etag)
+		if err != nil {
+			return err
+		}
+		if len(created) > 0 {
+			log.Infof("created missing ancestors %+v", created)
+		}
+
+		err = s.markFolders(ctx, tx, []string{parentPath(p)})
+		if err != nil {
+			return err
+		}
+
+		err = s.updateSize(ctx, tx, p, req.Size-oldSize, "")
+		if err != nil {
+			return err
+		}
+
+		err = s.propagateChanges(ctx, tx, p, etag, mtime, "")
+		if err != nil {
+			return err
+		}
+
+		err = s.dateAncestors(ctx, tx, created, etag, mtime)
+		if err != nil {
+			return err
+		}
+
+		if req.IdempotencyKey != "" {
+			return s.saveIdempotencyKey(tx, req.IdempotencyKey, p, etag, s.p.clock.Now().Unix())
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	s.hub.publish((&record{ID: id, Path: p, Checksum: nullChecksum(checksum), ETag: etag, MTime: mtime, Size: req.Size, Kind: kind}).toProto())
+
+	return &pb.Void{}, nil
+}
+
+func (s *server) BatchPut(ctx context.Context, req *pb.BatchPutReq) (*pb.Void, error) {
+
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+	defer s.release()
+
+	if err = s.writable(); err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	ctx, span := s.startSpan(ctx, "batchput")
+	defer span.finish(nil)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "batchput",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	idt, err := s.identity(ctx)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	paths := make([]string, len(req.Entries))
+	checksums := make([]string, len(req.Entries))
+	for i, e := range req.Entries {
+		p, err := s.normalizePath(e.Path)
+		if err != nil {
+			log.Error(err)
+			return &pb.Void{}, toGRPCError(err)
+		}
+		paths[i] = p
+		if err = s.authorize(idt, p); err != nil {
+			log.Error(err)
+			return &pb.Void{}, toGRPCError(err)
+		}
+		checksums[i], err = normalizeChecksum(e.Checksum, s.p.legacyChecksums)
+		if err != nil {
+			log.Error(err)
+			return &pb.Void{}, toGRPCError(err)
+		}
+		if err = validateKind(e.Kind); err != nil {
+			log.Error(err)
+			return &pb.Void{}, toGRPCError(err)
+		}
+	}
+
+	etag, err := s.p.idGen()
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+	mtime := s.p.clock.Now().Unix()
+
+	// the records and the propagation are committed together, the
+	// transaction is run again as a whole on transient errors
+	var saved []*record
+	defer s.lockHomes(paths...)()
+	err = s.transaction(ctx, func(tx *gorm.DB) error {
+		saved = []*record{}
+		created := []string{}
+
+		for i, e := range req.Entries {
+			if err := ctxError(ctx); err != nil {
+				return err
+			}
+
+			p := paths[i]
+
+			var id string
+			var oldSize int64
+			kind := e.Kind
+			r, err := getRecordByPath(tx, p)
+			if err != nil {
+				if err != gorm.RecordNotFound {
+					return err
+				}
+
+				rawID, err := s.p.idGen()
+				if err != nil {
+					return err
+				}
+				id = rawID
+
+				if kind == pb.Kind_UNKNOWN {
+					kind, err = defaultKind(tx, p)
+					if err != nil {
+						return err
+					}
+				}
+			} else {
+				id = r.ID
+				oldSize = r.Size
+				if kind == pb.Kind_UNKNOWN {
+					kind = r.Kind
+				}
+			}
+
+			withChange(log, etag, mtime).Infof("new record will have id=%s path=%s checksum=%s size=%d kind=%s", id, p, checksums[i], e.Size, kind)
+
+			err = s.insert(ctx, tx, id, p, checksums[i], etag, mtime, e.Size, kind)
+			if err != nil {
+				return err
+			}
+
+			ancestors, err := s.createAncestors(ctx, tx, p, etag)
+			if err != nil {
+				return err
+			}
+			created = append(created, ancestors...)
+
+			err = s.updateSize(ctx, tx, p, e.Size-oldSize, "")
+			if err != nil {
+				return err
+			}
+
+			saved = append(saved, &record{ID: id, Path: p, Checksum: nullChecksum(checksums[i]), ETag: etag, MTime: mtime, Size: e.Size, Kind: kind})
+		}
+
+		// the entries may come before their parents in the batch
+		parents := make([]string, len(paths))
+		for i, p := range paths {
+			parents[i] = parentPath(p)
+		}
+		err := s.markFolders(ctx, tx, parents)
+		if err != nil {
+			return err
+		}
+
+		// entries sharing ancestors update them once
+		err = s.propagateMany(ctx, tx, paths, etag, mtime)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("propagated changes for %d entries", len(paths))
+
+		return s.dateAncestors(ctx, tx, created, etag, mtime)
+	})
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	log.Infof("%d new records saved to db", len(req.Entries))
+
+	for _, rec := range saved {
+		s.hub.publish(rec.toProto())
+	}
+
+	return &pb.Void{}, nil
+}
+
+func (s *server) Touch(ctx context.Context, req *pb.TouchReq) (*pb.Void, error) {
+
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+	defer s.release()
+
+	if err = s.writable(); err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	ctx, span := s.startSpan(ctx, "touch")
+	defer span.finish(nil)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "touch",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	idt, err := s.identity(ctx)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	p, err := s.normalizePath(req.Path)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	log.Infof("path is %s", p)
+
+	if err = s.authorize(idt, p); err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	r, err := s.getByPath(ctx, p)
+	if err != nil {
+		log.Error(err)
+		if err == gorm.RecordNotFound {
+			return &pb.Void{}, grpc.Errorf(codes.NotFound, "path %s not found", p)
+		}
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	// with children etags the etag of a folder is derived from its
+	// children, that the touch does not change, so only its mtime moves
+	etag := r.ETag
+	if !s.p.childrenETags || r.Kind != pb.Kind_FOLDER {
+		etag, err = s.p.idGen()
+		if err != nil {
+			log.Error(err)
+			return &pb.Void{}, toGRPCError(err)
+		}
+	}
+	mtime := s.p.clock.Now().Unix()
+
+	// the record and the propagation are committed together
+	defer s.lockHomes(p)()
+	err = s.transaction(ctx, func(tx *gorm.DB) error {
+		// the checksum is left untouched, only the sync metadata changes
+		err := tx.Model(record{}).Where("id=?", r.ID).Updates(record{ETag: etag, MTime: mtime}).Error
+		if err != nil {
+			return err
+		}
+
+		withChange(log, etag, mtime).Info("record touched")
+
+		err = s.propagateChanges(ctx, tx, p, etag, mtime, "")
+		if err != nil {
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(err)
+	}
+
+	r.ETag = etag
+	r.MTime = mtime
+	s.hub.publish(r.toProto())
+
+	return &pb.Void{}, nil
+}
+
+func (s *server) Restore(ctx context.Context, req *pb.RestoreReq) (*pb.RestoreResp, error) {
+
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
+	if err != nil {
+		log.Error(err)
+		return &pb.RestoreResp{}, toGRPCError(err)
+	}
+	defer s.release()
+
+	if err = s.writable(); err != nil {
+		log.Error(err)
+		return &pb.RestoreResp{}, toGRPCError(err)
+	}
+
+	ctx, span := s.startSpan(ctx, "restore")
+	defer span.finish(nil)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "restore",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	idt, err := s.identity(ctx)
+	if err != nil {
+		log.Error(err)
+		return &pb.RestoreResp{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.RestoreResp{}, toGRPCError(err)
+	}
+
+	p, err := s.normalizePath(req.Path)
+	if err != nil {
+		log.Error(err)
+		return &pb.RestoreResp{}, toGRPCError(err)
+	}
+
+	log.Infof("path is %s", p)
+
+	if err = s.authorize(idt, p); err != nil {
+		log.Error(err)
+		return &pb.RestoreResp{}, toGRPCError(err)
+	}
+
+	etag, err := s.p.idGen()
+	if err != nil {
+		log.Error(err)
+		return &pb.RestoreResp{}, toGRPCError(err)
+	}
+	mtime := s.p.clock.Now().Unix()
+
+	// the size only comes back to the ancestors when p itself was removed
+	var sizeDelta int64
+	trashed := &record{}
+	err = s.db.Unscoped().Where("path=? AND deleted_at IS NOT NULL", p).First(trashed).Error
+	if err == nil {
+		sizeDelta = trashed.Size
+	}
+
+	// the restore and the propagation are committed together
+	var restored int64
+	defer s.lockHomes(p)()
+	err = s.transaction(ctx, func(tx *gorm.DB) error {
+		// restored records get a new etag and mtime for the sync
+		// clients to discover them again
+		res := tx.Unscoped().Model(record{}).Scopes(withPathPrefix(p)).Where("deleted_at IS NOT NULL").
+			UpdateColumns(map[string]interface{}{"deleted_at": gorm.Expr("NULL"), "e_tag": etag, "m_time": mtime})
+		if err := res.Error; err != nil {
+			return err
+		}
+		restored = res.RowsAffected
+
+		log.Infof("%d records restored", restored)
+
+		if restored == 0 {
+			return nil
+		}
+
+		err := s.updateSize(ctx, tx, p, sizeDelta, "")
+		if err != nil {
+			return err
+		}
+
+		err = s.propagateChanges(ctx, tx, p, etag, mtime, "")
+		if err != nil {
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+		return &pb.RestoreResp{}, toGRPCError(err)
+	}
+
+	if restored == 0 {
+		return &pb.RestoreResp{}, grpc.Errorf(codes.NotFound, "path %s not found in the trash", p)
+	}
+
+	rec, err := s.getByPath(ctx, p)
+	if err == nil {
+		s.hub.publish(rec.toProto())
+	}
+
+	return &pb.RestoreResp{Restored: restored}, nil
+}
+
+func (s *server) Purge(ctx context.Context, req *pb.PurgeReq) (*pb.PurgeResp, error) {
+
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
+	if err != nil {
+		log.Error(err)
+		return &pb.PurgeResp{}, toGRPCError(err)
+	}
+	defer s.release()
+
+	if err = s.writable(); err != nil {
+		log.Error(err)
+		return &pb.PurgeResp{}, toGRPCError(err)
+	}
+
+	ctx, span := s.startSpan(ctx, "purge")
+	defer span.finish(nil)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "purge",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	idt, err := s.identity(ctx)
+	if err != nil {
+		log.Error(err)
+		return &pb.PurgeResp{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.PurgeResp{}, toGRPCError(err)
+	}
+
+	p, err := s.normalizePath(req.Path)
+	if err != nil {
+		log.Error(err)
+		return &pb.PurgeResp{}, toGRPCError(err)
+	}
+
+	log.Infof("path is %s", p)
+
+	if err = s.authorize(idt, p); err != nil {
+		log.Error(err)
+		return &pb.PurgeResp{}, toGRPCError(err)
+	}
+
+	db := s.db.Unscoped().Scopes(withPathPrefix(p)).Where("deleted_at IS NOT NULL")
+	if req.OlderThan > 0 {
+		db = db.Where("deleted_at < ?", time.Unix(req.OlderThan, 0))
+	}
+
+	res := db.Delete(record{})
+	if err = res.Error; err != nil {
+		log.Error(err)
+		return &pb.PurgeResp{}, toGRPCError(err)
+	}
+
+	log.Infof("%d records purged", res.RowsAffected)
+
+	return &pb.PurgeResp{Purged: res.RowsAffected}, nil
+}
+
+func (s *server) Count(ctx context.Context, req *pb.CountReq) (*pb.CountResp, error) {
+
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
+	if err != nil {
+		log.Error(err)
+		return &pb.CountResp{}, toGRPCError(err)
+	}
+	defer s.release()
+
+	ctx, span := s.startSpan(ctx, "count")
+	defer span.finish(nil)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "count",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	idt, err := s.identity(ctx)
+	if err != nil {
+		log.Error(err)
+		return &pb.CountResp{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.CountResp{}, toGRPCError(err)
+	}
+
+	p, err := s.normalizePath(req.Path)
+	if err != nil {
+		log.Error(err)
+		return &pb.CountResp{}, toGRPCError(err)
+	}
+
+	log.Infof("path is %s", p)
+
+	if err = s.authorize(idt, p); err != nil {
+		log.Error(err)
+		return &pb.CountResp{}, toGRPCError(err)
+	}
+
+	scope := withPathPrefix(p)
+	if req.ExcludeSelf {
+		scope = withDescendants(p)
+	}
+
+	var count int64
+	err = s.db.Model(&record{}).Scopes(scope).Count(&count).Error
+	if err != nil {
+		log.Error(err)
+		return &pb.CountResp{}, toGRPCError(err)
+	}
+
+	res := &pb.CountResp{}
+	res.Count = count
+	return res, nil
+}
+
+func (s *server) HasChildren(ctx context.Context, req *pb.HasChildrenReq) (*pb.HasChildrenResp, error) {
+
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
+	if err != nil {
+		log.Error(err)
+		return &pb.HasChildrenResp{}, toGRPCError(err)
+	}
+	defer s.release()
+
+	ctx, span := s.startSpan(ctx, "haschildren")
+	defer span.finish(nil)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "haschildren",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	idt, err := s.identity(ctx)
+	if err != nil {
+		log.Error(err)
+		return &pb.HasChildrenResp{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.HasChildrenResp{}, toGRPCError(err)
+	}
+
+	p, err := s.normalizePath(req.Path)
+	if err != nil {
+		log.Error(err)
+		return &pb.HasChildrenResp{}, toGRPCError(err)
+	}
+
+	log.Infof("path is %s", p)
+
+	if err = s.authorize(idt, p); err != nil {
+		log.Error(err)
+		return &pb.HasChildrenResp{}, toGRPCError(err)
+	}
+
+	// a single descendant is enough, the database stops at the first one
+	ids := []string{}
+	err = s.db.Model(&record{}).Scopes(withDescendants(p)).Limit(1).Pluck("id", &ids).Error
+	if err != nil {
+		log.Error(err)
+		return &pb.HasChildrenResp{}, toGRPCError(err)
+	}
+
+	res := &pb.HasChildrenResp{}
+	res.HasChildren = len(ids) > 0
+	return res, nil
+}
+
+func (s *server) FindByChecksum(ctx context.Context, req *pb.ChecksumReq) (*pb.ChecksumResp, error) {
+
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
+	if err != nil {
+		log.Error(err)
+		return &pb.ChecksumResp{}, toGRPCError(err)
+	}
+	defer s.release()
+
+	ctx, span := s.startSpan(ctx, "findbychecksum")
+	defer span.finish(nil)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "findbychecksum",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	idt, err := s.identity(ctx)
+	if err != nil {
+		log.Error(err)
+		return &pb.ChecksumResp{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.ChecksumResp{}, toGRPCError(err)
+	}
+
+	p, err := s.normalizePath(req.Path)
+	if err != nil {
+		log.Error(err)
+		return &pb.ChecksumResp{}, toGRPCError(err)
+	}
+
+	log.Infof("path is %s", p)
+
+	if err = s.authorize(idt, p); err != nil {
+		log.Error(err)
+		return &pb.ChecksumResp{}, toGRPCError(err)
+	}
+
+	// the records without content have no checksum to match
+	checksum, err := normalizeChecksum(req.Checksum, s.p.legacyChecksums)
+	if err != nil {
+		log.Error(err)
+		return &pb.ChecksumResp{}, toGRPCError(err)
+	}
+	if checksum == "" {
+		return &pb.ChecksumResp{}, grpc.Errorf(codes.InvalidArgument, "checksum is empty")
+	}
+
+	log.Infof("checksum is %s", checksum)
+
+	paths := []string{}
+	err = s.db.Model(&record{}).Scopes(withPathPrefix(p)).Where("checksum=?", checksum).Order("path").Pluck("path", &paths).Error
+	if err != nil {
+		log.Error(err)
+		return &pb.ChecksumResp{}, toGRPCError(err)
+	}
+
+	res := &pb.ChecksumResp{}
+	res.Paths = paths
+	return res, nil
+}
+
+func (s *server) RecomputeEtag(ctx context.Context, req *pb.RecomputeEtagReq) (*pb.Record, error) {
+
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
+	if err != nil {
+		log.Error(err)
+		return &pb.Record{}, toGRPCError(err)
+	}
+	defer s.release()
+
+	if err = s.writable(); err != nil {
+		log.Error(err)
+		return &pb.Record{}, toGRPCError(err)
+	}
+
+	ctx, span := s.startSpan(ctx, "recomputeetag")
+	defer span.finish(nil)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "recomputeetag",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	idt, err := s.identity(ctx)
+	if err != nil {
+		log.Error(err)
+		return &pb.Record{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.Record{}, toGRPCError(err)
+	}
+
+	p, err := s.normalizePath(req.Path)
+	if err != nil {
+		log.Error(err)
+		return &pb.Record{}, toGRPCError(err)
+	}
+
+	log.Infof("path is %s", p)
+
+	if err = s.authorize(idt, p); err != nil {
+		log.Error(err)
+		return &pb.Record{}, toGRPCError(err)
+	}
+
+	if !s.p.childrenETags {
+		return &pb.Record{}, grpc.Errorf(codes.FailedPrecondition, "etags are not derived from the children")
+	}
+
+	mtime := s.p.clock.Now().Unix()
+
+	var rec *record
+	defer s.lockHomes(p)()
+	err = s.transaction(ctx, func(tx *gorm.DB) error {
+		// the folders are the records with children, the empty ones keep
+		// their etag like the files
+		paths := []string{}
+		err := tx.Model(record{}).Scopes(withDescendants(p)).Pluck("DISTINCT parent_path", &paths).Error
+		if err != nil {
+			return err
+		}
+		paths = append(paths, s.p.propagator.ancestors(p)...)
+		sort.Sort(byDepth(paths))
+
+		log.Infof("paths for update %+v", paths)
+
+		numRows, err := s.recomputeETags(ctx, tx, paths, mtime)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("%d of %d folders have being updated", numRows, len(paths))
+
+		rec, err = getRecordByPath(tx, p)
+		return err
+	})
+	if err != nil {
+		log.Error(err)
+		if err == gorm.RecordNotFound {
+			return &pb.Record{}, grpc.Errorf(codes.NotFound, "path %s not found", p)
+		}
+		return &pb.Record{}, toGRPCError(err)
+	}
+
+	s.hub.publish(rec.toProto())
+
+	return rec.toProto(), nil
+}
+
+func (s *server) Reconcile(ctx context.Context, req *pb.ReconcileReq) (*pb.ReconcileResp, error) {
+
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
+	if err != nil {
+		log.Error(err)
+		return &pb.ReconcileResp{}, toGRPCError(err)
+	}
+	defer s.release()
+
+	if err = s.writable(); err != nil {
+		log.Error(err)
+		return &pb.ReconcileResp{}, toGRPCError(err)
+	}
+
+	ctx, span := s.startSpan(ctx, "reconcile")
+	defer span.finish(nil)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "reconcile",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	idt, err := s.identity(ctx)
+	if err != nil {
+		log.Error(err)
+		return &pb.ReconcileResp{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.ReconcileResp{}, toGRPCError(err)
+	}
+
+	p, err := s.normalizePath(req.Path)
+	if err != nil {
+		log.Error(err)
+		return &pb.ReconcileResp{}, toGRPCError(err)
+	}
+
+	log.Infof("path is %s", p)
+
+	if err = s.authorize(idt, p); err != nil {
+		log.Error(err)
+		return &pb.ReconcileResp{}, toGRPCError(err)
+	}
+
+	limit := int(req.Limit)
+	if limit <= 0 || limit > maxReconcileLimit {
+		limit = defaultReconcileLimit
+	}
+
+	recs, err := getRecordsPageWithPathPrefix(s.db, p, req.After, limit)
+	if err != nil {
+		log.Error(err)
+		return &pb.ReconcileResp{}, toGRPCError(err)
+	}
+
+	res := &pb.ReconcileResp{}
+	for _, rec := range recs {
+		if err = ctxError(ctx); err != nil {
+			log.Error(err)
+			return &pb.ReconcileResp{}, err
+		}
+
+		fixed, err := s.reconcile(ctx, &rec)
+		if err != nil {
+			log.Error(err)
+			return &pb.ReconcileResp{}, toGRPCError(err)
+		}
+		res.Checked++
+		if fixed {
+			res.Fixed++
+		}
+	}
+
+	// a short page means there is nothing left after it
+	if len(recs) == limit {
+		res.Next = recs[len(recs)-1].Path
+	}
+
+	log.Infof("%d records checked and %d fixed", res.Checked, res.Fixed)
+
+	return res, nil
+}
+
+// Audit reports the records left stale by a failed propagation without
+// changing them, so it is served by the read only servers too.
+func (s *server) Audit(ctx context.Context, req *pb.AuditReq) (*pb.AuditResp, error) {
+
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
+	if err != nil {
+		log.Error(err)
+		return &pb.AuditResp{}, toGRPCError(err)
+	}
+	defer s.release()
+
+	ctx, span := s.startSpan(ctx, "audit")
+	defer span.finish(nil)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "audit",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	idt, err := s.identity(ctx)
+	if err != nil {
+		log.Error(err)
+		return &pb.AuditResp{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.AuditResp{}, toGRPCError(err)
+	}
+
+	p, err := s.normalizePath(req.Path)
+	if err != nil {
+		log.Error(err)
+		return &pb.AuditResp{}, toGRPCError(err)
+	}
+
+	log.Infof("path is %s", p)
+
+	if err = s.authorize(idt, p); err != nil {
+		log.Error(err)
+		return &pb.AuditResp{}, toGRPCError(err)
+	}
+
+	limit := int(req.Limit)
+	if limit <= 0 || limit > maxReconcileLimit {
+		limit = defaultReconcileLimit
+	}
+
+	recs, err := getRecordsPageWithPathPrefix(s.db, p, req.After, limit)
+	if err != nil {
+		log.Error(err)
+		return &pb.AuditResp{}, toGRPCError(err)
+	}
+
+	res := &pb.AuditResp{}
+	for _, rec := range recs {
+		if err = ctxError(ctx); err != nil {
+			log.Error(err)
+			return &pb.AuditResp{}, err
+		}
+
+		newest, err := s.staleBy(&rec)
+		if err != nil {
+			log.Error(err)
+			return &pb.AuditResp{}, toGRPCError(err)
+		}
+		res.Checked++
+		if newest != nil {
+			withChange(log, newest.ETag, newest.MTime).Warnf("%s is older than %s", rec.Path, newest.Path)
+			res.Stale = append(res.Stale, rec.Path)
+		}
+	}
+
+	// a short page means there is nothing left after it
+	if len(recs) == limit {
+		res.Next = recs[len(recs)-1].Path
+	}
+
+	log.Infof("%d records checked and %d stale", res.Checked, len(res.Stale))
+
+	return res, nil
+}
+
+func (s *server) GetTree(ctx context.Context, req *pb.GetTreeReq) (*pb.TreeNode, error) {
+
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
+	if err != nil {
+		log.Error(err)
+		return &pb.TreeNode{}, toGRPCError(err)
+	}
+	defer s.release()
+
+	ctx, span := s.startSpan(ctx, "gettree")
+	defer span.finish(nil)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "gettree",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	idt, err := s.identity(ctx)
+	if err != nil {
+		log.Error(err)
+		return &pb.TreeNode{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return &pb.TreeNode{}, toGRPCError(err)
+	}
+
+	p, err := s.normalizePath(req.Path)
+	if err != nil {
+		log.Error(err)
+		return &pb.TreeNode{}, toGRPCError(err)
+	}
+
+	log.Infof("path is %s", p)
+
+	if err = s.authorize(idt, p); err != nil {
+		log.Error(err)
+		return &pb.TreeNode{}, toGRPCError(err)
+	}
+
+	if req.MaxDepth < 0 {
+		err = grpc.Errorf(codes.InvalidArgument, "max depth %d is negative", req.MaxDepth)
+		log.Error(err)
+		return &pb.TreeNode{}, err
+	}
+
+	root, err := s.getTree(ctx, p, int(req.MaxDepth))
+	if err != nil {
+		log.Error(err)
+		return &pb.TreeNode{}, toGRPCError(err)
+	}
+
+	return root, nil
+}
+
+// Import inserts the records sent on the stream by batches of
+// importBatchSize records, each batch in a single statement. The
+// records rejected are counted and the import goes on, a database error
+// ends it keeping the batches already inserted, so it can be run again.
+// The ancestors are propagated to once the stream ends, unless the first
+// message sets skip_propagation as the tree imported is already current.
+func (s *server) Import(stream pb.Prop_ImportServer) error {
+
+	ctx := stream.Context()
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
+	if err != nil {
+		log.Error(err)
+		return toGRPCError(err)
+	}
+	defer s.release()
+
+	if err = s.writable(); err != nil {
+		log.Error(err)
+		return toGRPCError(err)
+	}
+
+	ctx, span := s.startSpan(ctx, "import")
+	defer span.finish(nil)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "import",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	req, err := stream.Recv()
+	if err != nil && err != io.EOF {
+		log.Error(err)
+		return err
+	}
+	first := req
+	if first == nil {
+		first = &pb.ImportReq{}
+	}
+
+	idt, err := s.identity(ctx)
+	if err != nil {
+		log.Error(err)
+		return unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return toGRPCError(err)
+	}
+
+	// the records without an etag and mtime share the ones propagated
+	etag, err := s.p.idGen()
+	if err != nil {
+		log.Error(err)
+		return toGRPCError(err)
+	}
+	now := s.p.clock.Now()
+	mtime := now.Unix()
+
+	resp := &pb.ImportResp{}
+	batch := []*record{}
+	inBatch := map[string]int{}
+
+	// a leaf by parent is enough to propagate to all the ancestors
+	leafOf := map[string]string{}
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := s.importBatch(ctx, batch); err != nil {
+			return err
+		}
+		for _, rec := range batch {
+			leafOf[parentPath(rec.Path)] = rec.Path
+		}
+		resp.Imported += int64(len(batch))
+		log.Debugf("%d records imported", resp.Imported)
+		batch = []*record{}
+		inBatch = map[string]int{}
+		return nil
+	}
+
+	for err != io.EOF {
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+
+		rec, recErr := s.importRecord(idt, req, etag, mtime, now)
+		if recErr != nil {
+			log.Error(recErr)
+			resp.Failed++
+			if len(resp.Errors) < maxImportErrors {
+				resp.Errors = append(resp.Errors, &pb.ImportError{Path: req.Path, Error: grpc.ErrorDesc(recErr)})
+			}
+		} else if i, ok := inBatch[rec.Path]; ok {
+			// a statement can not write the same path twice, the last
+			// record sent wins
+			batch[i] = rec
+		} else {
+			inBatch[rec.Path] = len(batch)
+			batch = append(batch, rec)
+		}
+
+		if len(batch) >= s.p.importBatchSize {
+			if err = flush(); err != nil {
+				log.Error(err)
+				return toGRPCError(err)
+			}
+		}
+
+		req, err = stream.Recv()
+	}
+
+	if err = flush(); err != nil {
+		log.Error(err)
+		return toGRPCError(err)
+	}
+
+	log.Infof("%d records imported, %d rejected", resp.Imported, resp.Failed)
+
+	// the records may come before their parents
+	parents := make([]string, 0, len(leafOf))
+	for p := range leafOf {
+		parents = append(parents, p)
+	}
+	sort.Strings(parents)
+	for i := 0; i < len(parents); i += s.p.importBatchSize {
+		end := i + s.p.importBatchSize
+		if end > len(parents) {
+			end = len(parents)
+		}
+		err = s.transaction(ctx, func(tx *gorm.DB) error {
+			return s.markFolders(ctx, tx, parents[i:end])
+		})
+		if err != nil {
+			log.Error(err)
+			return toGRPCError(err)
+		}
+	}
+
+	if !first.SkipPropagation && len(leafOf) > 0 {
+		leaves := make([]string, 0, len(leafOf))
+		for _, l := range leafOf {
+			leaves = append(leaves, l)
+		}
+		sort.Strings(leaves)
+
+		defer s.lockHomes(leaves...)()
+		err = s.transaction(ctx, func(tx *gorm.DB) error {
+			return s.propagateMany(ctx, tx, leaves, etag, mtime)
+		})
+		if err != nil {
+			log.Error(err)
+			return toGRPCError(err)
+		}
+
+		log.Infof("propagated changes for %d folders", len(leaves))
+	}
+
+	return stream.SendAndClose(resp)
+}
+
+// importRecord returns the record of an Import message after checking it
+// like Put does. etag and mtime are used when the message has none.
+func (s *server) importRecord(idt *lib.Identity, req *pb.ImportReq, etag string, mtime int64, now time.Time) (*record, error) {
+
+	p, err := s.normalizePath(req.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.authorize(idt, p); err != nil {
+		return nil, err
+	}
+	checksum, err := normalizeChecksum(req.Checksum, s.p.legacyChecksums)
+	if err != nil {
+		return nil, err
+	}
+	if err = validateETag(req.Etag); err != nil {
+		return nil, err
+	}
+	if err = validateMTime(req.Mtime, now); err != nil {
+		return nil, err
+	}
+	if err = validateKind(req.Kind); err != nil {
+		return nil, err
+	}
+
+	rec := &record{Path: p, Checksum: nullChecksum(checksum), ETag: req.Etag, MTime: req.Mtime, Size: req.Size, Kind: req.Kind}
+	if rec.ETag == "" {
+		rec.ETag = etag
+	}
+	if rec.MTime == 0 {
+		rec.MTime = mtime
+	}
+	return rec, nil
+}
+
+// importBatch upserts the records of an Import in a single statement. The
+// records already in the database keep their id, the others get a new one.
+// The records without kind keep theirs too, the new ones are folders when
+// they already have children.
+func (s *server) importBatch(ctx context.Context, batch []*record) error {
+
+	if err := ctxError(ctx); err != nil {
+		return err
+	}
+
+	_, sp := s.startSpan(ctx, "importBatch")
+	var err error
+	defer func() {
+		sp.finish(err)
+	}()
+
+	paths := make([]string, len(batch))
+	for i, rec := range batch {
+		paths[i] = rec.Path
+	}
+	existing := []record{}
+	err = s.db.Select("id, path, kind").Where("path IN (?)", paths).Find(&existing).Error
+	if err != nil {
+		return err
+	}
+	found := map[string]record{}
+	for _, rec := range existing {
+		found[rec.Path] = rec
+	}
+
+	parents := []string{}
+	err = s.db.Model(record{}).Where("parent_path IN (?)", paths).Pluck("DISTINCT parent_path", &parents).Error
+	if err != nil {
+		return err
+	}
+	hasChildren := map[string]bool{}
+	for _, p := range parents {
+		hasChildren[p] = true
+	}
+
+	for _, rec := range batch {
+		old, ok := found[rec.Path]
+		if rec.ID = old.ID; !ok {
+			if rec.ID, err = s.p.idGen(); err != nil {
+				return err
+			}
+		}
+		if rec.Kind != pb.Kind_UNKNOWN {
+			continue
+		}
+		switch {
+		case ok:
+			rec.Kind = old.Kind
+		case hasChildren[rec.Path]:
+			rec.Kind = pb.Kind_FOLDER
+		default:
+			rec.Kind = pb.Kind_FILE
+		}
+	}
+
+	// a transaction of a single statement, so the records get their seq
+	err = s.transaction(ctx, func(tx *gorm.DB) error {
+		return s.dialect.upsertMany(tx, batch)
+	})
+	return err
+}
+
+func (s *server) Watch(req *pb.WatchReq, stream pb.Prop_WatchServer) error {
+
+	ctx := stream.Context()
+	log := s.requestLogger(ctx)
+
+	err := s.acquire()
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	defer s.release()
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "watch",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	idt, err := s.identity(ctx)
+	if err != nil {
+		log.Error(err)
+		return unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	if err = s.limit(idt); err != nil {
+		log.Error(err)
+		return toGRPCError(err)
+	}
+
+	p, err := s.normalizePath(req.Path)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	log.Infof("path is %s", p)
+
+	if err = s.authorize(idt, p); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	sub := s.hub.subscribe(p)
+	defer s.hub.unsubscribe(sub)
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Infof("client went away")
+			return nil
+		case <-s.done:
+			log.Infof("server is shutting down")
+			return shuttingDownError
+		case rec := <-sub.events:
+			err = stream.Send(rec)
+			if err != nil {
+				log.Error(err)
+				return err
+			}
+		}
+	}
+}
+
+// limitSubtree fails when the records selected by db, the subtree at p,
+// are more than maxSubtreeNodes.
+func (s *server) limitSubtree(db *gorm.DB, p string) error {
+	if s.p.maxSubtreeNodes <= 0 {
+		return nil
+	}
+	var count int64
+	if err := db.Count(&count).Error; err != nil {
+		return err
+	}
+	if count > s.p.maxSubtreeNodes {
+		return grpc.Errorf(codes.FailedPrecondition, "path %s has %d records, more than the maximum of %d", p, count, s.p.maxSubtreeNodes)
+	}
+	return nil
+}
+
+func (s *server) getByPath(ctx context.Context, path string) (*record, error) {
+	_, sp := s.startSpan(ctx, "getByPath")
+	rec, err := getRecordByPath(s.db, path)
+	if err == gorm.RecordNotFound {
+		// a missing record is an expected outcome, not a failure
+		sp.finish(nil)
+	} else {
+		sp.finish(err)
+	}
+	return rec, err
+}
+
+// getRecordByPath returns the record at path.
+// db can be the server handle or an open transaction.
+func getRecordByPath(db *gorm.DB, path string) (*record, error) {
+
+	r := &record{}
+	err := db.Where("path=?", path).First(r).Error
+	return r, err
+}
+
+// insert upserts the record using db, that can be the server handle
+// or an open transaction. Transient errors are retried unless db is a
+// transaction, that must be retried as a whole by the caller. A record
+// created concurrently at p is updated by the upsert, but the id may
+// still be taken, like by a record moved away from p since it was read.
+// That fails with Aborted so the caller reads the record again.
+func (s *server) insert(ctx context.Context, db *gorm.DB, id, p, checksum, etag string, mtime, size int64, kind pb.Kind) error {
+
+	_, sp := s.startSpan(ctx, "insert")
+	var err error
+	if inTransaction(db) {
+		err = s.dialect.upsert(db, id, p, checksum, etag, mtime, size, kind)
+	} else {
+		err = s.retry(ctx, func() error {
+			return s.dialect.upsert(db, id, p, checksum, etag, mtime, size, kind)
+		})
+	}
+	sp.finish(err)
+	if err != nil {
+		if s.dialect.duplicate(err) {
+			return grpc.Errorf(codes.Aborted, "record %s at %s was changed concurrently", id, p)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// updateIfMatch updates the record at p only if its etag is ifMatch. It
+// fails with NotFound if there is no record and with Aborted, carrying the
+// current etag, if it has another one.
+func (s *server) updateIfMatch(ctx context.Context, db *gorm.DB, p, ifMatch, checksum, etag string, mtime, size int64, kind pb.Kind) error {
+
+	_, sp := s.startSpan(ctx, "updateIfMatch")
+	res := db.Model(record{}).Where("path=? AND e_tag=?", p, ifMatch).UpdateColumns(map[string]interface{}{
+		"checksum": nullChecksum(checksum),
+		"e_tag":    etag,
+		"m_time":   mtime,
+		"size":     size,
+		"kind":     kind,
+	})
+	sp.finish(res.Error)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected > 0 {
+		return nil
+	}
+
+	current, err := getRecordByPath(db, p)
+	if err == gorm.RecordNotFound {
+		return grpc.Errorf(codes.NotFound, "path %s not found", p)
+	}
+	if err != nil {
+		return err
+	}
+	return grpc.Errorf(codes.Aborted, "etag of %s is %s and not %s", p, current.ETag, ifMatch)
+}
+
+// update sets etag and mtime on p unless it has a newer mtime, or the
+// same one when the homes are serialized, see staleCond.
+// Like insert, transient errors are only retried outside a transaction.
+func (s *server) update(ctx context.Context, db *gorm.DB, p, etag string, mtime int64) (int64, error) {
+
+	_, sp := s.startSpan(ctx, "update")
+	var rows int64
+	fn := func() error {
+		res := db.Model(record{}).Where("path=? AND "+s.staleCond(), p, mtime).Updates(record{ETag: etag, MTime: mtime})
+		rows = res.RowsAffected
+		return res.Error
+	}
+	var err error
+	if inTransaction(db) {
+		err = fn()
+	} else {
+		err = s.retry(ctx, fn)
+	}
+	sp.finish(err)
+	return rows, err
+}
+
+// updateMany is like update but for several paths in a single statement.
+// It returns the total number of rows affected.
+func (s *server) updateMany(ctx context.Context, db *gorm.DB, paths []string, etag string, mtime int64) (int64, error) {
+
+	if len(paths) == 0 {
+		return 0, nil
+	}
+
+	_, sp := s.startSpan(ctx, "updateMany")
+
+	// the slice must be the first argument because of the way gorm
+	// expands the placeholders
+	var rows int64
+	fn := func() error {
+		res := db.Model(record{}).Where("path IN (?) AND "+s.staleCond(), paths, mtime).Updates(record{ETag: etag, MTime: mtime})
+		rows = res.RowsAffected
+		return res.Error
+	}
+	var err error
+	if inTransaction(db) {
+		err = fn()
+	} else {
+		err = s.retry(ctx, fn)
+	}
+	sp.finish(err)
+	return rows, err
+}
+
+// updateSize adds delta to the size of the ancestors of p strictly below
+// stopPath, or till the home directory if stopPath is empty. Unlike etag and
+// mtime the size is a sum that never becomes current by itself, so all
+// the ancestors are updated. It does nothing unless propagateSize is set.
+func (s *server) updateSize(ctx context.Context, db *gorm.DB, p string, delta int64, stopPath string) error {
+
+	if !s.p.propagateSize || delta == 0 {
+		return nil
+	}
+
+	paths := []string{}
+	for _, a := range getPathsTillHome(p, s.p.homeDepth) {
+		if stopPath != "" && !(isUnder(a, stopPath) && a != stopPath) {
+			continue
+		}
+		paths = append(paths, a)
+	}
+
+	if len(paths) == 0 {
+		return nil
+	}
+
+	_, sp := s.startSpan(ctx, "updateSize")
+
+	// the slice must be the first argument because of the way gorm
+	// expands the placeholders
+	err := db.Model(record{}).Where("path IN (?)", paths).UpdateColumn("size", gorm.Expr("size + ?", delta)).Error
+	sp.finish(err)
+	return err
+}
+
+// createAncestors creates the folder records missing between p and the
+// home directory, so the propagation reaches the ones above them and p is
+// listed. A folder in the trash is taken out of it keeping its id. The
+// folders are created with a zero mtime so the propagation does not stop
+// at them, dateAncestors gives the ones it did not reach etag and mtime.
+// It returns the paths of the folders created.
+func (s *server) createAncestors(ctx context.Context, db *gorm.DB, p, etag string) ([]string, error) {
+
+	paths := getPathsTillHome(p, s.p.homeDepth)
+	if len(paths) == 0 {
+		return nil, nil
+	}
+
+	_, sp := s.startSpan(ctx, "createAncestors")
+	var err error
+	defer func() {
+		sp.finish(err)
+	}()
+
+	existing := []record{}
+	err = db.Unscoped().Select("id, path, deleted_at").Where("path IN (?)", paths).Find(&existing).Error
+	if err != nil {
+		return nil, err
+	}
+	found := map[string]record{}
+	for _, rec := range existing {
+		found[rec.Path] = rec
+	}
+
+	missing := []*record{}
+	created := []string{}
+	for _, a := range paths {
+		old, ok := found[a]
+		if ok && old.DeletedAt == nil {
+			continue
+		}
+		rec := &record{ID: old.ID, Path: a, ETag: etag, Kind: pb.Kind_FOLDER}
+		if !ok {
+			if rec.ID, err = s.p.idGen(); err != nil {
+				return nil, err
+			}
+		}
+		missing = append(missing, rec)
+		created = append(created, a)
+	}
+
+	if len(missing) == 0 {
+		return nil, nil
+	}
+
+	if err = s.dialect.upsertMany(db, missing); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// dateAncestors gives etag and mtime to the folders created by
+// createAncestors that the propagation did not reach, like the ones above
+// a propagation boundary.
+func (s *server) dateAncestors(ctx context.Context, db *gorm.DB, paths []string, etag string, mtime int64) error {
+
+	if len(paths) == 0 {
+		return nil
+	}
+
+	_, sp := s.startSpan(ctx, "dateAncestors")
+
+	// the slice must be the first argument because of the way gorm
+	// expands the placeholders
+	err := db.Model(record{}).Where("path IN (?) AND m_time = 0", paths).
+		UpdateColumns(map[string]interface{}{"e_tag": etag, "m_time": mtime}).Error
+	sp.finish(err)
+	return err
+}
+
+// propagateChanges propagates mtime and etag until the user home directory
+// This propagation is needed for the client to discover changes
+// Ex: given the successful upload of the file /local/users/d/demo/photos/1.png
+// the etag and mtime will be propagated to:
+//    - /local/users/d/demo/photos
+//    - /local/users/d/demo
+// If stopPath is not empty the propagation stops after updating stopPath.
+// The updates use db, that can be the transaction of the mutation being
+// propagated so both apply or none does.
+func (s *server) propagateChanges(ctx context.Context, db *gorm.DB, p, etag string, mtime int64, stopPath string) (err error) {
+
+	log := s.requestLogger(ctx)
+
+	ctx, sp := s.startSpan(ctx, "propagate")
+	defer func() {
+		sp.finish(err)
+	}()
+
+	// the paths are ordered from the deepest one so the propagation can
+	// be short circuited after the first ancestor that is already current
+	paths := s.p.propagator.ancestors(p)
+	paths = pathsTillStop(paths, stopPath)
+	log.Infof("paths for update %+v", paths)
+
+	if s.p.childrenETags {
+		var numRows int64
+		numRows, err = s.recomputeETags(ctx, db, paths, mtime)
+		s.metrics.observePropagation(numRows, err)
+		return err
+	}
+
+	if s.p.bulkPropagation {
+		for _, p := range paths {
+			log.Debugf("parent path %s will be updated", p)
+		}
+		if err = ctxError(ctx); err != nil {
+			return err
+		}
+
+		// a single statement can not stop half way, so the ancestors
+		// above the first current one are left out beforehand as they
+		// are current too
+		i, err := firstCurrent(db, paths, mtime, s.p.serializeHomes)
+		if err != nil {
+			return err
+		}
+		if i >= 0 {
+			log.Infof("parent path %s is already current. Propagation stopped", paths[i])
+			paths = paths[:i]
+		}
+
+		numRows, err := s.updateMany(ctx, db, paths, etag, mtime)
+		if err != nil {
+			return err
+		}
+		withChange(log, etag, mtime).Infof("%d of %d parent paths have being updated", numRows, len(paths))
+		s.metrics.observePropagation(numRows, nil)
+		return nil
+	}
+
+	var totalRows int64
+	defer func() {
+		s.metrics.observePropagation(totalRows, err)
+	}()
+
+	for _, p := range paths {
+		if err = ctxError(ctx); err != nil {
+			return err
+		}
+
+		numRows, err := s.update(ctx, db, p, etag, mtime)
+		if err != nil {
+			return err
+		}
+		totalRows += numRows
+		if numRows == 0 {
+			withChange(log, etag, mtime).Warnf("parent path %s has been updated in the meanwhile so we do not override with old info. Propagation stopped", p)
+			// Following the CAS tree approach it does not make sense to update\
+			// parents if child has been updated wit new info
+			break
+		}
+		withChange(log, etag, mtime).Infof("parent path %s has being updated", p)
+	}
+
+	return nil
+}
+
+// propagateMany propagates the changes of several paths like
+// propagateChanges but updates the ancestors they share only once.
+// The propagation of every path still stops after its first ancestor
+// that is already current, as the ones above it are current too.
+func (s *server) propagateMany(ctx context.Context, db *gorm.DB, leaves []string, etag string, mtime int64) (err error) {
+
+	log := s.requestLogger(ctx)
+
+	ctx, sp := s.startSpan(ctx, "propagate")
+	defer func() {
+		sp.finish(err)
+	}()
+
+	// chainsOf tells the leaves, by index, every ancestor is shared by
+	chainsOf := map[string][]int{}
+	paths := []string{}
+	for i, l := range leaves {
+		for _, a := range s.p.propagator.ancestors(l) {
+			if _, ok := chainsOf[a]; !ok {
+				paths = append(paths, a)
+			}
+			chainsOf[a] = append(chainsOf[a], i)
+		}
+	}
+
+	// deeper paths first so every ancestor comes after the ones below it
+	sort.Sort(byDepth(paths))
+	log.Infof("paths for update %+v", paths)
+
+	if s.p.childrenETags {
+		var numRows int64
+		numRows, err = s.recomputeETags(ctx, db, paths, mtime)
+		s.metrics.observePropagation(numRows, err)
+		return err
+	}
+
+	var current map[string]bool
+	if s.p.bulkPropagation {
+		current, err = currentPaths(db, paths, mtime, s.p.serializeHomes)
+		if err != nil {
+			return err
+		}
+	}
+
+	var totalRows int64
+	defer func() {
+		s.metrics.observePropagation(totalRows, err)
+	}()
+
+	stopped := make([]bool, len(leaves))
+	pending := []string{}
+	for _, p := range paths {
+		if err = ctxError(ctx); err != nil {
+			return err
+		}
+
+		// the ancestor is left out when the propagation of all the
+		// leaves below it has already stopped
+		needed := false
+		for _, i := range chainsOf[p] {
+			needed = needed || !stopped[i]
+		}
+		if !needed {
+			continue
+		}
+
+		var updated bool
+		if s.p.bulkPropagation {
+			if !current[p] {
+				pending = append(pending, p)
+				updated = true
+			}
+		} else {
+			numRows, err := s.update(ctx, db, p, etag, mtime)
+			if err != nil {
+				return err
+			}
+			totalRows += numRows
+			updated = numRows > 0
+		}
+
+		if !updated {
+			log.Infof("parent path %s is already current. Propagation stopped", p)
+			for _, i := range chainsOf[p] {
+				stopped[i] = true
+			}
+		}
+	}
+
+	if s.p.bulkPropagation {
+		totalRows, err = s.updateMany(ctx, db, pending, etag, mtime)
+		if err != nil {
+			return err
+		}
+	}
+
+	withChange(log, etag, mtime).Infof("%d of %d parent paths have being updated", totalRows, len(paths))
+	return nil
+}
+
+// byDepth sorts the paths from the deepest one.
+type byDepth []string
+
+func (b byDepth) Len() int      { return len(b) }
+func (b byDepth) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byDepth) Less(i, j int) bool {
+	di, dj := strings.Count(b[i], "/"), strings.Count(b[j], "/")
+	if di != dj {
+		return di > dj
+	}
+	return b[i] < b[j]
+}
+
+// firstCurrent returns the index of the first of paths whose record
+// already has an mtime not older than mtime, or newer when ties, or -1
+// if there is none.
+func firstCurrent(db *gorm.DB, paths []string, mtime int64, ties bool) (int, error) {
+
+	if len(paths) == 0 {
+		return -1, nil
+	}
+
+	current, err := currentPaths(db, paths, mtime, ties)
+	if err != nil {
+		return -1, err
+	}
+	for i, p := range paths {
+		if current[p] {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+// currentPaths returns which of paths have a record with an mtime not
+// older than mtime. When ties the records with the same mtime are not
+// current as the later change of a second wins.
+func currentPaths(db *gorm.DB, paths []string, mtime int64, ties bool) (map[string]bool, error) {
+
+	current := map[string]bool{}
+	if len(paths) == 0 {
+		return current, nil
+	}
+
+	// the slice must be the first argument because of the way gorm
+	// expands the placeholders
+	cond := "path IN (?) AND m_time >= ?"
+	if ties {
+		cond = "path IN (?) AND m_time > ?"
+	}
+	recs := []record{}
+	err := db.Select("path").Where(cond, paths, mtime).Find(&recs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range recs {
+		current[r.Path] = true
+	}
+	return current, nil
+}
+
+// pathsTillStop truncates the list of paths to update after stopPath.
+// If stopPath is not found the list is returned untouched.
+func pathsTillStop(paths []string, stopPath string) []string {
+	for i, p := range paths {
+		if p == stopPath {
+			return paths[:i+1]
+		}
+	}
+	return paths
+}
+
+// commonAncestor returns the lowest common ancestor of the paths a and b.
+// Ex: commonAncestor("/a/b/c", "/a/b/d/e") returns "/a/b"
+func commonAncestor(a, b string) string {
+
+	aTokens := strings.Split(path.Clean(a), "/")
+	bTokens := strings.Split(path.Clean(b), "/")
+
+	common := []string{}
+	for i := 0; i < len(aTokens) && i < len(bTokens); i++ {
+		if aTokens[i] != bTokens[i] {
+			break
+		}
+		common = append(common, aTokens[i])
+	}
+
+	return path.Clean("/" + path.Join(common...))
+}
+
+// authorize checks that p is inside the home directory of idt.
+// The home directory is the path made of the first homeDepth tokens
+// and its last token must be the identity pid, like /local/users/d/demo.
+func (s *server) authorize(idt *lib.Identity, p string) error {
+
+	tokens := strings.Split(p, "/")
+	if s.p.homeDepth <= 0 || len(tokens) < s.p.homeDepth {
+		return permissionDenied
+	}
+
+	owner := tokens[s.p.homeDepth-1]
+	if owner != idt.Pid && !(s.p.caseInsensitive && strings.EqualFold(owner, idt.Pid)) {
+		return permissionDenied
+	}
+
+	return nil
+}
+
+// homeOf returns the home directory p is in. p must be at least as
+// deep as the home directory, as checked by authorize.
+func homeOf(p string, homeDepth int) string {
+	tokens := strings.Split(p, "/")
+	return path.Clean("/" + path.Join(tokens[0:homeDepth]...))
+}
+
+// getPathsTillHome returns the ancestors of p until the home directory,
+// deeper paths first. homeDepth is the number of tokens of the home
+// directory path, 5 for /local/users/d/demo.
+func getPathsTillHome(p string, homeDepth int) []string {
+
+	paths := []string{}
+	tokens := strings.Split(p, "/")
+
+	// if not under home dir we do not propagate. The bounds are checked
+	// here so a path at or above home never panics the handler goroutine
+	if homeDepth <= 0 || len(tokens) < homeDepth {
+		return paths
+	}
+
+	homeTokens := tokens[0:homeDepth]
+	restTokens := tokens[homeDepth:]
+
+	home := path.Clean("/" + path.Join(homeTokens...))
 
 	previous := home
 	paths = append(paths, previous)
@@ -492,7 +4509,25 @@ func getPathsTillHome(ctx context.Context, p string) []string {
 		paths[i], paths[opp] = paths[opp], paths[i]
 
 	}
-	log.Infof("paths for update %+v", paths)
 
 	return paths
 }
+
+// rebasePath returns the path p moved from under src to under dst.
+// The relative part is obtained with strings.TrimPrefix and not with
+// strings.Trim because the latter treats src as a cutset and mangles
+// children whose names share characters with src.
+// Ex: rebasePath("/a/b/c/cab", "/a/b/c", "/x/y") returns "/x/y/cab"
+func rebasePath(p, src, dst string) string {
+	return path.Join(dst, path.Clean(strings.TrimPrefix(p, src)))
+}
+
+// underRoot reports if p is below any of the roots.
+func underRoot(p string, roots map[string]bool) bool {
+	for d := path.Dir(p); d != p; p, d = d, path.Dir(d) {
+		if roots[d] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	rus "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	testSecret = "secret"
+	testHome   = "/local/users/d/demo"
+)
+
+var testDBs int64
+
+// testServer is a server on a private in-memory SQLite database. Its
+// PropServer is the chain of wrappers main serves, s is the server at the
+// end of it, to check the database with. The clock only moves when told
+// to, as the ancestors are not updated twice in the same second.
+type testServer struct {
+	pb.PropServer
+	s     *server
+	clock *fakeClock
+	token string
+}
+
+// newTestServer returns a testServer for the demo user. configure, if not
+// nil, changes the parameters before the server is created.
+func newTestServer(t testing.TB, configure func(p *newServerParams)) *testServer {
+	dsn := fmt.Sprintf("file:test%d?mode=memory&cache=shared", atomic.AddInt64(&testDBs, 1))
+	p := &newServerParams{
+		driver:            "sqlite3",
+		dsn:               dsn,
+		sharedSecret:      testSecret,
+		maxSqlConcurrency: 1,
+		maxSqlIdle:        1,
+		clock:             newFakeClock(time.Now()),
+	}
+	if configure != nil {
+		configure(p)
+	}
+	s, err := newServer(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return &testServer{
+		PropServer: newTraceServer(newMetricsServer(newAuthServer(s), s.metrics)),
+		s:          s,
+		clock:      p.clock.(*fakeClock),
+		token:      testToken(t, "demo", time.Now().Add(time.Hour)),
+	}
+}
+
+// capturedLogs collects the entries of a logger.
+type capturedLogs struct {
+	mu      sync.Mutex
+	entries []rus.Entry
+}
+
+func (c *capturedLogs) Levels() []rus.Level {
+	return []rus.Level{rus.PanicLevel, rus.FatalLevel, rus.ErrorLevel, rus.WarnLevel, rus.InfoLevel, rus.DebugLevel}
+}
+
+func (c *capturedLogs) Fire(e *rus.Entry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = append(c.entries, *e)
+	return nil
+}
+
+// find returns the entries whose message contains s.
+func (c *capturedLogs) find(s string) []rus.Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var found []rus.Entry
+	for _, e := range c.entries {
+		if strings.Contains(e.Message, s) {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+// newCapturingLogger returns a logger of every level whose entries are
+// collected by the returned capturedLogs.
+func newCapturingLogger() (*rus.Logger, *capturedLogs) {
+	c := &capturedLogs{}
+	l := rus.New()
+	l.Out = ioutil.Discard
+	l.Level = rus.DebugLevel
+	l.Hooks.Add(c)
+	return l, c
+}
+
+// testToken returns an access token of pid expiring at exp.
+func testToken(t testing.TB, pid string, exp time.Time) string {
+	return signedToken(t, pid, exp, testSecret)
+}
+
+// signedToken is testToken signed with secret.
+func signedToken(t testing.TB, pid string, exp time.Time, secret string) string {
+	token := jwt.New(jwt.SigningMethodHS256)
+	token.Claims["pid"] = pid
+	token.Claims["idp"] = "local"
+	token.Claims["display_name"] = pid
+	token.Claims["email"] = pid + "@example.org"
+	token.Claims["exp"] = exp.Unix()
+	signed, err := token.SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func (ts *testServer) put(t testing.TB, p string) {
+	if _, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: p}); err != nil {
+		t.Fatalf("put %s: %s", p, err)
+	}
+}
+
+func (ts *testServer) get(t testing.TB, p string) *pb.Record {
+	rec, err := ts.Get(context.Background(), &pb.GetReq{AccessToken: ts.token, Path: p})
+	if err != nil {
+		t.Fatalf("get %s: %s", p, err)
+	}
+	return rec
+}
+
+// record returns the row of p, even if it is in the trash.
+func (ts *testServer) record(t testing.TB, p string) *record {
+	rec := &record{}
+	if err := ts.s.db.Unscoped().Where("path = ?", p).First(rec).Error; err != nil {
+		t.Fatalf("record %s: %s", p, err)
+	}
+	return rec
+}
+
+// count returns the number of rows, even the ones in the trash.
+func (ts *testServer) count(t testing.TB) int64 {
+	var n int64
+	if err := ts.s.db.Unscoped().Model(record{}).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// dbState returns the rows of the database, even the ones in the trash,
+// to compare the states different code paths leave behind.
+func dbState(t testing.TB, ts *testServer) []string {
+	var recs []record
+	if err := ts.s.db.Unscoped().Order("path").Find(&recs).Error; err != nil {
+		t.Fatal(err)
+	}
+	state := make([]string, 0, len(recs))
+	for _, r := range recs {
+		state = append(state, fmt.Sprintf("%s parent=%s seq=%d deleted=%t", r.String(), r.ParentPath, r.Seq, r.DeletedAt != nil))
+	}
+	return state
+}
+
+// errInjected is the error of the statements failNth makes fail.
+var errInjected = errors.New("injected failure")
+
+// failNth makes the nth statement run by the callbacks of register fail
+// with errInjected, as in
+//
+//	failNth(ts.s.db.Callback().Update().Before("gorm:update").Register, 2)
+func failNth(register func(name string, fc func(scope *gorm.Scope)), n int) {
+	var count int64
+	register("test:fail_nth", func(scope *gorm.Scope) {
+		if atomic.AddInt64(&count, 1) == int64(n) {
+			scope.Err(errInjected)
+		}
+	})
+}
+
+func wantCode(t testing.TB, err error, code codes.Code) {
+	t.Helper()
+	if grpc.Code(err) != code {
+		t.Fatalf("got error %v, want code %s", err, code)
+	}
+}
+
+func TestPutGet(t *testing.T) {
+	ts := newTestServer(t, nil)
+	p := testHome + "/a/b.txt"
+
+	sum := "md5:d41d8cd98f00b204e9800998ecf8427e"
+	_, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: p, Checksum: sum, Size: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := ts.get(t, p)
+	if rec.Path != p || rec.Checksum != sum || rec.Size != 10 || rec.Kind != pb.Kind_FILE {
+		t.Fatalf("got %v", rec)
+	}
+	for _, a := range []string{testHome + "/a", testHome} {
+		parent := ts.get(t, a)
+		if parent.Etag != rec.Etag || parent.Kind != pb.Kind_FOLDER {
+			t.Errorf("ancestor %s is %v, want the etag %s of the file", a, parent, rec.Etag)
+		}
+	}
+}
+
+// TestPutCreatesAncestors checks a deep put creates the missing folders
+// with its etag and mtime, keeping the ones that exist, so they are
+// listed.
+func TestPutCreatesAncestors(t *testing.T) {
+	ts := newTestServer(t, nil)
+	if _, err := ts.Get(context.Background(), &pb.GetReq{AccessToken: ts.token, Path: testHome + "/a", ForceCreation: true}); err != nil {
+		t.Fatal(err)
+	}
+	a := ts.get(t, testHome+"/a")
+
+	ts.clock.Advance(time.Second)
+	p := testHome + "/a/b/c/d.txt"
+	ts.put(t, p)
+	rec := ts.get(t, p)
+	for _, f := range []string{"/a/b/c", "/a/b", "/a", ""} {
+		parent := ts.get(t, testHome+f)
+		if parent.Kind != pb.Kind_FOLDER || parent.Etag != rec.Etag || parent.Modified != rec.Modified {
+			t.Errorf("ancestor %s is %v, want a folder with the etag and mtime of %v", testHome+f, parent, rec)
+		}
+	}
+	if id := ts.get(t, testHome+"/a").Id; id != a.Id {
+		t.Errorf("got the id %s for the existing /a, want %s", id, a.Id)
+	}
+	if n := ts.count(t); n != 5 {
+		t.Errorf("got %d records, want the home, 3 folders and the file", n)
+	}
+
+	want := []string{"/a/b", "/a/b/c", "/a/b/c/d.txt"}
+	if got := ts.list(t, &pb.ListReq{Path: testHome + "/a", Recursive: true}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPutKeepsID(t *testing.T) {
+	ts := newTestServer(t, nil)
+	p := testHome + "/a.txt"
+
+	ts.put(t, p)
+	first := ts.get(t, p)
+	ts.clock.Advance(time.Second)
+	ts.put(t, p)
+	second := ts.get(t, p)
+
+	if second.Id != first.Id {
+		t.Fatalf("id changed from %s to %s", first.Id, second.Id)
+	}
+	if second.Etag == first.Etag {
+		t.Fatalf("etag %s did not change", second.Etag)
+	}
+}
+
+func TestGetMissing(t *testing.T) {
+	ts := newTestServer(t, nil)
+	_, err := ts.Get(context.Background(), &pb.GetReq{AccessToken: ts.token, Path: testHome + "/missing"})
+	wantCode(t, err, codes.NotFound)
+}
+
+func TestForeignHome(t *testing.T) {
+	ts := newTestServer(t, nil)
+	_, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: "/local/users/o/other/a.txt"})
+	wantCode(t, err, codes.PermissionDenied)
+}
+
+func TestMv(t *testing.T) {
+	ts := newTestServer(t, nil)
+	src, dst := testHome+"/a", testHome+"/b"
+	ts.put(t, src+"/c.txt")
+	id := ts.get(t, src+"/c.txt").Id
+	ts.clock.Advance(time.Second)
+
+	resp, err := ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: src, Dst: dst})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ts.Get(context.Background(), &pb.GetReq{AccessToken: ts.token, Path: src + "/c.txt"})
+	wantCode(t, err, codes.NotFound)
+	moved := ts.get(t, dst+"/c.txt")
+	if moved.Id != id {
+		t.Errorf("moved record has id %s, want %s", moved.Id, id)
+	}
+	if home := ts.get(t, testHome); home.Etag != resp.Etag {
+		t.Errorf("home etag %s is not the etag %s of the move", home.Etag, resp.Etag)
+	}
+}
+
+func TestRm(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/b.txt")
+	before := ts.get(t, testHome)
+	ts.clock.Advance(time.Second)
+
+	resp, err := ts.Rm(context.Background(), &pb.RmReq{AccessToken: ts.token, Path: testHome + "/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Deleted != 2 {
+		t.Errorf("deleted %d records, want 2", resp.Deleted)
+	}
+
+	for _, p := range []string{testHome + "/a", testHome + "/a/b.txt"} {
+		_, err = ts.Get(context.Background(), &pb.GetReq{AccessToken: ts.token, Path: p})
+		wantCode(t, err, codes.NotFound)
+	}
+	if after := ts.get(t, testHome); after.Etag == before.Etag {
+		t.Errorf("home etag %s did not change", after.Etag)
+	}
+}
+
+// TestStatMissing checks a Stat of a missing path creates no record,
+// unlike a Get with ForceCreation.
+func TestStatMissing(t *testing.T) {
+	ts := newTestServer(t, nil)
+	_, err := ts.Stat(context.Background(), &pb.StatReq{AccessToken: ts.token, Path: testHome + "/a"})
+	wantCode(t, err, codes.NotFound)
+	if n := ts.count(t); n != 0 {
+		t.Errorf("the Stat created %d records", n)
+	}
+
+	_, err = ts.Get(context.Background(), &pb.GetReq{AccessToken: ts.token, Path: testHome + "/a", ForceCreation: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := ts.count(t); n == 0 {
+		t.Error("the Get created no record")
+	}
+}
+
+func TestStat(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a.txt")
+	rec, err := ts.Stat(context.Background(), &pb.StatReq{AccessToken: ts.token, Path: testHome + "/a.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ts.get(t, testHome+"/a.txt"); !reflect.DeepEqual(rec, want) {
+		t.Errorf("got %v, want %v", rec, want)
+	}
+}
+
+// TestGetWithAncestors checks the chain goes from the record to the home
+// with the etags stored, the ancestors without a record reported apart.
+func TestGetWithAncestors(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/b/c.txt")
+	ts.clock.Advance(time.Second)
+	ts.put(t, testHome+"/a/d.txt")
+
+	req := &pb.GetReq{AccessToken: ts.token, Path: testHome + "/a/b/c.txt"}
+	resp, err := ts.GetWithAncestors(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{testHome + "/a/b/c.txt", testHome + "/a/b", testHome + "/a", testHome}
+	if len(resp.Records) != len(want) || len(resp.Missing) != 0 {
+		t.Fatalf("got %v, want the chain %v", resp, want)
+	}
+	for i, rec := range resp.Records {
+		if rec.Path != want[i] || rec.Etag != ts.record(t, want[i]).ETag {
+			t.Errorf("got %v at %d, want %s with its etag", rec, i, want[i])
+		}
+	}
+
+	if err = ts.s.db.Unscoped().Where("path = ?", testHome+"/a/b").Delete(record{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	resp, err = ts.GetWithAncestors(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Records) != 3 || !reflect.DeepEqual(resp.Missing, []string{testHome + "/a/b"}) {
+		t.Errorf("got %v, want %s missing", resp, testHome+"/a/b")
+	}
+
+	_, err = ts.GetWithAncestors(context.Background(), &pb.GetReq{AccessToken: ts.token, Path: testHome + "/x"})
+	wantCode(t, err, codes.NotFound)
+}
+
+// TestGetForceCreationRefetchError checks a Get fails when the record is
+// created but cannot be read back. The failing query is the last one of
+// the same Get on another server.
+func TestGetForceCreationRefetchError(t *testing.T) {
+	req := &pb.GetReq{Path: testHome + "/a", ForceCreation: true}
+
+	ts := newTestServer(t, nil)
+	var queries int
+	ts.s.db.Callback().Query().Before("gorm:query").Register("test:count", func(scope *gorm.Scope) {
+		queries++
+	})
+	req.AccessToken = ts.token
+	if _, err := ts.Get(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	ts = newTestServer(t, nil)
+	failNth(ts.s.db.Callback().Query().Before("gorm:query").Register, queries)
+	req.AccessToken = ts.token
+	rec, err := ts.Get(context.Background(), req)
+	wantCode(t, err, codes.Internal)
+	if rec.Path != "" {
+		t.Errorf("got the record %v along with the error", rec)
+	}
+	// the record was created, the next Get finds it
+	ts.get(t, testHome+"/a")
+}
+
+func TestSQLLog(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		logger, logs := newCapturingLogger()
+		ts := newTestServer(t, func(p *newServerParams) {
+			p.logger = logger
+			p.sqlLog = enabled
+		})
+		ts.put(t, testHome+"/a.txt")
+		ts.get(t, testHome+"/a.txt")
+
+		if logged := len(logs.find("SELECT")) > 0; logged != enabled {
+			t.Errorf("SQL log enabled: %t, the statements were logged: %t", enabled, logged)
+		}
+	}
+}
+
+// TestAccessLog checks the handlers log to the injected logger with the
+// fields of the request.
+func TestAccessLog(t *testing.T) {
+	logger, logs := newCapturingLogger()
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.logger = logger
+	})
+	ctx := metadata.NewContext(context.Background(), metadata.Pairs("trace", "client-trace-1"))
+	if _, err := ts.Put(ctx, &pb.PutReq{AccessToken: ts.token, Path: testHome + "/a.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	finished := logs.find("request finished")
+	if len(finished) != 1 {
+		t.Fatalf("got %d access logs, want 1", len(finished))
+	}
+	e := finished[0]
+	for k, want := range map[string]interface{}{"method": "put", "type": "grpcaccess", "trace": "client-trace-1", "svc": serviceID} {
+		if e.Data[k] != want {
+			t.Errorf("got %s=%v, want %v", k, e.Data[k], want)
+		}
+	}
+	if _, ok := e.Data["duration"].(float64); !ok || e.Level != rus.InfoLevel {
+		t.Errorf("got the entry %v, want an info with the duration", e)
+	}
+}
+
+func TestExists(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/b.txt")
+	n := ts.count(t)
+
+	for p, want := range map[string]bool{"/a/b.txt": true, "/a": true, "/a/c.txt": false, "/d/e": false} {
+		resp, err := ts.Exists(context.Background(), &pb.ExistsReq{AccessToken: ts.token, Path: testHome + p})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Exists != want {
+			t.Errorf("%s exists: %t, want %t", p, resp.Exists, want)
+		}
+	}
+	if after := ts.count(t); after != n {
+		t.Errorf("got %d records after the calls, want %d", after, n)
+	}
+}
+
+// TestTouch checks a Touch gives the record and its ancestors a new etag
+// and mtime but keeps the checksum and the size.
+func TestTouch(t *testing.T) {
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.clock = newFakeClock(fixedTime)
+		p.idGen = newSequentialIDs("seq")
+	})
+	sum := "md5:d41d8cd98f00b204e9800998ecf8427e"
+	_, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: testHome + "/a/f.txt", Checksum: sum, Size: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.put(t, testHome+"/a/g.txt")
+
+	ts.clock.Advance(time.Hour)
+	if _, err = ts.Touch(context.Background(), &pb.TouchReq{AccessToken: ts.token, Path: testHome + "/a/f.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	rec := ts.get(t, testHome+"/a/f.txt")
+	if rec.Checksum != sum || rec.Size != 10 {
+		t.Errorf("got %v, want the checksum %s and size 10 kept", rec, sum)
+	}
+	touched := fixedTime.Add(time.Hour).Unix()
+	wantEtag(t, ts, "seq-7", "/a/f.txt", "/a", "")
+	wantModified(t, ts, touched, "/a/f.txt", "/a", "")
+	wantEtag(t, ts, "seq-5", "/a/g.txt")
+
+	_, err = ts.Touch(context.Background(), &pb.TouchReq{AccessToken: ts.token, Path: testHome + "/missing"})
+	wantCode(t, err, codes.NotFound)
+}
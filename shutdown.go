@@ -0,0 +1,68 @@
+package main
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+var shuttingDownError = grpc.Errorf(codes.Unavailable, "server is shutting down")
+
+// acquire registers an in-flight request. It fails once the
+// server is shutting down so no new request touches the database.
+func (s *server) acquire() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return shuttingDownError
+	}
+	s.inflight.Add(1)
+	return nil
+}
+
+// release marks an in-flight request as finished.
+func (s *server) release() {
+	s.inflight.Done()
+}
+
+// Shutdown stops accepting new requests, ends the Watch streams and
+// waits for the in-flight requests to finish or ctx to expire before
+// closing the database handle.
+func (s *server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closing = true
+	close(s.done)
+	s.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+		s.logger.Info("in-flight requests drained")
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.logger.Error(err)
+	}
+
+	if cerr := s.db.Close(); cerr != nil {
+		s.logger.Error(cerr)
+		if err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Close is Shutdown without deadline.
+func (s *server) Close() error {
+	return s.Shutdown(context.Background())
+}
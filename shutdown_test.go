@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+// blockFirstQuery makes the first query of ts wait until the returned
+// function is called. started is closed once the query is waiting.
+func blockFirstQuery(ts *testServer) (started chan struct{}, unblock func()) {
+	started = make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	ts.s.db.Callback().Query().Before("gorm:query").Register("test:block", func(scope *gorm.Scope) {
+		once.Do(func() {
+			close(started)
+			<-release
+		})
+	})
+	return started, func() { close(release) }
+}
+
+// TestShutdownDrains checks Shutdown waits for the in-flight request
+// before closing the database, and that new requests are refused.
+func TestShutdownDrains(t *testing.T) {
+	ts := newTestServer(t, nil)
+	started, unblock := blockFirstQuery(ts)
+
+	putErr := make(chan error, 1)
+	go func() {
+		_, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: testHome + "/a.txt"})
+		putErr <- err
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- ts.s.Shutdown(context.Background()) }()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v before the request finished", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the server is shutting down, a new request is refused at once
+	_, err := ts.Get(context.Background(), &pb.GetReq{AccessToken: ts.token, Path: testHome})
+	wantCode(t, err, codes.Unavailable)
+
+	unblock()
+	if err = <-putErr; err != nil {
+		t.Errorf("the in-flight put failed: %s", err)
+	}
+	if err = <-shutdown; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	ts := newTestServer(t, nil)
+	started, unblock := blockFirstQuery(ts)
+	defer unblock()
+
+	go ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: testHome + "/a.txt"})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := ts.s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want the deadline of the shutdown exceeded", err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+)
+
+func newSizeServer(t *testing.T) *testServer {
+	return newTestServer(t, func(p *newServerParams) {
+		p.propagateSize = true
+	})
+}
+
+func (ts *testServer) putSize(t *testing.T, p string, size int64) {
+	_, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: p, Size: size})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// wantSizes checks the records of the paths below the home have the
+// sizes of sizes.
+func wantSizes(t *testing.T, ts *testServer, sizes map[string]int64) {
+	for p, size := range sizes {
+		if rec := ts.get(t, testHome+p); rec.Size != size {
+			t.Errorf("%s has size %d, want %d", testHome+p, rec.Size, size)
+		}
+	}
+}
+
+func TestSizePut(t *testing.T) {
+	ts := newSizeServer(t)
+	ts.putSize(t, testHome+"/a/b/f.txt", 10)
+	ts.putSize(t, testHome+"/a/g.txt", 5)
+	wantSizes(t, ts, map[string]int64{"/a/b/f.txt": 10, "/a/g.txt": 5, "/a/b": 10, "/a": 15, "": 15})
+
+	// a put again adjusts the ancestors by the difference only
+	ts.clock.Advance(time.Second)
+	ts.putSize(t, testHome+"/a/b/f.txt", 4)
+	wantSizes(t, ts, map[string]int64{"/a/b/f.txt": 4, "/a/b": 4, "/a": 9, "": 9})
+}
+
+func TestSizeRm(t *testing.T) {
+	ts := newSizeServer(t)
+	ts.putSize(t, testHome+"/a/b/f.txt", 10)
+	ts.putSize(t, testHome+"/a/b/g.txt", 3)
+	ts.putSize(t, testHome+"/a/h.txt", 5)
+	ts.clock.Advance(time.Second)
+
+	ts.rm(t, &pb.RmReq{Path: testHome + "/a/b/g.txt"})
+	wantSizes(t, ts, map[string]int64{"/a/b": 10, "/a": 15, "": 15})
+	ts.clock.Advance(time.Second)
+	ts.rm(t, &pb.RmReq{Path: testHome + "/a/b"})
+	wantSizes(t, ts, map[string]int64{"/a": 5, "": 5})
+}
+
+// TestSizeRmOlderThan checks the sizes of the old records removed below
+// a folder kept by OlderThan leave its ancestors and the folder itself.
+func TestSizeRmOlderThan(t *testing.T) {
+	ts := newSizeServer(t)
+	ts.putSize(t, testHome+"/a/old.txt", 10)
+	ts.putSize(t, testHome+"/a/b/older.txt", 2)
+	ts.clock.Advance(time.Second)
+	ts.putSize(t, testHome+"/a/new.txt", 5)
+	ts.putSize(t, testHome+"/a/b/newer.txt", 1)
+
+	ts.clock.Advance(time.Second)
+	ts.rm(t, &pb.RmReq{Path: testHome + "/a", OlderThan: ts.clock.Now().Unix() - 1})
+	wantSizes(t, ts, map[string]int64{"/a/b": 1, "/a": 6, "": 6})
+}
+
+// TestSizeNotPropagated checks the folders keep a zero size unless the
+// propagation of the sizes is enabled.
+func TestSizeNotPropagated(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.putSize(t, testHome+"/a/f.txt", 10)
+	wantSizes(t, ts, map[string]int64{"/a/f.txt": 10, "/a": 0, "": 0})
+}
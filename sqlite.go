@@ -0,0 +1,7 @@
+// +build sqlite
+
+package main
+
+// The SQLite driver needs cgo so it is only linked in when building
+// with -tags sqlite, for embedded and test deployments.
+import _ "github.com/mattn/go-sqlite3"
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// subtreeCalls run a Mv, Copy and Rm of the folder at src, of 5 records.
+var subtreeCalls = map[string]func(ts *testServer, src string) error{
+	"mv": func(ts *testServer, src string) error {
+		_, err := ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: src, Dst: src + "-mv"})
+		return err
+	},
+	"copy": func(ts *testServer, src string) error {
+		_, err := ts.Copy(context.Background(), &pb.CopyReq{AccessToken: ts.token, Src: src, Dst: src + "-copy"})
+		return err
+	},
+	"rm": func(ts *testServer, src string) error {
+		_, err := ts.Rm(context.Background(), &pb.RmReq{AccessToken: ts.token, Path: src})
+		return err
+	},
+}
+
+func newSubtreeServer(t *testing.T, max int64) *testServer {
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.maxSubtreeNodes = max
+	})
+	putSubtree(t, ts, testHome+"/a", 4)
+	ts.clock.Advance(time.Second)
+	return ts
+}
+
+func TestMaxSubtreeNodesUnder(t *testing.T) {
+	for name, call := range subtreeCalls {
+		ts := newSubtreeServer(t, 5)
+		if err := call(ts, testHome+"/a"); err != nil {
+			t.Errorf("%s of 5 records: %v", name, err)
+		}
+	}
+}
+
+func TestMaxSubtreeNodesOver(t *testing.T) {
+	for name, call := range subtreeCalls {
+		ts := newSubtreeServer(t, 4)
+		before := dbState(t, ts)
+		if err := call(ts, testHome+"/a"); grpc.Code(err) != codes.FailedPrecondition {
+			t.Errorf("%s of 5 records: got %v, want FailedPrecondition", name, err)
+		}
+		if after := dbState(t, ts); !reflect.DeepEqual(after, before) {
+			t.Errorf("%s: the rejected call changed the records into\n%s", name, strings.Join(after, "\n"))
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"regexp"
+)
+
+// tablePrefixSetting is the gorm setting holding the table name prefix,
+// so each server handle resolves its own table names.
+const tablePrefixSetting = "clawio:table_prefix"
+
+// validTablePrefix keeps the prefix usable unquoted in table and index names.
+var validTablePrefix = regexp.MustCompile(`^[a-z0-9_]*$`)
+
+func init() {
+	gorm.DefaultTableNameHandler = func(db *gorm.DB, defaultTableName string) string {
+		return tablePrefix(db) + defaultTableName
+	}
+}
+
+// withTablePrefix returns a handle whose table names start with prefix.
+func withTablePrefix(db *gorm.DB, prefix string) (*gorm.DB, error) {
+	if !validTablePrefix.MatchString(prefix) {
+		return nil, fmt.Errorf("table prefix %s must only contain lowercase letters, digits and underscores", prefix)
+	}
+	return db.Set(tablePrefixSetting, prefix), nil
+}
+
+// tablePrefix returns the table name prefix of db.
+func tablePrefix(db *gorm.DB) string {
+	if prefix, ok := db.Get(tablePrefixSetting); ok {
+		return prefix.(string)
+	}
+	return ""
+}
+
+// recordsTable returns the quoted name of the records table of db
+// for the statements gorm cannot build for us.
+func recordsTable(db *gorm.DB) string {
+	return db.NewScope(&record{}).QuotedTableName()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// newTLSConfig returns the TLS configuration of the listeners, or nil
+// when certFile and keyFile are empty and the server is in plaintext.
+// With clientCAFile the clients must present a certificate signed by
+// one of its CAs.
+func newTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, fmt.Errorf("client CA %s requires a certificate and key", clientCAFile)
+		}
+		return nil, nil
+	}
+
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("TLS requires both a certificate and a key")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &tls.Config{}
+	c.Certificates = []tls.Certificate{cert}
+	c.MinVersion = tls.VersionTLS12
+
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("client CA %s has no PEM encoded certificates", clientCAFile)
+		}
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return c, nil
+}
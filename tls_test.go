@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/grpclog"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1alpha"
+)
+
+// testCert is a certificate with its key, and the files they are in.
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newTestCert writes a certificate for localhost signed by ca, or self
+// signed when ca is nil, and its key to dir.
+func newTestCert(t *testing.T, dir, name string, ca *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &testCert{cert: cert, key: key, certFile: filepath.Join(dir, name+".crt"), keyFile: filepath.Join(dir, name+".key")}
+	if err = ioutil.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// serveTLS serves the health checks of ts with the TLS configuration of
+// the files and returns the address listened to.
+func serveTLS(t *testing.T, ts *testServer, certFile, keyFile, clientCAFile string) string {
+	config, err := newTLSConfig(certFile, keyFile, clientCAFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer(grpc.Creds(credentials.NewTLS(config)))
+	healthpb.RegisterHealthServer(srv, newHealthServer(ts.s))
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+func init() {
+	// the rejected clients log every attempt to reconnect
+	grpclog.SetLogger(log.New(ioutil.Discard, "", 0))
+}
+
+// check runs a health check on addr with the dial options.
+func check(t *testing.T, addr string, opts ...grpc.DialOption) error {
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	return err
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil)
+	srvCert := newTestCert(t, dir, "server", ca)
+	addr := serveTLS(t, newTestServer(t, nil), srvCert.certFile, srvCert.keyFile, "")
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	if err := check(t, addr, grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(pool, "localhost"))); err != nil {
+		t.Errorf("the TLS client is rejected: %v", err)
+	}
+	if err := check(t, addr, grpc.WithInsecure()); err == nil {
+		t.Error("the plaintext client is accepted")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil)
+	srvCert := newTestCert(t, dir, "server", ca)
+	client := newTestCert(t, dir, "client", ca)
+	other := newTestCert(t, dir, "other", nil)
+	addr := serveTLS(t, newTestServer(t, nil), srvCert.certFile, srvCert.keyFile, ca.certFile)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	dial := func(c *testCert) grpc.DialOption {
+		config := &tls.Config{RootCAs: pool, ServerName: "localhost"}
+		if c != nil {
+			pair, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.Certificates = []tls.Certificate{pair}
+		}
+		return grpc.WithTransportCredentials(credentials.NewTLS(config))
+	}
+	if err := check(t, addr, dial(client)); err != nil {
+		t.Errorf("the client with a certificate of the CA is rejected: %v", err)
+	}
+	if err := check(t, addr, dial(nil)); err == nil {
+		t.Error("the client without certificate is accepted")
+	}
+	if err := check(t, addr, dial(other)); err == nil {
+		t.Error("the client with a certificate of another CA is accepted")
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	cert := newTestCert(t, dir, "server", nil)
+	if c, err := newTLSConfig("", "", ""); c != nil || err != nil {
+		t.Errorf("got %v, %v without files, want plaintext", c, err)
+	}
+	for _, files := range [][3]string{
+		{cert.certFile, "", ""},
+		{"", cert.keyFile, ""},
+		{"", "", cert.certFile},
+		{cert.certFile, cert.certFile, ""},
+		{cert.certFile, cert.keyFile, filepath.Join(dir, "missing.crt")},
+		{cert.certFile, cert.keyFile, cert.keyFile},
+	} {
+		if _, err := newTLSConfig(files[0], files[1], files[2]); err == nil {
+			t.Errorf("the files %q are accepted", files)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"github.com/clawio/service-auth/lib"
+	"github.com/dgrijalva/jwt-go"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultTokenCacheTTL is how long a parsed token is served from the
+	// cache, unless it expires before.
+	defaultTokenCacheTTL = time.Minute
+
+	// defaultTokenCacheSize is the number of parsed tokens kept.
+	defaultTokenCacheSize = 10000
+)
+
+// tokenCache is a LRU cache of the identities of the verified tokens,
+// so the chatty clients do not verify the same token on every request.
+type tokenCache struct {
+	ttl  time.Duration
+	size int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type tokenEntry struct {
+	token   string
+	idt     *lib.Identity
+	expires time.Time
+}
+
+func newTokenCache(ttl time.Duration, size int) *tokenCache {
+	return &tokenCache{
+		ttl:     ttl,
+		size:    size,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// get returns the identity of the token if it is cached and not expired.
+func (c *tokenCache) get(token string, now time.Time) (*lib.Identity, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[token]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*tokenEntry)
+	if !now.Before(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, token)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e.idt, true
+}
+
+// put caches the identity of the token until the TTL of the cache or the
+// expiry of the token, whichever comes first.
+func (c *tokenCache) put(token string, idt *lib.Identity, now time.Time) {
+
+	expires := now.Add(c.ttl)
+	if exp, ok := tokenExpiry(token); ok && exp.Before(expires) {
+		expires = exp
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[token]; ok {
+		el.Value.(*tokenEntry).expires = expires
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[token] = c.lru.PushFront(&tokenEntry{token, idt, expires})
+	for c.lru.Len() > c.size {
+		last := c.lru.Back()
+		c.lru.Remove(last)
+		delete(c.entries, last.Value.(*tokenEntry).token)
+	}
+}
+
+// tokenExpiry returns the exp claim of a token already verified.
+func tokenExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := jwt.DecodeSegment(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	claims := struct {
+		Exp *float64 `json:"exp"`
+	}{}
+	if err = json.Unmarshal(payload, &claims); err != nil || claims.Exp == nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(*claims.Exp), 0), true
+}
+
+// parseToken returns the identity of the access token, verifying it only
+// when it is not cached. The token is verified with the shared secret and
+// then with the previous ones, so the tokens issued before a rotation are
+// still accepted. The error is the one of the current secret.
+func (s *server) parseToken(token string) (*lib.Identity, error) {
+
+	now := s.p.clock.Now()
+	if idt, ok := s.tokens.get(token, now); ok {
+		return idt, nil
+	}
+
+	idt, err := lib.ParseToken(token, s.p.sharedSecret)
+	for i := 0; err != nil && i < len(s.p.previousSecrets); i++ {
+		if prev, prevErr := lib.ParseToken(token, s.p.previousSecrets[i]); prevErr == nil {
+			idt, err = prev, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.tokens.put(token, idt, now)
+	return idt, nil
+}
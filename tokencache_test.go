@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestTokenCacheHit checks a second parse of a token is served from the
+// cache: it still succeeds once the secret that signed it is gone.
+func TestTokenCacheHit(t *testing.T) {
+	ts := newTestServer(t, nil)
+	idt, err := ts.s.parseToken(ts.token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts.s.p.sharedSecret = "rotated"
+	cached, err := ts.s.parseToken(ts.token)
+	if err != nil {
+		t.Fatalf("the token was verified again: %s", err)
+	}
+	if cached != idt {
+		t.Errorf("got identity %v, want the cached %v", cached, idt)
+	}
+}
+
+// TestTokenCacheExpired checks a token is not served from the cache once
+// it expires, even when the TTL of the cache is not over.
+func TestTokenCacheExpired(t *testing.T) {
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.tokenCacheTTL = time.Hour
+	})
+	token := testToken(t, "demo", ts.clock.Now().Add(time.Minute))
+	if _, err := ts.s.parseToken(token); err != nil {
+		t.Fatal(err)
+	}
+
+	ts.clock.Advance(time.Minute)
+	if _, ok := ts.s.tokens.get(token, ts.clock.Now()); ok {
+		t.Error("the expired token was served from the cache")
+	}
+	ts.s.p.sharedSecret = "rotated"
+	if _, err := ts.s.parseToken(token); err == nil {
+		t.Error("the expired token was not verified again")
+	}
+}
+
+func TestTokenCacheTTL(t *testing.T) {
+	now := time.Now()
+	c := newTokenCache(time.Minute, 10)
+	c.put("token", nil, now)
+
+	if _, ok := c.get("token", now.Add(time.Minute-time.Second)); !ok {
+		t.Error("the token is not cached before the TTL")
+	}
+	if _, ok := c.get("token", now.Add(time.Minute)); ok {
+		t.Error("the token is cached after the TTL")
+	}
+	if len(c.entries) != 0 || c.lru.Len() != 0 {
+		t.Errorf("the expired token is still held")
+	}
+}
+
+func TestTokenCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	now := time.Now()
+	c := newTokenCache(time.Minute, 2)
+	c.put("a", nil, now)
+	c.put("b", nil, now)
+	c.get("a", now)
+	c.put("c", nil, now)
+
+	for token, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := c.get(token, now); ok != want {
+			t.Errorf("token %s cached: %t, want %t", token, ok, want)
+		}
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	exp := time.Unix(time.Now().Add(time.Hour).Unix(), 0)
+	if got, ok := tokenExpiry(testToken(t, "demo", exp)); !ok || !got.Equal(exp) {
+		t.Errorf("got expiry %v, %t, want %v", got, ok, exp)
+	}
+	if _, ok := tokenExpiry("not a token"); ok {
+		t.Error("got an expiry out of a malformed token")
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	rus "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// traceServer wraps a PropServer to resolve the trace id of every RPC
+// once, as the grpc version in use has no interceptors. The id sent by
+// the client, or a new one, is stored in the context the handlers read
+// it from and is returned to the client in the trailer metadata.
+type traceServer struct {
+	srv pb.PropServer
+}
+
+func newTraceServer(srv pb.PropServer) pb.PropServer {
+	return &traceServer{srv: srv}
+}
+
+// traceIDKey is the context key of the trace id of the request.
+type traceIDKey struct{}
+
+// trace returns ctx holding the trace id of the request.
+func (t *traceServer) trace(ctx context.Context) (context.Context, string, error) {
+	traceID, err := getGRPCTraceID(ctx)
+	if err != nil {
+		return ctx, "", err
+	}
+	return context.WithValue(ctx, traceIDKey{}, traceID), traceID, nil
+}
+
+// traceIDFrom returns the trace id stored in ctx by traceServer, empty
+// for the work not started by a request, like the trash purges.
+func traceIDFrom(ctx context.Context) string {
+	traceID, _ := ctx.Value(traceIDKey{}).(string)
+	return traceID
+}
+
+// requestLogger returns the logger of the request of ctx.
+func (s *server) requestLogger(ctx context.Context) *rus.Entry {
+	return s.logger.WithField("trace", traceIDFrom(ctx)).WithField("svc", serviceID)
+}
+
+// traceUnary is trace for the unary RPCs, that also sets the trailer.
+// The error of SetTrailer is ignored as the RPCs called in process,
+// outside of a gRPC stream, have no trailer to set.
+func (t *traceServer) traceUnary(ctx context.Context) (context.Context, error) {
+	ctx, traceID, err := t.trace(ctx)
+	if err != nil {
+		return ctx, err
+	}
+	grpc.SetTrailer(ctx, metadata.Pairs("trace", traceID))
+	return ctx, nil
+}
+
+func (t *traceServer) Put(ctx context.Context, req *pb.PutReq) (*pb.Void, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.Void{}, toGRPCError(err)
+	}
+	return t.srv.Put(ctx, req)
+}
+
+func (t *traceServer) Get(ctx context.Context, req *pb.GetReq) (*pb.Record, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.Record{}, toGRPCError(err)
+	}
+	return t.srv.Get(ctx, req)
+}
+
+func (t *traceServer) Mv(ctx context.Context, req *pb.MvReq) (*pb.MvResp, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.MvResp{}, toGRPCError(err)
+	}
+	return t.srv.Mv(ctx, req)
+}
+
+func (t *traceServer) Rm(ctx context.Context, req *pb.RmReq) (*pb.RmResp, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.RmResp{}, toGRPCError(err)
+	}
+	return t.srv.Rm(ctx, req)
+}
+
+func (t *traceServer) List(ctx context.Context, req *pb.ListReq) (*pb.ListResp, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.ListResp{}, toGRPCError(err)
+	}
+	return t.srv.List(ctx, req)
+}
+
+func (t *traceServer) Stat(ctx context.Context, req *pb.StatReq) (*pb.Record, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.Record{}, toGRPCError(err)
+	}
+	return t.srv.Stat(ctx, req)
+}
+
+func (t *traceServer) Copy(ctx context.Context, req *pb.CopyReq) (*pb.Void, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.Void{}, toGRPCError(err)
+	}
+	return t.srv.Copy(ctx, req)
+}
+
+func (t *traceServer) BatchPut(ctx context.Context, req *pb.BatchPutReq) (*pb.Void, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.Void{}, toGRPCError(err)
+	}
+	return t.srv.BatchPut(ctx, req)
+}
+
+func (t *traceServer) BatchGet(ctx context.Context, req *pb.BatchGetReq) (*pb.BatchGetResp, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.BatchGetResp{}, toGRPCError(err)
+	}
+	return t.srv.BatchGet(ctx, req)
+}
+
+func (t *traceServer) Exists(ctx context.Context, req *pb.ExistsReq) (*pb.ExistsResp, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.ExistsResp{}, toGRPCError(err)
+	}
+	return t.srv.Exists(ctx, req)
+}
+
+func (t *traceServer) GetByID(ctx context.Context, req *pb.GetByIdReq) (*pb.Record, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.Record{}, toGRPCError(err)
+	}
+	return t.srv.GetByID(ctx, req)
+}
+
+func (t *traceServer) ChangesSince(ctx context.Context, req *pb.ChangesReq) (*pb.ChangesResp, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.ChangesResp{}, toGRPCError(err)
+	}
+	return t.srv.ChangesSince(ctx, req)
+}
+
+func (t *traceServer) Touch(ctx context.Context, req *pb.TouchReq) (*pb.Void, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.Void{}, toGRPCError(err)
+	}
+	return t.srv.Touch(ctx, req)
+}
+
+func (t *traceServer) Restore(ctx context.Context, req *pb.RestoreReq) (*pb.RestoreResp, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.RestoreResp{}, toGRPCError(err)
+	}
+	return t.srv.Restore(ctx, req)
+}
+
+func (t *traceServer) Purge(ctx context.Context, req *pb.PurgeReq) (*pb.PurgeResp, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.PurgeResp{}, toGRPCError(err)
+	}
+	return t.srv.Purge(ctx, req)
+}
+
+func (t *traceServer) Count(ctx context.Context, req *pb.CountReq) (*pb.CountResp, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.CountResp{}, toGRPCError(err)
+	}
+	return t.srv.Count(ctx, req)
+}
+
+func (t *traceServer) Reconcile(ctx context.Context, req *pb.ReconcileReq) (*pb.ReconcileResp, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.ReconcileResp{}, toGRPCError(err)
+	}
+	return t.srv.Reconcile(ctx, req)
+}
+
+func (t *traceServer) GetTree(ctx context.Context, req *pb.GetTreeReq) (*pb.TreeNode, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.TreeNode{}, toGRPCError(err)
+	}
+	return t.srv.GetTree(ctx, req)
+}
+
+func (t *traceServer) RmMany(ctx context.Context, req *pb.RmManyReq) (*pb.RmResp, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.RmResp{}, toGRPCError(err)
+	}
+	return t.srv.RmMany(ctx, req)
+}
+
+func (t *traceServer) Version(ctx context.Context, req *pb.Void) (*pb.VersionResp, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.VersionResp{}, toGRPCError(err)
+	}
+	return t.srv.Version(ctx, req)
+}
+
+func (t *traceServer) RmByID(ctx context.Context, req *pb.RmByIdReq) (*pb.RmResp, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.RmResp{}, toGRPCError(err)
+	}
+	return t.srv.RmByID(ctx, req)
+}
+
+func (t *traceServer) FindByChecksum(ctx context.Context, req *pb.ChecksumReq) (*pb.ChecksumResp, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.ChecksumResp{}, toGRPCError(err)
+	}
+	return t.srv.FindByChecksum(ctx, req)
+}
+
+func (t *traceServer) RecomputeEtag(ctx context.Context, req *pb.RecomputeEtagReq) (*pb.Record, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.Record{}, toGRPCError(err)
+	}
+	return t.srv.RecomputeEtag(ctx, req)
+}
+
+func (t *traceServer) GetWithAncestors(ctx context.Context, req *pb.GetReq) (*pb.AncestorsResp, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.AncestorsResp{}, toGRPCError(err)
+	}
+	return t.srv.GetWithAncestors(ctx, req)
+}
+
+func (t *traceServer) Audit(ctx context.Context, req *pb.AuditReq) (*pb.AuditResp, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.AuditResp{}, toGRPCError(err)
+	}
+	return t.srv.Audit(ctx, req)
+}
+
+func (t *traceServer) HasChildren(ctx context.Context, req *pb.HasChildrenReq) (*pb.HasChildrenResp, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.HasChildrenResp{}, toGRPCError(err)
+	}
+	return t.srv.HasChildren(ctx, req)
+}
+
+func (t *traceServer) ListByCheckpoint(ctx context.Context, req *pb.CheckpointReq) (*pb.CheckpointResp, error) {
+	ctx, err := t.traceUnary(ctx)
+	if err != nil {
+		return &pb.CheckpointResp{}, toGRPCError(err)
+	}
+	return t.srv.ListByCheckpoint(ctx, req)
+}
+
+// watchStream is a Watch stream with the context of a wrapper, like the
+// one holding the trace id.
+type watchStream struct {
+	pb.Prop_WatchServer
+	ctx context.Context
+}
+
+func (s *watchStream) Context() context.Context {
+	return s.ctx
+}
+
+func (t *traceServer) Watch(req *pb.WatchReq, stream pb.Prop_WatchServer) error {
+	ctx, traceID, err := t.trace(stream.Context())
+	if err != nil {
+		return toGRPCError(err)
+	}
+	stream.SetTrailer(metadata.Pairs("trace", traceID))
+	return t.srv.Watch(req, &watchStream{stream, ctx})
+}
+
+// importStream is an Import stream with the context of a wrapper. When
+// peeked is set the first message has already been received, so first
+// and err are returned by the next Recv.
+type importStream struct {
+	pb.Prop_ImportServer
+	ctx    context.Context
+	peeked bool
+	first  *pb.ImportReq
+	err    error
+}
+
+func (s *importStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *importStream) Recv() (*pb.ImportReq, error) {
+	if s.peeked {
+		s.peeked = false
+		return s.first, s.err
+	}
+	return s.Prop_ImportServer.Recv()
+}
+
+func (t *traceServer) Import(stream pb.Prop_ImportServer) error {
+	ctx, traceID, err := t.trace(stream.Context())
+	if err != nil {
+		return toGRPCError(err)
+	}
+	stream.SetTrailer(metadata.Pairs("trace", traceID))
+	return t.srv.Import(&importStream{Prop_ImportServer: stream, ctx: ctx})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+// recordingExporter keeps the finished spans.
+type recordingExporter struct {
+	mu    sync.Mutex
+	spans []*span
+}
+
+func (e *recordingExporter) export(sp *span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, sp)
+}
+
+// traceIDs returns the distinct trace ids of the spans.
+func (e *recordingExporter) traceIDs() map[string]bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ids := map[string]bool{}
+	for _, sp := range e.spans {
+		ids[sp.TraceID] = true
+	}
+	return ids
+}
+
+func newTracedServer(t *testing.T) (*testServer, *recordingExporter) {
+	e := &recordingExporter{}
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.spanExporter = e
+	})
+	return ts, e
+}
+
+func TestTraceIDFromClient(t *testing.T) {
+	ts, e := newTracedServer(t)
+	ctx := metadata.NewContext(context.Background(), metadata.Pairs("trace", "client-trace-1"))
+
+	_, err := ts.Put(ctx, &pb.PutReq{AccessToken: ts.token, Path: testHome + "/a/b.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := e.traceIDs()
+	if len(ids) != 1 || !ids["client-trace-1"] {
+		t.Errorf("got trace ids %v, want only client-trace-1", ids)
+	}
+}
+
+func TestTraceIDGenerated(t *testing.T) {
+	for name, ctx := range map[string]context.Context{
+		"missing":   context.Background(),
+		"malformed": metadata.NewContext(context.Background(), metadata.Pairs("trace", "has spaces")),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ts, e := newTracedServer(t)
+			if _, err := ts.Put(ctx, &pb.PutReq{AccessToken: ts.token, Path: testHome + "/a.txt"}); err != nil {
+				t.Fatal(err)
+			}
+
+			// the propagation shares the trace id of the request
+			ids := e.traceIDs()
+			if len(ids) != 1 || ids[""] || ids["has spaces"] {
+				t.Errorf("got trace ids %v, want a single generated one", ids)
+			}
+		})
+	}
+}
+
+func TestTraceIDFrom(t *testing.T) {
+	if id := traceIDFrom(context.Background()); id != "" {
+		t.Errorf("got %s out of a request, want none", id)
+	}
+
+	ctx, id, err := (&traceServer{}).trace(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if traceIDFrom(ctx) != id || id == "" {
+		t.Errorf("got %s, want %s", traceIDFrom(ctx), id)
+	}
+}
+
+// hierarchy returns the spans as "name<-parent name", in the order they
+// finished.
+func (e *recordingExporter) hierarchy() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	names := map[string]string{}
+	for _, sp := range e.spans {
+		names[sp.ID] = sp.Name
+	}
+	h := []string{}
+	for _, sp := range e.spans {
+		h = append(h, sp.Name+"<-"+names[sp.ParentID])
+	}
+	return h
+}
+
+// TestPutSpans checks the spans of a Put of an existing file: the
+// database operations are children of the request and the updates of the
+// ancestors are children of the propagation.
+func TestPutSpans(t *testing.T) {
+	ts, e := newTracedServer(t)
+	ts.put(t, testHome+"/a/b.txt")
+	ts.clock.Advance(time.Second)
+	e.mu.Lock()
+	e.spans = nil
+	e.mu.Unlock()
+
+	ctx := metadata.NewContext(context.Background(), metadata.Pairs("trace", "client-trace-1"))
+	if _, err := ts.Put(ctx, &pb.PutReq{AccessToken: ts.token, Path: testHome + "/a/b.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"getByPath<-put",
+		"insert<-put",
+		"createAncestors<-put",
+		"markFolders<-put",
+		"update<-propagate",
+		"update<-propagate",
+		"propagate<-put",
+		"put<-",
+	}
+	if got := e.hierarchy(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got the spans %v, want %v", got, want)
+	}
+	if ids := e.traceIDs(); len(ids) != 1 || !ids["client-trace-1"] {
+		t.Errorf("got trace ids %v, want only client-trace-1", ids)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"github.com/nu7hatch/gouuid"
+	rus "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"time"
+)
+
+type spanKey int
+
+// currentSpanKey is the context key of the span
+// the new spans are children of.
+const currentSpanKey spanKey = 0
+
+// span is a timed operation done while serving a request.
+// All the spans of a request share the trace id of the request.
+type span struct {
+	TraceID  string
+	ID       string
+	ParentID string
+	Name     string
+	Start    time.Time
+	Duration time.Duration
+	Err      error
+
+	exporter spanExporter
+}
+
+// spanExporter receives the finished spans.
+type spanExporter interface {
+	export(sp *span)
+}
+
+// newSpanExporter returns the exporter with the given name.
+// An empty name disables tracing.
+func newSpanExporter(name string, logger *rus.Logger) (spanExporter, error) {
+	switch name {
+	case "", "none":
+		return nopExporter{}, nil
+	case "log":
+		return &logExporter{logger}, nil
+	default:
+		return nil, fmt.Errorf("span exporter %s is not supported", name)
+	}
+}
+
+type nopExporter struct{}
+
+func (nopExporter) export(sp *span) {}
+
+// logExporter writes the finished spans to the log at debug level.
+type logExporter struct {
+	logger *rus.Logger
+}
+
+func (e *logExporter) export(sp *span) {
+	entry := e.logger.WithFields(rus.Fields{
+		"trace":    sp.TraceID,
+		"span":     sp.ID,
+		"parent":   sp.ParentID,
+		"name":     sp.Name,
+		"duration": sp.Duration.Seconds(),
+		"type":     "span",
+	})
+	if sp.Err != nil {
+		entry = entry.WithField("error", sp.Err.Error())
+	}
+	entry.Debug("span finished")
+}
+
+// startSpan starts a span as a child of the span in ctx, if any,
+// and returns a context carrying the new span.
+func (s *server) startSpan(ctx context.Context, name string) (context.Context, *span) {
+	sp := &span{}
+	sp.Name = name
+	sp.Start = time.Now()
+	sp.exporter = s.p.spanExporter
+
+	sp.TraceID = traceIDFrom(ctx)
+
+	if id, err := uuid.NewV4(); err == nil {
+		sp.ID = id.String()
+	}
+
+	if parent, ok := ctx.Value(currentSpanKey).(*span); ok {
+		sp.ParentID = parent.ID
+	}
+
+	return context.WithValue(ctx, currentSpanKey, sp), sp
+}
+
+// finish ends the span and hands it to the exporter.
+func (sp *span) finish(err error) {
+	sp.Duration = time.Since(sp.Start)
+	sp.Err = err
+	sp.exporter.export(sp)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+// defaultTrashRetention is how long soft deleted records are kept
+// before the background purge removes them.
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+// purgeInterval is the period of the background purge.
+const purgeInterval = time.Hour
+
+// forDelete returns the handle to delete records with. Deletes are soft,
+// setting deleted_at, when the trash is enabled and permanent otherwise.
+func (s *server) forDelete(db *gorm.DB) *gorm.DB {
+	if s.p.softDelete {
+		return db
+	}
+	return db.Unscoped()
+}
+
+// removeRecords deletes the records of selection, a handle returned by
+// forDelete. The soft deleted records also get mtime so ChangesSince
+// returns them, as tombstones, after the changes made before their
+// removal. It returns the number of records removed.
+func (s *server) removeRecords(selection *gorm.DB, mtime int64) (int64, error) {
+	var res *gorm.DB
+	if s.p.softDelete {
+		res = selection.UpdateColumns(map[string]interface{}{"deleted_at": gorm.NowFunc(), "m_time": mtime})
+	} else {
+		res = selection.Delete(record{})
+	}
+	return res.RowsAffected, res.Error
+}
+
+// purgeTrash permanently removes the soft deleted records at p and below.
+// It is used before writing to p, as the records in the trash still hold
+// their paths.
+func purgeTrash(db *gorm.DB, p string) error {
+	return db.Unscoped().Scopes(withPathPrefix(p)).Where("deleted_at IS NOT NULL").Delete(record{}).Error
+}
+
+// purgePageSize is the number of paths purgePaths removes by statement,
+// below the 999 variables of a statement of the SQLite versions before 3.32.
+const purgePageSize = 500
+
+// purgePaths permanently removes the records at paths, in the trash or not.
+func purgePaths(db *gorm.DB, paths []string) error {
+	for i := 0; i < len(paths); i += purgePageSize {
+		end := i + purgePageSize
+		if end > len(paths) {
+			end = len(paths)
+		}
+		err := db.Unscoped().Where("path IN (?)", paths[i:end]).Delete(record{}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeExpired permanently removes the records deleted before t
+// and returns how many were removed.
+func purgeExpired(db *gorm.DB, t time.Time) (int64, error) {
+	res := db.Unscoped().Where("deleted_at IS NOT NULL AND deleted_at < ?", t).Delete(record{})
+	return res.RowsAffected, res.Error
+}
+
+// purgeLoop purges the expired records of the trash until
+// the server shuts down.
+func (s *server) purgeLoop() {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.acquire(); err != nil {
+				return
+			}
+			n, err := purgeExpired(s.db, s.p.clock.Now().Add(-s.p.trashRetention))
+			s.release()
+			if err != nil {
+				s.logger.Error(err)
+				continue
+			}
+			s.logger.Infof("%d expired records purged from the trash", n)
+		}
+	}
+}
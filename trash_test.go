@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+func newTrashServer(t *testing.T) *testServer {
+	return newTestServer(t, func(p *newServerParams) {
+		p.softDelete = true
+		p.trashRetention = time.Hour
+	})
+}
+
+// TestTrashRmRestore checks the removed records are kept in the trash,
+// hidden from the reads, until they are restored.
+func TestTrashRmRestore(t *testing.T) {
+	ts := newTrashServer(t)
+	ts.put(t, testHome+"/a/f.txt")
+	ts.put(t, testHome+"/b.txt")
+	id := ts.get(t, testHome+"/a/f.txt").Id
+	ts.clock.Advance(time.Second)
+
+	if resp := ts.rm(t, &pb.RmReq{Path: testHome + "/a"}); resp.Deleted != 2 {
+		t.Errorf("deleted %d records, want 2", resp.Deleted)
+	}
+	for _, p := range []string{"/a", "/a/f.txt"} {
+		_, err := ts.Get(context.Background(), &pb.GetReq{AccessToken: ts.token, Path: testHome + p})
+		wantCode(t, err, codes.NotFound)
+		if rec := ts.record(t, testHome+p); rec.DeletedAt == nil {
+			t.Errorf("%s is not in the trash", p)
+		}
+	}
+	if got := ts.list(t, &pb.ListReq{Path: testHome}); !reflect.DeepEqual(got, []string{"/b.txt"}) {
+		t.Errorf("got %v, want b.txt only", got)
+	}
+
+	ts.clock.Advance(time.Second)
+	resp, err := ts.Restore(context.Background(), &pb.RestoreReq{AccessToken: ts.token, Path: testHome + "/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Restored != 2 {
+		t.Errorf("restored %d records, want 2", resp.Restored)
+	}
+	if rec := ts.get(t, testHome+"/a/f.txt"); rec.Id != id {
+		t.Errorf("got %v, want the record %s back", rec, id)
+	}
+	if home, a := ts.get(t, testHome), ts.get(t, testHome+"/a"); home.Etag != a.Etag {
+		t.Errorf("the restore of etag %s was not propagated to the home of etag %s", a.Etag, home.Etag)
+	}
+}
+
+func TestTrashPurge(t *testing.T) {
+	ts := newTrashServer(t)
+	ts.put(t, testHome+"/a/f.txt")
+	ts.put(t, testHome+"/b.txt")
+	ts.clock.Advance(time.Second)
+	ts.rm(t, &pb.RmReq{Path: testHome + "/a"})
+
+	resp, err := ts.Purge(context.Background(), &pb.PurgeReq{AccessToken: ts.token, Path: testHome})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Purged != 2 {
+		t.Errorf("purged %d records, want 2", resp.Purged)
+	}
+	if n := ts.count(t); n != 2 {
+		t.Errorf("got %d records, want b.txt and the home", n)
+	}
+	_, err = ts.Restore(context.Background(), &pb.RestoreReq{AccessToken: ts.token, Path: testHome + "/a"})
+	wantCode(t, err, codes.NotFound)
+}
+
+// TestTrashPurgeExpired checks only the records deleted before the
+// retention are purged.
+func TestTrashPurgeExpired(t *testing.T) {
+	ts := newTrashServer(t)
+	ts.put(t, testHome+"/a.txt")
+	ts.put(t, testHome+"/b.txt")
+	ts.clock.Advance(time.Second)
+	ts.rm(t, &pb.RmReq{Path: testHome + "/a.txt"})
+
+	n, err := purgeExpired(ts.s.db, ts.clock.Now().Add(-ts.s.p.trashRetention))
+	if err != nil || n != 0 {
+		t.Errorf("purged %d, %v before the retention, want none", n, err)
+	}
+	ts.clock.Advance(2 * time.Hour)
+	n, err = purgeExpired(ts.s.db, ts.clock.Now().Add(-ts.s.p.trashRetention))
+	if err != nil || n != 1 {
+		t.Errorf("purged %d, %v after the retention, want a.txt", n, err)
+	}
+	ts.get(t, testHome+"/b.txt")
+}
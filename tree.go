@@ -0,0 +1,80 @@
+package main
+
+import (
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"path"
+	"strings"
+)
+
+// maxTreeNodes is the largest tree returned by GetTree.
+const maxTreeNodes = 10000
+
+// getTree loads the subtree at p in pages and nests every record below
+// its closest loaded ancestor. Records deeper than maxDepth levels below
+// p are left out, unless maxDepth is 0.
+func (s *server) getTree(ctx context.Context, p string, maxDepth int) (*pb.TreeNode, error) {
+
+	nodes := map[string]*pb.TreeNode{}
+	var root *pb.TreeNode
+	var last string
+	for {
+		recs, err := getRecordsPageWithPathPrefix(s.db, p, last, subtreePageSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(recs) == 0 {
+			break
+		}
+		last = recs[len(recs)-1].Path
+
+		// the records are sorted by path so the root comes first and
+		// an ancestor is always loaded before its descendants
+		if root == nil {
+			if recs[0].Path != p {
+				break
+			}
+			root = &pb.TreeNode{Record: recs[0].toProto()}
+			nodes[p] = root
+			recs = recs[1:]
+		}
+
+		for i := range recs {
+			if err := ctxError(ctx); err != nil {
+				return nil, err
+			}
+
+			rec := &recs[i]
+			if maxDepth > 0 && depthBelow(rec.Path, p) > maxDepth {
+				continue
+			}
+			if len(nodes) == maxTreeNodes {
+				return nil, grpc.Errorf(codes.ResourceExhausted, "tree at %s has more than %d nodes", p, maxTreeNodes)
+			}
+
+			node := &pb.TreeNode{Record: rec.toProto()}
+			nodes[rec.Path] = node
+
+			parent := root
+			for dir := path.Dir(rec.Path); dir != p; dir = path.Dir(dir) {
+				if n, ok := nodes[dir]; ok {
+					parent = n
+					break
+				}
+			}
+			parent.Children = append(parent.Children, node)
+		}
+	}
+
+	if root == nil {
+		return nil, grpc.Errorf(codes.NotFound, "path %s not found", p)
+	}
+	return root, nil
+}
+
+// depthBelow returns the number of path segments of p below ancestor.
+func depthBelow(p, ancestor string) int {
+	return strings.Count(strings.TrimPrefix(p, strings.TrimSuffix(ancestor, "/")), "/")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+// render writes the paths of the tree below the home, indenting the
+// children below their parent.
+func render(node *pb.TreeNode, indent string, b *strings.Builder) {
+	fmt.Fprintf(b, "%s%s\n", indent, strings.TrimPrefix(node.Record.Path, testHome))
+	for _, c := range node.Children {
+		render(c, indent+"  ", b)
+	}
+}
+
+func (ts *testServer) tree(t *testing.T, p string, maxDepth int64) string {
+	root, err := ts.GetTree(context.Background(), &pb.GetTreeReq{AccessToken: ts.token, Path: p, MaxDepth: maxDepth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &strings.Builder{}
+	render(root, "", b)
+	return b.String()
+}
+
+func newTreeServer(t *testing.T) *testServer {
+	ts := newTestServer(t, nil)
+	for _, p := range []string{"/a/b/c.txt", "/a/b/d/e.txt", "/a/f.txt", "/ab.txt"} {
+		ts.put(t, testHome+p)
+	}
+	return ts
+}
+
+func TestGetTreeNesting(t *testing.T) {
+	ts := newTreeServer(t)
+	want := `/a
+  /a/b
+    /a/b/c.txt
+    /a/b/d
+      /a/b/d/e.txt
+  /a/f.txt
+`
+	if got := ts.tree(t, testHome+"/a", 0); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestGetTreeMaxDepth(t *testing.T) {
+	ts := newTreeServer(t)
+	for depth, want := range map[int64]string{
+		1: "/a\n  /a/b\n  /a/f.txt\n",
+		2: "/a\n  /a/b\n    /a/b/c.txt\n    /a/b/d\n  /a/f.txt\n",
+	} {
+		if got := ts.tree(t, testHome+"/a", depth); got != want {
+			t.Errorf("depth %d: got\n%s\nwant\n%s", depth, got, want)
+		}
+	}
+}
+
+func TestGetTreeErrors(t *testing.T) {
+	ts := newTreeServer(t)
+	_, err := ts.GetTree(context.Background(), &pb.GetTreeReq{AccessToken: ts.token, Path: testHome + "/missing"})
+	wantCode(t, err, codes.NotFound)
+	_, err = ts.GetTree(context.Background(), &pb.GetTreeReq{AccessToken: ts.token, Path: testHome, MaxDepth: -1})
+	wantCode(t, err, codes.InvalidArgument)
+}
+
+func TestGetTreeTooLarge(t *testing.T) {
+	ts := newTestServer(t, nil)
+	putSubtree(t, ts, testHome+"/a", maxTreeNodes)
+
+	_, err := ts.GetTree(context.Background(), &pb.GetTreeReq{AccessToken: ts.token, Path: testHome + "/a"})
+	wantCode(t, err, codes.ResourceExhausted)
+	// the depth limit keeps the tree below the limit
+	if _, err = ts.GetTree(context.Background(), &pb.GetTreeReq{AccessToken: ts.token, Path: testHome, MaxDepth: 1}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,27 +1,77 @@
 package main
 
 import (
+	"encoding/base64"
 	"fmt"
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jinzhu/gorm"
+	_ "github.com/lib/pq"
 	"github.com/nu7hatch/gouuid"
+	rus "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	metadata "google.golang.org/grpc/metadata"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // TODO(labkode) set collation for table and column to utf8. The default is swedish
+
+// The id is the primary key and is kept across moves so it can be used
+// to track a record across renames.
+// The parent path is indexed so the children are found by equality, and
+// the checksum to find the records sharing a content. The checksum is
+// NULL when it is unknown.
 type record struct {
-	ID       string
-	Path     string `sql:"unique_index:idx_path"`
-	Checksum string
-	ETag     string
-	MTime    uint32
+	ID         string `gorm:"primary_key"`
+	Path       string
+	ParentPath string  `sql:"index"`
+	Checksum   *string `sql:"index"`
+	ETag       string
+	MTime      int64
+	Size       int64
+	Kind       pb.Kind
+
+	// Seq orders the changes of the records, see assignSeq.
+	Seq int64 `sql:"index"`
+
+	// DeletedAt is set when the record is in the trash. gorm excludes
+	// these records from the queries unless Unscoped is used.
+	DeletedAt *time.Time `sql:"index"`
 }
 
 func (r *record) String() string {
-	return fmt.Sprintf("id=%s path=%s sum=%s etag=%s mtime=%d",
-		r.ID, r.Path, r.Checksum, r.ETag, r.MTime)
+	return fmt.Sprintf("id=%s path=%s sum=%s etag=%s mtime=%d size=%d kind=%s",
+		r.ID, r.Path, r.checksum(), r.ETag, r.MTime, r.Size, r.Kind)
+}
+
+// checksum returns the checksum of the record, empty when it is unknown.
+func (r *record) checksum() string {
+	if r.Checksum == nil {
+		return ""
+	}
+	return *r.Checksum
 }
+
+func (r *record) toProto() *pb.Record {
+	pr := &pb.Record{}
+	pr.Id = r.ID
+	pr.Path = r.Path
+	pr.Etag = r.ETag
+	pr.Modified = r.MTime
+	pr.Checksum = r.checksum()
+	pr.HasChecksum = r.Checksum != nil
+	pr.Size = r.Size
+	pr.Kind = r.Kind
+	pr.Deleted = r.DeletedAt != nil
+	return pr
+}
+
 func newDB(driver, dsn string) (*gorm.DB, error) {
 
 	db, err := gorm.Open(driver, dsn)
@@ -29,14 +79,135 @@ func newDB(driver, dsn string) (*gorm.DB, error) {
 		return nil, err
 	}
 
-	db.AutoMigrate(&record{})
-
 	return &db, nil
 }
-func newGRPCTraceContext(ctx context.Context, trace string) context.Context {
-	md := metadata.Pairs("trace", trace)
-	ctx = metadata.NewContext(ctx, md)
-	return ctx
+
+// likeEscaper escapes the LIKE wildcards and the escape character itself
+// so paths like /local/users/d/demo/50%_off.txt are matched literally.
+// The escape character is ! and not \ because the backslash needs
+// to be escaped itself in MySQL string literals but not in PostgreSQL ones.
+var likeEscaper = strings.NewReplacer(`!`, `!!`, `%`, `!%`, `_`, `!_`)
+
+func escapeLike(p string) string {
+	return likeEscaper.Replace(p)
+}
+
+// withPathPrefix returns a gorm scope selecting the record at p and all its
+// descendants. The pattern is p/% instead of p% to avoid getting
+// path1 and path11 in from the DB.
+func withPathPrefix(p string) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("path LIKE ? ESCAPE '!' OR path=?", descendantsPattern(p), p)
+	}
+}
+
+// withDescendants returns a gorm scope selecting all the descendants of p
+// but not p itself.
+func withDescendants(p string) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("path LIKE ? ESCAPE '!'", descendantsPattern(p))
+	}
+}
+
+// withChildren returns a gorm scope selecting only the direct children of p,
+// the records exactly one path segment deeper than p.
+func withChildren(p string) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("parent_path=?", p)
+	}
+}
+
+// parentPath returns the path of the parent of p. The root has none.
+func parentPath(p string) string {
+	if p == "/" {
+		return ""
+	}
+	return path.Dir(p)
+}
+
+// descendantsPattern returns the LIKE pattern matching only the true
+// descendants of p, so /local/users/d/demo/photo does not select
+// /local/users/d/demo/photos nor /local/users/d/demo/photo-backup.
+// The root is special cased to not end up with //%.
+func descendantsPattern(p string) string {
+	return escapeLike(strings.TrimSuffix(p, "/")) + "/%"
+}
+
+// newNopLogger returns a logger that discards everything.
+// It is the default logger of the server so callers that do not
+// inject one, like tests, do not get their output polluted.
+func newNopLogger() *rus.Logger {
+	l := rus.New()
+	l.Out = ioutil.Discard
+	l.Level = rus.PanicLevel
+	return l
+}
+
+// encodeChangesToken returns an opaque continuation token
+// pointing to the record with the given mtime, or seq, and path.
+func encodeChangesToken(mtime int64, p string) string {
+	return base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", mtime, p)))
+}
+
+func decodeChangesToken(token string) (int64, string, error) {
+	data, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, "", err
+	}
+
+	tokens := strings.SplitN(string(data), ":", 2)
+	if len(tokens) != 2 {
+		return 0, "", fmt.Errorf("malformed token %s", token)
+	}
+
+	mtime, err := strconv.ParseInt(tokens[0], 10, 64)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return mtime, tokens[1], nil
+}
+
+// ctxError returns a gRPC error if the context has been cancelled or
+// its deadline has expired. gorm does not know about contexts so it is
+// checked between statements of long operations to stop issuing them.
+func ctxError(ctx context.Context) error {
+	switch ctx.Err() {
+	case context.Canceled:
+		return grpc.Errorf(codes.Canceled, "request canceled")
+	case context.DeadlineExceeded:
+		return grpc.Errorf(codes.DeadlineExceeded, "request deadline exceeded")
+	default:
+		return nil
+	}
+}
+
+// toGRPCError maps an error to the one returned to the client. gRPC
+// errors are returned as they are, a missing record becomes NotFound and
+// any other error becomes Internal so the SQL details are not leaked.
+// The handlers log the original error.
+func toGRPCError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if grpc.Code(err) != codes.Unknown {
+		return err
+	}
+	if err == gorm.RecordNotFound {
+		return grpc.Errorf(codes.NotFound, "record not found")
+	}
+	return grpc.Errorf(codes.Internal, "internal error")
+}
+
+// withChange adds the etag and mtime of a change to the log entry. The
+// mtime is logged as the integer stored and as a RFC3339 timestamp, so
+// the log lines never depend on a format verb matching its type.
+func withChange(log *rus.Entry, etag string, mtime int64) *rus.Entry {
+	return log.WithFields(rus.Fields{
+		"etag":     etag,
+		"mtime":    mtime,
+		"modified": time.Unix(mtime, 0).UTC().Format(time.RFC3339),
+	})
 }
 
 func getGRPCTraceID(ctx context.Context) (string, error) {
@@ -50,7 +221,12 @@ func getGRPCTraceID(ctx context.Context) (string, error) {
 		return id.String(), nil
 	}
 
+	// the gateway forwards the Grpc-Metadata-Trace header with the key
+	// in its canonical form, the gRPC version in use does not lower it
 	tokens := md["trace"]
+	if len(tokens) == 0 {
+		tokens = md["Trace"]
+	}
 	if len(tokens) == 0 {
 		id, err := uuid.NewV4()
 		if err != nil {
@@ -59,7 +235,8 @@ func getGRPCTraceID(ctx context.Context) (string, error) {
 		return id.String(), nil
 	}
 
-	if tokens[0] != "" {
+	// a malformed trace id would garble the log lines, it is replaced
+	if validTraceID(tokens[0]) {
 		return tokens[0], nil
 	}
 
@@ -69,3 +246,105 @@ func getGRPCTraceID(ctx context.Context) (string, error) {
 	}
 	return id.String(), nil
 }
+
+// maxTraceIDLength is the longest trace id accepted from a client.
+const maxTraceIDLength = 128
+
+// validTraceID reports if a trace id sent by a client is not empty, not
+// too long and has no spaces nor control characters.
+func validTraceID(id string) bool {
+	if id == "" || len(id) > maxTraceIDLength {
+		return false
+	}
+	for _, r := range id {
+		if r <= ' ' || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// cleanPath validates a path sent by a client and returns it cleaned.
+// Empty, relative and paths with parent references are rejected as they
+// would otherwise be stored at an unexpected place.
+func cleanPath(p string) (string, error) {
+	if p == "" {
+		return "", grpc.Errorf(codes.InvalidArgument, "path is empty")
+	}
+
+	if !strings.HasPrefix(p, "/") {
+		return "", grpc.Errorf(codes.InvalidArgument, "path %s is not absolute", p)
+	}
+
+	for _, token := range strings.Split(p, "/") {
+		if token == ".." {
+			return "", grpc.Errorf(codes.InvalidArgument, "path %s contains ..", p)
+		}
+	}
+
+	return path.Clean(p), nil
+}
+
+// normalizePath is cleanPath followed by the normalizations configured
+// for the server. Every path sent by a client goes through it so all
+// the operations resolve the same record for the same logical path.
+func (s *server) normalizePath(p string) (string, error) {
+	p, err := cleanPath(p)
+	if err != nil {
+		return "", err
+	}
+	if s.p.caseInsensitive {
+		p = strings.ToLower(p)
+	}
+	if err = s.validatePath(p); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// defaultMaxPathLength is the size of the path column.
+const defaultMaxPathLength = 255
+
+// validatePath rejects the paths longer than the path column, that would
+// fail with an opaque database error, or deeper than maxPathSegments.
+func (s *server) validatePath(p string) error {
+	if len(p) > s.p.maxPathLength {
+		return grpc.Errorf(codes.InvalidArgument, "path %s is longer than %d bytes", p, s.p.maxPathLength)
+	}
+	if s.p.maxPathSegments > 0 && p != "/" && strings.Count(p, "/") > s.p.maxPathSegments {
+		return grpc.Errorf(codes.InvalidArgument, "path %s has more than %d segments", p, s.p.maxPathSegments)
+	}
+	return nil
+}
+
+// maxETagLength is the longest etag accepted from a client.
+const maxETagLength = 255
+
+// maxMTimeSkew is how far in the future a client mtime may be. A later
+// one would stop the propagation of the changes that come after it.
+const maxMTimeSkew = 5 * time.Minute
+
+// validateETag rejects the client etags that can not be stored as is.
+func validateETag(etag string) error {
+	if len(etag) > maxETagLength {
+		return grpc.Errorf(codes.InvalidArgument, "etag is longer than %d bytes", maxETagLength)
+	}
+	for _, r := range etag {
+		if r <= ' ' || r == 0x7f {
+			return grpc.Errorf(codes.InvalidArgument, "etag %q contains spaces or control characters", etag)
+		}
+	}
+	return nil
+}
+
+// validateMTime rejects the client mtimes before the epoch or too far
+// in the future of now.
+func validateMTime(mtime int64, now time.Time) error {
+	if mtime < 0 {
+		return grpc.Errorf(codes.InvalidArgument, "mtime %d is negative", mtime)
+	}
+	if max := now.Add(maxMTimeSkew).Unix(); mtime > max {
+		return grpc.Errorf(codes.InvalidArgument, "mtime %d is in the future", mtime)
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestToGRPCError(t *testing.T) {
+	raw := errors.New(`pq: relation "records" does not exist`)
+	tests := []struct {
+		err  error
+		code codes.Code
+	}{
+		{gorm.RecordNotFound, codes.NotFound},
+		{raw, codes.Internal},
+		{grpc.Errorf(codes.InvalidArgument, "bad path"), codes.InvalidArgument},
+		{permissionDenied, codes.PermissionDenied},
+	}
+	for _, tt := range tests {
+		err := toGRPCError(tt.err)
+		if grpc.Code(err) != tt.code {
+			t.Errorf("%v became %v, want code %s", tt.err, err, tt.code)
+		}
+	}
+
+	if err := toGRPCError(raw); strings.Contains(grpc.ErrorDesc(err), "records") {
+		t.Errorf("%v leaks the raw error", err)
+	}
+	if toGRPCError(nil) != nil {
+		t.Error("nil did not stay nil")
+	}
+}
+
+func TestMvErrors(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ctx := context.Background()
+
+	_, err := ts.Mv(ctx, &pb.MvReq{AccessToken: "bad", Src: testHome + "/a", Dst: testHome + "/b"})
+	wantCode(t, err, codes.Unauthenticated)
+
+	ts.put(t, testHome+"/a")
+	_, err = ts.Mv(ctx, &pb.MvReq{AccessToken: ts.token, Src: testHome + "/a", Dst: "/local/users/o/other/a"})
+	wantCode(t, err, codes.PermissionDenied)
+}
+
+func TestGetByIDMissing(t *testing.T) {
+	ts := newTestServer(t, nil)
+	_, err := ts.GetByID(context.Background(), &pb.GetByIdReq{AccessToken: ts.token, Id: "missing"})
+	wantCode(t, err, codes.NotFound)
+}
+
+func TestEscapeLike(t *testing.T) {
+	for p, want := range map[string]string{
+		"/a/b":          "/a/b",
+		"/a/50%_off":    "/a/50!%!_off",
+		"/a/wow!":       "/a/wow!!",
+		"/a/!%_/b_c %x": "/a/!!!%!_/b!_c !%x",
+	} {
+		if got := escapeLike(p); got != want {
+			t.Errorf("escapeLike(%q) = %q, want %q", p, got, want)
+		}
+	}
+}
+
+// TestWildcardPaths checks a % or _ in a path is matched literally, the
+// paths the wildcards would match being left untouched.
+func TestWildcardPaths(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, p := range []string{"/a%/f.txt", "/abc/f.txt", "/a_c/g.txt", "/axc/g.txt", "/a!/h.txt"} {
+		ts.put(t, testHome+p)
+	}
+	ts.clock.Advance(time.Second)
+
+	resp, err := ts.Rm(context.Background(), &pb.RmReq{AccessToken: ts.token, Path: testHome + "/a%"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Deleted != 2 {
+		t.Errorf("deleted %d records, want a%% and its file", resp.Deleted)
+	}
+	_, err = ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: testHome + "/a_c", Dst: testHome + "/m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ts.Rm(context.Background(), &pb.RmReq{AccessToken: ts.token, Path: testHome + "/a!"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"/abc/f.txt", "/axc/g.txt", "/m/g.txt"} {
+		ts.get(t, testHome+p)
+	}
+	for _, p := range []string{"/a%/f.txt", "/a_c/g.txt", "/a!/h.txt"} {
+		_, err = ts.Get(context.Background(), &pb.GetReq{AccessToken: ts.token, Path: testHome + p})
+		wantCode(t, err, codes.NotFound)
+	}
+}
+
+// TestSiblingPrefixes checks a Mv or a Rm of a folder leaves alone the
+// siblings whose names start with its own.
+func TestSiblingPrefixes(t *testing.T) {
+	ts := newTestServer(t, nil)
+	siblings := []string{"/ab", "/ab/f.txt", "/a1", "/a1/f.txt", "/a.txt"}
+	for _, p := range []string{"/a/f.txt", "/ab/f.txt", "/a1/f.txt", "/a.txt"} {
+		ts.put(t, testHome+p)
+	}
+	state := func() []string {
+		var s []string
+		for _, p := range siblings {
+			s = append(s, ts.record(t, testHome+p).String())
+		}
+		return s
+	}
+	before := state()
+
+	ts.clock.Advance(time.Second)
+	_, err := ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: testHome + "/a", Dst: testHome + "/b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.clock.Advance(time.Second)
+	resp, err := ts.Rm(context.Background(), &pb.RmReq{AccessToken: ts.token, Path: testHome + "/b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Deleted != 2 {
+		t.Errorf("deleted %d records, want b and its file", resp.Deleted)
+	}
+	if after := state(); !reflect.DeepEqual(after, before) {
+		t.Errorf("the siblings changed from\n%s\nto\n%s", strings.Join(before, "\n"), strings.Join(after, "\n"))
+	}
+}
+
+// TestMvSubtreeQueryError checks a failing query of the subtree fails the
+// Mv instead of moving nothing.
+func TestMvSubtreeQueryError(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/f.txt")
+	ts.clock.Advance(time.Second)
+
+	ts.s.db.Callback().Query().Before("gorm:query").Register("test:fail_subtree", func(scope *gorm.Scope) {
+		if _, ok := scope.Value.(*[]record); ok {
+			scope.Err(errInjected)
+		}
+	})
+	_, err := ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: testHome + "/a", Dst: testHome + "/b"})
+	wantCode(t, err, codes.Internal)
+	ts.record(t, testHome+"/a/f.txt")
+}
+
+// TestGetByIDAfterMv checks a record is found by its id at the path it
+// was moved to.
+func TestGetByIDAfterMv(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/f.txt")
+	id := ts.get(t, testHome+"/a/f.txt").Id
+	ts.clock.Advance(time.Second)
+
+	_, err := ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: testHome + "/a", Dst: testHome + "/b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := ts.GetByID(context.Background(), &pb.GetByIdReq{AccessToken: ts.token, Id: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Path != testHome+"/b/f.txt" || rec.Id != id {
+		t.Errorf("got %v, want %s at its new path", rec, id)
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	for p, want := range map[string]string{
+		"/a/b":        "/a/b",
+		"/a/b/":       "/a/b",
+		"//a/./b":     "/a/b",
+		"/":           "/",
+		"/a/..b/c..d": "/a/..b/c..d",
+	} {
+		if got, err := cleanPath(p); err != nil || got != want {
+			t.Errorf("cleanPath(%q) = %q, %v, want %q", p, got, err, want)
+		}
+	}
+	for _, p := range []string{"", "relative/x", "a", "/a/../b", "/a/..", "../a"} {
+		if got, err := cleanPath(p); grpc.Code(err) != codes.InvalidArgument {
+			t.Errorf("cleanPath(%q) = %q, %v, want InvalidArgument", p, got, err)
+		}
+	}
+}
+
+// TestInvalidPaths checks the handlers reject the invalid paths before
+// writing anything.
+func TestInvalidPaths(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ctx := context.Background()
+	for _, p := range []string{"", "relative/x", testHome + "/a/../b"} {
+		_, err := ts.Get(ctx, &pb.GetReq{AccessToken: ts.token, Path: p, ForceCreation: true})
+		wantCode(t, err, codes.InvalidArgument)
+		_, err = ts.Put(ctx, &pb.PutReq{AccessToken: ts.token, Path: p})
+		wantCode(t, err, codes.InvalidArgument)
+		_, err = ts.Mv(ctx, &pb.MvReq{AccessToken: ts.token, Src: p, Dst: testHome + "/b"})
+		wantCode(t, err, codes.InvalidArgument)
+		_, err = ts.Mv(ctx, &pb.MvReq{AccessToken: ts.token, Src: testHome + "/b", Dst: p})
+		wantCode(t, err, codes.InvalidArgument)
+		_, err = ts.Rm(ctx, &pb.RmReq{AccessToken: ts.token, Path: p})
+		wantCode(t, err, codes.InvalidArgument)
+	}
+	if n := ts.count(t); n != 0 {
+		t.Errorf("got %d records, want none", n)
+	}
+}
+
+// TestTrailingSlash checks a path with a trailing slash is the record
+// without it.
+func TestTrailingSlash(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/b/")
+	ts.put(t, testHome+"/a/b")
+	if n := ts.count(t); n != 3 {
+		t.Errorf("got %d records, want b, a and the home", n)
+	}
+	if rec := ts.get(t, testHome+"/a/b/"); rec.Path != testHome+"/a/b" {
+		t.Errorf("got the path %s, want it without the trailing slash", rec.Path)
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.caseInsensitive = true
+	})
+	ts.put(t, testHome+"/A/b.txt")
+	id := ts.get(t, testHome+"/a/b.txt").Id
+	ts.put(t, testHome+"/a/B.txt")
+	if n := ts.count(t); n != 3 {
+		t.Errorf("got %d records, want a single b.txt", n)
+	}
+	if rec := ts.get(t, strings.ToUpper(testHome)+"/a/b.TXT"); rec.Id != id {
+		t.Errorf("got %v, want the record %s", rec, id)
+	}
+
+	// the paths are kept as they are otherwise
+	cs := newTestServer(t, nil)
+	cs.put(t, testHome+"/A/b.txt")
+	cs.put(t, testHome+"/a/b.txt")
+	if n := cs.count(t); n != 5 {
+		t.Errorf("got %d records, want A and a apart", n)
+	}
+}
+
+// wantParentPaths checks every record of ts is linked to its parent.
+func wantParentPaths(t *testing.T, ts *testServer) {
+	var recs []record
+	if err := ts.s.db.Unscoped().Find(&recs).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		if rec.ParentPath != parentPath(rec.Path) {
+			t.Errorf("%s has the parent %s", rec.Path, rec.ParentPath)
+		}
+	}
+}
+
+func TestParentPaths(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, p := range []string{"/a/b/c.txt", "/a/b/d/e.txt", "/a/f.txt"} {
+		ts.put(t, testHome+p)
+	}
+	wantParentPaths(t, ts)
+
+	ts.clock.Advance(time.Second)
+	for _, req := range []*pb.MvReq{
+		{Src: testHome + "/a/b", Dst: testHome + "/g/b"},
+		{Src: testHome + "/a/f.txt", Dst: testHome + "/g/b/d/f.txt"},
+	} {
+		req.AccessToken = ts.token
+		if _, err := ts.Mv(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantParentPaths(t, ts)
+	want := []string{"/g/b/d/e.txt", "/g/b/d/f.txt"}
+	if got := ts.list(t, &pb.ListReq{Path: testHome + "/g/b/d"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got the children %v, want %v", got, want)
+	}
+}
+
+// pathOfLength returns a path below the home of n bytes.
+func pathOfLength(n int) string {
+	return testHome + "/" + strings.Repeat("a", n-len(testHome)-1)
+}
+
+func TestPathLength(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, n := range []int{defaultMaxPathLength - 1, defaultMaxPathLength} {
+		ts.put(t, pathOfLength(n))
+	}
+
+	long := pathOfLength(defaultMaxPathLength + 1)
+	_, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: long})
+	wantCode(t, err, codes.InvalidArgument)
+	if err != nil && !strings.Contains(err.Error(), "longer than 255 bytes") {
+		t.Errorf("got %v, want the limit in the message", err)
+	}
+	_, err = ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: pathOfLength(defaultMaxPathLength), Dst: long})
+	wantCode(t, err, codes.InvalidArgument)
+	if n := ts.count(t); n != 3 {
+		t.Errorf("got %d records, want the home and the 2 puts", n)
+	}
+}
+
+// TestPathSegments checks the segments of the home count toward the
+// limit, here of 2 segments below it.
+func TestPathSegments(t *testing.T) {
+	ts := newTestServer(t, func(p *newServerParams) {
+		p.maxPathSegments = 6
+	})
+	ts.put(t, testHome+"/a")
+	ts.put(t, testHome+"/b/c")
+
+	_, err := ts.Put(context.Background(), &pb.PutReq{AccessToken: ts.token, Path: testHome + "/b/c/d"})
+	wantCode(t, err, codes.InvalidArgument)
+	if err != nil && !strings.Contains(err.Error(), "more than 6 segments") {
+		t.Errorf("got %v, want the limit in the message", err)
+	}
+	_, err = ts.Mv(context.Background(), &pb.MvReq{AccessToken: ts.token, Src: testHome + "/a", Dst: testHome + "/b/c/a"})
+	wantCode(t, err, codes.InvalidArgument)
+	ts.get(t, testHome+"/a")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	rus "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"time"
+)
+
+// The build is described at build time with
+//
+//	go build -ldflags "-X main.version=1.0.0 -X main.gitCommit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	gitCommit = ""
+	buildTime = ""
+)
+
+// Version returns the build of the running instance. It does not require
+// authentication so it can be used by the deployment tools.
+func (s *server) Version(ctx context.Context, req *pb.Void) (*pb.VersionResp, error) {
+
+	log := s.requestLogger(ctx)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "version",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	res := &pb.VersionResp{}
+	res.Version = version
+	res.GitCommit = gitCommit
+	res.BuildTime = buildTime
+	res.Driver = s.p.driver
+	res.SchemaVersion = schemaVersion()
+	return res, nil
+}
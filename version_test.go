@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+)
+
+// TestVersion checks the values set by -ldflags are returned, with the
+// driver and the schema version of the server.
+func TestVersion(t *testing.T) {
+	saved := []string{version, gitCommit, buildTime}
+	defer func() { version, gitCommit, buildTime = saved[0], saved[1], saved[2] }()
+	version, gitCommit, buildTime = "1.2.3", "0123abc", "2016-01-02T15:04:05Z"
+
+	ts := newTestServer(t, nil)
+	resp, err := ts.Version(context.Background(), &pb.Void{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &pb.VersionResp{Version: "1.2.3", GitCommit: "0123abc", BuildTime: "2016-01-02T15:04:05Z", Driver: "sqlite3", SchemaVersion: schemaVersion()}
+	if *resp != *want {
+		t.Errorf("got %v, want %v", resp, want)
+	}
+}
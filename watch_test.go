@@ -0,0 +1,145 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+// fakeWatchStream is the server side of a Watch stream, that hands the
+// records sent over to the test.
+type fakeWatchStream struct {
+	ctx     context.Context
+	records chan *pb.Record
+}
+
+func (s *fakeWatchStream) Send(rec *pb.Record) error {
+	s.records <- rec
+	return nil
+}
+
+func (s *fakeWatchStream) Context() context.Context     { return s.ctx }
+func (s *fakeWatchStream) SendHeader(metadata.MD) error { return nil }
+func (s *fakeWatchStream) SetTrailer(metadata.MD)       {}
+func (s *fakeWatchStream) SendMsg(m interface{}) error  { return nil }
+func (s *fakeWatchStream) RecvMsg(m interface{}) error  { return nil }
+
+// subscribers returns the number of subscriptions of the hub of ts.
+func subscribers(ts *testServer) int {
+	ts.s.hub.mu.Lock()
+	defer ts.s.hub.mu.Unlock()
+	return len(ts.s.hub.subs)
+}
+
+// watch starts a Watch of p and returns its stream once it is subscribed
+// and the channel the Watch result is sent to.
+func watch(t *testing.T, ts *testServer, ctx context.Context, p string) (*fakeWatchStream, chan error) {
+	stream := &fakeWatchStream{ctx: ctx, records: make(chan *pb.Record, 16)}
+	done := make(chan error, 1)
+	go func() {
+		done <- ts.Watch(&pb.WatchReq{AccessToken: ts.token, Path: p}, stream)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); subscribers(ts) == 0; {
+		select {
+		case err := <-done:
+			t.Fatalf("watch ended: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("watch did not subscribe")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return stream, done
+}
+
+func nextEvent(t *testing.T, stream *fakeWatchStream) *pb.Record {
+	select {
+	case rec := <-stream.records:
+		return rec
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event arrived")
+		return nil
+	}
+}
+
+func TestWatch(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, done := watch(t, ts, ctx, testHome+"/a")
+
+	ts.put(t, testHome+"/a/b.txt")
+	if ev := nextEvent(t, stream); ev.Path != testHome+"/a/b.txt" || ev.Deleted || ev.Id == "" {
+		t.Errorf("got event %v, want the put of b.txt", ev)
+	}
+
+	// the changes outside the watched path are not streamed
+	ts.put(t, testHome+"/c.txt")
+
+	ts.clock.Advance(time.Second)
+	if _, err := ts.Rm(context.Background(), &pb.RmReq{AccessToken: ts.token, Path: testHome + "/a/b.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := nextEvent(t, stream); ev.Path != testHome+"/a/b.txt" || !ev.Deleted {
+		t.Errorf("got event %v, want the removal of b.txt", ev)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("watch ended with %v after the client went away", err)
+	}
+	if n := subscribers(ts); n != 0 {
+		t.Errorf("%d subscriptions left after the client went away", n)
+	}
+}
+
+// TestWatchRemovedAncestor checks a watcher below a removed path learns
+// about the removal.
+func TestWatchRemovedAncestor(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.put(t, testHome+"/a/b/c.txt")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, _ := watch(t, ts, ctx, testHome+"/a/b")
+
+	ts.clock.Advance(time.Second)
+	if _, err := ts.Rm(context.Background(), &pb.RmReq{AccessToken: ts.token, Path: testHome + "/a"}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := nextEvent(t, stream); ev.Path != testHome+"/a" || !ev.Deleted {
+		t.Errorf("got event %v, want the removal of a", ev)
+	}
+}
+
+// TestWatchRmOlderThan checks the removals streamed by an Rm that keeps
+// newer records are the ones of the removed records, not of its path.
+func TestWatchRmOlderThan(t *testing.T) {
+	ts := newTestServer(t, nil)
+	stream, _ := watch(t, ts, context.Background(), testHome+"/a")
+	ts.put(t, testHome+"/a/old.txt")
+	ts.put(t, testHome+"/a/b/older.txt")
+	ts.clock.Advance(time.Second)
+	ts.put(t, testHome+"/a/new.txt")
+	for i := 0; i < 3; i++ {
+		nextEvent(t, stream)
+	}
+
+	ts.clock.Advance(time.Second)
+	ts.rm(t, &pb.RmReq{Path: testHome + "/a", OlderThan: ts.clock.Now().Unix() - 1})
+	ts.put(t, testHome+"/a/end.txt")
+
+	removed := []string{}
+	for ev := nextEvent(t, stream); ev.Path != testHome+"/a/end.txt"; ev = nextEvent(t, stream) {
+		if !ev.Deleted {
+			t.Errorf("got event %v, want a removal", ev)
+		}
+		removed = append(removed, ev.Path)
+	}
+	if want := []string{testHome + "/a/b", testHome + "/a/old.txt"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("got the removals of %v, want %v", removed, want)
+	}
+}